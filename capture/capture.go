@@ -0,0 +1,80 @@
+/*
+Capture of the RPC traffic of a node, for debugging. Every message a node sends or receives is
+written as one JSON line to its capture file. Messages belonging to the same lookup share a trace
+id, so that the captures of all nodes can later be merged into a message sequence diagram of that
+lookup (see View).
+*/
+package capture
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// Directions of a captured message.
+const (
+	SEND = "send"
+	RECV = "recv"
+)
+
+/*
+A single captured message.
+*/
+type Event struct {
+	Time     time.Time     `json:"time"`               // When the message was sent or received
+	Node     string        `json:"node"`               // IP of the capturing node
+	Peer     string        `json:"peer"`               // IP of the other end
+	Dir      string        `json:"dir"`                // SEND | RECV
+	Type     string        `json:"type"`               // Message type, e.g. find_successor
+	TraceId  uint64        `json:"trace_id,omitempty"` // Lookup the message belongs to, 0 if none
+	Bytes    int           `json:"bytes"`              // Encoded size of the request
+	Duration time.Duration `json:"duration_ns"`        // Time until the reply arrived (SEND) or was produced (RECV)
+	Reply    string        `json:"reply,omitempty"`    // Type of the reply
+}
+
+/*
+Appends captured messages to a JSON Lines file.
+*/
+type Recorder struct {
+	mu      sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+/*
+Opens (or creates) the capture file at path for appending.
+*/
+func NewRecorder(path string) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+/*
+Writes event to the capture file. A nil Recorder drops the event, so callers need not check
+whether capturing is enabled.
+*/
+func (r *Recorder) Record(event Event) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.encoder.Encode(event)
+}
+
+/*
+Closes the capture file.
+*/
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
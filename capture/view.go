@@ -0,0 +1,82 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+/*
+Reads all events from the given capture files.
+*/
+func Load(paths ...string) ([]Event, error) {
+	events := []Event{}
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var event Event
+			if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+				file.Close()
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			events = append(events, event)
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return events, nil
+}
+
+/*
+Returns the trace ids found in events, in order of first appearance.
+*/
+func Traces(events []Event) []uint64 {
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	seen := map[uint64]bool{}
+	traces := []uint64{}
+	for _, event := range events {
+		if event.TraceId != 0 && !seen[event.TraceId] {
+			seen[event.TraceId] = true
+			traces = append(traces, event.TraceId)
+		}
+	}
+	return traces
+}
+
+/*
+Writes a Mermaid sequence diagram of the lookup with the given trace id. Each sent request becomes
+an arrow to the peer, and its reply an arrow back once the round trip has completed.
+*/
+func View(w io.Writer, events []Event, traceId uint64) {
+	type arrow struct {
+		at   time.Time
+		line string
+	}
+	arrows := []arrow{}
+	for _, event := range events {
+		if event.TraceId != traceId || event.Dir != SEND {
+			continue
+		}
+		arrows = append(arrows,
+			arrow{event.Time, fmt.Sprintf("    %q->>%q: %s (%d B)", event.Node, event.Peer, event.Type, event.Bytes)},
+			arrow{event.Time.Add(event.Duration), fmt.Sprintf("    %q-->>%q: %s (%s)", event.Peer, event.Node, event.Reply, event.Duration.Round(time.Microsecond))},
+		)
+	}
+	sort.SliceStable(arrows, func(i, j int) bool { return arrows[i].at.Before(arrows[j].at) })
+
+	fmt.Fprintln(w, "sequenceDiagram")
+	for _, a := range arrows {
+		fmt.Fprintln(w, a.line)
+	}
+}
@@ -0,0 +1,217 @@
+/*
+The ring lookup as a library, for DNS servers written in Go that want to answer names from a ring
+without running a node, e.g. as a backend plugin of CoreDNS. Chord is a Handler in the style of
+CoreDNS plugins: it answers the queries for its zones with the records in the ring, and passes
+everything else on to the next handler of the chain. Queries and responses are DNS messages in wire
+format, so that the package needs no DNS library; a server that has parsed messages packs them
+before calling ServeDNS, and wraps its response writer to unpack the response. For CoreDNS, with
+github.com/miekg/dns:
+
+	func (p plugin) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		query, err := r.Pack()
+		if err != nil {
+			return dns.RcodeFormatError, err
+		}
+		return p.chord.ServeDNS(ctx, writer{w}, query)
+	}
+
+	func (w writer) WriteMsg(msg []byte) error {
+		response := new(dns.Msg)
+		if err := response.Unpack(msg); err != nil {
+			return err
+		}
+		return w.ResponseWriter.WriteMsg(response)
+	}
+
+with p.chord.Next wrapping the next plugin the other way around. The package logs through the
+global zerolog logger, at the level set with node.SetLogLevel.
+*/
+package chorddns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/fauzxan/dns-chord/v2/node"
+)
+
+// Constants
+const (
+	NAME            = "chord"         // Name of the handler, as returned by Name.
+	DEFAULT_TIMEOUT = 2 * time.Second // Time a lookup may take if Chord.Timeout is not set, as on the DNS listener of a node.
+)
+
+/*
+Writes the response to a query, in wire format. RemoteAddr is that of the client, and tells
+whether the response has to fit into a UDP datagram.
+*/
+type ResponseWriter interface {
+	WriteMsg(msg []byte) error
+	RemoteAddr() net.Addr
+}
+
+/*
+A DNS handler of a chain, as in CoreDNS. ServeDNS returns the response code of the query, and
+writes the response unless ClientWrite of it is false, in which case the server answers the
+client, e.g. with a SERVFAIL.
+*/
+type Handler interface {
+	ServeDNS(ctx context.Context, w ResponseWriter, query []byte) (int, error)
+	Name() string
+}
+
+/*
+Adapts a function to a Handler.
+*/
+type HandlerFunc func(ctx context.Context, w ResponseWriter, query []byte) (int, error)
+
+func (f HandlerFunc) ServeDNS(ctx context.Context, w ResponseWriter, query []byte) (int, error) {
+	return f(ctx, w, query)
+}
+
+func (f HandlerFunc) Name() string {
+	return "handlerfunc"
+}
+
+/*
+Returns true if a handler has written the response of a query with the response code rcode, and
+false if it left the response to the server, as plugin.ClientWrite does in CoreDNS.
+*/
+func ClientWrite(rcode int) bool {
+	switch rcode {
+	case node.RCODE_SERVFAIL, node.RCODE_REFUSED, node.RCODE_FORMERR, node.RCODE_NOTIMP:
+		return false
+	}
+	return true
+}
+
+/*
+Answers queries from a ring, as a client of it.
+*/
+type Chord struct {
+	Seeds       []string      // Nodes of the ring to look names up through, in order of preference
+	Zones       []string      // Zones to answer for, every name if empty. Queries for other names go to Next.
+	Fallthrough bool          // Pass queries for names that are not in the ring on to Next, rather than answer NXDOMAIN
+	Timeout     time.Duration // Time a lookup may take, across all seeds. The deadline of the context may shorten it.
+	Next        Handler       // Next handler of the chain, or nil
+	client      *node.Node
+}
+
+/*
+Returns a handler that looks names up through seeds, configured like a node of the ring, e.g. with
+its identity for ACLs and its wire format.
+*/
+func New(seeds []string, config node.Config) *Chord {
+	return &Chord{Seeds: seeds, Timeout: DEFAULT_TIMEOUT, client: node.NewClient(config)}
+}
+
+func (c *Chord) Name() string {
+	return NAME
+}
+
+/*
+Answers a query with the records of its name in the ring, or passes it on to Next if the name is
+outside the zones, or not in the ring with Fallthrough set. A ring that can not be reached is
+reported as a SERVFAIL with the error, for the server to answer.
+*/
+func (c *Chord) ServeDNS(ctx context.Context, w ResponseWriter, query []byte) (int, error) {
+	name, _, err := node.ParseDNSQuestion(query)
+	if err == nil && !c.inZones(name) {
+		return c.next(ctx, w, query, name)
+	}
+	_, udp := w.RemoteAddr().(*net.UDPAddr)
+	var response []byte
+	var rcode uint16
+	err = c.viaSeeds(ctx, func(seed string, timeout time.Duration) error {
+		var err error
+		response, rcode, err = c.client.AnswerVia(seed, query, udp, timeout)
+		return err
+	})
+	if err != nil {
+		return node.RCODE_SERVFAIL, fmt.Errorf("%s: %w", NAME, err)
+	}
+	if rcode == node.RCODE_NXDOMAIN && c.Fallthrough {
+		return c.next(ctx, w, query, name)
+	}
+	if !ClientWrite(int(rcode)) {
+		return int(rcode), nil
+	}
+	if err := w.WriteMsg(response); err != nil {
+		return node.RCODE_SERVFAIL, fmt.Errorf("%s: %w", NAME, err)
+	}
+	return int(rcode), nil
+}
+
+/*
+Looks name up in the ring, without falling back to legacy DNS. Returns the errors of
+node.LookupVia.
+*/
+func (c *Chord) Lookup(ctx context.Context, name string) ([]node.Record, error) {
+	var records []node.Record
+	err := c.viaSeeds(ctx, func(seed string, timeout time.Duration) error {
+		var err error
+		records, err = c.client.LookupVia(seed, name, timeout)
+		return err
+	})
+	return records, err
+}
+
+/*
+Runs op through each seed in turn, with the time left of the lookup, until one of them can be
+reached.
+*/
+func (c *Chord) viaSeeds(ctx context.Context, op func(seed string, timeout time.Duration) error) error {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = DEFAULT_TIMEOUT
+	}
+	deadline := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	err := fmt.Errorf("%w: no seeds", node.ErrUnreachable)
+	for _, seed := range c.Seeds {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		left := time.Until(deadline)
+		if left <= 0 {
+			return fmt.Errorf("%w after %s", node.ErrTimeout, timeout)
+		}
+		if err = op(seed, left); !errors.Is(err, node.ErrUnreachable) {
+			return err
+		}
+	}
+	return err
+}
+
+/*
+Returns true if name is in one of the zones, or if there are none.
+*/
+func (c *Chord) inZones(name string) bool {
+	if len(c.Zones) == 0 {
+		return true
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, zone := range c.Zones {
+		zone = strings.ToLower(strings.TrimSuffix(zone, "."))
+		if name == zone || strings.HasSuffix(name, "."+zone) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Passes a query on to Next, or fails it if there is none, as plugin.NextOrFailure does in CoreDNS.
+*/
+func (c *Chord) next(ctx context.Context, w ResponseWriter, query []byte, name string) (int, error) {
+	if c.Next == nil {
+		return node.RCODE_SERVFAIL, fmt.Errorf("%s: no next handler for %s", NAME, name)
+	}
+	return c.Next.ServeDNS(ctx, w, query)
+}
@@ -0,0 +1,387 @@
+/*
+Reproducible churn experiments against a local ring. A scenario file describes when nodes join, are
+killed or crash, and how the query rate changes over time; Run executes it with in-process nodes and
+writes one CSV row of metrics per second, so that ad hoc demos become repeatable measurements.
+
+A scenario is a JSON file such as:
+
+	{
+	  "duration": "60s",
+	  "base_port": 4000,
+	  "names": ["google.com", "example.com"],
+	  "events": [
+	    {"at": "0s",  "action": "join", "node": "a"},
+	    {"at": "5s",  "action": "join", "node": "b"},
+	    {"at": "10s", "action": "rate", "qps": 20},
+	    {"at": "30s", "action": "kill", "node": "a"}
+	  ]
+	}
+
+A scenario may also place its nodes in zones and set the latency between them, to emulate a ring
+spread over several data centres on one machine (see node/simlatency.go):
+
+	"zones": {"a": "dc1", "b": "dc2"},
+	"latency": {"dc1/dc2": "40ms", "dc1/dc1": "1ms", "dc2/dc2": "1ms"},
+*/
+package experiment
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fauzxan/dns-chord/v2/hashing"
+	"github.com/fauzxan/dns-chord/v2/node"
+	"github.com/rs/zerolog/log"
+)
+
+// Scenario actions.
+const (
+	JOIN   = "join"   // Start the named node and join it to the ring (or create the ring).
+	KILL   = "kill"   // Stop the named node without handing anything over.
+	CRASH  = "crash"  // Crash the named node, see node/crash.go: it stops responding at once, and its peers find out by timeouts.
+	RATE   = "rate"   // Set the query rate, in queries per second, across all live nodes.
+	FREEZE = "freeze" // Freeze the ring topology, see node/freeze.go, e.g. to measure a stable ring.
+	THAW   = "thaw"   // Thaw the ring topology again.
+)
+
+/*
+A scheduled change to the ring or to the workload.
+*/
+type Event struct {
+	At     Duration `json:"at"`     // Offset from the start of the experiment
+	Action string   `json:"action"` // JOIN | KILL | CRASH | RATE | FREEZE | THAW
+	Node   string   `json:"node"`   // Name of the node, for JOIN, KILL and CRASH
+	QPS    float64  `json:"qps"`    // Queries per second, for RATE
+}
+
+/*
+An experiment, as read from a scenario file.
+*/
+type Scenario struct {
+	Duration Duration `json:"duration"`  // Total length of the experiment
+	BasePort int      `json:"base_port"` // Nodes listen on consecutive ports from here
+	Names    []string `json:"names"`     // Names to query
+	Events   []Event  `json:"events"`
+
+	Zones   map[string]string   `json:"zones"`   // Zone of each node name, none if absent
+	Latency map[string]Duration `json:"latency"` // Simulated latency between pairs of zones, as zone/zone
+}
+
+/*
+A time.Duration that is written as a string such as "5s" in scenario files.
+*/
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+/*
+Reads and validates a scenario file.
+*/
+func Load(path string) (Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Scenario{}, err
+	}
+	scenario := Scenario{BasePort: 4000}
+	if err := json.Unmarshal(data, &scenario); err != nil {
+		return Scenario{}, err
+	}
+	if len(scenario.Names) == 0 {
+		return Scenario{}, fmt.Errorf("scenario has no names to query")
+	}
+	for _, event := range scenario.Events {
+		switch event.Action {
+		case JOIN, KILL, CRASH:
+			if event.Node == "" {
+				return Scenario{}, fmt.Errorf("%s event at %s has no node", event.Action, event.At)
+			}
+		case RATE, FREEZE, THAW:
+		default:
+			return Scenario{}, fmt.Errorf("unknown action %q", event.Action)
+		}
+	}
+	if _, err := scenario.latencyMatrix(); err != nil {
+		return Scenario{}, err
+	}
+	sort.SliceStable(scenario.Events, func(i, j int) bool { return scenario.Events[i].At.Duration < scenario.Events[j].At.Duration })
+	return scenario, nil
+}
+
+/*
+Returns the latency matrix of the scenario, in the form of node.Config.SimLatency.
+*/
+func (scenario Scenario) latencyMatrix() (map[string]time.Duration, error) {
+	entries := []string{}
+	for pair, latency := range scenario.Latency {
+		entries = append(entries, pair+"="+latency.String())
+	}
+	return node.ParseLatencyMatrix(entries)
+}
+
+/*
+Metrics of one second of the experiment.
+*/
+type sample struct {
+	live      int
+	queries   int
+	errors    int
+	totalTime time.Duration
+	maxTime   time.Duration
+}
+
+/*
+State of a running experiment.
+*/
+type runner struct {
+	scenario Scenario
+	mu       sync.Mutex
+	nodes    map[string]*node.Node // live nodes by name
+	ports    map[string]int        // port assigned to each node name
+	qps      float64
+	samples  []sample
+	start    time.Time
+}
+
+/*
+Executes the scenario and writes the metrics CSV to out, one row per second. Unless report is nil,
+the end-of-run report of the ring is written to it in format before the nodes shut down, see
+node/report.go.
+*/
+func Run(scenario Scenario, out io.Writer, report io.Writer, format string) error {
+	r := &runner{scenario: scenario, nodes: map[string]*node.Node{}, ports: map[string]int{}}
+	r.samples = make([]sample, int(scenario.Duration.Seconds())+1)
+	r.start = time.Now()
+
+	done := make(chan struct{})
+	go r.workload(done)
+
+	for _, event := range scenario.Events {
+		if event.At.Duration > scenario.Duration.Duration {
+			break
+		}
+		time.Sleep(time.Until(r.start.Add(event.At.Duration)))
+		if err := r.apply(event); err != nil {
+			log.Error().Err(err).Msgf("Could not apply %s event at %s", event.Action, event.At)
+		}
+	}
+	time.Sleep(time.Until(r.start.Add(scenario.Duration.Duration)))
+	close(done)
+
+	r.mu.Lock()
+	if report != nil {
+		if err := r.writeReport(report, format); err != nil {
+			r.mu.Unlock()
+			return err
+		}
+	}
+	for _, n := range r.nodes {
+		n.Shutdown()
+	}
+	r.mu.Unlock()
+	return r.writeCSV(out)
+}
+
+/*
+Writes the report of the ring to w in format, collected through the first live node by name. The
+caller holds r.mu.
+*/
+func (r *runner) writeReport(w io.Writer, format string) error {
+	names := make([]string, 0, len(r.nodes))
+	for name := range r.nodes {
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return node.WriteReport(w, node.Report{Collected: time.Now()}, format)
+	}
+	sort.Strings(names)
+	return node.WriteReport(w, r.nodes[names[0]].CollectReport(), format)
+}
+
+func (r *runner) apply(event Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch event.Action {
+	case JOIN:
+		if _, ok := r.nodes[event.Node]; ok {
+			return fmt.Errorf("node %s is already live", event.Node)
+		}
+		port, ok := r.ports[event.Node]
+		if !ok {
+			port = r.scenario.BasePort + len(r.ports)
+			r.ports[event.Node] = port
+		}
+		n, err := r.startNode(event.Node, port)
+		if err != nil {
+			return err
+		}
+		r.nodes[event.Node] = n
+		log.Info().Msgf("t=%s: node %s joined at %s as instance %s", event.At, event.Node, n.IP, n.InstanceID())
+	case KILL:
+		n, ok := r.nodes[event.Node]
+		if !ok {
+			return fmt.Errorf("node %s is not live", event.Node)
+		}
+		delete(r.nodes, event.Node)
+		go n.Shutdown()
+		log.Info().Msgf("t=%s: node %s killed", event.At, event.Node)
+	case CRASH:
+		n, ok := r.nodes[event.Node]
+		if !ok {
+			return fmt.Errorf("node %s is not live", event.Node)
+		}
+		delete(r.nodes, event.Node)
+		n.Crash()
+		log.Info().Msgf("t=%s: node %s crashed", event.At, event.Node)
+	case RATE:
+		r.qps = event.QPS
+		log.Info().Msgf("t=%s: query rate set to %.1f/s", event.At, event.QPS)
+	case FREEZE, THAW:
+		state := node.FREEZE_STATE_FROZEN
+		if event.Action == THAW {
+			state = node.FREEZE_STATE_THAWED
+		}
+		for _, n := range r.nodes {
+			states, err := n.FreezeRing(state)
+			if err != nil {
+				return err
+			}
+			log.Info().Msgf("t=%s: %d node(s) %s", event.At, len(states), state)
+			return nil
+		}
+		return fmt.Errorf("no node is live")
+	}
+	return nil
+}
+
+/*
+Starts the named node on the given port, in its zone of the scenario, joining it through any live
+node, or creating the ring if there is none. Must be called with the runner lock held.
+*/
+func (r *runner) startNode(name string, port int) (*node.Node, error) {
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	n := &node.Node{
+		Nodeid:        hashing.Hash(addr),
+		IP:            addr,
+		CachedQuery:   make(map[uint64]node.LRUCache),
+		HashIPStorage: make(map[uint64]map[uint64][]node.Record),
+		Config:        r.nodeConfig(name),
+	}
+	n.Serve(listener)
+	for _, helper := range r.nodes {
+		n.JoinNetwork(helper.IP)
+		return n, nil
+	}
+	n.CreateNetwork()
+	return n, nil
+}
+
+/*
+Returns the configuration of the named node: that of the environment, with the zone and the
+latency matrix of the scenario if it has them.
+*/
+func (r *runner) nodeConfig(name string) node.Config {
+	config := node.LoadConfig()
+	if zone, ok := r.scenario.Zones[name]; ok {
+		config.Zone = zone
+	}
+	if len(r.scenario.Latency) > 0 {
+		// Load has validated the matrix already
+		config.SimLatency, _ = r.scenario.latencyMatrix()
+	}
+	return config
+}
+
+/*
+Issues queries against random live nodes at the current rate until done is closed.
+*/
+func (r *runner) workload(done chan struct{}) {
+	for {
+		r.mu.Lock()
+		qps := r.qps
+		live := make([]*node.Node, 0, len(r.nodes))
+		for _, n := range r.nodes {
+			live = append(live, n)
+		}
+		r.mu.Unlock()
+
+		if qps <= 0 || len(live) == 0 {
+			select {
+			case <-done:
+				return
+			case <-time.After(100 * time.Millisecond):
+			}
+			continue
+		}
+		select {
+		case <-done:
+			return
+		case <-time.After(time.Duration(float64(time.Second) / qps)):
+		}
+		target := live[rand.Intn(len(live))]
+		name := r.scenario.Names[rand.Intn(len(r.scenario.Names))]
+		go r.query(target, name)
+	}
+}
+
+func (r *runner) query(n *node.Node, name string) {
+	start := time.Now()
+	_, err := n.Resolve(name)
+	elapsed := time.Since(start)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	second := int(start.Sub(r.start).Seconds())
+	if second >= len(r.samples) {
+		return
+	}
+	s := &r.samples[second]
+	s.live = len(r.nodes)
+	s.queries++
+	if err != nil {
+		s.errors++
+	}
+	s.totalTime += elapsed
+	s.maxTime = max(s.maxTime, elapsed)
+}
+
+func (r *runner) writeCSV(out io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := fmt.Fprintln(out, "second,live_nodes,queries,errors,avg_latency_ms,max_latency_ms"); err != nil {
+		return err
+	}
+	for second, s := range r.samples {
+		avg := 0.0
+		if s.queries > 0 {
+			avg = float64(s.totalTime.Microseconds()) / float64(s.queries) / 1000
+		}
+		if _, err := fmt.Fprintf(out, "%d,%d,%d,%d,%.3f,%.3f\n", second, s.live, s.queries, s.errors, avg, float64(s.maxTime.Microseconds())/1000); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+/*
+Hashing of names and addresses onto the ring. Node IDs and the keys of names are both taken from
+here, so that they live in one keyspace of 2^Bits() IDs. The width defaults to DEFAULT_BITS, and is
+set once at startup from RING_BITS, before any ID is computed; every node of a ring, and every
+client of it, must use the same width, and the same rounding, set from LEGACY_HASH, see Hash.
+*/
+package hashing
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash/maphash"
+	"math/bits"
+	"sync"
+)
+
+// Constants
+const (
+	DEFAULT_BITS = 32 // Width of the keyspace if RING_BITS is not set.
+	MIN_BITS     = 8  // Narrowest keyspace, below which IDs of even small rings collide.
+	MAX_BITS     = 64 // Widest keyspace, as IDs are uint64.
+
+	HASH_CACHE_SLOTS = 1024 // Slots of the cache of recent digests, a power of two.
+)
+
+var width = DEFAULT_BITS
+var legacy bool
+
+/*
+Digests of recently hashed inputs, see Hash. An input is kept in the slot its maphash picks, until
+another input takes the slot.
+*/
+var cache struct {
+	seed  maphash.Seed
+	slots [HASH_CACHE_SLOTS]struct {
+		mu     sync.Mutex
+		used   bool
+		input  string
+		digest uint64 // First 8 bytes of the SHA-256 digest of input
+	}
+}
+
+func init() {
+	cache.seed = maphash.MakeSeed()
+}
+
+/*
+Returns the width of the keyspace in bits.
+*/
+func Bits() int {
+	return width
+}
+
+/*
+Returns the mask of the IDs in the keyspace, 2^Bits()-1. Arithmetic on IDs is modulo Mask()+1.
+*/
+func Mask() uint64 {
+	return ^uint64(0) >> (64 - width)
+}
+
+/*
+Sets the width of the keyspace to n bits. Returns an error if n is not between MIN_BITS and
+MAX_BITS. Not safe to call once nodes are running.
+*/
+func SetBits(n int) error {
+	if n < MIN_BITS || n > MAX_BITS {
+		return fmt.Errorf("ring width %d is not between %d and %d bits", n, MIN_BITS, MAX_BITS)
+	}
+	width = n
+	return nil
+}
+
+/*
+Sets whether IDs are rounded as nodes that predate integer hashing computed them, see Hash. Not
+safe to call once nodes are running.
+*/
+func SetLegacyRounding(on bool) {
+	legacy = on
+}
+
+/*
+Returns true if IDs are rounded as nodes that predate integer hashing computed them.
+*/
+func LegacyRounding() bool {
+	return legacy
+}
+
+/*
+Returns the ID of input: the first 8 bytes of its SHA-256 digest, truncated to the low Bits() bits.
+Nodes up to integer hashing took the modulus of those bytes through float64 in the default width,
+which rounds them to 53 significant bits first, and leaves the low 11 bits of the IDs zero. A ring
+started by such nodes keeps its IDs with legacy rounding on, see SetLegacyRounding, which
+reproduces the rounding with integer operations. Digests of recently hashed inputs are kept in a
+small cache, as the names of queries and the addresses of nodes keep coming back, and a cached ID
+costs a fraction of a SHA-256.
+*/
+func Hash(input string) uint64 {
+	slot := &cache.slots[maphash.String(cache.seed, input)&(HASH_CACHE_SLOTS-1)]
+	slot.mu.Lock()
+	v, cached := slot.digest, slot.used && slot.input == input
+	slot.mu.Unlock()
+	if !cached {
+		id := sha256.Sum256([]byte(input))
+		v = binary.BigEndian.Uint64(id[:8])
+		slot.mu.Lock()
+		slot.input, slot.digest, slot.used = input, v, true
+		slot.mu.Unlock()
+	}
+	if legacy && width == DEFAULT_BITS {
+		v = roundToFloat64(v)
+	}
+	return v & Mask()
+}
+
+/*
+Rounds v to the nearest value representable as a float64 (53 significant bits, ties to even), as
+float64(v) does. A value that rounds up to 2^64 wraps to 0, which is the same modulo 2^Bits().
+*/
+func roundToFloat64(v uint64) uint64 {
+	shift := bits.Len64(v) - 53
+	if shift <= 0 {
+		return v
+	}
+	half := uint64(1) << (shift - 1)
+	rest := v & (1<<shift - 1)
+	v &^= 1<<shift - 1
+	if rest > half || (rest == half && v&(1<<shift) != 0) {
+		v += 1 << shift
+	}
+	return v
+}
@@ -0,0 +1,141 @@
+package hashing
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"testing"
+)
+
+/*
+The hash as nodes that predate integer hashing computed it, through float64.
+*/
+func legacyHash(input string) uint64 {
+	id := sha256.Sum256([]byte(input))
+	return uint64(math.Mod(float64(binary.BigEndian.Uint64(id[:8])), math.Pow(2, DEFAULT_BITS)))
+}
+
+func TestHashDefaultWidth(t *testing.T) {
+	tests := []struct {
+		input  string
+		want   uint64
+		legacy uint64
+	}{
+		{"", 2566659092, 2566660096},
+		{"example.com", 4004493733, 4004493312},
+		{"192.168.1.10:8000\n", 2146886887, 2146887680},
+	}
+	for _, test := range tests {
+		if got := Hash(test.input); got != test.want {
+			t.Errorf("Hash(%q) = %d, want %d", test.input, got, test.want)
+		}
+	}
+	SetLegacyRounding(true)
+	defer SetLegacyRounding(false)
+	for _, test := range tests {
+		if got := Hash(test.input); got != test.legacy {
+			t.Errorf("Hash(%q) with legacy rounding = %d, want %d", test.input, got, test.legacy)
+		}
+	}
+	for i := 0; i < 10000; i++ {
+		input := fmt.Sprintf("host%d.example:%d\n", i, 8000+i)
+		if got, want := Hash(input), legacyHash(input); got != want {
+			t.Fatalf("Hash(%q) with legacy rounding = %d, the float64 hash is %d", input, got, want)
+		}
+	}
+}
+
+func TestHashCached(t *testing.T) {
+	// More inputs than slots, so that inputs take each other's slots, each hashed twice in a row
+	// and again after the others.
+	inputs := make([]string, 4*HASH_CACHE_SLOTS)
+	for i := range inputs {
+		inputs[i] = fmt.Sprintf("name%d.example", i)
+	}
+	for round := 0; round < 2; round++ {
+		for _, input := range inputs {
+			id := sha256.Sum256([]byte(input))
+			want := binary.BigEndian.Uint64(id[:8]) & Mask()
+			if got := Hash(input); got != want {
+				t.Fatalf("Hash(%q) = %d, want %d", input, got, want)
+			}
+			if got := Hash(input); got != want {
+				t.Fatalf("Hash(%q) from the cache = %d, want %d", input, got, want)
+			}
+		}
+	}
+}
+
+func TestRoundToFloat64(t *testing.T) {
+	tests := []uint64{0, 1, 1<<53 - 1, 1 << 53, 1<<53 + 1, 1<<53 + 3, 1<<54 + 2, 1<<54 + 6, 1<<63 - 1, 1 << 63, math.MaxUint64 - 1<<10}
+	for _, v := range tests {
+		if got, want := roundToFloat64(v), uint64(float64(v)); got != want {
+			t.Errorf("roundToFloat64(%d) = %d, float64 rounds to %d", v, got, want)
+		}
+	}
+	// Values that round up to 2^64 wrap to 0.
+	if got := roundToFloat64(math.MaxUint64); got != 0 {
+		t.Errorf("roundToFloat64(MaxUint64) = %d, want 0", got)
+	}
+}
+
+func TestHashOtherWidths(t *testing.T) {
+	defer SetBits(DEFAULT_BITS)
+	for _, n := range []int{MIN_BITS, 16, 48, MAX_BITS} {
+		if err := SetBits(n); err != nil {
+			t.Fatal(err)
+		}
+		id := sha256.Sum256([]byte("example.com"))
+		if got, want := Hash("example.com"), binary.BigEndian.Uint64(id[:8])&Mask(); got != want {
+			t.Errorf("Hash in %d bits = %d, want %d", n, got, want)
+		}
+	}
+	if err := SetBits(MAX_BITS + 1); err == nil {
+		t.Errorf("SetBits(%d) succeeded", MAX_BITS+1)
+	}
+}
+
+const HASH_BUDGET_NS = 100 // Most a hash of a name hashed recently may take on average.
+
+/*
+Fails the benchmark b if its hashes took HASH_BUDGET_NS or more on average.
+*/
+func checkBudget(b *testing.B) {
+	if perHash := float64(b.Elapsed().Nanoseconds()) / float64(b.N); b.N > 1000 && perHash >= HASH_BUDGET_NS {
+		b.Errorf("a hash took %.1f ns on average, over the budget of %d ns", perHash, HASH_BUDGET_NS)
+	}
+}
+
+/*
+Hashes a working set of names, as queries and finger fixes do, which fits the cache.
+*/
+func BenchmarkHash(b *testing.B) {
+	names := make([]string, HASH_CACHE_SLOTS/4)
+	for i := range names {
+		names[i] = fmt.Sprintf("192.168.%d.%d:8000\n", i/256, i%256)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Hash(names[i%len(names)])
+	}
+	b.StopTimer()
+	checkBudget(b)
+}
+
+/*
+Hashes a new name every time, which costs a SHA-256. It is not held to HASH_BUDGET_NS, as SHA-256
+alone takes about 100 ns on some machines.
+*/
+func BenchmarkHashUncached(b *testing.B) {
+	names := make([]string, b.N)
+	for i := range names {
+		names[i] = fmt.Sprintf("host%d.example", i)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Hash(names[i])
+	}
+}
@@ -6,13 +6,22 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"net"
-	"net/rpc"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/fauzxan/dns-chord/v2/capture"
+	"github.com/fauzxan/dns-chord/v2/experiment"
+	"github.com/fauzxan/dns-chord/v2/hashing"
 	"github.com/fauzxan/dns-chord/v2/utility"
 
 	"github.com/fauzxan/dns-chord/v2/node"
@@ -28,6 +37,311 @@ import (
 var system = color.New(color.FgCyan).Add(color.BgBlack)
 var numQueries = 100
 
+// Exit codes of the subcommands, so that scripts can branch on the outcome
+const (
+	EXIT_OK          = 0
+	EXIT_FAILURE     = 1 // Any failure without a code of its own
+	EXIT_USAGE       = 2 // Malformed arguments
+	EXIT_NOT_FOUND   = 3 // The name is not in the ring
+	EXIT_UNREACHABLE = 4 // The ring, or the node responsible for the name, could not be reached
+	EXIT_TIMEOUT     = 5 // The operation did not complete in time
+	EXIT_DENIED      = 6 // The ACL of the record set does not allow the operation, or the node refused a CONTROL command
+)
+
+// Command line flags
+var nodeIdFlag = flag.String("node-id", "", "place this node at the given ID in the keyspace instead of hashing its address (testing only)")
+var nodeNameFlag = flag.String("node-name", "", "derive this node's ID from the given name instead of its address (testing only)")
+var balancedJoinFlag = flag.Bool("balanced-join", false, "ask the helper for an ID that best balances the key load, instead of hashing this node's address")
+var selfTestFlag = flag.Bool("selftest", false, "run the self-test battery and exit, with a non-zero status if any check fails")
+var observeFlag = flag.Bool("observe", false, "join the ring as an observer that follows it without storing keys, same as OBSERVER=true")
+var allowCrashFlag = flag.Bool("allow-crash", false, "let the menu, the admin endpoint and other nodes crash this node, for demos and chaos tests, same as ALLOW_CRASH=true")
+var captureFlag = flag.String("capture", "", "write every sent and received RPC message to this JSON Lines file")
+
+/*
+Prints the message sequence diagram of a lookup from one or more capture files:
+
+	dns-chord capture-view [trace-id] node1.jsonl node2.jsonl ...
+
+Without a trace id, the ids of all captured lookups are listed instead.
+*/
+func viewCapture(args []string) int {
+	var traceId uint64
+	if len(args) > 0 {
+		if id, err := strconv.ParseUint(args[0], 10, 64); err == nil {
+			traceId = id
+			args = args[1:]
+		}
+	}
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: dns-chord capture-view [trace-id] capture.jsonl ...")
+		return EXIT_USAGE
+	}
+	events, err := capture.Load(args...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading capture:", err)
+		return EXIT_FAILURE
+	}
+	if traceId == 0 {
+		for _, id := range capture.Traces(events) {
+			fmt.Println(id)
+		}
+		return EXIT_OK
+	}
+	capture.View(os.Stdout, events, traceId)
+	return EXIT_OK
+}
+
+/*
+Returns the exit code for the error of a ring operation.
+*/
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return EXIT_OK
+	case errors.Is(err, node.ErrNotFound):
+		return EXIT_NOT_FOUND
+	case errors.Is(err, node.ErrUnreachable):
+		return EXIT_UNREACHABLE
+	case errors.Is(err, node.ErrTimeout):
+		return EXIT_TIMEOUT
+	case errors.Is(err, node.ErrAccessDenied), errors.Is(err, node.ErrControlRefused):
+		return EXIT_DENIED
+	}
+	return EXIT_FAILURE
+}
+
+/*
+Parses the flags of the lookup and put subcommands, and returns the remaining arguments.
+*/
+func clientFlags(name string, args []string) (time.Duration, []string, bool) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	timeout := flags.Duration("timeout", node.CLIENT_TIMEOUT, "give up after this long")
+	if err := flags.Parse(args); err != nil {
+		return 0, nil, false
+	}
+	return *timeout, flags.Args(), true
+}
+
+/*
+Looks a name up in the ring through one of its nodes, and prints its stored records, one per line,
+on stdout:
+
+	dns-chord lookup [-timeout 10s] ip:port name
+
+The exit status tells apart names that are not in the ring, an unreachable ring and timeouts.
+*/
+func lookupName(args []string) int {
+	timeout, args, ok := clientFlags("lookup", args)
+	if !ok || len(args) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: dns-chord lookup [-timeout 10s] ip:port name")
+		return EXIT_USAGE
+	}
+	godotenv.Load()
+	records, err := node.NewClient(node.LoadConfig()).LookupVia(args[0], args[1], timeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not look up %s: %v\n", args[1], err)
+		return exitCode(err)
+	}
+	for _, record := range records {
+		fmt.Println(node.RecordText(record))
+	}
+	return EXIT_OK
+}
+
+/*
+Runs a stateless gateway that answers DNS queries on DNS_PORT and REST queries on GATEWAY_PORT by
+sending them into the ring through the given nodes, or GATEWAY_NODES, see node/gateway.go:
+
+	dns-chord gateway [ip:port ...]
+*/
+func runGateway(args []string) int {
+	godotenv.Load()
+	config := node.LoadConfig()
+	if err := node.SetLogLevel(config.LogLevel); err != nil {
+		log.Error().Err(err).Msg("Ignoring LOG_LEVEL")
+	}
+	node.SetLogSampling(config.LogSampleThreshold, config.LogSampleRate)
+	nodes := args
+	if len(nodes) == 0 {
+		nodes = config.GatewayNodes
+	}
+	if len(nodes) == 0 || (config.DNSPort == "" && config.GatewayPort == "") {
+		fmt.Fprintln(os.Stderr, "usage: dns-chord gateway [ip:port ...], with DNS_PORT or GATEWAY_PORT set, and GATEWAY_NODES if no nodes are given")
+		return EXIT_USAGE
+	}
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+
+	gateway := node.NewGateway(config, nodes)
+	log.Logger = log.With().Str("instance", gateway.InstanceID()).Logger()
+	log.Info().Msgf("Instance %s", gateway.InstanceID())
+	if config.DNSEnabled && config.DNSPort != "" {
+		gateway.ServeDNS(":" + config.DNSPort)
+	}
+	if config.MetricsEnabled && config.MetricsPort != "" {
+		gateway.ServeMetrics(":" + config.MetricsPort)
+	}
+	gatewayAddr := ""
+	if config.GatewayPort != "" {
+		gatewayAddr = ":" + config.GatewayPort
+	}
+	gateway.StartGateway(gatewayAddr)
+
+	<-interrupt
+	log.Info().Msg("Shutting down...")
+	gateway.Shutdown()
+	return EXIT_OK
+}
+
+/*
+Runs a CONTROL command, e.g. query example.com, leave, crash, loglevel debug or stats, on a node,
+signed with CONTROL_KEY, and prints its output, one line each, on stdout:
+
+	dns-chord control [-timeout 10s] ip:port command [args]
+*/
+func controlNode(args []string) int {
+	timeout, args, ok := clientFlags("control", args)
+	if !ok || len(args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: dns-chord control [-timeout 10s] ip:port command [args]")
+		return EXIT_USAGE
+	}
+	godotenv.Load()
+	config := node.LoadConfig()
+	if config.ControlKey == "" {
+		fmt.Fprintln(os.Stderr, "Set CONTROL_KEY to the key the nodes were started with")
+		return EXIT_USAGE
+	}
+	output, err := node.NewClient(config).ControlVia(args[0], strings.Join(args[1:], " "), timeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not run %s on %s: %v\n", args[1], args[0], err)
+		return exitCode(err)
+	}
+	for _, line := range output {
+		fmt.Println(line)
+	}
+	return EXIT_OK
+}
+
+/*
+Publishes an address record in the ring through one of its nodes:
+
+	dns-chord put [-timeout 10s] ip:port name address [ttl [replicas]]
+*/
+func putName(args []string) int {
+	timeout, args, ok := clientFlags("put", args)
+	if !ok || len(args) < 3 || len(args) > 5 {
+		fmt.Fprintln(os.Stderr, "usage: dns-chord put [-timeout 10s] ip:port name address [ttl [replicas]]")
+		return EXIT_USAGE
+	}
+	numbers := []int{0, 0} // ttl, replicas
+	for i, arg := range args[3:] {
+		var err error
+		if numbers[i], err = strconv.Atoi(arg); err != nil {
+			fmt.Fprintln(os.Stderr, "usage: dns-chord put [-timeout 10s] ip:port name address [ttl [replicas]]")
+			return EXIT_USAGE
+		}
+	}
+	godotenv.Load()
+	if err := node.NewClient(node.LoadConfig()).PutVia(args[0], args[1], args[2], numbers[0], numbers[1], timeout); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not publish %s: %v\n", args[1], err)
+		return exitCode(err)
+	}
+	return EXIT_OK
+}
+
+/*
+Exports the record sets of a ring to a file (or stdout), or imports them from a file (or stdin),
+through one of its nodes:
+
+	dns-chord storage export [-format jsonl] ip:port [out.jsonl]
+	dns-chord storage import [-format jsonl|hosts] [-workers n] [-rate n] ip:port [in.jsonl]
+*/
+func storage(args []string) int {
+	usage := "usage: dns-chord storage export|import [-format jsonl|hosts] [-workers n] [-rate n] ip:port [file.jsonl]"
+	if len(args) == 0 || (args[0] != "export" && args[0] != "import") {
+		fmt.Fprintln(os.Stderr, usage)
+		return EXIT_USAGE
+	}
+	godotenv.Load()
+	config := node.LoadConfig()
+	flags := flag.NewFlagSet("storage "+args[0], flag.ContinueOnError)
+	format := flags.String("format", node.EXPORT_FORMAT_JSONL, "format of the file, jsonl, or hosts for imports")
+	flags.IntVar(&config.ImportWorkers, "workers", config.ImportWorkers, "record sets an import routes at once")
+	flags.Float64Var(&config.ImportRate, "rate", config.ImportRate, "record sets per second an import sends to any one node, 0 for no limit")
+	if err := flags.Parse(args[1:]); err != nil || flags.NArg() < 1 || flags.NArg() > 2 || (*format != node.EXPORT_FORMAT_JSONL && (*format != node.EXPORT_FORMAT_HOSTS || args[0] != "import")) {
+		fmt.Fprintln(os.Stderr, usage)
+		return EXIT_USAGE
+	}
+	client := node.NewClient(config)
+	helper := flags.Arg(0)
+
+	if args[0] == "export" {
+		out := os.Stdout
+		if flags.NArg() == 2 {
+			file, err := os.Create(flags.Arg(1))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error creating export file:", err)
+				return EXIT_FAILURE
+			}
+			defer file.Close()
+			out = file
+		}
+		count, err := client.ExportVia(helper, out, *format)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error exporting records:", err)
+			return exitCode(err)
+		}
+		fmt.Fprintf(os.Stderr, "Exported %d record set(s)\n", count)
+		return EXIT_OK
+	}
+
+	in := os.Stdin
+	if flags.NArg() == 2 {
+		file, err := os.Open(flags.Arg(1))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error opening import file:", err)
+			return EXIT_FAILURE
+		}
+		defer file.Close()
+		in = file
+	}
+	count, err := client.ImportVia(helper, in, *format)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error importing records after %d record set(s): %v\n", count, err)
+		return exitCode(err)
+	}
+	fmt.Fprintf(os.Stderr, "Imported %d record set(s)\n", count)
+	return EXIT_OK
+}
+
+/*
+Returns the ID of this node at addr, as assigned by the ID_STRATEGY of config, see
+node/idstrategy.go. Test topologies can pin a node to a chosen point in the keyspace with --node-id,
+or derive it from a name with --node-name.
+*/
+func nodeId(config node.Config, addr string) uint64 {
+	var strategy node.IDStrategy
+	var err error
+	switch {
+	case *nodeIdFlag != "":
+		var id uint64
+		id, err = node.ParseNodeID(*nodeIdFlag)
+		strategy = node.FixedID{ID: id}
+	case *nodeNameFlag != "":
+		strategy = node.NameID{Name: *nodeNameFlag}
+	default:
+		strategy, err = node.NewIDStrategy(config)
+	}
+	if err != nil {
+		log.Fatal().Err(err).Msg("Could not assign the node ID")
+	}
+	id, err := strategy.NodeID(addr)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Could not assign the node ID")
+	}
+	return id
+}
+
 /*
 Show a list of options to choose from.
 */
@@ -35,15 +349,228 @@ func showmenu() {
 	system.Println("********************************")
 	system.Println("\t\tMENU")
 	system.Println("Press 1 to see the fingertable")
+	system.Println("Press f to fix every finger at once")
 	system.Println("Press 2 to see the successor and predecessor")
+	system.Println("Press w to walk the ring from this node or another, and check its integrity")
 	system.Println("Press 3 to see the node storage")
 	system.Println("Press 4 to see the cache")
+	system.Println("Press c to see the cache statistics")
 	system.Println("Press 5 to query a website")
+	system.Println("Press p to publish a record (put <name> <ip> [ttl [replicas]])")
+	system.Println("Press h to see the version history of a name")
+	system.Println("Press k to move a name to another node (move <name> <ip:port>)")
+	system.Println("Press r to roll a name back to an earlier version (rollback <name> <version>)")
+	system.Println("Press 7 to see the goroutine counts")
+	system.Println("Press 8 to see the peer latencies")
+	system.Println("Press 9 to decommission this node")
+	system.Println("Press q to leave the ring at once, without draining traffic")
+	system.Println("Press x to simulate a crash of this node or another (needs -allow-crash)")
+	system.Println("Press g to export the routing graph in DOT format")
+	system.Println("Press l to list the names under a domain suffix")
+	system.Println("Press s to collect the statistics of every node into a CSV file")
+	system.Println("Press v to set the log level, of this node or the whole ring (v <level> [*])")
 	system.Println("Press m to see the menu")
 	system.Println("********************************")
 }
 
+/*
+Runs a churn experiment from a scenario file against a local ring, writing the metrics CSV to
+stdout or to the given file, and the end-of-run report to the last file given, in HTML if its name
+ends in .html and in Markdown otherwise:
+
+	dns-chord experiment scenario.json [metrics.csv [report.md]]
+*/
+func runExperiment(args []string) int {
+	if len(args) == 0 || len(args) > 3 {
+		fmt.Fprintln(os.Stderr, "usage: dns-chord experiment scenario.json [metrics.csv [report.md]]")
+		return EXIT_USAGE
+	}
+	scenario, err := experiment.Load(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading scenario:", err)
+		return EXIT_FAILURE
+	}
+	out := os.Stdout
+	if len(args) > 1 {
+		out, err = os.Create(args[1])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error creating metrics file:", err)
+			return EXIT_FAILURE
+		}
+		defer out.Close()
+	}
+	var report io.Writer
+	format := node.REPORT_FORMAT_MARKDOWN
+	if len(args) > 2 {
+		file, err := os.Create(args[2])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error creating report file:", err)
+			return EXIT_FAILURE
+		}
+		defer file.Close()
+		report = file
+		if strings.HasSuffix(args[2], ".html") {
+			format = node.REPORT_FORMAT_HTML
+		}
+	}
+	if err := experiment.Run(scenario, out, report, format); err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing metrics:", err)
+		return EXIT_FAILURE
+	}
+	return EXIT_OK
+}
+
+/*
+Collects the counters and recent pointer changes of every node of a ring through one of its nodes,
+and writes the end-of-run report, with latency percentiles, hop counts, churn and cache hit rates,
+to stdout or to the given file:
+
+	dns-chord report [-format markdown|html] [-timeout 30s] ip:port [report.md]
+*/
+func writeReport(args []string) int {
+	usage := "usage: dns-chord report [-format markdown|html] [-timeout 30s] ip:port [report.md]"
+	flags := flag.NewFlagSet("report", flag.ContinueOnError)
+	format := flags.String("format", node.REPORT_FORMAT_MARKDOWN, "format of the report, markdown or html")
+	timeout := flags.Duration("timeout", node.REPORT_TIMEOUT, "give up after this long")
+	if err := flags.Parse(args); err != nil || flags.NArg() < 1 || flags.NArg() > 2 || (*format != node.REPORT_FORMAT_MARKDOWN && *format != node.REPORT_FORMAT_HTML) {
+		fmt.Fprintln(os.Stderr, usage)
+		return EXIT_USAGE
+	}
+	godotenv.Load()
+	report, err := node.NewClient(node.LoadConfig()).CollectReportVia(flags.Arg(0), *timeout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error collecting the report:", err)
+		return exitCode(err)
+	}
+	out := os.Stdout
+	if flags.NArg() == 2 {
+		file, err := os.Create(flags.Arg(1))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error creating report file:", err)
+			return EXIT_FAILURE
+		}
+		defer file.Close()
+		out = file
+	}
+	if err := node.WriteReport(out, report, *format); err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing the report:", err)
+		return EXIT_FAILURE
+	}
+	return EXIT_OK
+}
+
+/*
+Builds a memory-mapped store file for DISK_STORE from storage snapshots of ./data:
+
+	dns-chord build-store out.store data/node1.json data/node2.json ...
+*/
+func buildStore(args []string) int {
+	if len(args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: dns-chord build-store out.store snapshot.json ...")
+		return EXIT_USAGE
+	}
+	var snapshots []map[uint64]map[uint64][]node.Record
+	for _, path := range args[1:] {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error reading snapshot:", err)
+			return EXIT_FAILURE
+		}
+		var snapshot map[uint64]map[uint64][]node.Record
+		if err := json.Unmarshal(data, &snapshot); err != nil {
+			fmt.Fprintln(os.Stderr, "Error decoding snapshot:", err)
+			return EXIT_FAILURE
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	count, err := node.WriteStore(args[0], snapshots...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing store:", err)
+		return EXIT_FAILURE
+	}
+	fmt.Printf("Wrote %d keys to %s\n", count, args[0])
+	return EXIT_OK
+}
+
+/*
+Checks the keyspace arithmetic and the routing algorithm against the reference model, on random
+inputs from a seeded source:
+
+	dns-chord check-model [iterations] [seed]
+*/
+func checkModel(args []string) int {
+	iterations, seed := node.MODEL_ITERATIONS, int64(node.MODEL_SEED)
+	var err error
+	if len(args) > 0 {
+		if iterations, err = strconv.Atoi(args[0]); err != nil {
+			fmt.Fprintln(os.Stderr, "usage: dns-chord check-model [iterations] [seed]")
+			return EXIT_USAGE
+		}
+	}
+	if len(args) > 1 {
+		if seed, err = strconv.ParseInt(args[1], 10, 64); err != nil {
+			fmt.Fprintln(os.Stderr, "usage: dns-chord check-model [iterations] [seed]")
+			return EXIT_USAGE
+		}
+	}
+	if err := node.CheckModel(seed, iterations); err != nil {
+		fmt.Fprintln(os.Stderr, "Model check failed:", err)
+		return EXIT_FAILURE
+	}
+	fmt.Printf("Model check passed: %d iterations per property, seed %d\n", iterations, seed)
+	return EXIT_OK
+}
+
 func main() {
+	flag.Parse()
+	if *selfTestFlag {
+		zerolog.SetGlobalLevel(zerolog.Disabled)
+		if err := node.SelfTest(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "Self-test failed:", err)
+			os.Exit(EXIT_FAILURE)
+		}
+		os.Exit(EXIT_OK)
+	}
+	// Node IDs and keys must be hashed into the same keyspace as the rest of the ring, by nodes and clients alike.
+	godotenv.Load()
+	keyspace := node.LoadConfig()
+	if err := hashing.SetBits(keyspace.RingBits); err != nil {
+		fmt.Fprintln(os.Stderr, "Error in RING_BITS:", err)
+		os.Exit(EXIT_FAILURE)
+	}
+	hashing.SetLegacyRounding(keyspace.LegacyHash)
+	switch flag.Arg(0) {
+	case "capture-view":
+		os.Exit(viewCapture(flag.Args()[1:]))
+	case "build-store":
+		os.Exit(buildStore(flag.Args()[1:]))
+	case "check-model":
+		zerolog.SetGlobalLevel(zerolog.WarnLevel)
+		os.Exit(checkModel(flag.Args()[1:]))
+	case "lookup":
+		zerolog.SetGlobalLevel(zerolog.Disabled)
+		os.Exit(lookupName(flag.Args()[1:]))
+	case "put":
+		zerolog.SetGlobalLevel(zerolog.Disabled)
+		os.Exit(putName(flag.Args()[1:]))
+	case "control":
+		zerolog.SetGlobalLevel(zerolog.Disabled)
+		os.Exit(controlNode(flag.Args()[1:]))
+	case "storage":
+		zerolog.SetGlobalLevel(zerolog.Disabled)
+		os.Exit(storage(flag.Args()[1:]))
+	case "report":
+		zerolog.SetGlobalLevel(zerolog.Disabled)
+		os.Exit(writeReport(flag.Args()[1:]))
+	case "gateway":
+		zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+		os.Exit(runGateway(flag.Args()[1:]))
+	case "experiment":
+		zerolog.SetGlobalLevel(zerolog.WarnLevel)
+		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+		os.Exit(runExperiment(flag.Args()[1:]))
+	}
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 	zerolog.SetGlobalLevel(zerolog.InfoLevel)
@@ -60,10 +587,26 @@ func main() {
 	myIpAddress := utility.GetOutboundIP().String()
 	reader := bufio.NewReader(os.Stdin)
 	// read input from user
-	system.Println("Enter your port number:")
-	port, err = reader.ReadString('\n')
-	if err != nil {
-		log.Error().Err(err).Msg("Error reading input")
+	config := node.LoadConfig()
+	if err := node.SetLogLevel(config.LogLevel); err != nil {
+		log.Error().Err(err).Msg("Ignoring LOG_LEVEL")
+	}
+	node.SetLogSampling(config.LogSampleThreshold, config.LogSampleRate)
+	if *observeFlag {
+		config.Observer = true
+	}
+	if *allowCrashFlag {
+		config.AllowCrash = true
+	}
+	if config.RPCPort != "" {
+		// Keep the trailing newline, so that IDs match those of nodes whose port was typed in.
+		port = config.RPCPort + "\n"
+	} else {
+		system.Println("Enter your port number:")
+		port, err = reader.ReadString('\n')
+		if err != nil {
+			log.Error().Err(err).Msg("Error reading input")
+		}
 	}
 	system.Println("Enter IP address and port used to join network:")
 	// read input from user
@@ -75,15 +618,38 @@ func main() {
 	var addr = myIpAddress + ":" + port
 
 	// Create new Node object for yourself
+	// A process with virtual nodes is a failure domain of its own, see node/vnodes.go
+	config.Zone = node.VirtualZone(config, addr[:len(addr)-1])
 	me := node.Node{
-		Nodeid:        utility.GenerateHash(addr),
+		Nodeid:        nodeId(config, addr[:len(addr)-1]),
 		IP:            addr[:len(addr)-1],
 		CachedQuery:   make(map[uint64]node.LRUCache, 69),
-		HashIPStorage: make(map[uint64]map[uint64][]string, 69),
+		HashIPStorage: make(map[uint64]map[uint64][]node.Record, 69),
+		Config:        config,
+	}
+
+	if config.DiskStore != "" {
+		if err := me.OpenDiskStore(config.DiskStore); err != nil {
+			log.Error().Err(err).Msg("Could not open the disk store")
+		}
+	}
+	if config.CachePersist {
+		me.LoadCache()
+	}
+
+	if *captureFlag != "" {
+		me.Capture, err = capture.NewRecorder(*captureFlag)
+		if err != nil {
+			log.Error().Err(err).Msg("Could not open capture file")
+		}
+		defer me.Capture.Close()
 	}
 
 	log.Info().Str("Address", addr)
 	log.Info().Uint64("My id is", me.Nodeid)
+	// Every log line of the process names the instance of its node, see node/instance.go
+	log.Logger = log.With().Str("instance", me.InstanceID()).Logger()
+	log.Info().Msgf("Instance %s", me.InstanceID())
 
 	// Bind yourself to a port and listen to it
 	tcpAddr, err := net.ResolveTCPAddr("tcp", me.IP)
@@ -96,9 +662,46 @@ func main() {
 	}
 
 	// Register RPC methods and accept incoming requests
-	rpc.Register(&me)
 	log.Info().Msgf("Node is running at IP address: %s", tcpAddr.String())
-	go rpc.Accept(inbound)
+	me.Serve(inbound)
+
+	// Start the optional listeners, each on its own port
+	if config.DNSEnabled && config.DNSPort != "" {
+		me.ServeDNS(":" + config.DNSPort)
+	}
+	if config.AdminEnabled && config.AdminPort != "" {
+		me.ServeAdmin(":" + config.AdminPort)
+	}
+	if config.MetricsEnabled && config.MetricsPort != "" {
+		me.ServeMetrics(":" + config.MetricsPort)
+	}
+	if config.RelayPort != "" {
+		me.ServeRelay(":" + config.RelayPort)
+	}
+	if config.RelayVia != "" {
+		if err := me.ConnectRelay(config.RelayVia); err != nil {
+			log.Error().Err(err).Msg("Could not connect to the relay")
+		}
+	}
+
+	// Additional rings this process takes part in, e.g. NAMESPACES=staging with STAGING_RPC_PORT, STAGING_JOIN, ...
+	rings := node.Rings{}
+	rings.Add("", &me)
+	for _, namespace := range strings.Split(os.Getenv("NAMESPACES"), ",") {
+		if namespace = strings.TrimSpace(namespace); namespace == "" {
+			continue
+		}
+		ring, err := node.StartRing(myIpAddress, node.LoadNamespaceConfig(namespace))
+		if err != nil {
+			log.Error().Err(err).Msgf("Could not start the ring of namespace %s", namespace)
+			continue
+		}
+		rings.Add(namespace, ring)
+	}
+
+	// Stop background goroutines and close connections cleanly on Ctrl+C
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
 
 	helperIp = helperIp[:len(helperIp)-1]
 
@@ -107,10 +710,25 @@ func main() {
 		chord network, or joins an existing chord network accordingly.
 	*/
 	if len(strings.Split(helperIp, ":")) == 1 { // I am the only node in this network
-		me.CreateNetwork()
+		// Unless this node has been part of a ring before, and one of its peers is still alive
+		if rejoin, ok := me.RejoinAddress(); ok {
+			log.Info().Msgf("Rejoining the network through %s from the address book", rejoin)
+			me.JoinNetwork(rejoin)
+		} else if me.Observing() {
+			log.Fatal().Msg("An observer needs a ring to join, enter the address of one of its nodes")
+		} else {
+			me.CreateNetwork()
+		}
 	} else {
+		if *balancedJoinFlag && *nodeIdFlag == "" {
+			if id, ok := me.SuggestedId(helperIp); ok {
+				me.Nodeid = id
+				log.Info().Msgf("My id is %d", me.Nodeid)
+			}
+		}
 		me.JoinNetwork(helperIp)
 	}
+	vnodes := me.StartVirtualNodes(myIpAddress)
 
 	showmenu()
 	dataList, err := utility.ReadCSV("./website_data/" + "websites" + ".csv")
@@ -118,55 +736,348 @@ func main() {
 		fmt.Println("Error reading CSV:", err)
 		return
 	}
-	// Keep the parent thread alive
+	go runMenu(&me, &rings, dataList)
+
+	select {
+	case <-interrupt:
+		log.Info().Msg("Shutting down...")
+	case <-me.Left():
+		// Decommissioned by a CONTROL command, see node/control.go
+		log.Info().Msg("Left the ring, shutting down...")
+	}
+	for _, vnode := range vnodes {
+		vnode.Shutdown()
+	}
+	rings.Shutdown()
+}
+
+/*
+Reads menu choices from stdin and submits them to the node's command loop, see node/commands.go.
+Waits up to node.COMMAND_WAIT for each command, so that a slow one does not hold up the menu.
+*/
+func runMenu(me *node.Node, rings *node.Rings, dataList []string) {
+	run := func(name string, fn func()) {
+		if !node.Await(me.Submit(name, fn), node.COMMAND_WAIT) {
+			system.Println(name, "is still running, its output follows when it is done")
+		}
+	}
 	for {
 		time.Sleep(1000)
 		var input string
 		system.Println("********************************")
-		system.Println("     Enter 1, 2, 3, 4, 5, 6, m:    ")
+		system.Println("    Enter 1, 2, 3, 4, 5, 6, 7, 8, 9, c, f, g, h, k, l, m, p, q, r, s, v, w, x:  ")
 		system.Println("********************************")
 		fmt.Scanln(&input)
 
 		switch input {
 		case "1":
 			system.Println("Printing Fingertable:")
-			me.PrintFingers()
+			run("fingers", me.PrintFingers)
+		case "f":
+			if me.Frozen() {
+				log.Warn().Msg("The ring topology is frozen, thaw it first")
+				break
+			}
+			run("fix_fingers", func() {
+				system.Println("Fixed all fingers,", me.FixAllFingers(), "changed")
+			})
 		case "2":
 			system.Println("Printing Successor and Predecessor:")
-			system.Println("Successor:")
-			me.PrintSuccessor()
-			system.Println("Predecessor:")
-			me.PrintPredecessor()
+			run("successor and predecessor", func() {
+				system.Println("Successor:")
+				me.PrintSuccessor()
+				system.Println("Predecessor:")
+				me.PrintPredecessor()
+			})
 		case "3":
 			system.Println("Printing Node Storage:")
-			me.PrintStorage()
+			run("storage", me.PrintStorage)
 		case "4":
 			system.Println("Printing Cache:")
-			me.PrintCache()
+			run("cache", me.PrintCache)
+		case "c":
+			system.Println("Printing cache statistics:")
+			run("cache_stats", me.PrintCacheStats)
 		case "5":
 			log.Info().Msg("Querying website:")
-			system.Println("Please type the website:")
+			system.Println("Please type the website, optionally followed by @namespace (or a prefix followed by ? to list matching names):")
 			// Pause logging
 			zerolog.SetGlobalLevel(zerolog.Disabled)
 			fmt.Scanln(&input)
 			// Resume logging
-			zerolog.SetGlobalLevel(zerolog.InfoLevel)
-			me.QueryDNS(input)
+			zerolog.SetGlobalLevel(node.LogLevel())
+			if prefix, ok := strings.CutSuffix(input, "?"); ok {
+				run("completion", func() {
+					for _, name := range me.CompleteNames(strings.ToLower(prefix)) {
+						system.Println(node.DisplayName(name))
+					}
+				})
+				break
+			}
+			// website@namespace queries the ring of another namespace
+			if website, namespace, ok := strings.Cut(input, "@"); ok {
+				ring, err := rings.Get(namespace)
+				if err != nil {
+					log.Error().Err(err).Msg("Could not query website")
+					break
+				}
+				run("query", func() { ring.QueryDNS(website) })
+				break
+			}
+			website := input
+			run("query", func() { me.QueryDNS(website) })
 		case "6":
 			log.Info().Msgf("Querying %v websites", numQueries)
 			// Pause logging
 			zerolog.SetGlobalLevel(zerolog.Disabled)
 			fmt.Scanln(&input)
 			// Resume logging
-			zerolog.SetGlobalLevel(zerolog.InfoLevel)
-			start := time.Now().UnixMilli()
-			for _, query := range dataList[:numQueries] {
-				// log.Info().Msg(query)
-				me.QueryDNS(query)
+			zerolog.SetGlobalLevel(node.LogLevel())
+			run("bulk query", func() {
+				start := time.Now().UnixMilli()
+				queries := dataList[:min(numQueries, len(dataList))]
+				progress := me.StartProgress("bulk query", len(queries))
+				for _, query := range queries {
+					if progress.Stopped() {
+						break
+					}
+					// log.Info().Msg(query)
+					me.QueryDNS(query)
+					progress.Add(1)
+				}
+				progress.Finish()
+				end := time.Now().UnixMilli()
+				timeTaken := end - start
+				log.Info().Msgf("TIME %v", timeTaken)
+			})
+		case "7":
+			system.Println("Printing Goroutine Counts:")
+			run("goroutines", me.PrintGoroutines)
+		case "8":
+			system.Println("Printing Peer Latencies:")
+			run("latencies", me.PrintLatencies)
+		case "9":
+			system.Println("Decommissioning, this node exits once its traffic has drained:")
+			<-me.Submit("decommission", func() {
+				me.Decommission(node.DECOMMISSION_LOOKUP_THRESHOLD, node.DECOMMISSION_TIMEOUT)
+			})
+			// main shuts the other rings down once the node has left
+			return
+		case "q":
+			system.Println("Leaving the ring, this node exits once its keys are handed off:")
+			<-me.Submit("leave", me.Leave)
+			return
+		case "x":
+			system.Println("Type self to crash this node, or the ip:port of a node to crash (both need -allow-crash):")
+			// Pause logging
+			zerolog.SetGlobalLevel(zerolog.Disabled)
+			fmt.Scanln(&input)
+			// Resume logging
+			zerolog.SetGlobalLevel(node.LogLevel())
+			if input != "self" {
+				target := input
+				run("crash", func() {
+					if err := me.CrashPeer(target); err != nil {
+						log.Error().Err(err).Msg("Could not crash the node")
+						return
+					}
+					system.Println(target, "crashed")
+				})
+				break
+			}
+			if !me.Config.AllowCrash {
+				log.Warn().Msg("Crashes are not allowed, start the node with -allow-crash or ALLOW_CRASH=true")
+				break
+			}
+			me.Crash()
+			system.Println("This node has crashed, press Ctrl+C to exit")
+		case "w":
+			system.Println("Type self to walk the ring from this node, or the ip:port of the node to walk it from:")
+			// Pause logging
+			zerolog.SetGlobalLevel(zerolog.Disabled)
+			fmt.Scanln(&input)
+			// Resume logging
+			zerolog.SetGlobalLevel(node.LogLevel())
+			from := input
+			if from == "self" {
+				from = ""
 			}
-			end := time.Now().UnixMilli()
-			timeTaken := end - start
-			log.Info().Msgf("TIME %v", timeTaken)
+			run("ring_walk", func() { me.PrintRingWalk(from) })
+		case "g":
+			system.Println("Type node to export this node's fingers, or ring to export the whole ring:")
+			// Pause logging
+			zerolog.SetGlobalLevel(zerolog.Disabled)
+			fmt.Scanln(&input)
+			// Resume logging
+			zerolog.SetGlobalLevel(node.LogLevel())
+			path := fmt.Sprintf("./data/graph-%s.dot", me.FileName())
+			scope := input
+			run("graph", func() {
+				file, err := os.Create(path)
+				if err != nil {
+					log.Error().Err(err).Msg("Could not create the graph file")
+					return
+				}
+				err = me.WriteGraph(file, scope == "ring")
+				file.Close()
+				if err != nil {
+					log.Error().Err(err).Msg("Could not write the graph")
+					return
+				}
+				system.Println("Graph written to", path, "- render it with: dot -Tsvg", path, "-o ring.svg")
+			})
+		case "l":
+			system.Println("Please type the domain suffix, followed by * to list the whole ring rather than this node (e.g. example.com *):")
+			// Pause logging
+			zerolog.SetGlobalLevel(zerolog.Disabled)
+			var scope string
+			fmt.Scanln(&input, &scope)
+			// Resume logging
+			zerolog.SetGlobalLevel(node.LogLevel())
+			suffix := input
+			run("list", func() {
+				list, err := me.ListSuffix(suffix, scope == "*")
+				if err != nil {
+					log.Error().Err(err).Msg("Could not list names")
+					return
+				}
+				for _, entry := range list {
+					system.Println(entry.Name, node.RecordsText(entry.Records))
+				}
+				system.Println(len(list), "name(s) under", suffix)
+			})
+		case "p":
+			system.Println("Please type the name and the IP address, optionally followed by a TTL in seconds and a replication factor (e.g. build.internal 10.0.0.7 60 4):")
+			// Pause logging
+			zerolog.SetGlobalLevel(zerolog.Disabled)
+			var ip, ttl, replicas string
+			fmt.Scanln(&input, &ip, &ttl, &replicas)
+			// Resume logging
+			zerolog.SetGlobalLevel(node.LogLevel())
+			website := input
+			run("put", func() {
+				seconds := 0
+				if ttl != "" {
+					var err error
+					if seconds, err = strconv.Atoi(ttl); err != nil {
+						log.Error().Msgf("TTL %q is not a number", ttl)
+						return
+					}
+				}
+				factor := 0
+				if replicas != "" {
+					var err error
+					if factor, err = strconv.Atoi(replicas); err != nil {
+						log.Error().Msgf("Replication factor %q is not a number", replicas)
+						return
+					}
+				}
+				if err := me.PutRecord(website, ip, seconds, factor); err != nil {
+					log.Error().Err(err).Msg("Could not publish the record")
+					return
+				}
+				system.Println("Published", website, ip)
+			})
+		case "v":
+			system.Println("Please type the log level (trace, debug, info, warn, error), followed by * to set it on the whole ring (e.g. debug *):")
+			// Pause logging
+			zerolog.SetGlobalLevel(zerolog.Disabled)
+			var scope string
+			fmt.Scanln(&input, &scope)
+			// Resume logging
+			zerolog.SetGlobalLevel(node.LogLevel())
+			level := input
+			run("log_level", func() {
+				if scope != "*" {
+					if err := node.SetLogLevel(level); err != nil {
+						log.Error().Err(err).Msg("Could not set the log level")
+					}
+					return
+				}
+				levels, err := me.SetRingLogLevel(level)
+				if err != nil {
+					log.Error().Err(err).Msg("Could not set the log level")
+					return
+				}
+				for IP, level := range levels {
+					system.Println(IP, level)
+				}
+				system.Println("Log level set on", len(levels), "node(s)")
+			})
+		case "h":
+			system.Println("Please type the name:")
+			// Pause logging
+			zerolog.SetGlobalLevel(zerolog.Disabled)
+			fmt.Scanln(&input)
+			// Resume logging
+			zerolog.SetGlobalLevel(node.LogLevel())
+			website := input
+			run("history", func() {
+				versions, err := me.History(website)
+				if err != nil {
+					log.Error().Err(err).Msg("Could not get the history")
+					return
+				}
+				for i, version := range versions {
+					system.Println(i, version.Time.Format(time.RFC3339), version.Origin, node.RecordsText(version.Records))
+				}
+				system.Println(len(versions), "version(s) of", website)
+			})
+		case "k":
+			system.Println("Please type the name and the address of the node to move it to (e.g. hot.example.com 10.0.0.5:8000):")
+			// Pause logging
+			zerolog.SetGlobalLevel(zerolog.Disabled)
+			var target string
+			fmt.Scanln(&input, &target)
+			// Resume logging
+			zerolog.SetGlobalLevel(node.LogLevel())
+			website := input
+			run("move", func() {
+				if err := me.MoveKey(website, target); err != nil {
+					log.Error().Err(err).Msg("Could not move the name")
+					return
+				}
+				system.Println("Moved", website, "to", target)
+			})
+		case "r":
+			system.Println("Please type the name and the version to restore, as numbered by h (e.g. example.com 2):")
+			// Pause logging
+			zerolog.SetGlobalLevel(zerolog.Disabled)
+			var version string
+			fmt.Scanln(&input, &version)
+			// Resume logging
+			zerolog.SetGlobalLevel(node.LogLevel())
+			website := input
+			run("rollback", func() {
+				index, err := strconv.Atoi(version)
+				if err != nil {
+					log.Error().Msgf("Version %q is not a number", version)
+					return
+				}
+				if err := me.Rollback(website, index); err != nil {
+					log.Error().Err(err).Msg("Could not roll back")
+					return
+				}
+				system.Println("Rolled", website, "back to version", index)
+			})
+		case "s":
+			system.Println("Collecting ring statistics:")
+			path := fmt.Sprintf("./data/stats-%d.csv", time.Now().Unix())
+			run("stats", func() {
+				list := me.CollectStats()
+				file, err := os.Create(path)
+				if err != nil {
+					log.Error().Err(err).Msg("Could not create the statistics file")
+					return
+				}
+				err = node.WriteStatsCSV(file, list)
+				file.Close()
+				if err != nil {
+					log.Error().Err(err).Msg("Could not write the statistics")
+					return
+				}
+				system.Println("Statistics of", len(list), "node(s) written to", path)
+			})
 		case "m":
 			showmenu()
 		default:
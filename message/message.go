@@ -7,13 +7,27 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-// Sample message structure. To be replaced with a struct for protobuff
+// Sample message structure. Encoded with gob, or with protobuf as described in wire.proto
 type RequestMessage struct {
-	Type     string // PING | SYNC | FIND_SUCCESSOR | CLOSEST_PRECEDING_NODE | PUT
-	TargetId uint64 // ID of the parameter node passed to the destination
-	IP       string // IP of the parameter node passed to the destination
-	Payload  map[uint64][]string
-	HopCount int
+	Type      string // PING | SYNC | FIND_SUCCESSOR | CLOSEST_PRECEDING_NODE | PUT
+	TargetId  uint64 // ID of the parameter node passed to the destination
+	IP        string // IP of the parameter node passed to the destination
+	Payload   map[uint64][]Record
+	HopCount  int
+	Names     map[uint64]string // Names of the hashed keys in Payload, where known
+	From      string            // IP of the sending node
+	TraceId   uint64            // ID of the lookup this message belongs to, 0 if none. Used for capturing.
+	Identity  string            // Identity of the sending node, for record ACLs
+	Signature []byte            // HMAC of the message with the key of Identity, see node/acl.go
+	Signed    int64             // Unix nanoseconds at which Identity signed the message, 0 if unsigned
+
+	SnapshotEpoch uint64            // Epoch of the last ring snapshot the sender recorded
+	Version       int               // Wire version of the sender, 0 for nodes that predate versioning
+	Budget        int64             // Nanoseconds the receiver has to reply, including any lookups it forwards. 0 if unbounded.
+	Limit         int               // Most record sets the reply may carry, e.g. a page of a SHIFT. 0 if unlimited.
+	Instance      string            // Instance ID of the sender, new with every start of it. Empty for nodes that predate instance IDs.
+	Background    bool              // Set on the lookups of ring maintenance, which yield to those of clients
+	Checksums     map[uint64]uint32 // Checksums of record sets by key, or digests of slots by slot, to compare in SCRUB, SLOT_KEYS and SLOT_DIGESTS
 }
 
 type ResponseMessage struct {
@@ -21,7 +35,36 @@ type ResponseMessage struct {
 	Nodeid        uint64 // ID of the node in the response message
 	IP            string // IP of the node in the response message
 	QueryResponse []string
-	Payload       map[uint64][]string
+	Payload       map[uint64][]Record
+	PredecessorId uint64            // ID of the responding node's predecessor. Used with Nodeid to prove ownership of a key.
+	PredecessorIP string            // IP of the responding node's predecessor. Empty if the responder has no predecessor.
+	Names         map[uint64]string // Names of the hashed keys in Payload, where known
+	KeyCount      int               // Number of keys the responding node is responsible for, or in a SHIFT reply, still has to shift
+	SuggestedId   uint64            // ID at which a new node would best balance the key load
+	Fingers       map[uint64]string // Distinct fingers of the responding node, Nodeid -> IP
+	SnapshotEpoch uint64            // Epoch of the last ring snapshot the responder recorded
+	Snapshot      []byte            // JSON encoded state of the responder at a snapshot's cut
+	Version       int               // Wire version of the responder, 0 for nodes that predate versioning
+	Zone          string            // Failure domain of the responder, empty if it is not tagged with one
+	Replicas      map[uint64]string // Nodes holding replicas of the key of a GET the responder owns, Nodeid -> IP
+	Instance      string            // Instance ID of the responder, new with every start of it. Empty for nodes that predate instance IDs.
+	HopCount      int               // Hops a FIND_SUCCESSOR took in all, those before the responder included. 0 for nodes that predate it.
+	Elapsed       int64             // Nanoseconds the responder spent on a FIND_SUCCESSOR, the hops it forwarded to included
+	Records       []Record          // Record set of the key of a GET, nil if the responder holds none
+}
+
+// A DNS record of a record set, without its name, which is that of the key the set is stored under
+type Record struct {
+	Type  uint16 // DNS type, or a private-use type for the records that control how the ring treats a record set
+	Class uint16 // DNS class, IN for every record but compressed ones
+	TTL   uint32 // TTL of DNS answers for the record in seconds, 0 for the TTL of its record set
+	Rdata []byte // Record data in wire format
+}
+
+// A message for a node behind a relay, sent to the relay to be forwarded over the node's outbound connection
+type RelayRequest struct {
+	Target  string // Name the relayed node registered with at the relay
+	Message RequestMessage
 }
 
 /*
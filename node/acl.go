@@ -0,0 +1,262 @@
+/*
+Record-level access control, for private internal names in a shared ring. A record set can carry
+an ACL record listing the node identities that may read and update it, e.g.
+
+	ACL read=billing,ops write=ops
+
+The responsible node enforces it on GET and PUT: a request is only served if it is signed by an
+identity on the list ("*" allows everyone). Without a write list, the read list applies to updates
+as well. A record set without an ACL record is public, and the first writer of a name may attach one.
+
+Node identities are authenticated with shared keys: every node is configured with its identity and
+the keys of all identities (NODE_IDENTITY, NODE_KEYS), and signs each GET and PUT with HMACs over
+the message type, the identity and the time it signed at. A GET's covers its key, and a PUT has one
+for every key of its payload, which covers the key, its records and its name, so that a PUT
+forwarded to the current owners of its keys can carry the MACs of the keys each owner gets, and
+keeps the identity of the original writer. The responsible node only takes a signature signed
+within SIGNATURE_MAX_AGE of its own clock, and only once, so that a request cannot be replayed, or
+its signature reused for other keys or records. Requests between ring members for maintenance
+(REPLICATE, SHIFT, ...) are not subject to ACLs, and are not signed.
+*/
+package node
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fauzxan/dns-chord/v2/message"
+	"github.com/rs/zerolog/log"
+)
+
+// Record types.
+const (
+	TYPE_ACL = "ACL" // Access control list of the record set, e.g. "ACL read=ops,billing write=ops".
+)
+
+// Constants
+const (
+	SIGNATURE_MAX_AGE = 30 * time.Second // Most a signed GET or PUT may be older or newer than the clock of the node that checks it.
+)
+
+var ErrAccessDenied = errors.New("access denied by the record's ACL")
+
+/*
+Signatures of the GETs and PUTs a node received within the last SIGNATURE_MAX_AGE, to refuse replays.
+*/
+type signatureState struct {
+	mu     sync.Mutex
+	seen   map[string]time.Time
+	pruned time.Time
+}
+
+/*
+Returns true for the types of requests that carry signatures, those record ACLs apply to.
+*/
+func signedType(msgType string) bool {
+	return msgType == GET || msgType == PUT
+}
+
+/*
+Returns the MAC of one entry of msg, keyed with key: of the key id, its name and its records.
+*/
+func signatureEntry(msg *message.RequestMessage, key []byte, id uint64, name string, records []Record) []byte {
+	mac := hmac.New(sha256.New, key)
+	field := func(value string) {
+		mac.Write(binary.BigEndian.AppendUint64(nil, uint64(len(value))))
+		mac.Write([]byte(value))
+	}
+	field(msg.Type)
+	field(msg.Identity)
+	mac.Write(binary.BigEndian.AppendUint64(nil, uint64(msg.Signed)))
+	mac.Write(binary.BigEndian.AppendUint64(nil, id))
+	field(name)
+	mac.Write(binary.BigEndian.AppendUint64(nil, uint64(len(records))))
+	for _, record := range records {
+		mac.Write(binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(nil, record.Type), record.Class))
+		mac.Write(binary.BigEndian.AppendUint32(nil, record.TTL))
+		field(string(record.Rdata))
+	}
+	return mac.Sum(nil)
+}
+
+/*
+Returns the signature of msg, keyed with key: the MAC of its key, TargetId, for a message without a
+payload, and else the MACs of the entries of its payload, in ascending key order.
+*/
+func signature(msg *message.RequestMessage, key []byte) []byte {
+	if len(msg.Payload) == 0 {
+		return signatureEntry(msg, key, msg.TargetId, "", nil)
+	}
+	signature := make([]byte, 0, len(msg.Payload)*sha256.Size)
+	for _, id := range sortedKeys(msg.Payload) {
+		signature = append(signature, signatureEntry(msg, key, id, msg.Names[id], msg.Payload[id])...)
+	}
+	return signature
+}
+
+/*
+Returns the signature of the part payload of the signed PUT msg, for forwarding that part to its
+owner: the MACs of its entries, taken from the signature of msg. Returns nil if msg is not signed.
+*/
+func forwardedSignature(msg *message.RequestMessage, payload map[uint64][]Record) []byte {
+	ids := sortedKeys(msg.Payload)
+	if len(msg.Signature) != len(ids)*sha256.Size {
+		return nil
+	}
+	index := make(map[uint64]int, len(ids))
+	for i, id := range ids {
+		index[id] = i
+	}
+	signature := make([]byte, 0, len(payload)*sha256.Size)
+	for _, id := range sortedKeys(payload) {
+		i := index[id]
+		signature = append(signature, msg.Signature[i*sha256.Size:(i+1)*sha256.Size]...)
+	}
+	return signature
+}
+
+/*
+Signs msg with this node's identity, if it has one, msg is a GET or PUT and not already signed,
+e.g. because it is being forwarded on behalf of another node.
+*/
+func (node *Node) signRequest(msg *message.RequestMessage) {
+	key, ok := node.Config.NodeKeys[node.Config.NodeIdentity]
+	if msg.Identity != "" || !signedType(msg.Type) || node.Config.NodeIdentity == "" || !ok {
+		return
+	}
+	msg.Identity = node.Config.NodeIdentity
+	msg.Signed = time.Now().UnixNano()
+	msg.Signature = signature(msg, []byte(key))
+}
+
+/*
+Returns the identity msg was signed with, or "" if it is unsigned, the signature does not verify,
+or it was not signed within SIGNATURE_MAX_AGE.
+*/
+func (node *Node) verifiedIdentity(msg *message.RequestMessage) string {
+	key, ok := node.Config.NodeKeys[msg.Identity]
+	if msg.Identity == "" || !ok {
+		return ""
+	}
+	if !hmac.Equal(msg.Signature, signature(msg, []byte(key))) {
+		log.Warn().Msgf("Invalid signature of identity %s from %s", msg.Identity, msg.From)
+		return ""
+	}
+	if age := time.Since(time.Unix(0, msg.Signed)); age > SIGNATURE_MAX_AGE || age < -SIGNATURE_MAX_AGE {
+		log.Warn().Msgf("Signature of identity %s from %s was made %s from this node's clock", msg.Identity, msg.From, age.Round(time.Millisecond))
+		return ""
+	}
+	return msg.Identity
+}
+
+/*
+Drops the identity of msg, a request just received, if its signature was seen before, so that a
+replayed GET or PUT is served as an unsigned one.
+*/
+func (node *Node) dropReplayedIdentity(msg *message.RequestMessage) {
+	if !signedType(msg.Type) || node.verifiedIdentity(msg) == "" {
+		return
+	}
+	state := &node.signatures
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	now := time.Now()
+	if state.seen == nil {
+		state.seen = make(map[string]time.Time)
+	}
+	if now.Sub(state.pruned) > SIGNATURE_MAX_AGE {
+		for signature, seen := range state.seen {
+			if now.Sub(seen) > 2*SIGNATURE_MAX_AGE {
+				delete(state.seen, signature)
+			}
+		}
+		state.pruned = now
+	}
+	if _, replayed := state.seen[string(msg.Signature)]; replayed {
+		log.Warn().Msgf("Replayed signature of identity %s from %s", msg.Identity, msg.From)
+		node.incMetric("acl_replays_total", 1)
+		msg.Identity, msg.Signature = "", nil
+		return
+	}
+	state.seen[string(msg.Signature)] = now
+}
+
+/*
+Returns the identities allowed to read and to write a record set, or nil lists if it has no ACL.
+*/
+func parseACL(records []Record) (read []string, write []string) {
+	for _, record := range records {
+		rtype, value := ParseRecord(record)
+		if rtype != TYPE_ACL {
+			continue
+		}
+		for _, field := range strings.Fields(value) {
+			name, list, _ := strings.Cut(field, "=")
+			switch strings.ToLower(name) {
+			case "read":
+				read = append(read, strings.Split(list, ",")...)
+			case "write":
+				write = append(write, strings.Split(list, ",")...)
+			}
+		}
+		if write == nil {
+			write = read
+		}
+		if read == nil {
+			read = []string{"*"}
+		}
+	}
+	return read, write
+}
+
+/*
+Returns true if identity is on list. A nil list, i.e. no ACL, allows everyone.
+*/
+func allowed(list []string, identity string) bool {
+	if list == nil {
+		return true
+	}
+	for _, entry := range list {
+		if entry == "*" || (identity != "" && entry == identity) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Returns true if the sender of msg may read the stored record set records.
+*/
+func (node *Node) mayRead(msg *message.RequestMessage, records []Record) bool {
+	read, _ := parseACL(decompressRecords(records))
+	if allowed(read, node.verifiedIdentity(msg)) {
+		return true
+	}
+	node.incMetric(`acl_denials_total{op="read"}`, 1)
+	return false
+}
+
+/*
+Returns the part of payload the sender of msg may write, judged by the ACLs of the record sets
+currently stored under its keys.
+*/
+func (node *Node) authorizeWrites(msg *message.RequestMessage, payload map[uint64][]Record) map[uint64][]Record {
+	identity := node.verifiedIdentity(msg)
+	permitted := make(map[uint64][]Record, len(payload))
+	for key, records := range payload {
+		if current := node.GetQuery(key); current != nil {
+			if _, write := parseACL(decompressRecords(current)); !allowed(write, identity) {
+				log.Warn().Msgf("Denied update of key %d to identity %q", key, identity)
+				node.incMetric(`acl_denials_total{op="write"}`, 1)
+				continue
+			}
+		}
+		permitted[key] = records
+	}
+	return permitted
+}
@@ -0,0 +1,80 @@
+package node
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fauzxan/dns-chord/v2/message"
+)
+
+func aclTestNode() *Node {
+	return &Node{Config: Config{NodeIdentity: "ops", NodeKeys: map[string]string{"ops": "secret1", "billing": "secret2"}}}
+}
+
+func TestSignatureCoversContent(t *testing.T) {
+	node := aclTestNode()
+	msg := message.RequestMessage{Type: PUT, TargetId: 1, Payload: map[uint64][]Record{10: {NewRecord(TYPE_A, "192.0.2.1")}, 20: {NewRecord(TYPE_A, "192.0.2.2")}}, Names: map[uint64]string{10: "a.example", 20: "b.example"}}
+	node.signRequest(&msg)
+	if got := node.verifiedIdentity(&msg); got != "ops" {
+		t.Fatalf("identity %q of a signed PUT, want ops", got)
+	}
+	for name, tamper := range map[string]func(*message.RequestMessage){
+		"records": func(msg *message.RequestMessage) {
+			msg.Payload = map[uint64][]Record{10: {NewRecord(TYPE_A, "192.0.2.9")}, 20: {NewRecord(TYPE_A, "192.0.2.2")}}
+		},
+		"key": func(msg *message.RequestMessage) {
+			msg.Payload = map[uint64][]Record{11: {NewRecord(TYPE_A, "192.0.2.1")}, 20: {NewRecord(TYPE_A, "192.0.2.2")}}
+		},
+		"name": func(msg *message.RequestMessage) { msg.Names = map[uint64]string{10: "c.example", 20: "b.example"} },
+		"type": func(msg *message.RequestMessage) { msg.Type = GET },
+		"time": func(msg *message.RequestMessage) { msg.Signed++ },
+	} {
+		tampered := msg
+		tamper(&tampered)
+		if got := node.verifiedIdentity(&tampered); got != "" {
+			t.Errorf("a PUT with other %s verified as %q", name, got)
+		}
+	}
+	get := message.RequestMessage{Type: GET, TargetId: 10}
+	node.signRequest(&get)
+	get.TargetId = 20
+	if got := node.verifiedIdentity(&get); got != "" {
+		t.Errorf("the signature of a GET verified for another key as %q", got)
+	}
+}
+
+func TestSignatureExpires(t *testing.T) {
+	node := aclTestNode()
+	msg := message.RequestMessage{Type: GET, TargetId: 10, Identity: "ops", Signed: time.Now().Add(-2 * SIGNATURE_MAX_AGE).UnixNano()}
+	msg.Signature = signature(&msg, []byte("secret1"))
+	if got := node.verifiedIdentity(&msg); got != "" {
+		t.Errorf("a stale signature verified as %q", got)
+	}
+}
+
+func TestSignatureReplayed(t *testing.T) {
+	node := aclTestNode()
+	msg := message.RequestMessage{Type: GET, TargetId: 10}
+	node.signRequest(&msg)
+	first, replay := msg, msg
+	node.dropReplayedIdentity(&first)
+	node.dropReplayedIdentity(&replay)
+	if first.Identity != "ops" || replay.Identity != "" {
+		t.Errorf("identities %q and %q of a request and its replay, want ops and none", first.Identity, replay.Identity)
+	}
+}
+
+func TestForwardedSignature(t *testing.T) {
+	node := aclTestNode()
+	msg := message.RequestMessage{Type: PUT, TargetId: 1, Payload: map[uint64][]Record{10: {NewRecord(TYPE_A, "192.0.2.1")}, 20: {NewRecord(TYPE_A, "192.0.2.2")}, 30: nil}}
+	node.signRequest(&msg)
+	part := map[uint64][]Record{30: nil, 10: {NewRecord(TYPE_A, "192.0.2.1")}}
+	forwarded := message.RequestMessage{Type: PUT, TargetId: 2, Payload: part, Identity: msg.Identity, Signed: msg.Signed, Signature: forwardedSignature(&msg, part)}
+	if got := node.verifiedIdentity(&forwarded); got != "ops" {
+		t.Errorf("identity %q of a forwarded part of a PUT, want ops", got)
+	}
+	forwarded.Payload = map[uint64][]Record{30: {NewRecord(TYPE_A, "192.0.2.9")}, 10: {NewRecord(TYPE_A, "192.0.2.1")}}
+	if got := node.verifiedIdentity(&forwarded); got != "" {
+		t.Errorf("a forwarded part with other records verified as %q", got)
+	}
+}
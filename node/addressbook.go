@@ -0,0 +1,176 @@
+/*
+Persistent address book of peers. Every node remembers the peers it has recently seen alive
+(successors, fingers, predecessor, and senders of incoming messages) and periodically saves them
+next to its storage. When the node restarts, or when its whole successor list has died, the address
+book provides alternate entry points into the ring.
+*/
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fauzxan/dns-chord/v2/message"
+	"github.com/rs/zerolog/log"
+)
+
+// Constants
+const (
+	ADDRESS_BOOK_SIZE          = 64               // Maximum number of peers remembered.
+	ADDRESS_BOOK_SAVE_INTERVAL = 30 * time.Second // Time between two saves of the address book.
+)
+
+/*
+A peer as remembered by the address book.
+*/
+type Peer struct {
+	Nodeid   uint64    `json:"nodeid"`
+	IP       string    `json:"ip"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+/*
+Book keeping of the peers seen alive, keyed by IP.
+*/
+type addressBook struct {
+	mu     sync.Mutex
+	loaded bool
+	peers  map[string]Peer
+}
+
+/*
+Records that the peer at IP has been seen alive.
+*/
+func (node *Node) rememberPeer(nodeid uint64, IP string) {
+	if IP == "" || IP == node.IP {
+		return
+	}
+	node.addressBook.mu.Lock()
+	defer node.addressBook.mu.Unlock()
+	node.loadAddressBook()
+	if known, ok := node.addressBook.peers[IP]; ok && nodeid == 0 {
+		// Senders of incoming messages are only known by IP, keep the ID learned before.
+		nodeid = known.Nodeid
+	}
+	node.addressBook.peers[IP] = Peer{Nodeid: nodeid, IP: IP, LastSeen: time.Now()}
+	if len(node.addressBook.peers) > ADDRESS_BOOK_SIZE {
+		oldest := ""
+		for ip, peer := range node.addressBook.peers {
+			if oldest == "" || peer.LastSeen.Before(node.addressBook.peers[oldest].LastSeen) {
+				oldest = ip
+			}
+		}
+		delete(node.addressBook.peers, oldest)
+	}
+}
+
+/*
+Returns the remembered peers, most recently seen first.
+*/
+func (node *Node) Peers() []Peer {
+	node.addressBook.mu.Lock()
+	defer node.addressBook.mu.Unlock()
+	node.loadAddressBook()
+	peers := make([]Peer, 0, len(node.addressBook.peers))
+	for _, peer := range node.addressBook.peers {
+		peers = append(peers, peer)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].LastSeen.After(peers[j].LastSeen) })
+	return peers
+}
+
+/*
+Returns the first remembered peer that is still alive, skipping the given IPs.
+*/
+func (node *Node) findLivePeer(skip ...string) (Peer, bool) {
+	skipped := map[string]bool{}
+	for _, IP := range skip {
+		skipped[IP] = true
+	}
+	for _, peer := range node.Peers() {
+		if skipped[peer.IP] {
+			continue
+		}
+		if node.CallRPC(message.RequestMessage{Type: PING}, peer.IP).Type == ACK {
+			return peer, true
+		}
+	}
+	return Peer{}, false
+}
+
+/*
+Periodically records the current neighbours of the node and saves the address book.
+*/
+func (node *Node) maintainAddressBook() {
+	for node.sleep(ADDRESS_BOOK_SAVE_INTERVAL) {
+		neighbours := append(append([]Pointer{node.successor(), node.predecessor()}, node.succList()...), node.fingers()...)
+		for _, pointer := range neighbours {
+			node.rememberPeer(pointer.Nodeid, pointer.IP)
+		}
+		node.saveAddressBook()
+	}
+}
+
+func (node *Node) addressBookPath() string {
+	return fmt.Sprintf("%s/peers-%s.json", node.dataDir(), node.FileName())
+}
+
+/*
+Loads the address book from disk the first time it is needed. Must be called with the address
+book lock held.
+*/
+func (node *Node) loadAddressBook() {
+	if node.addressBook.loaded {
+		return
+	}
+	node.addressBook.loaded = true
+	node.addressBook.peers = make(map[string]Peer)
+	data, err := os.ReadFile(node.addressBookPath())
+	if err != nil {
+		return
+	}
+	peers := []Peer{}
+	if err := json.Unmarshal(data, &peers); err != nil {
+		log.Error().Err(err).Msg("Error decoding the address book")
+		return
+	}
+	for _, peer := range peers {
+		node.addressBook.peers[peer.IP] = peer
+	}
+}
+
+/*
+Writes the address book to disk.
+*/
+func (node *Node) saveAddressBook() {
+	data, err := json.Marshal(node.Peers())
+	if err != nil {
+		log.Error().Err(err).Msg("Error encoding the address book")
+		return
+	}
+	if err := os.WriteFile(node.addressBookPath(), data, 0666); err != nil {
+		log.Error().Err(err).Msg("Error writing the address book")
+	}
+}
+
+/*
+Looks for an alternate entry point into the ring in the address book, and makes the node's
+successor the one that entry point finds for it. Returns false if no remembered peer is alive.
+*/
+func (node *Node) rejoinFromAddressBook() bool {
+	peer, ok := node.findLivePeer(node.successor().IP)
+	if !ok {
+		return false
+	}
+	reply := node.CallRPC(message.RequestMessage{Type: FIND_SUCCESSOR, TargetId: node.Nodeid}, peer.IP)
+	if reply.Type == EMPTY || reply.IP == "" {
+		return false
+	}
+	log.Info().Msgf("Found new successor Nodeid: %d IP: %s through the address book", reply.Nodeid, reply.IP)
+	node.setSuccessor(Pointer{Nodeid: reply.Nodeid, IP: reply.IP}, CAUSE_REJOIN)
+	return true
+}
@@ -0,0 +1,367 @@
+/*
+HTTP admin endpoint for inspecting a running node. Responses are JSON so they can be consumed by
+scripts and dashboards as well as read by operators with curl.
+*/
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+/*
+Starts the admin HTTP server on addr in a tracked goroutine. The server is closed when the node
+shuts down.
+*/
+func (node *Node) ServeAdmin(addr string) {
+	mux := http.NewServeMux()
+	handle := func(path string, role string, handler http.HandlerFunc) {
+		mux.HandleFunc(path, node.requireRole(role, handler))
+	}
+	handle("/goroutines", ADMIN_ROLE_READ, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, node.GoroutineCounts())
+	})
+	handle("/peers", ADMIN_ROLE_READ, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, node.Peers())
+	})
+	handle("/peers/latency", ADMIN_ROLE_READ, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, node.PeerLatencies())
+	})
+	handle("/peers/health", ADMIN_ROLE_READ, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, node.PeerHealth())
+	})
+	handle("/lookups", ADMIN_ROLE_READ, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, node.LookupStats())
+	})
+	handle("/progress", ADMIN_ROLE_READ, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, node.ActiveProgress())
+	})
+	handle("/progress/cancel", ADMIN_ROLE_OPERATOR, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "id is not a number", http.StatusBadRequest)
+			return
+		}
+		if err := node.CancelOperation(id); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	handle("/names", ADMIN_ROLE_READ, func(w http.ResponseWriter, r *http.Request) {
+		list, err := node.ListSuffix(r.URL.Query().Get("suffix"), r.URL.Query().Get("scope") == "ring")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, list)
+	})
+	handle("/history", ADMIN_ROLE_READ, func(w http.ResponseWriter, r *http.Request) {
+		versions, err := node.History(r.URL.Query().Get("name"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, versions)
+	})
+	handle("/move", ADMIN_ROLE_OPERATOR, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := node.MoveKey(r.URL.Query().Get("name"), r.URL.Query().Get("to")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	handle("/rollback", ADMIN_ROLE_OPERATOR, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		version, err := strconv.Atoi(r.URL.Query().Get("version"))
+		if err != nil {
+			http.Error(w, "version is not a number", http.StatusBadRequest)
+			return
+		}
+		if err := node.Rollback(r.URL.Query().Get("name"), version); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	handle("/hotkeys", ADMIN_ROLE_READ, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, node.HotKeys())
+	})
+	handle("/scrub", ADMIN_ROLE_READ, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, node.ScrubStatus())
+	})
+	handle("/scrub/run", ADMIN_ROLE_OPERATOR, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, node.Scrub())
+	})
+	handle("/antientropy", ADMIN_ROLE_READ, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, node.AntiEntropyStatus())
+	})
+	handle("/antientropy/run", ADMIN_ROLE_OPERATOR, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, node.SyncReplicas())
+	})
+	handle("/consistency", ADMIN_ROLE_READ, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, node.Consistency())
+	})
+	handle("/consistency/check", ADMIN_ROLE_OPERATOR, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		score, ok := node.CheckConsistency()
+		if !ok {
+			http.Error(w, "the ring walk broke off", http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, score)
+	})
+	handle("/loglevel", ADMIN_ROLE_READ, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]string{node.IP: LogLevel().String()})
+	})
+	handle("/loglevel/set", ADMIN_ROLE_OPERATOR, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		level := r.URL.Query().Get("level")
+		if r.URL.Query().Get("scope") == "ring" {
+			levels, err := node.SetRingLogLevel(level)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeJSON(w, levels)
+			return
+		}
+		if err := SetLogLevel(level); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, map[string]string{node.IP: LogLevel().String()})
+	})
+	handle("/freeze", ADMIN_ROLE_READ, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("scope") != "ring" {
+			writeJSON(w, map[string]string{node.IP: node.freezeState()})
+			return
+		}
+		states, _ := node.FreezeRing("")
+		writeJSON(w, states)
+	})
+	handle("/freeze/set", ADMIN_ROLE_OPERATOR, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		state := r.URL.Query().Get("state")
+		if state != FREEZE_STATE_FROZEN && state != FREEZE_STATE_THAWED {
+			http.Error(w, fmt.Sprintf("state must be %s or %s", FREEZE_STATE_FROZEN, FREEZE_STATE_THAWED), http.StatusBadRequest)
+			return
+		}
+		states, _ := node.FreezeRing(state)
+		writeJSON(w, states)
+	})
+	handle("/fingers/fix", ADMIN_ROLE_OPERATOR, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		if node.Frozen() {
+			http.Error(w, "the ring topology is frozen", http.StatusConflict)
+			return
+		}
+		writeJSON(w, map[string]int{"changed": node.FixAllFingers()})
+	})
+	handle("/crash", ADMIN_ROLE_OPERATOR, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		if target := r.URL.Query().Get("node"); target != "" && target != node.IP {
+			if err := node.CrashPeer(target); err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			writeJSON(w, map[string]string{target: "crashed"})
+			return
+		}
+		if !node.Config.AllowCrash {
+			http.Error(w, "crashes are not allowed, set ALLOW_CRASH=true", http.StatusForbidden)
+			return
+		}
+		writeJSON(w, map[string]string{node.IP: "crashed"})
+		time.AfterFunc(CRASH_REPLY_GRACE, node.Crash)
+	})
+	handle("/export", ADMIN_ROLE_READ, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/jsonl")
+		if _, err := node.Export(w, EXPORT_FORMAT_JSONL, r.URL.Query().Get("scope") == "ring"); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		}
+	})
+	handle("/import", ADMIN_ROLE_OPERATOR, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = EXPORT_FORMAT_JSONL
+		}
+		count, err := node.Import(r.Body, format)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("imported %d record set(s): %v", count, err), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, map[string]int{"imported": count})
+	})
+	handle("/flapping", ADMIN_ROLE_READ, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, node.FlapStatus())
+	})
+	handle("/cache", ADMIN_ROLE_READ, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, node.CacheStats())
+	})
+	handle("/health", ADMIN_ROLE_READ, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, struct {
+			Instance string `json:"instance"`
+			Nodeid   uint64 `json:"nodeid"`
+			ResourceUsage
+		}{node.InstanceID(), node.Nodeid, node.ResourceUsage()})
+	})
+	handle("/stats", ADMIN_ROLE_READ, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("scope") != "ring" {
+			writeJSON(w, node.Stats())
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv")
+		if err := WriteStatsCSV(w, node.CollectStats()); err != nil {
+			log.Error().Err(err).Msg("Error writing the ring statistics")
+		}
+	})
+	handle("/report", ADMIN_ROLE_READ, func(w http.ResponseWriter, r *http.Request) {
+		format := r.URL.Query().Get("format")
+		switch format {
+		case "", REPORT_FORMAT_MARKDOWN:
+			format = REPORT_FORMAT_MARKDOWN
+			w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		case REPORT_FORMAT_HTML:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		default:
+			http.Error(w, "format must be markdown or html", http.StatusBadRequest)
+			return
+		}
+		if err := WriteReport(w, node.CollectReport(), format); err != nil {
+			log.Error().Err(err).Msg("Error writing the report")
+		}
+	})
+	handle("/breakers", ADMIN_ROLE_READ, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, node.Breakers())
+	})
+	handle("/upstreams", ADMIN_ROLE_READ, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, node.Upstreams())
+	})
+	handle("/graph", ADMIN_ROLE_READ, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/vnd.graphviz")
+		node.WriteGraph(w, r.URL.Query().Get("scope") == "ring")
+	})
+	handle("/put", ADMIN_ROLE_OPERATOR, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		query := r.URL.Query()
+		ttl := 0
+		if value := query.Get("ttl"); value != "" {
+			var err error
+			if ttl, err = strconv.Atoi(value); err != nil {
+				http.Error(w, "ttl is not a number", http.StatusBadRequest)
+				return
+			}
+		}
+		replicas := 0
+		if value := query.Get("replicas"); value != "" {
+			var err error
+			if replicas, err = strconv.Atoi(value); err != nil {
+				http.Error(w, "replicas is not a number", http.StatusBadRequest)
+				return
+			}
+		}
+		if err := node.PutRecord(query.Get("name"), query.Get("ip"), ttl, replicas); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	handle("/snapshot", ADMIN_ROLE_OPERATOR, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, node.TakeSnapshot())
+	})
+	handle("/ring", ADMIN_ROLE_READ, func(w http.ResponseWriter, r *http.Request) {
+		meta, err := node.RingMetadata()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, meta)
+	})
+
+	if node.Config.AdminBadTokens > 0 {
+		log.Error().Msgf("Not serving the admin endpoint, %d entries of ADMIN_TOKENS are malformed", node.Config.AdminBadTokens)
+		return
+	}
+	tlsConfig, err := node.adminTLSConfig()
+	if err != nil {
+		log.Error().Err(err).Msg("Could not configure TLS for the admin endpoint")
+		return
+	}
+	server := &http.Server{Addr: addr, Handler: mux, TLSConfig: tlsConfig}
+	node.spawn("admin_http", func() {
+		log.Info().Msgf("Admin endpoint is running at address: %s", addr)
+		if !node.adminAuthEnabled() {
+			log.Warn().Msg("The admin endpoint is not authenticated, set ADMIN_TOKENS or ADMIN_CLIENT_CA to protect it")
+		}
+		var err error
+		if tlsConfig != nil {
+			err = server.ListenAndServeTLS(node.Config.AdminTLSCert, node.Config.AdminTLSKey)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Error().Err(err).Msg("Admin endpoint stopped")
+		}
+	})
+	node.spawn("admin_shutdown", func() {
+		<-node.context().Done()
+		server.Close()
+	})
+}
+
+/*
+Admin utility function to write v as the JSON body of the response.
+*/
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error().Err(err).Msg("Error encoding admin response")
+	}
+}
@@ -0,0 +1,112 @@
+/*
+Authentication of the admin API. Requests authenticate with a bearer token (ADMIN_TOKENS), or over
+HTTPS with a client certificate signed by ADMIN_CLIENT_CA. Each identity has a role: read-only
+identities may inspect the node, while operators may also trigger actions that load or change the
+ring. Without tokens and without a client CA, the admin API is open, as it always was, and should
+only be bound to trusted interfaces. If an entry of ADMIN_TOKENS is malformed, e.g. has no role or
+a misspelled one, the admin API is not served at all.
+*/
+package node
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Constants
+const (
+	ADMIN_ROLE_READ     = "read"     // May use the inspection endpoints.
+	ADMIN_ROLE_OPERATOR = "operator" // May also use endpoints that act on the node or the ring.
+)
+
+/*
+Returns true if the admin API requires authentication. Malformed ADMIN_TOKENS count as set, so
+that a typo in them does not open the API.
+*/
+func (node *Node) adminAuthEnabled() bool {
+	return len(node.Config.AdminTokens) > 0 || node.Config.AdminBadTokens > 0 || node.Config.AdminClientCA != ""
+}
+
+/*
+Returns the role of the identity behind the request, or false if the request is not authenticated.
+*/
+func (node *Node) adminRole(r *http.Request) (string, bool) {
+	if !node.adminAuthEnabled() {
+		return ADMIN_ROLE_OPERATOR, true
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		name := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		if slices.Contains(node.Config.AdminOperators, name) {
+			return ADMIN_ROLE_OPERATOR, true
+		}
+		return ADMIN_ROLE_READ, true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return "", false
+	}
+	for known, role := range node.Config.AdminTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(known)) == 1 {
+			return role, true
+		}
+	}
+	return "", false
+}
+
+/*
+Wraps an admin handler so that it only serves requests of identities with the given role, or
+operators.
+*/
+func (node *Node) requireRole(role string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		granted, ok := node.adminRole(r)
+		if !ok {
+			node.incMetric(`admin_requests_denied_total{reason="unauthenticated"}`, 1)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="dns-chord"`)
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+		if granted != role && granted != ADMIN_ROLE_OPERATOR {
+			node.incMetric(`admin_requests_denied_total{reason="forbidden"}`, 1)
+			log.Warn().Msgf("Denied %s role access to %s from %s", granted, r.URL.Path, r.RemoteAddr)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+/*
+Returns the TLS configuration of the admin API, or nil if it serves plain HTTP. With a client CA,
+client certificates are verified if presented, so that token authentication keeps working.
+*/
+func (node *Node) adminTLSConfig() (*tls.Config, error) {
+	if node.Config.AdminTLSCert == "" {
+		if node.Config.AdminClientCA != "" {
+			return nil, errors.New("ADMIN_CLIENT_CA requires ADMIN_TLS_CERT and ADMIN_TLS_KEY")
+		}
+		return nil, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if node.Config.AdminClientCA != "" {
+		pem, err := os.ReadFile(node.Config.AdminClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in ADMIN_CLIENT_CA")
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
@@ -0,0 +1,313 @@
+/*
+Anti-entropy between an owner and its replicas. Replication rounds and write-through only ever
+push, so a replica that missed them, e.g. during a partition or a throttled round that broke off,
+stays behind until the next full round gets through, and keys the replica should no longer hold
+are never found. Every ANTI_ENTROPY_INTERVAL (default 30s), a node therefore compares the keys it
+owns with the copy of each of its replicas. The keys are spread over ANTI_ENTROPY_SLOTS slots by
+a hash of them, and the owner sends a digest of every slot, the checksum of the keys in it and of
+their records, in a SLOT_DIGESTS message. The replica replies with the slots whose digest differs
+from that of its copy. For those slots only, the owner sends the checksum of every key in a
+SLOT_KEYS message, and the replica replies with the keys it holds a different or no copy of, and
+the record sets of the keys it holds that the owner did not list. The owner then repairs:
+
+ 1. Keys the replica is missing or holds another copy of are replicated to it again. The owner's
+    copy wins, as with the scrubber, see scrub.go.
+ 2. Keys the owner has, but the replica is not to hold, e.g. after the replication factor was
+    lowered (see replicas.go), are dropped from the replica.
+ 3. Keys only the replica has that fall into the owner's range are taken over by the owner, so
+    that a write the owner missed is not lost, and replicated with the next round.
+
+A ring that is in sync thus costs one small message per replica and round. The last round is
+served at /antientropy, and POST /antientropy/run runs one at once.
+*/
+package node
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fauzxan/dns-chord/v2/message"
+	"github.com/rs/zerolog/log"
+)
+
+// Constants
+const (
+	DEFAULT_ANTI_ENTROPY_INTERVAL = 30 * time.Second // ANTI_ENTROPY_INTERVAL if not set.
+	ANTI_ENTROPY_SLOT_BITS        = 6                // Slots the keys of an owner are spread over for their digests, as a power of two.
+	ANTI_ENTROPY_SLOTS            = 1 << ANTI_ENTROPY_SLOT_BITS
+)
+
+/*
+Outcome of an anti-entropy round.
+*/
+type AntiEntropyRound struct {
+	Started        time.Time `json:"started"`
+	Finished       time.Time `json:"finished"`        // Zero while the round runs
+	Replicas       int       `json:"replicas"`        // Replicas compared with
+	Unreachable    int       `json:"unreachable"`     // Replicas that did not answer
+	SlotsDiffering int       `json:"slots_differing"` // Slots whose digest differed, over all replicas
+	KeysPushed     int       `json:"keys_pushed"`     // Keys replicated again to a replica that was missing or held another copy of them
+	KeysDropped    int       `json:"keys_dropped"`    // Keys dropped from a replica that is not to hold them
+	KeysPulled     int       `json:"keys_pulled"`     // Keys of this node's range taken over from a replica
+}
+
+/*
+The state of anti-entropy on a node.
+*/
+type antiEntropyState struct {
+	mu    sync.Mutex
+	round AntiEntropyRound // Current or last round
+}
+
+/*
+Returns the slot of key: the top bits of a Fibonacci hash of it, as the low bits of keys can all
+be zero in the default keyspace, see hashing.go.
+*/
+func slotOf(key uint64) int {
+	return int((key * 0x9E3779B97F4A7C15) >> (64 - ANTI_ENTROPY_SLOT_BITS))
+}
+
+/*
+Returns the checksum of every record set in storage, keyed by slot and key.
+*/
+func slotChecksums(storage map[uint64][]Record) map[int]map[uint64]uint32 {
+	slots := make(map[int]map[uint64]uint32)
+	for key, records := range storage {
+		slot := slotOf(key)
+		if slots[slot] == nil {
+			slots[slot] = make(map[uint64]uint32)
+		}
+		slots[slot][key] = recordsChecksum(records)
+	}
+	return slots
+}
+
+/*
+Returns the digest of a slot: the checksum of its keys in ascending order, each with the checksum
+of its records.
+*/
+func slotDigest(sums map[uint64]uint32) uint32 {
+	keys := make([]uint64, 0, len(sums))
+	for key := range sums {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	hash := crc32.NewIEEE()
+	var entry [12]byte
+	for _, key := range keys {
+		binary.BigEndian.PutUint64(entry[:8], key)
+		binary.BigEndian.PutUint32(entry[8:], sums[key])
+		hash.Write(entry[:])
+	}
+	return hash.Sum32()
+}
+
+/*
+Periodically compares the keys of this node with its replicas.
+*/
+func (node *Node) antiEntropy() {
+	for node.sleep(maintenanceInterval(node.Config.AntiEntropyInterval, DEFAULT_ANTI_ENTROPY_INTERVAL)) {
+		node.SyncReplicas()
+	}
+}
+
+/*
+Runs an anti-entropy round with every replica of this node and returns its outcome, see the top
+of this file.
+*/
+func (node *Node) SyncReplicas() AntiEntropyRound {
+	round := AntiEntropyRound{Started: time.Now()}
+	if node.Observing() {
+		return round
+	}
+	node.setAntiEntropyRound(round)
+	targets := node.replicaTargets()
+	if most := node.mostReplicas(); most > len(targets) {
+		targets = append(targets, node.extraReplicaTargets(targets, most-len(targets))...)
+	}
+	for i, target := range targets {
+		// The keys the target is to hold, see replicaPayload. Empty record sets are keys it is not to hold.
+		expected := node.replicaPayload(i)
+		for key, records := range expected {
+			if len(records) == 0 {
+				delete(expected, key)
+			}
+		}
+		round.Replicas++
+		if !node.syncReplica(target, expected, &round) {
+			round.Unreachable++
+		}
+		node.setAntiEntropyRound(round)
+	}
+	round.Finished = time.Now()
+	node.setAntiEntropyRound(round)
+	node.incMetric("anti_entropy_rounds_total", 1)
+	if round.KeysPushed+round.KeysDropped+round.KeysPulled > 0 {
+		log.Info().Msgf("Anti-entropy with %d replica(s): %d slot(s) differed, %d key(s) pushed, %d dropped, %d taken over",
+			round.Replicas, round.SlotsDiffering, round.KeysPushed, round.KeysDropped, round.KeysPulled)
+	}
+	return round
+}
+
+/*
+Compares the keys the replica target is to hold, expected, with its copy, and repairs the
+differences into round. Returns false if the replica did not answer.
+*/
+func (node *Node) syncReplica(target Pointer, expected map[uint64][]Record, round *AntiEntropyRound) bool {
+	slots := slotChecksums(expected)
+	digests := make(map[uint64]uint32, len(slots))
+	for slot, sums := range slots {
+		digests[uint64(slot)] = slotDigest(sums)
+	}
+	reply := node.CallRPC(message.RequestMessage{Type: SLOT_DIGESTS, TargetId: node.Nodeid, Checksums: digests}, target.IP)
+	if reply.Type != ACK {
+		return false
+	}
+	if len(reply.QueryResponse) == 0 {
+		return true
+	}
+	round.SlotsDiffering += len(reply.QueryResponse)
+	node.incMetric("anti_entropy_slots_differing_total", uint64(len(reply.QueryResponse)))
+
+	sums := make(map[uint64]uint32)
+	for _, line := range reply.QueryResponse {
+		slot, err := strconv.Atoi(line)
+		if err != nil {
+			continue
+		}
+		for key, sum := range slots[slot] {
+			sums[key] = sum
+		}
+	}
+	reply = node.CallRPC(message.RequestMessage{Type: SLOT_KEYS, TargetId: node.Nodeid, IP: strings.Join(reply.QueryResponse, ","), Checksums: sums}, target.IP)
+	if reply.Type != ACK {
+		return false
+	}
+
+	repair := make(map[uint64][]Record)
+	for _, line := range reply.QueryResponse {
+		if key, err := strconv.ParseUint(line, 10, 64); err == nil && expected[key] != nil {
+			repair[key] = expected[key]
+		}
+	}
+	pushed := len(repair)
+	pulled := make(map[uint64][]Record)
+	predecessor := node.predecessor()
+	node.storageMu.RLock()
+	for key, records := range reply.Payload {
+		if _, owned := node.HashIPStorage[node.Nodeid][key]; owned {
+			repair[key] = []Record{} // Held by the replica, which is not to hold it.
+		} else if predecessor.IP != "" && len(records) > 0 && belongsTo(key, predecessor.Nodeid, node.Nodeid) {
+			pulled[key] = records
+		}
+	}
+	node.storageMu.RUnlock()
+
+	if len(pulled) > 0 {
+		node.learnNames(reply.Names)
+		node.takeOverPulled(pulled)
+		round.KeysPulled += len(pulled)
+		node.incMetric(`anti_entropy_keys_repaired_total{kind="pulled"}`, uint64(len(pulled)))
+		log.Info().Msgf("Took over %d key(s) of this node's range that only Nodeid: %d IP: %s held", len(pulled), target.Nodeid, target.IP)
+	}
+	if len(repair) == 0 {
+		return true
+	}
+	msg := message.RequestMessage{Type: REPLICATE, TargetId: node.Nodeid, Payload: repair, Names: node.namesFor(repair)}
+	if reply := node.CallRPC(msg, target.IP); reply.Type == EMPTY {
+		return false
+	}
+	round.KeysPushed += pushed
+	round.KeysDropped += len(repair) - pushed
+	node.incMetric(`anti_entropy_keys_repaired_total{kind="pushed"}`, uint64(pushed))
+	node.incMetric(`anti_entropy_keys_repaired_total{kind="dropped"}`, uint64(len(repair)-pushed))
+	return true
+}
+
+/*
+Stores the keys taken over from a replica in this node's own bucket, unless they were written in
+the meantime.
+*/
+func (node *Node) takeOverPulled(pulled map[uint64][]Record) {
+	pulled = node.dropInvalid(pulled)
+	node.storageMu.Lock()
+	defer node.storageMu.Unlock()
+	if node.HashIPStorage[node.Nodeid] == nil {
+		node.HashIPStorage[node.Nodeid] = make(map[uint64][]Record)
+	}
+	for key, records := range pulled {
+		if _, ok := node.HashIPStorage[node.Nodeid][key]; ok {
+			continue
+		}
+		node.HashIPStorage[node.Nodeid][key] = records
+		node.stampChecksum(node.Nodeid, key, records)
+	}
+}
+
+/*
+Processes a SLOT_DIGESTS message: returns the slots whose digest in digests differs from that of
+the copy in bucket, one decimal slot per line. Slots the copy has keys in and digests has not
+differ as well.
+*/
+func (node *Node) compareSlots(bucket uint64, digests map[uint64]uint32) []string {
+	node.storageMu.RLock()
+	slots := slotChecksums(node.HashIPStorage[bucket])
+	node.storageMu.RUnlock()
+	differing := []string{}
+	for slot := 0; slot < ANTI_ENTROPY_SLOTS; slot++ {
+		digest, listed := digests[uint64(slot)]
+		sums, held := slots[slot]
+		switch {
+		case !listed && !held:
+		case !listed || !held || slotDigest(sums) != digest:
+			differing = append(differing, strconv.Itoa(slot))
+		}
+	}
+	return differing
+}
+
+/*
+Processes a SLOT_KEYS message for the comma separated slots in msg.IP: sets the keys whose
+checksum in msg.Checksums differs from that of the copy in bucket msg.TargetId, or that are
+missing from it, one decimal key per line, and the record sets and names of the keys of the copy in
+those slots that msg.Checksums does not list.
+*/
+func (node *Node) compareSlotKeys(msg *message.RequestMessage, reply *message.ResponseMessage) {
+	requested := make(map[int]bool)
+	for _, field := range strings.Split(msg.IP, ",") {
+		if slot, err := strconv.Atoi(field); err == nil {
+			requested[slot] = true
+		}
+	}
+	reply.QueryResponse = node.compareChecksums(msg.TargetId, msg.Checksums)
+	extra := make(map[uint64][]Record)
+	node.storageMu.RLock()
+	for key, records := range node.HashIPStorage[msg.TargetId] {
+		if _, listed := msg.Checksums[key]; !listed && requested[slotOf(key)] {
+			extra[key] = records
+		}
+	}
+	node.storageMu.RUnlock()
+	reply.Payload = extra
+	reply.Names = node.namesFor(extra)
+}
+
+func (node *Node) setAntiEntropyRound(round AntiEntropyRound) {
+	node.entropy.mu.Lock()
+	defer node.entropy.mu.Unlock()
+	node.entropy.round = round
+}
+
+/*
+Returns the current or last anti-entropy round.
+*/
+func (node *Node) AntiEntropyStatus() AntiEntropyRound {
+	node.entropy.mu.Lock()
+	defer node.entropy.mu.Unlock()
+	return node.entropy.round
+}
@@ -0,0 +1,122 @@
+/*
+Per-peer circuit breakers for outbound RPCs. A peer that failed BREAKER_FAILURES calls in a row,
+by refusing the connection or timing out, is not called again for BREAKER_COOLDOWN: calls to it
+fail straight away as if the peer had not answered, instead of each waiting for its own timeout,
+e.g. on every stabilize round. Once the cool-down has passed, a single trial call goes through;
+the breaker closes again if it succeeds, and stays open for another cool-down if it does not.
+*/
+package node
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Constants
+const (
+	BREAKER_FAILURES = 3                // Consecutive failed calls after which the breaker of a peer opens.
+	BREAKER_COOLDOWN = 10 * time.Second // Time an open breaker short-circuits calls before it lets a trial call through.
+)
+
+/*
+State of the breaker of a single peer.
+*/
+type PeerBreaker struct {
+	IP        string    `json:"ip"`
+	Failures  int       `json:"failures"`   // Consecutive failed calls
+	OpenUntil time.Time `json:"open_until"` // When the breaker lets a trial call through, zero if closed
+	Trial     bool      `json:"trial"`      // Set while the trial call is in flight
+}
+
+/*
+Breakers of every peer called, keyed by IP.
+*/
+type breakerTable struct {
+	mu    sync.Mutex
+	peers map[string]*PeerBreaker
+}
+
+/*
+Returns whether a call to IP may go out, and counts it as short-circuited if not.
+*/
+func (node *Node) breakerAllows(IP string) bool {
+	node.breakers.mu.Lock()
+	defer node.breakers.mu.Unlock()
+	breaker := node.breakers.peers[IP]
+	if breaker == nil || breaker.OpenUntil.IsZero() {
+		return true
+	}
+	if !breaker.Trial && time.Now().After(breaker.OpenUntil) {
+		breaker.Trial = true
+		return true
+	}
+	node.incMetric("rpc_short_circuits_total", 1)
+	return false
+}
+
+/*
+Records the outcome of a call to IP, and opens or closes its breaker accordingly.
+*/
+func (node *Node) breakerRecord(IP string, ok bool) {
+	node.breakers.mu.Lock()
+	defer node.breakers.mu.Unlock()
+	if node.breakers.peers == nil {
+		node.breakers.peers = make(map[string]*PeerBreaker)
+	}
+	breaker := node.breakers.peers[IP]
+	if ok {
+		if breaker != nil && !breaker.OpenUntil.IsZero() {
+			log.Info().Msgf("Circuit breaker of %s closed", IP)
+		}
+		delete(node.breakers.peers, IP)
+		return
+	}
+	if breaker == nil {
+		breaker = &PeerBreaker{IP: IP}
+		node.breakers.peers[IP] = breaker
+	}
+	breaker.Failures++
+	if breaker.Trial || breaker.Failures >= BREAKER_FAILURES {
+		if breaker.OpenUntil.IsZero() {
+			log.Warn().Msgf("Circuit breaker of %s opened after %d failed calls", IP, breaker.Failures)
+			node.incMetric("rpc_breaker_opened_total", 1)
+		}
+		breaker.OpenUntil = time.Now().Add(BREAKER_COOLDOWN)
+		breaker.Trial = false
+	}
+}
+
+/*
+Closes the breaker of IP, on a message from it: a peer that calls this node is back, e.g. after a
+restart, and need not wait for the cool-down to be called again.
+*/
+func (node *Node) breakerReset(IP string) {
+	node.breakers.mu.Lock()
+	defer node.breakers.mu.Unlock()
+	if breaker := node.breakers.peers[IP]; breaker != nil && !breaker.OpenUntil.IsZero() {
+		log.Info().Msgf("Circuit breaker of %s closed, the peer called in", IP)
+	}
+	delete(node.breakers.peers, IP)
+}
+
+/*
+Returns the breakers of the peers with failed calls, open ones first.
+*/
+func (node *Node) Breakers() []PeerBreaker {
+	node.breakers.mu.Lock()
+	defer node.breakers.mu.Unlock()
+	list := []PeerBreaker{}
+	for _, breaker := range node.breakers.peers {
+		list = append(list, *breaker)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].OpenUntil.IsZero() != list[j].OpenUntil.IsZero() {
+			return !list[i].OpenUntil.IsZero()
+		}
+		return list[i].IP < list[j].IP
+	})
+	return list
+}
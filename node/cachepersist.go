@@ -0,0 +1,90 @@
+/*
+Cache persistence. With CACHE_PERSIST set, a node writes its query cache next to its storage when
+it shuts down, and reads it back when it starts, so that a restarted node answers from a warm
+cache. Expiry times are kept as they were, so time spent down counts against the TTL of an entry;
+entries that expired in the meantime are dropped on load.
+*/
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+/*
+A cache entry as written to disk.
+*/
+type persistedCacheEntry struct {
+	Key       uint64    `json:"key"`
+	Name      string    `json:"name,omitempty"`
+	Records   []Record  `json:"records"`
+	Expires   time.Time `json:"expires"`
+	Added     time.Time `json:"added"`
+	CacheTime uint64    `json:"cache_time"`
+	Hits      uint64    `json:"hits"`
+}
+
+func (node *Node) cachePath() string {
+	return fmt.Sprintf("%s/cache-%s.json", node.dataDir(), node.FileName())
+}
+
+/*
+Writes the query cache to disk.
+*/
+func (node *Node) saveCache() {
+	node.cacheMu.Lock()
+	entries := make([]persistedCacheEntry, 0, len(node.CachedQuery))
+	for key, entry := range node.CachedQuery {
+		entries = append(entries, persistedCacheEntry{Key: key, Name: entry.name, Records: entry.value, Expires: entry.expires, Added: entry.added, CacheTime: entry.cacheTime, Hits: entry.hits})
+	}
+	node.cacheMu.Unlock()
+	data, err := json.Marshal(entries)
+	if err != nil {
+		log.Error().Err(err).Msg("Error encoding the cache")
+		return
+	}
+	if err := os.WriteFile(node.cachePath(), data, 0666); err != nil {
+		log.Error().Err(err).Msg("Error writing the cache")
+		return
+	}
+	log.Info().Msgf("Saved %d cache entries", len(entries))
+}
+
+/*
+Reads the query cache written at the last shutdown, without the entries that have expired since.
+*/
+func (node *Node) LoadCache() {
+	data, err := os.ReadFile(node.cachePath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error().Err(err).Msg("Error reading the cache")
+		}
+		return
+	}
+	entries := []persistedCacheEntry{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		log.Error().Err(err).Msg("Error decoding the cache")
+		return
+	}
+	now := time.Now()
+	loaded := 0
+	node.cacheMu.Lock()
+	if node.CachedQuery == nil {
+		node.CachedQuery = make(map[uint64]LRUCache)
+	}
+	for _, entry := range entries {
+		if !entry.Expires.IsZero() && now.After(entry.Expires) {
+			continue
+		}
+		node.CachedQuery[entry.Key] = LRUCache{value: entry.Records, cacheTime: entry.CacheTime, expires: entry.Expires, name: entry.Name, added: entry.Added, hits: entry.Hits}
+		node.CacheTime = max(node.CacheTime, entry.CacheTime)
+		loaded++
+	}
+	node.cacheMu.Unlock()
+	node.evictCache()
+	log.Info().Msgf("Loaded %d cache entries, dropped %d that have expired", loaded, len(entries)-loaded)
+}
@@ -0,0 +1,93 @@
+/*
+Statistics of the query cache: how often lookups are answered from it, how many entries it loses
+to LRU eviction and to expiry, how old its entries are, and which names are served from it most.
+*/
+package node
+
+import (
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Constants
+const (
+	CACHE_STATS_TOP = 10 // Number of most hit names in the cache statistics.
+)
+
+/*
+Statistics of the query cache of a node, since the node started.
+*/
+type CacheStats struct {
+	Entries        int          `json:"entries"`
+	Hits           uint64       `json:"hits"`
+	Misses         uint64       `json:"misses"`
+	HitRate        float64      `json:"hit_rate"` // Hits per lookup, 0 before the first lookup
+	Evictions      uint64       `json:"evictions"`
+	Expirations    uint64       `json:"expirations"`
+	AverageAgeSecs float64      `json:"average_age_secs"`
+	Top            []CachedName `json:"top"` // Entries with the most hits, most hit first
+}
+
+/*
+A cached name and how often it has been served from the cache.
+*/
+type CachedName struct {
+	Name    string  `json:"name"`
+	Hits    uint64  `json:"hits"`
+	AgeSecs float64 `json:"age_secs"`
+}
+
+/*
+Returns the statistics of the query cache.
+*/
+func (node *Node) CacheStats() CacheStats {
+	counters := node.Counters()
+	stats := CacheStats{
+		Hits:        counters[`resolutions_total{source="cache"}`],
+		Misses:      counters["cache_misses_total"],
+		Evictions:   counters[`cache_evictions_total{reason="lru"}`],
+		Expirations: counters[`cache_evictions_total{reason="expired"}`],
+		Top:         []CachedName{},
+	}
+	if lookups := stats.Hits + stats.Misses; lookups > 0 {
+		stats.HitRate = float64(stats.Hits) / float64(lookups)
+	}
+
+	now := time.Now()
+	node.cacheMu.Lock()
+	stats.Entries = len(node.CachedQuery)
+	for _, entry := range node.CachedQuery {
+		age := now.Sub(entry.added).Seconds()
+		stats.AverageAgeSecs += age
+		stats.Top = append(stats.Top, CachedName{Name: DisplayName(entry.name), Hits: entry.hits, AgeSecs: age})
+	}
+	node.cacheMu.Unlock()
+	if stats.Entries > 0 {
+		stats.AverageAgeSecs /= float64(stats.Entries)
+	}
+	sort.Slice(stats.Top, func(i, j int) bool {
+		if stats.Top[i].Hits != stats.Top[j].Hits {
+			return stats.Top[i].Hits > stats.Top[j].Hits
+		}
+		return stats.Top[i].Name < stats.Top[j].Name
+	})
+	if len(stats.Top) > CACHE_STATS_TOP {
+		stats.Top = stats.Top[:CACHE_STATS_TOP]
+	}
+	return stats
+}
+
+/*
+Prints the statistics of the query cache.
+*/
+func (node *Node) PrintCacheStats() {
+	stats := node.CacheStats()
+	log.Info().Msg("CACHE STATISTICS REQUESTED")
+	log.Info().Msgf(">entries: %d hits: %d misses: %d hit rate: %.1f%%", stats.Entries, stats.Hits, stats.Misses, 100*stats.HitRate)
+	log.Info().Msgf(">evictions: %d expirations: %d average age: %.1fs", stats.Evictions, stats.Expirations, stats.AverageAgeSecs)
+	for _, name := range stats.Top {
+		log.Info().Msgf(">%s hits: %d age: %.1fs", name.Name, name.Hits, name.AgeSecs)
+	}
+}
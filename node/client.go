@@ -0,0 +1,227 @@
+/*
+One-shot ring operations for the command line. A client is a Node that is not part of any ring: it
+asks a node of the ring to find the responsible node, and talks to that node directly, following
+the hints of busy and shutting down nodes. A lookup remembers the owner of the name and the replicas
+the owner reported, so that a later read can go to them directly, see Reread. Failures are reported as the sentinel errors below, so
+that the CLI can map them to exit codes that scripts branch on.
+*/
+package node
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/fauzxan/dns-chord/v2/hashing"
+	"github.com/fauzxan/dns-chord/v2/message"
+)
+
+// Constants
+const (
+	CLIENT_TIMEOUT = 10 * time.Second // Default time a client operation may take.
+)
+
+var (
+	ErrUnreachable = errors.New("the ring could not be reached")
+	ErrTimeout     = errors.New("the operation timed out")
+)
+
+/*
+Returns a client for the ring, configured like a node of it, e.g. with its identity for ACLs and
+its wire format.
+*/
+func NewClient(config Config) *Node {
+	return &Node{Config: config}
+}
+
+/*
+Runs op, and returns ErrTimeout if it does not complete within timeout. The operation itself is
+abandoned, not cancelled, which is fine for a process that exits right after.
+*/
+func withTimeout(timeout time.Duration, op func() error) error {
+	done := make(chan error, 1)
+	go func() { done <- op() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("%w after %s", ErrTimeout, timeout)
+	}
+}
+
+/*
+Sends msg to IP, and to the nodes hinted at by BUSY and SHUTTING_DOWN replies, at most
+MAX_BUSY_RETRIES times. Returns ErrUnreachable if no node replied.
+*/
+func (node *Node) clientCall(msg message.RequestMessage, IP string) (message.ResponseMessage, error) {
+	reply := node.CallRPC(msg, IP)
+	for retries := 0; redirectable(reply) && reply.IP != "" && retries < MAX_BUSY_RETRIES; retries++ {
+		IP = reply.IP
+		reply = node.CallRPC(msg, IP)
+	}
+	if reply.Type == EMPTY || redirectable(reply) {
+		return reply, fmt.Errorf("%w: no reply to %s from %s", ErrUnreachable, msg.Type, IP)
+	}
+	return reply, nil
+}
+
+/*
+Asks helper for the node responsible for key.
+*/
+func (node *Node) clientOwner(helper string, key uint64) (Pointer, error) {
+	reply, err := node.clientCall(message.RequestMessage{Type: FIND_SUCCESSOR, TargetId: key}, helper)
+	if err != nil {
+		return Pointer{}, err
+	}
+	if reply.IP == "" {
+		return Pointer{}, fmt.Errorf("%w: %s did not find the node responsible for %d", ErrUnreachable, helper, key)
+	}
+	return Pointer{Nodeid: reply.Nodeid, IP: reply.IP}, nil
+}
+
+/*
+A name looked up by a client, and the nodes to read it from again.
+*/
+type Lookup struct {
+	Key      uint64
+	Records  []Record
+	Owner    Pointer   // Node responsible for the name
+	Replicas []Pointer // Nodes holding replicas of it, as reported by the owner
+}
+
+/*
+Looks website up in the ring through helper, without falling back to legacy DNS. Returns
+ErrNotFound, ErrAccessDenied, ErrUnreachable or ErrTimeout if there are no records to return.
+*/
+func (node *Node) LookupVia(helper string, website string, timeout time.Duration) ([]Record, error) {
+	lookup, err := node.LookupReplicasVia(helper, website, timeout)
+	return lookup.Records, err
+}
+
+/*
+LookupVia, also returning the owner and the replicas of website for Reread.
+*/
+func (node *Node) LookupReplicasVia(helper string, website string, timeout time.Duration) (Lookup, error) {
+	website, err := NormalizeName(website)
+	if err != nil {
+		return Lookup{}, err
+	}
+	lookup := Lookup{Key: hashing.Hash(website)}
+	err = withTimeout(timeout, func() error {
+		owner, err := node.clientOwner(helper, lookup.Key)
+		if err != nil {
+			return err
+		}
+		lookup.Owner = owner
+		return node.clientRead(&lookup, owner)
+	})
+	return lookup, err
+}
+
+/*
+Reads the name of an earlier lookup again, from its owner or, if the owner does not reply, from
+its replicas in turn, without another lookup in the ring. Returns the same errors as LookupVia.
+*/
+func (node *Node) Reread(lookup Lookup, timeout time.Duration) (Lookup, error) {
+	err := withTimeout(timeout, func() error {
+		err := fmt.Errorf("%w: no node to read %d from", ErrUnreachable, lookup.Key)
+		for _, source := range append([]Pointer{lookup.Owner}, lookup.Replicas...) {
+			if err = node.clientRead(&lookup, source); !errors.Is(err, ErrUnreachable) {
+				return err
+			}
+		}
+		return err
+	})
+	return lookup, err
+}
+
+/*
+Reads the records of lookup from source. A reply of the node owning the key, which may be a replica
+that took over from a failed owner, updates the owner and replicas of lookup.
+*/
+func (node *Node) clientRead(lookup *Lookup, source Pointer) error {
+	reply, err := node.clientCall(message.RequestMessage{Type: GET, TargetId: lookup.Key}, source.IP)
+	if err != nil {
+		return err
+	}
+	if reply.Type == DENIED {
+		return ErrAccessDenied
+	}
+	if reply.Records == nil {
+		return ErrNotFound
+	}
+	lookup.Records = node.followMove(lookup.Key, decompressRecords(reply.Records))
+	if reply.Replicas != nil {
+		lookup.Owner = source
+		lookup.Replicas = []Pointer{}
+		for nodeid, IP := range reply.Replicas {
+			lookup.Replicas = append(lookup.Replicas, Pointer{Nodeid: nodeid, IP: IP})
+		}
+		// Nearest by RTT first, then closest successor of the key, as replicas are placed in successor order.
+		distance := func(pointer Pointer) uint64 { return (pointer.Nodeid - lookup.Key) & hashing.Mask() }
+		sort.Slice(lookup.Replicas, func(i, j int) bool { return distance(lookup.Replicas[i]) < distance(lookup.Replicas[j]) })
+		node.byLatency(lookup.Replicas)
+	}
+	return nil
+}
+
+/*
+Answers a DNS query in wire format with the records of its name in the ring, looked up through
+helper as LookupVia does, and returns the response along with its response code. Names that are
+not in the ring get NXDOMAIN, and names whose ACL denies this client REFUSED. If the ring could not
+be reached in time, the response is a SERVFAIL, and the error says why.
+*/
+func (node *Node) AnswerVia(helper string, query []byte, udp bool, timeout time.Duration) ([]byte, uint16, error) {
+	var err error
+	response, rcode := node.respondDNS(query, udp, func(question dnsQuestion) dnsAnswer {
+		var records []Record
+		records, err = node.LookupVia(helper, question.Name, timeout)
+		switch {
+		case err == nil:
+			return dnsAnswer{Rcode: RCODE_NOERROR, Answers: recordsToRRs(records, question.Type)}
+		case errors.Is(err, ErrNotFound), errors.Is(err, errInvalidName):
+			err = nil
+			return dnsAnswer{Rcode: RCODE_NXDOMAIN}
+		case errors.Is(err, ErrAccessDenied):
+			err = nil
+			return dnsAnswer{Rcode: RCODE_REFUSED}
+		}
+		return dnsAnswer{Rcode: RCODE_SERVFAIL}
+	})
+	return response, rcode, err
+}
+
+/*
+Publishes a manual address record for website through helper, as PutRecord does. Returns
+ErrUnreachable or ErrTimeout if the responsible node did not accept it.
+*/
+func (node *Node) PutVia(helper string, website string, ip string, ttl int, replicas int, timeout time.Duration) error {
+	website, err := NormalizeName(website)
+	if err != nil {
+		return err
+	}
+	records, err := addressRecords(ip, ttl, replicas)
+	if err != nil {
+		return err
+	}
+	key := hashing.Hash(website)
+	return withTimeout(timeout, func() error {
+		owner, err := node.clientOwner(helper, key)
+		if err != nil {
+			return err
+		}
+		msg := message.RequestMessage{Type: PUT, TargetId: owner.Nodeid, Payload: map[uint64][]Record{key: compressRecords(records)}, Names: map[uint64]string{key: website}}
+		reply, err := node.clientCall(msg, owner.IP)
+		if err != nil {
+			return err
+		}
+		if reply.Type == DENIED {
+			return ErrAccessDenied
+		}
+		if reply.Type != ACK && reply.Type != REDIRECT {
+			return fmt.Errorf("the responsible node did not accept the records of %s", website)
+		}
+		return nil
+	})
+}
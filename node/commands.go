@@ -0,0 +1,78 @@
+/*
+Command channel for interactive operations. The menu does not call into the node directly, but
+submits commands that the node runs one at a time on a goroutine of its own. Slow operations, like
+ring walks and bulk queries, therefore neither block the menu nor run on the goroutines that drive
+the protocol timers, and the menu can give up waiting on a command without cancelling it.
+*/
+package node
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Constants
+const (
+	COMMAND_QUEUE_SIZE = 16               // Number of commands that can be queued before Submit blocks.
+	COMMAND_WAIT       = 10 * time.Second // How long the menu waits for a command before moving on.
+)
+
+type command struct {
+	name string
+	run  func()
+	done chan struct{}
+}
+
+type commandQueue struct {
+	once     sync.Once
+	commands chan command
+}
+
+/*
+Queues run to be executed by the node's command loop, and returns a channel that is closed once it
+has finished. Commands run in the order they were submitted.
+*/
+func (node *Node) Submit(name string, run func()) <-chan struct{} {
+	node.commands.once.Do(func() {
+		node.commands.commands = make(chan command, COMMAND_QUEUE_SIZE)
+		node.spawn("commands", node.runCommands)
+	})
+	done := make(chan struct{})
+	select {
+	case node.commands.commands <- command{name: name, run: run, done: done}:
+	case <-node.context().Done():
+		close(done)
+	}
+	return done
+}
+
+/*
+Runs submitted commands until the node shuts down.
+*/
+func (node *Node) runCommands() {
+	for {
+		select {
+		case cmd := <-node.commands.commands:
+			start := time.Now()
+			cmd.run()
+			log.Debug().Msgf("Command %s took %v", cmd.name, time.Since(start))
+			close(cmd.done)
+		case <-node.context().Done():
+			return
+		}
+	}
+}
+
+/*
+Waits up to timeout for a submitted command to finish. Returns false if it is still running.
+*/
+func Await(done <-chan struct{}, timeout time.Duration) bool {
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
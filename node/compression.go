@@ -0,0 +1,124 @@
+/*
+Transparent compression of large records. TXT records (and arbitrary payloads in the future) can be
+kilobytes in size, so rdata above COMPRESSION_THRESHOLD is gzipped before it is stored or sent over
+the wire, and inflated again when it is read. Small records, such as addresses, are left untouched.
+*/
+package node
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Constants
+const (
+	COMPRESSION_THRESHOLD = 512         // Rdata of at least this many bytes is compressed.
+	COMPRESSED_CLASS      = 0xFF00      // Private-use class (RFC 6895) of a record whose rdata is gzipped. Never read from DNS or user input.
+	LEGACY_COMPRESSED     = "\x00gzip:" // Prefix of a compressed record in text form, as stored by older versions.
+)
+
+/*
+Returns the compressed form of record if its rdata is large enough and compression makes it
+smaller, and record unchanged otherwise.
+*/
+func compressRecord(record Record) Record {
+	if len(record.Rdata) < COMPRESSION_THRESHOLD || record.Class == COMPRESSED_CLASS {
+		return record
+	}
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(record.Rdata); err != nil {
+		log.Error().Err(err).Msg("Error compressing record")
+		return record
+	}
+	if err := writer.Close(); err != nil {
+		log.Error().Err(err).Msg("Error compressing record")
+		return record
+	}
+	if buf.Len() >= len(record.Rdata) {
+		return record
+	}
+	return Record{Type: record.Type, Class: COMPRESSED_CLASS, TTL: record.TTL, Rdata: buf.Bytes()}
+}
+
+/*
+Returns the original form of a record that may have been compressed by compressRecord.
+*/
+func decompressRecord(record Record) Record {
+	if record.Class != COMPRESSED_CLASS {
+		return record
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(record.Rdata))
+	if err != nil {
+		log.Error().Err(err).Msg("Error decompressing record")
+		return record
+	}
+	defer reader.Close()
+	inflated, err := io.ReadAll(reader)
+	if err != nil {
+		log.Error().Err(err).Msg("Error decompressing record")
+		return record
+	}
+	return Record{Type: record.Type, Class: DNS_CLASS_IN, TTL: record.TTL, Rdata: inflated}
+}
+
+/*
+Returns the text form of a record compressed by an older version, which gzipped the text and
+encoded it in base64 after LEGACY_COMPRESSED, and record unchanged if it is not compressed.
+*/
+func decompressLegacyRecord(record string) string {
+	encoded, ok := strings.CutPrefix(record, LEGACY_COMPRESSED)
+	if !ok {
+		return record
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		log.Error().Err(err).Msg("Error decoding compressed record")
+		return record
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		log.Error().Err(err).Msg("Error decompressing record")
+		return record
+	}
+	defer reader.Close()
+	inflated, err := io.ReadAll(reader)
+	if err != nil {
+		log.Error().Err(err).Msg("Error decompressing record")
+		return record
+	}
+	return string(inflated)
+}
+
+/*
+Applies compressRecord to every record of a record set.
+*/
+func compressRecords(records []Record) []Record {
+	if records == nil {
+		return nil
+	}
+	compressed := make([]Record, len(records))
+	for i, record := range records {
+		compressed[i] = compressRecord(record)
+	}
+	return compressed
+}
+
+/*
+Applies decompressRecord to every record of a record set.
+*/
+func decompressRecords(records []Record) []Record {
+	if records == nil {
+		return nil
+	}
+	inflated := make([]Record, len(records))
+	for i, record := range records {
+		inflated[i] = decompressRecord(record)
+	}
+	return inflated
+}
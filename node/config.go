@@ -0,0 +1,319 @@
+/*
+Node configuration, read from the environment (and therefore from the .env file loaded in main).
+Every listener of a node is bound to its own port, and every listener apart from the Chord RPC
+listener can be switched off independently.
+*/
+package node
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fauzxan/dns-chord/v2/hashing"
+	"github.com/rs/zerolog/log"
+)
+
+/*
+Ports and switches for the listeners of a node. An empty port disables the listener.
+*/
+type Config struct {
+	Namespace      string // Namespace of the ring, empty for the default ring. See LoadNamespaceConfig.
+	RPCPort        string // RPC_PORT: Chord RPC. Prompted for on startup if empty.
+	DNSPort        string // DNS_PORT: DNS over UDP and TCP.
+	AdminPort      string // ADMIN_PORT: HTTP admin endpoint.
+	MetricsPort    string // METRICS_PORT: Prometheus metrics endpoint.
+	DNSEnabled     bool   // DNS_ENABLED: defaults to true if DNS_PORT is set.
+	AdminEnabled   bool   // ADMIN_ENABLED: defaults to true if ADMIN_PORT is set.
+	MetricsEnabled bool   // METRICS_ENABLED: defaults to true if METRICS_PORT is set.
+
+	MaxInflightRPCs int     // OVERLOAD_MAX_INFLIGHT: RPCs in flight above which lookups are shed. 0 disables.
+	MaxLoadPerCPU   float64 // OVERLOAD_MAX_LOAD: load average per CPU above which lookups are shed. 0 disables.
+
+	AuthZones       []string // AUTH_ZONES: comma separated zones the ring is authoritative for.
+	AuthNameservers []string // AUTH_NS: comma separated name servers of the authoritative zones. Defaults to ns.<zone>.
+
+	QueryLogFile   string // QUERY_LOG_FILE: file to log every DNS query to. Empty disables query logging.
+	QueryLogFormat string // QUERY_LOG_FORMAT: dnstap (default) or json.
+
+	CachePersist bool    // CACHE_PERSIST: save the query cache on shutdown, and load it on startup, see cachepersist.go.
+	XFetchBeta   float64 // XFETCH_BETA: how early popular cache entries are refreshed before they expire, see xfetch.go. 0 disables. Defaults to 1.
+
+	DiskStore string // DISK_STORE: store file to serve GETs from when a key is not in memory. Empty disables it.
+
+	DNSDebug bool // DNS_DEBUG: add a TXT record on how it was answered to every DNS answer, see dnsdebug.go.
+
+	VerifyFingers bool // VERIFY_FINGERS: check every finger against a walk of the ring after each FixFingers round (debugging).
+
+	DataDir string // DATA_DIR: directory for storage snapshots and the address book. Defaults to ./data, or ./data/<namespace>.
+	Join    string // JOIN: address to join the ring through. Only used by namespaced rings, the default ring prompts for it.
+
+	RelayPort string // RELAY_PORT: accept connections of nodes behind NAT on this port, and relay RPCs to them. Empty disables it.
+	RelayVia  string // RELAY_VIA: relay listener to connect to when this node can not accept inbound connections. Needs NODE_IDENTITY and NODE_KEYS.
+
+	IDStrategy  string // ID_STRATEGY: how the ID of the node is assigned: address, random, fixed, name or pubkey, see idstrategy.go. Defaults to address.
+	NodeID      string // NODE_ID: ID of the node with ID_STRATEGY=fixed.
+	NodeName    string // NODE_NAME: name the ID of the node is the hash of with ID_STRATEGY=name.
+	NodeKeyFile string // NODE_KEY_FILE: PEM key file with ID_STRATEGY=pubkey. Defaults to node-key.pem in DATA_DIR.
+
+	NodeIdentity string            // NODE_IDENTITY: identity this node signs its requests with, for record ACLs.
+	NodeKeys     map[string]string // NODE_KEYS: comma separated identity:key pairs of all identities in the ring.
+	ControlKey   string            // CONTROL_KEY: key test orchestrators sign CONTROL commands with, see control.go. Empty refuses them.
+
+	Upstreams []string // UPSTREAMS: comma separated resolvers (host:port) for cache fills. Empty uses the system resolver.
+
+	WireFormat string // WIRE_FORMAT: encoding of outgoing RPCs, gob (default) or protobuf. Incoming RPCs may use either.
+
+	AdminTokens    map[string]string // ADMIN_TOKENS: comma separated token:role pairs, role read or operator.
+	AdminBadTokens int               // Entries of ADMIN_TOKENS without a role or with an unknown one, which keep the admin endpoint from serving.
+	AdminTLSCert   string            // ADMIN_TLS_CERT: certificate to serve the admin endpoint over HTTPS with.
+	AdminTLSKey    string            // ADMIN_TLS_KEY: key of ADMIN_TLS_CERT.
+	AdminClientCA  string            // ADMIN_CLIENT_CA: CA that signs the client certificates accepted by the admin endpoint.
+	AdminOperators []string          // ADMIN_OPERATORS: comma separated client certificate common names with the operator role.
+
+	MaxRPCs        int // LIMIT_MAX_RPCS: RPCs handled at once, above which all but maintenance RPCs are shed. 0 disables.
+	MaxConns       int // LIMIT_MAX_CONNS: open inbound RPC connections, above which new ones are closed. 0 disables.
+	MaxCacheBytes  int // LIMIT_CACHE_BYTES: approximate memory of the cache, above which it evicts. 0 disables.
+	MaxStorageKeys int // LIMIT_STORAGE_KEYS: keys in storage, replicas included, above which new keys are refused. 0 disables.
+
+	HotKeyRate float64 // HOT_KEY_RATE: GETs per second above which a key is boosted, see hotkeys.go. 0 disables. Defaults to 50.
+
+	ImportWorkers int     // IMPORT_WORKERS: record sets routed to their owners at once by an import. Defaults to 8.
+	ImportRate    float64 // IMPORT_RATE: record sets per second an import sends to any one node. 0 disables the limit. Defaults to 1000.
+
+	TransferRate      float64 // TRANSFER_RATE: record sets per second moved by bulk key transfers (shift, replicate, handoff), see transfer.go. 0 disables.
+	TransferBandwidth int     // TRANSFER_BANDWIDTH: bytes per second moved by bulk key transfers. 0 disables.
+
+	AllowCrash bool // ALLOW_CRASH: let the menu, the admin endpoint and CRASH RPCs crash this node, see crash.go (demos and chaos tests).
+
+	MinTTL int // MIN_TTL: seconds the TTL of an upstream answer is raised to before it is cached and stored, see ttl.go. Defaults to 30.
+	MaxTTL int // MAX_TTL: seconds the TTL of an upstream answer is lowered to. 0 disables. Defaults to 86400.
+
+	LookupRetries int // LOOKUP_RETRIES: other paths a lookup tries when its first fails, see retry.go. 0 disables. Defaults to 2.
+
+	WriteThrough bool // WRITE_THROUGH: send accepted PUTs to the replicas at once instead of with the next replication round, see writethrough.go. Defaults to true.
+
+	LookupSlots        int // LOOKUP_SLOTS: lookups a node runs at once, see fairness.go. 0 disables the limit. Defaults to 32.
+	LookupClientWeight int // LOOKUP_CLIENT_WEIGHT: client lookups run before a waiting maintenance lookup. Defaults to 4.
+
+	Observer bool // OBSERVER: follow the ring without taking part of the keyspace, see observer.go.
+
+	GatewayNodes []string // GATEWAY_NODES: comma separated ring nodes (host:port) a gateway sends lookups through, see gateway.go.
+	GatewayPort  string   // GATEWAY_PORT: REST queries and health checks of a gateway over HTTP. Empty disables them.
+
+	LogLevel string // LOG_LEVEL: initial log level of the process, e.g. debug for protocol logs. Defaults to info, see loglevel.go.
+
+	LogSampleThreshold int // LOG_SAMPLE_THRESHOLD: query log lines per second above which they are sampled, see logsampling.go. 0 disables. Defaults to 100.
+	LogSampleRate      int // LOG_SAMPLE_RATE: 1 in this many query log lines is logged above the threshold. Defaults to 10.
+
+	Zone string // ZONE: failure domain (host, rack, ...) of the node. Replicas are placed outside it where possible.
+
+	VirtualNodes int // VIRTUAL_NODES: positions this process takes on the ring, see vnodes.go. Defaults to 1.
+
+	SimLatency map[string]time.Duration // SIM_LATENCY: comma separated zone/zone=duration latencies to add to RPCs between zones, see simlatency.go.
+
+	RingBits   int  // RING_BITS: width of the keyspace in bits, the same on every node and client of the ring, see hashing.go. Defaults to 32.
+	LegacyHash bool // LEGACY_HASH: round IDs as nodes that predate integer hashing did, for rings they started, see hashing.go.
+
+	TimerJitter float64 // TIMER_JITTER: fraction by which stabilize, fix fingers and check predecessor intervals vary, at most 0.5. Defaults to 0.1.
+
+	StabilizeInterval        time.Duration // STABILIZE_INTERVAL: time between two stabilize rounds, e.g. 500ms. Defaults to 1s.
+	FixFingerInterval        time.Duration // FIX_FINGER_INTERVAL: time between fixing two fingers, see FixFingers. Defaults to 250ms.
+	CheckPredecessorInterval time.Duration // CHECK_PREDECESSOR_INTERVAL: time between two checks of the predecessor. Defaults to 1s.
+	ReplicateInterval        time.Duration // REPLICATE_INTERVAL: time between two replication rounds. Defaults to 5s.
+	AntiEntropyInterval      time.Duration // ANTI_ENTROPY_INTERVAL: time between two comparisons of the owned keys with the replicas, see antientropy.go. Defaults to 30s.
+
+	FailureMisses      int           // FAILURE_MISSES: heartbeats a peer must miss in a row to be declared failed, see failuredetector.go. Defaults to 3.
+	FailurePingTimeout time.Duration // FAILURE_PING_TIMEOUT: time after which a heartbeat counts as missed. 0 for CALL_TIMEOUT, the default.
+	FailurePhi         float64       // FAILURE_PHI: suspicion level above which a peer that missed a heartbeat is declared failed. 0, the default, disables it.
+}
+
+/*
+Reads the configuration of the default ring from the environment.
+*/
+func LoadConfig() Config {
+	return LoadNamespaceConfig("")
+}
+
+/*
+Reads the configuration of the ring in namespace from the environment. Every variable of a
+namespaced ring is prefixed with the upper case namespace, e.g. STAGING_RPC_PORT, and its data is
+kept in a directory of its own, so that rings running in one process share nothing.
+*/
+func LoadNamespaceConfig(namespace string) Config {
+	prefix := ""
+	dataDir := "./data"
+	if namespace != "" {
+		prefix = strings.ToUpper(namespace) + "_"
+		dataDir = "./data/" + namespace
+	}
+	key := func(name string) string { return prefix + name }
+
+	config := Config{
+		Namespace:   namespace,
+		RPCPort:     os.Getenv(key("RPC_PORT")),
+		DNSPort:     os.Getenv(key("DNS_PORT")),
+		AdminPort:   os.Getenv(key("ADMIN_PORT")),
+		MetricsPort: os.Getenv(key("METRICS_PORT")),
+		Join:        os.Getenv(key("JOIN")),
+	}
+	config.DNSEnabled = envBool(key("DNS_ENABLED"), config.DNSPort != "")
+	config.AdminEnabled = envBool(key("ADMIN_ENABLED"), config.AdminPort != "")
+	config.MetricsEnabled = envBool(key("METRICS_ENABLED"), config.MetricsPort != "")
+	config.MaxInflightRPCs = envInt(key("OVERLOAD_MAX_INFLIGHT"), 64)
+	config.MaxLoadPerCPU = envFloat(key("OVERLOAD_MAX_LOAD"), 0)
+	config.AuthZones = envList(key("AUTH_ZONES"))
+	config.AuthNameservers = envList(key("AUTH_NS"))
+	config.QueryLogFile = os.Getenv(key("QUERY_LOG_FILE"))
+	config.QueryLogFormat = envString(key("QUERY_LOG_FORMAT"), QUERY_LOG_DNSTAP)
+	config.CachePersist = envBool(key("CACHE_PERSIST"), false)
+	config.XFetchBeta = envFloat(key("XFETCH_BETA"), DEFAULT_XFETCH_BETA)
+	config.DiskStore = os.Getenv(key("DISK_STORE"))
+	config.DNSDebug = envBool(key("DNS_DEBUG"), false)
+	config.VerifyFingers = envBool(key("VERIFY_FINGERS"), false)
+	config.DataDir = envString(key("DATA_DIR"), dataDir)
+	config.RelayPort = os.Getenv(key("RELAY_PORT"))
+	config.RelayVia = os.Getenv(key("RELAY_VIA"))
+	config.Upstreams = envList(key("UPSTREAMS"))
+	config.WireFormat = envString(key("WIRE_FORMAT"), WIRE_FORMAT_GOB)
+	config.AdminTokens = make(map[string]string)
+	for i, entry := range envList(key("ADMIN_TOKENS")) {
+		if token, role, ok := strings.Cut(entry, ":"); ok && token != "" && (role == ADMIN_ROLE_READ || role == ADMIN_ROLE_OPERATOR) {
+			config.AdminTokens[token] = role
+		} else {
+			// The token itself is a secret, only its position and role are logged.
+			config.AdminBadTokens++
+			log.Error().Msgf("Entry %d of %s is not a token:role pair with role %s or %s (role %q)", i+1, key("ADMIN_TOKENS"), ADMIN_ROLE_READ, ADMIN_ROLE_OPERATOR, role)
+		}
+	}
+	config.AdminTLSCert = os.Getenv(key("ADMIN_TLS_CERT"))
+	config.AdminTLSKey = os.Getenv(key("ADMIN_TLS_KEY"))
+	config.AdminClientCA = os.Getenv(key("ADMIN_CLIENT_CA"))
+	config.AdminOperators = envList(key("ADMIN_OPERATORS"))
+	config.MaxRPCs = envInt(key("LIMIT_MAX_RPCS"), 0)
+	config.MaxConns = envInt(key("LIMIT_MAX_CONNS"), 0)
+	config.MaxCacheBytes = envInt(key("LIMIT_CACHE_BYTES"), 0)
+	config.MaxStorageKeys = envInt(key("LIMIT_STORAGE_KEYS"), 0)
+	config.HotKeyRate = envFloat(key("HOT_KEY_RATE"), 50)
+	config.ImportWorkers = envInt(key("IMPORT_WORKERS"), 8)
+	config.ImportRate = envFloat(key("IMPORT_RATE"), 1000)
+	config.TransferRate = envFloat(key("TRANSFER_RATE"), 0)
+	config.TransferBandwidth = envInt(key("TRANSFER_BANDWIDTH"), 0)
+	config.LookupRetries = envInt(key("LOOKUP_RETRIES"), 2)
+	config.WriteThrough = envBool(key("WRITE_THROUGH"), true)
+	config.LookupSlots = envInt(key("LOOKUP_SLOTS"), DEFAULT_LOOKUP_SLOTS)
+	config.LookupClientWeight = envInt(key("LOOKUP_CLIENT_WEIGHT"), DEFAULT_LOOKUP_CLIENT_WEIGHT)
+	config.AllowCrash = envBool(key("ALLOW_CRASH"), false)
+	config.MinTTL = envInt(key("MIN_TTL"), DEFAULT_MIN_TTL)
+	config.MaxTTL = envInt(key("MAX_TTL"), DEFAULT_MAX_TTL)
+	config.Observer = envBool(key("OBSERVER"), false)
+	config.GatewayNodes = envList(key("GATEWAY_NODES"))
+	config.GatewayPort = os.Getenv(key("GATEWAY_PORT"))
+	config.LogLevel = envString(key("LOG_LEVEL"), "info")
+	config.LogSampleThreshold = envInt(key("LOG_SAMPLE_THRESHOLD"), DEFAULT_LOG_SAMPLE_THRESHOLD)
+	config.LogSampleRate = envInt(key("LOG_SAMPLE_RATE"), DEFAULT_LOG_SAMPLE_RATE)
+	config.Zone = os.Getenv(key("ZONE"))
+	config.VirtualNodes = envInt(key("VIRTUAL_NODES"), 1)
+	if matrix, err := ParseLatencyMatrix(envList(key("SIM_LATENCY"))); err != nil {
+		log.Error().Err(err).Msg("Ignoring SIM_LATENCY")
+	} else {
+		config.SimLatency = matrix
+	}
+	// The keyspace is that of the process, shared by all of its rings.
+	config.RingBits = envInt("RING_BITS", hashing.DEFAULT_BITS)
+	config.LegacyHash = envBool("LEGACY_HASH", false)
+	config.TimerJitter = envFloat(key("TIMER_JITTER"), 0.1)
+	config.StabilizeInterval = envDuration(key("STABILIZE_INTERVAL"), DEFAULT_STABILIZE_INTERVAL)
+	config.FixFingerInterval = envDuration(key("FIX_FINGER_INTERVAL"), DEFAULT_FIX_FINGER_INTERVAL)
+	config.CheckPredecessorInterval = envDuration(key("CHECK_PREDECESSOR_INTERVAL"), DEFAULT_CHECK_PREDECESSOR_INTERVAL)
+	config.ReplicateInterval = envDuration(key("REPLICATE_INTERVAL"), DEFAULT_REPLICATE_INTERVAL)
+	config.AntiEntropyInterval = envDuration(key("ANTI_ENTROPY_INTERVAL"), DEFAULT_ANTI_ENTROPY_INTERVAL)
+	config.FailureMisses = envInt(key("FAILURE_MISSES"), DEFAULT_FAILURE_MISSES)
+	config.FailurePingTimeout = envDuration(key("FAILURE_PING_TIMEOUT"), 0)
+	config.FailurePhi = envFloat(key("FAILURE_PHI"), 0)
+	config.IDStrategy = envString(key("ID_STRATEGY"), ID_STRATEGY_ADDRESS)
+	config.NodeID = os.Getenv(key("NODE_ID"))
+	config.NodeName = os.Getenv(key("NODE_NAME"))
+	config.NodeKeyFile = os.Getenv(key("NODE_KEY_FILE"))
+	config.NodeIdentity = os.Getenv(key("NODE_IDENTITY"))
+	config.ControlKey = os.Getenv(key("CONTROL_KEY"))
+	config.NodeKeys = make(map[string]string)
+	for _, entry := range envList(key("NODE_KEYS")) {
+		if identity, secret, ok := strings.Cut(entry, ":"); ok {
+			config.NodeKeys[identity] = secret
+		}
+	}
+	return config
+}
+
+/*
+Config utility function to read a string environment variable, falling back to def if it is unset.
+*/
+func envString(key string, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return def
+}
+
+/*
+Config utility function to read a boolean environment variable, falling back to def if it is
+unset or malformed.
+*/
+func envBool(key string, def bool) bool {
+	value, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return value
+}
+
+/*
+Config utility function to read an integer environment variable, falling back to def if it is
+unset or malformed.
+*/
+func envInt(key string, def int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return value
+}
+
+/*
+Config utility function to read a floating point environment variable, falling back to def if it
+is unset or malformed.
+*/
+func envFloat(key string, def float64) float64 {
+	value, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil {
+		return def
+	}
+	return value
+}
+
+/*
+Config utility function to read a duration environment variable, e.g. 500ms, falling back to def if
+it is unset or malformed.
+*/
+func envDuration(key string, def time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return value
+}
+
+/*
+Config utility function to read a comma separated environment variable. Empty entries are dropped.
+*/
+func envList(key string) []string {
+	list := []string{}
+	for _, entry := range strings.Split(os.Getenv(key), ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
@@ -0,0 +1,143 @@
+/*
+Ring consistency score, a single number to watch while tuning timers and churn. Every
+CONSISTENCY_INTERVAL, the node walks the ring along the successor pointers and compares its own
+pointers with what the walk found: the fraction of its fingers that point at the true successor of
+their target, the fraction of its successor list (its successor, then the nodes it replicates to)
+that are among its true successors, and whether its predecessor is the node whose successor it is.
+The score is the mean of the three, 1 in a ring that has settled, and is exported along with its
+parts as dns_chord_consistency_* gauges. A walk that breaks off leaves the last score in place and
+is counted in consistency_checks_total{result="failed"}. Observers are not part of the ring and do
+not score it.
+*/
+package node
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/fauzxan/dns-chord/v2/hashing"
+	"github.com/rs/zerolog/log"
+)
+
+// Constants
+const (
+	CONSISTENCY_INTERVAL = 30 * time.Second // Time between two consistency checks of a node.
+)
+
+/*
+Outcome of the last consistency check of a node, each part between 0 and 1.
+*/
+type ConsistencyScore struct {
+	Score       float64   `json:"score"`       // Mean of the three parts below
+	Fingers     float64   `json:"fingers"`     // Fingers that point at the true successor of their target
+	Successors  float64   `json:"successors"`  // Entries of the successor list among the true successors
+	Predecessor float64   `json:"predecessor"` // 1 if the predecessor is the node whose successor this node is, else 0
+	Checked     time.Time `json:"checked"`     // Time of the check, zero if there was none yet
+}
+
+/*
+The last consistency score of a node.
+*/
+type consistencyState struct {
+	mu   sync.Mutex
+	last ConsistencyScore
+}
+
+/*
+Checks the consistency of this node every CONSISTENCY_INTERVAL, see the top of this file.
+*/
+func (node *Node) scoreConsistency() {
+	for node.sleep(CONSISTENCY_INTERVAL) {
+		if !node.Observing() {
+			node.CheckConsistency()
+		}
+	}
+}
+
+/*
+Walks the ring and scores the pointers of this node against it. Returns false, and leaves the
+last score in place, if the walk did not make it around the ring.
+*/
+func (node *Node) CheckConsistency() (ConsistencyScore, bool) {
+	ring, ok := node.walkRing()
+	if !ok {
+		log.Debug().Msgf("Consistency check skipped, the ring walk broke off after %d nodes", len(ring))
+		node.incMetric(`consistency_checks_total{result="failed"}`, 1)
+		return node.Consistency(), false
+	}
+	score := ConsistencyScore{Checked: time.Now()}
+
+	correct := 0
+	for i, finger := range node.fingers() {
+		target := (node.Nodeid + 1<<i) & hashing.Mask()
+		if finger.IP == ringSuccessor(ring, target).IP {
+			correct++
+		}
+	}
+	score.Fingers = float64(correct) / float64(hashing.Bits())
+
+	// The true successors follow this node in the walk; a lone node is its own successor.
+	truth := ring[1:]
+	if len(truth) == 0 {
+		truth = ring
+	}
+	truth = truth[:min(len(truth), node.replicaSpan())]
+	successors := []Pointer{node.successor()}
+	node.replicas.mu.Lock()
+	for _, target := range node.replicas.targets {
+		if target.IP != node.successor().IP {
+			successors = append(successors, target)
+		}
+	}
+	node.replicas.mu.Unlock()
+	correct = 0
+	for i, successor := range successors {
+		for j, expected := range truth {
+			// The successor itself has to be the first of them.
+			if successor.IP == expected.IP && (i > 0 || j == 0) {
+				correct++
+				break
+			}
+		}
+	}
+	score.Successors = float64(correct) / float64(len(successors))
+
+	if node.predecessor().IP == ring[len(ring)-1].IP {
+		score.Predecessor = 1
+	}
+	score.Score = (score.Fingers + score.Successors + score.Predecessor) / 3
+
+	node.consistency.mu.Lock()
+	node.consistency.last = score
+	node.consistency.mu.Unlock()
+	node.incMetric(`consistency_checks_total{result="ok"}`, 1)
+	log.Debug().Msgf("Consistency score %.3f: fingers %.3f, successors %.3f, predecessor %.0f",
+		score.Score, score.Fingers, score.Successors, score.Predecessor)
+	return score, true
+}
+
+/*
+Returns the outcome of the last consistency check of this node.
+*/
+func (node *Node) Consistency() ConsistencyScore {
+	node.consistency.mu.Lock()
+	defer node.consistency.mu.Unlock()
+	return node.consistency.last
+}
+
+/*
+Writes the last consistency score and its parts as gauges, once there is one.
+*/
+func (node *Node) writeConsistency(w io.Writer) {
+	score := node.Consistency()
+	if score.Checked.IsZero() {
+		return
+	}
+	fmt.Fprintf(w, "dns_chord_consistency_score %g\n", score.Score)
+	fmt.Fprintf(w, "dns_chord_consistency_fingers %g\n", score.Fingers)
+	fmt.Fprintf(w, "dns_chord_consistency_successors %g\n", score.Successors)
+	fmt.Fprintf(w, "dns_chord_consistency_predecessor %g\n", score.Predecessor)
+	fmt.Fprintf(w, "dns_chord_consistency_last_check_timestamp_seconds %d\n", score.Checked.Unix())
+}
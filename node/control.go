@@ -0,0 +1,193 @@
+/*
+Remote control of nodes by a test orchestrator, so that distributed experiments across machines can
+be scripted from one driver. A CONTROL message carries a command line in IP, e.g.
+
+	query example.com
+	leave
+	crash
+	loglevel debug
+	stats
+
+and the node runs it and replies with its output, one line each in QueryResponse. Commands are
+authenticated with a key shared by the orchestrator and the nodes (CONTROL_KEY): the message is
+signed, as the identity CONTROL_IDENTITY, with an HMAC of its command line and the time it was
+sent, carried in TargetId in Unix nanoseconds. A node refuses commands signed with another key,
+sent more than CONTROL_MAX_AGE from its own clock, or seen before, and without a CONTROL_KEY
+refuses them all. Crashes still need ALLOW_CRASH, see crash.go. From the command line:
+
+	dns-chord control [-timeout 10s] ip:port command [args]
+*/
+package node
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fauzxan/dns-chord/v2/message"
+	"github.com/rs/zerolog/log"
+)
+
+// Constants
+const (
+	CONTROL_QUERY     = "query"    // Resolves the name in the argument and replies with its records.
+	CONTROL_LEAVE     = "leave"    // Decommissions the node, see decommission.go, after replying.
+	CONTROL_CRASH     = "crash"    // Crashes the node, see crash.go, after replying.
+	CONTROL_LOG_LEVEL = "loglevel" // Sets the log level of the process to the argument, see loglevel.go.
+	CONTROL_STATS     = "stats"    // Replies with the statistics of the node, one "name value" line each.
+
+	CONTROL_IDENTITY = "control" // Identity of CONTROL messages, which are signed with CONTROL_KEY instead of a node key.
+
+	CONTROL_MAX_AGE       = 30 * time.Second // Most a command may be older or newer than the clock of the node that runs it.
+	CONTROL_QUERY_TIMEOUT = 5 * time.Second  // Time a query command is given to resolve its name.
+)
+
+var ErrControlRefused = errors.New("the node refused the command")
+
+/*
+Signatures of the commands a node ran within the last CONTROL_MAX_AGE, to refuse replays.
+*/
+type controlState struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+/*
+Returns the signature of the command line sent at sent, keyed with key.
+*/
+func controlSignature(key string, command string, sent uint64) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(CONTROL))
+	mac.Write([]byte{0})
+	mac.Write([]byte(command))
+	mac.Write([]byte{0})
+	mac.Write([]byte(strconv.FormatUint(sent, 10)))
+	return mac.Sum(nil)
+}
+
+/*
+Returns an error if msg is not a CONTROL message this node may run: signed with CONTROL_KEY,
+sent within CONTROL_MAX_AGE, and not seen before.
+*/
+func (node *Node) authenticateControl(msg *message.RequestMessage) error {
+	if node.Config.ControlKey == "" {
+		return errors.New("CONTROL_KEY is not set")
+	}
+	if !hmac.Equal(msg.Signature, controlSignature(node.Config.ControlKey, msg.IP, msg.TargetId)) {
+		return errors.New("invalid signature")
+	}
+	age := time.Since(time.Unix(0, int64(msg.TargetId)))
+	if age > CONTROL_MAX_AGE || age < -CONTROL_MAX_AGE {
+		return fmt.Errorf("sent %s from this node's clock", age.Round(time.Millisecond))
+	}
+	node.control.mu.Lock()
+	defer node.control.mu.Unlock()
+	if node.control.seen == nil {
+		node.control.seen = make(map[string]time.Time)
+	}
+	for signature, seen := range node.control.seen {
+		if time.Since(seen) > 2*CONTROL_MAX_AGE {
+			delete(node.control.seen, signature)
+		}
+	}
+	if _, replayed := node.control.seen[string(msg.Signature)]; replayed {
+		return errors.New("replayed")
+	}
+	node.control.seen[string(msg.Signature)] = time.Now()
+	return nil
+}
+
+/*
+Processes a CONTROL message: runs its command if it is authentic, and replies with the output.
+*/
+func (node *Node) handleControl(msg *message.RequestMessage, reply *message.ResponseMessage) {
+	// Orchestrators run as clients, which are not part of the ring and have no address in From.
+	sender := msg.From
+	if sender == "" {
+		sender = "a client"
+	}
+	if err := node.authenticateControl(msg); err != nil {
+		log.Warn().Err(err).Msgf("Refusing command %q of %s", msg.IP, sender)
+		node.incMetric(`control_commands_total{result="refused"}`, 1)
+		reply.Type = DENIED
+		reply.QueryResponse = []string{err.Error()}
+		return
+	}
+	log.Info().Msgf("Running command %q of %s", msg.IP, sender)
+	output, err := node.runControl(strings.Fields(msg.IP))
+	if err != nil {
+		node.incMetric(`control_commands_total{result="failed"}`, 1)
+		reply.Type = ERROR
+		reply.QueryResponse = []string{err.Error()}
+		return
+	}
+	node.incMetric(`control_commands_total{result="ok"}`, 1)
+	reply.Type = ACK
+	reply.QueryResponse = output
+}
+
+/*
+Runs the command in fields and returns its output.
+*/
+func (node *Node) runControl(fields []string) ([]string, error) {
+	if len(fields) == 0 {
+		return nil, errors.New("empty command")
+	}
+	command, args := fields[0], fields[1:]
+	switch {
+	case command == CONTROL_QUERY && len(args) == 1:
+		resolution, err := node.ResolveBefore(args[0], time.Now().Add(CONTROL_QUERY_TIMEOUT))
+		if err != nil {
+			return nil, err
+		}
+		return RecordsText(resolution.Records), nil
+	case command == CONTROL_LEAVE && len(args) == 0:
+		go node.Decommission(DECOMMISSION_LOOKUP_THRESHOLD, DECOMMISSION_TIMEOUT)
+		return []string{"leaving"}, nil
+	case command == CONTROL_CRASH && len(args) == 0:
+		if !node.Config.AllowCrash {
+			return nil, errors.New("ALLOW_CRASH is not set")
+		}
+		time.AfterFunc(CRASH_REPLY_GRACE, node.Crash)
+		return []string{"crashing"}, nil
+	case command == CONTROL_LOG_LEVEL && len(args) == 1:
+		if err := SetLogLevel(args[0]); err != nil {
+			return nil, err
+		}
+		return []string{LogLevel().String()}, nil
+	case command == CONTROL_STATS && len(args) == 0:
+		return node.statsReply(), nil
+	}
+	return nil, fmt.Errorf("unknown command %q, or wrong number of arguments", strings.Join(fields, " "))
+}
+
+/*
+Runs command, a command line as described at the top of this file, on the node at IP, signed with
+CONTROL_KEY. Returns its output, an error wrapping ErrControlRefused if the node refused or failed
+to run it, ErrUnreachable if it did not reply, or ErrTimeout after timeout.
+*/
+func (node *Node) ControlVia(IP string, command string, timeout time.Duration) ([]string, error) {
+	var output []string
+	err := withTimeout(timeout, func() error {
+		sent := uint64(time.Now().UnixNano())
+		command = strings.Join(strings.Fields(command), " ")
+		msg := message.RequestMessage{Type: CONTROL, IP: command, TargetId: sent, Identity: CONTROL_IDENTITY, Signature: controlSignature(node.Config.ControlKey, command, sent)}
+		reply := node.CallRPC(msg, IP)
+		switch reply.Type {
+		case ACK:
+			output = reply.QueryResponse
+			return nil
+		case DENIED, ERROR:
+			return fmt.Errorf("%w: %s", ErrControlRefused, strings.Join(reply.QueryResponse, "; "))
+		case EMPTY:
+			return fmt.Errorf("%w: %s did not reply", ErrUnreachable, IP)
+		}
+		return fmt.Errorf("%w: %s does not support CONTROL", ErrControlRefused, IP)
+	})
+	return output, err
+}
@@ -0,0 +1,85 @@
+/*
+Simulated crashes, for demonstrations and chaos tests. A crashed node stops responding at once:
+it closes its RPC listener and every open connection, drops the RPCs it is still handling and
+those it would send, and stops its background tasks, but hands nothing over, saves nothing and
+tells no one, so that its peers find out the way they would about a real crash, through timeouts.
+Unlike a killed process, a crashed node stays in memory, which lets in-process rings and
+experiments crash nodes too. Only nodes started with ALLOW_CRASH (or -allow-crash) can be crashed
+from the menu, the admin endpoint or a CRASH RPC.
+*/
+package node
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/fauzxan/dns-chord/v2/message"
+	"github.com/rs/zerolog/log"
+)
+
+// Constants
+const (
+	CRASH_REPLY_GRACE = 100 * time.Millisecond // Time the reply to a CRASH RPC is given to go out before the node crashes.
+)
+
+/*
+Returned by the RPC handler of a crashed node, which makes the call fail like one to a dead node.
+*/
+var ErrCrashed = errors.New("node crashed")
+
+/*
+Returns true if this node has crashed.
+*/
+func (node *Node) Crashed() bool {
+	return node.crashed.Load()
+}
+
+/*
+Crashes this node, see the top of this file. Does nothing if it has crashed already.
+*/
+func (node *Node) Crash() {
+	node.context()
+	if node.crashed.Swap(true) {
+		return
+	}
+	log.Warn().Msg("Simulating a crash, this node no longer responds")
+	node.life.cancel()
+	node.life.mu.Lock()
+	if node.life.listener != nil {
+		node.life.listener.Close()
+	}
+	for conn := range node.life.conns {
+		conn.Close()
+	}
+	node.life.mu.Unlock()
+}
+
+/*
+Processes a CRASH message: crashes this node shortly after replying, if it allows crashes.
+*/
+func (node *Node) handleCrash(msg *message.RequestMessage, reply *message.ResponseMessage) {
+	if !node.Config.AllowCrash {
+		log.Warn().Msgf("Refusing to crash on behalf of %s, ALLOW_CRASH is not set", msg.From)
+		reply.Type = DENIED
+		return
+	}
+	log.Warn().Msgf("Crashing on behalf of %s", msg.From)
+	reply.Type = ACK
+	time.AfterFunc(CRASH_REPLY_GRACE, node.Crash)
+}
+
+/*
+Crashes the node at IP, which has to allow crashes. Returns an error wrapping ErrUnreachable if
+it did not reply.
+*/
+func (node *Node) CrashPeer(IP string) error {
+	switch reply := node.CallRPC(message.RequestMessage{Type: CRASH}, IP); reply.Type {
+	case ACK:
+		return nil
+	case DENIED:
+		return fmt.Errorf("%s does not allow crashes, start it with ALLOW_CRASH=true", IP)
+	default:
+		return fmt.Errorf("%w: %s did not reply", ErrUnreachable, IP)
+	}
+}
@@ -0,0 +1,163 @@
+/*
+Time-bounded lookups. ResolveBefore gives the ring lookup until a deadline, and answers with the
+best data at hand if it has not completed by then: a fresh answer straight from the upstream
+resolvers, asked in parallel once half of the time is up, or else the cached records of the name,
+even if they have expired. Such answers are flagged as degraded. The ring lookup carries on in the
+background until the deadline regardless, and fills the cache if it completes, so the next lookup
+benefits.
+
+The deadline also bounds the ring lookup itself. Every forwarded FIND_SUCCESSOR carries the budget
+its receiver has left, in a share that shrinks with each hop: of the time left, a node keeps one
+share per hop still expected (estimated from the ring size) and hands the rest on. A slow hop
+therefore times out with time to spare, which the node that forwarded to it spends retrying
+through its successor, instead of taking the whole budget with it.
+*/
+package node
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/fauzxan/dns-chord/v2/hashing"
+	"github.com/fauzxan/dns-chord/v2/message"
+	"github.com/rs/zerolog/log"
+)
+
+// Constants
+const (
+	DEADLINE_HEDGE_FRACTION = 0.5 // Share of the time to the deadline after which upstream is asked in parallel.
+)
+
+/*
+Records of a time-bounded lookup, and where they came from.
+*/
+type Resolution struct {
+	Records  []Record
+	Source   string // ring, upstream or stale_cache
+	Degraded bool   // Set if the ring lookup did not complete in time, and the records may be stale or bypass the ring
+	Trace    LookupTrace
+}
+
+type resolveResult struct {
+	records []Record
+	trace   LookupTrace
+	err     error
+}
+
+/*
+Resolves website by the deadline, with a degraded answer if the ring lookup does not complete in
+time. Returns an error wrapping context.DeadlineExceeded if there is nothing to answer with, or
+context.Canceled if the lookup was cancelled, see progress.go.
+*/
+func (node *Node) ResolveBefore(website string, deadline time.Time) (Resolution, error) {
+	stale, hasStale := node.staleCache(website)
+	lookup := node.startOperation("lookup "+website, 1, true)
+	defer lookup.Finish()
+
+	ring := make(chan resolveResult, 1)
+	node.spawn("resolve", func() {
+		var trace LookupTrace
+		records, err := node.resolve(website, true, deadline, &trace)
+		ring <- resolveResult{records, trace, err}
+	})
+	budget := time.Until(deadline)
+	hedge := time.NewTimer(time.Duration(float64(budget) * DEADLINE_HEDGE_FRACTION))
+	defer hedge.Stop()
+	expired := time.NewTimer(budget)
+	defer expired.Stop()
+
+	var upstream chan resolveResult
+	var direct *resolveResult
+	for {
+		select {
+		case result := <-ring:
+			if result.err != nil && hasStale {
+				log.Debug().Err(result.err).Msgf("Ring lookup of %s failed, answering from the stale cache", website)
+				return node.degraded(stale.value, "stale_cache", time.Since(stale.added)), nil
+			}
+			return Resolution{Records: result.records, Source: "ring", Trace: result.trace}, result.err
+		case <-hedge.C:
+			upstream = make(chan resolveResult, 1)
+			node.spawn("resolve_upstream", func() {
+				ips, err := node.lookupUpstream(website)
+				records := []Record{}
+				for _, ip := range ips {
+					records = append(records, addressRecord(ip))
+				}
+				upstream <- resolveResult{records, LookupTrace{}, err}
+			})
+		case result := <-upstream:
+			if result.err == nil {
+				direct = &result
+			}
+		case <-lookup.Context().Done():
+			return Resolution{}, fmt.Errorf("resolving %s: %w", website, context.Canceled)
+		case <-expired.C:
+			if direct != nil {
+				return node.degraded(direct.records, "upstream", 0), nil
+			}
+			if hasStale {
+				return node.degraded(stale.value, "stale_cache", time.Since(stale.added)), nil
+			}
+			node.incMetric(`resolutions_total{source="deadline_exceeded"}`, 1)
+			return Resolution{}, fmt.Errorf("resolving %s: %w", website, context.DeadlineExceeded)
+		}
+	}
+}
+
+/*
+Returns a degraded resolution of records from source, that had been cached for cacheAge.
+*/
+func (node *Node) degraded(records []Record, source string, cacheAge time.Duration) Resolution {
+	node.incMetric(fmt.Sprintf("resolutions_total{source=%q}", "degraded_"+source), 1)
+	resolution := Resolution{Records: records, Source: source, Degraded: true}
+	resolution.Trace.local(node, source, 0, cacheAge)
+	return resolution
+}
+
+/*
+Returns the cache entry of website, whether or not it has expired.
+*/
+func (node *Node) staleCache(website string) (LRUCache, bool) {
+	website, err := NormalizeName(website)
+	if err != nil {
+		return LRUCache{}, false
+	}
+	node.cacheMu.Lock()
+	defer node.cacheMu.Unlock()
+	entry, ok := node.CachedQuery[hashing.Hash(website)]
+	return entry, ok
+}
+
+/*
+Returns the number of hops a lookup is expected to take: half the binary logarithm of the ring
+size, as for Chord, and at least one.
+*/
+func (node *Node) expectedHops() int {
+	return max(1, int(math.Ceil(math.Log2(float64(node.estimateRingSize()))/2)))
+}
+
+/*
+Returns the budget to forward a lookup with at hop hopCount, given its deadline: the time left
+without the share this node keeps for a retry. Returns 0 for lookups without a deadline.
+*/
+func (node *Node) forwardBudget(deadline time.Time, hopCount int) time.Duration {
+	if deadline.IsZero() {
+		return 0
+	}
+	remaining := time.Until(deadline)
+	hops := time.Duration(max(1, node.expectedHops()-hopCount+1))
+	return max(1, remaining*hops/(hops+1))
+}
+
+/*
+Returns the deadline of a received message from its budget, or the zero time if it has none.
+*/
+func budgetDeadline(msg *message.RequestMessage) time.Time {
+	if msg.Budget <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(msg.Budget))
+}
@@ -0,0 +1,195 @@
+/*
+Decommissioning takes a busy node out of the ring gradually instead of all at once. The node first
+stops advertising itself: it no longer notifies its successor, and lookups routed through it are
+bounced to its successor with a BUSY hint, so that peers route around it while their fingers catch
+up. Once the lookups it still sees taper off, its keys are handed off to the successor, which takes
+over its range, and the node shuts down.
+*/
+package node
+
+import (
+	"sync"
+	"time"
+
+	"github.com/fauzxan/dns-chord/v2/message"
+	"github.com/rs/zerolog/log"
+)
+
+// Constants
+const (
+	DECOMMISSION_LOOKUP_THRESHOLD = 1                // Lookups per second below which traffic counts as drained.
+	DECOMMISSION_TIMEOUT          = 60 * time.Second // Upper bound on waiting for traffic to drain before handing off anyway.
+	DECOMMISSION_POLL_INTERVAL    = 1 * time.Second  // How often the routed lookup rate is sampled.
+)
+
+/*
+Closed once a decommissioned node has left the ring.
+*/
+type departure struct {
+	once sync.Once
+	done chan struct{}
+}
+
+/*
+Returns true if the node is being decommissioned.
+*/
+func (node *Node) Decommissioning() bool {
+	return node.draining.Load()
+}
+
+/*
+Drains traffic away from the node, hands its keys off to the successor and shuts the node down.
+Waits until fewer than threshold lookups per second are routed through the node, or until timeout.
+*/
+func (node *Node) Decommission(threshold float64, timeout time.Duration) {
+	if !node.draining.CompareAndSwap(false, true) {
+		return
+	}
+	log.Info().Msg("> Decommissioning, draining traffic...")
+
+	lookups := func() uint64 { return node.Counters()[`messages_received_total{type="`+FIND_SUCCESSOR+`"}`] }
+	deadline := time.Now().Add(timeout)
+	last := lookups()
+	for node.sleep(DECOMMISSION_POLL_INTERVAL) {
+		current := lookups()
+		rate := float64(current-last) / DECOMMISSION_POLL_INTERVAL.Seconds()
+		last = current
+		log.Info().Msgf("> %.1f lookups per second routed through this node", rate)
+		if rate < threshold {
+			break
+		}
+		if time.Now().After(deadline) {
+			log.Warn().Msg("Traffic did not drain in time, handing off anyway")
+			break
+		}
+	}
+
+	node.depart()
+}
+
+/*
+Leaves the ring at once: hands the keys off to the successor, links the predecessor to the
+successor and shuts the node down, without draining traffic first as Decommission does.
+*/
+func (node *Node) Leave() {
+	if !node.draining.CompareAndSwap(false, true) {
+		return
+	}
+	log.Info().Msg("> Leaving the ring...")
+	node.depart()
+}
+
+/*
+Hands the range of a node that stopped advertising itself off to its neighbours, and shuts it down.
+*/
+func (node *Node) depart() {
+	node.departSiblings()
+	node.handoff()
+	node.relinkPredecessor()
+	node.Shutdown()
+	node.Left()
+	close(node.departure.done)
+}
+
+/*
+Returns a channel that is closed once the node has been decommissioned and left the ring.
+*/
+func (node *Node) Left() <-chan struct{} {
+	node.departure.once.Do(func() {
+		node.departure.done = make(chan struct{})
+	})
+	return node.departure.done
+}
+
+/*
+Sends all keys this node is responsible for to the successor, along with the predecessor, so that
+the successor takes over the range right away instead of waiting for CheckPredecessor to notice.
+*/
+func (node *Node) handoff() {
+	if node.successor().IP == node.IP {
+		log.Warn().Msg("No successor to hand keys off to")
+		return
+	}
+	node.storageMu.RLock()
+	payload := make(map[uint64][]Record, len(node.HashIPStorage[node.Nodeid]))
+	for key, records := range node.HashIPStorage[node.Nodeid] {
+		payload[key] = decompressRecords(records)
+	}
+	node.storageMu.RUnlock()
+	names := node.namesFor(payload)
+	// The handoff has to arrive in one message, it only waits for its turn, see transfer.go
+	node.throttleTransfer("handoff", len(payload), payloadBytes(payload, names))
+
+	predecessor, successor := node.predecessor(), node.successor()
+	reply := node.CallRPC(message.RequestMessage{
+		Type:     HANDOFF,
+		TargetId: predecessor.Nodeid,
+		IP:       predecessor.IP,
+		Payload:  payload,
+		Names:    names,
+	}, successor.IP)
+	if reply.Type != ACK {
+		log.Error().Msgf("Successor %s did not accept the handoff, its replicas will take over", successor.IP)
+		return
+	}
+	node.incMetric(`keys_transferred_total{kind="handoff"}`, uint64(len(payload)))
+	log.Info().Msgf("> Handed %d keys off to %s", len(payload), successor.IP)
+}
+
+/*
+Tells the predecessor that this node is leaving, and that its successor is now this node's
+successor, so that it need not wait for stabilize to find out.
+*/
+func (node *Node) relinkPredecessor() {
+	predecessor, successor := node.predecessor(), node.successor()
+	if predecessor.IP == "" || predecessor.IP == node.IP || successor.IP == node.IP {
+		return
+	}
+	reply := node.CallRPC(message.RequestMessage{
+		Type:     LEAVE,
+		TargetId: successor.Nodeid,
+		IP:       successor.IP,
+	}, predecessor.IP)
+	if reply.Type != ACK {
+		log.Warn().Msgf("Predecessor %s did not accept the new successor, it will find it with stabilize", predecessor.IP)
+		return
+	}
+	log.Info().Msgf("> Linked predecessor %s to successor %s", predecessor.IP, successor.IP)
+}
+
+/*
+Links this node to the successor of its leaving successor, which is passed in msg.
+*/
+func (node *Node) relink(msg *message.RequestMessage) bool {
+	if msg.From != node.successor().IP || node.Frozen() {
+		return false
+	}
+	successor := Pointer{Nodeid: msg.TargetId, IP: msg.IP}
+	if msg.IP == "" || msg.IP == node.IP {
+		// The ring is down to this node.
+		successor = Pointer{Nodeid: node.Nodeid, IP: node.IP}
+	}
+	node.setSuccessor(successor, CAUSE_LEAVE)
+	return true
+}
+
+/*
+Takes over the range and keys of a decommissioned predecessor, whose own predecessor is passed in msg.
+*/
+func (node *Node) takeOver(msg *message.RequestMessage) bool {
+	if msg.From != node.predecessor().IP {
+		return false
+	}
+	node.learnNames(msg.Names)
+	node.PutQuery(node.Nodeid, msg.Payload)
+	node.storageMu.Lock()
+	delete(node.HashIPStorage, node.predecessor().Nodeid)
+	node.storageMu.Unlock()
+	predecessor := Pointer{Nodeid: msg.TargetId, IP: msg.IP}
+	if msg.IP == node.IP {
+		// The ring is down to this node.
+		predecessor = Pointer{}
+	}
+	node.setPredecessor(predecessor, CAUSE_HANDOFF)
+	return true
+}
@@ -0,0 +1,183 @@
+/*
+Read-only, memory-mapped store for record sets that do not fit in memory. A store file is built
+offline from storage snapshots ("dns-chord build-store") and mapped into the address space of the
+node, which serves GETs from it when a key is not in its in-memory storage. Lookups binary search
+a sorted index in the mapping, so only the pages actually touched are read from disk, and a small
+LRU cache keeps the decoded record sets of hot keys. In-memory storage always takes precedence
+over the store, which is never written to by a running node.
+
+File layout (all integers big endian):
+
+	header  "DCSTORE1" | count uint64
+	index   count * (key uint64 | offset uint64 | length uint32), sorted by key
+	data    the JSON encoded record sets the index points into
+*/
+package node
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Constants
+const (
+	DISK_STORE_MAGIC       = "DCSTORE1"
+	DISK_STORE_HEADER_SIZE = 16
+	DISK_STORE_ENTRY_SIZE  = 20
+	DISK_CACHE_ENTRIES     = 4096 // Number of decoded record sets kept in the LRU cache of a store.
+)
+
+var errCorruptStore = errors.New("corrupt disk store")
+
+/*
+A memory-mapped store file.
+*/
+type diskStore struct {
+	data  []byte // the mapping of the whole file
+	count int
+	close func() error
+
+	mu    sync.Mutex
+	cache map[uint64]*list.Element
+	lru   *list.List // of diskStoreEntry, most recently used first
+}
+
+type diskStoreEntry struct {
+	key     uint64
+	records []Record
+}
+
+/*
+Writes a store file at path from one or more storage snapshots, as persisted in ./data. Where
+snapshots disagree on a key, the later one wins. Returns the number of keys written.
+*/
+func WriteStore(path string, snapshots ...map[uint64]map[uint64][]Record) (int, error) {
+	merged := make(map[uint64][]Record)
+	for _, snapshot := range snapshots {
+		for _, bucket := range snapshot {
+			for key, records := range bucket {
+				merged[key] = records
+			}
+		}
+	}
+	keys := make([]uint64, 0, len(merged))
+	for key := range merged {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	var index, data bytes.Buffer
+	for _, key := range keys {
+		encoded, err := json.Marshal(merged[key])
+		if err != nil {
+			return 0, err
+		}
+		index.Write(binary.BigEndian.AppendUint64(nil, key))
+		index.Write(binary.BigEndian.AppendUint64(nil, uint64(data.Len())))
+		index.Write(binary.BigEndian.AppendUint32(nil, uint32(len(encoded))))
+		data.Write(encoded)
+	}
+
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return 0, err
+	}
+	header := append([]byte(DISK_STORE_MAGIC), binary.BigEndian.AppendUint64(nil, uint64(len(keys)))...)
+	for _, part := range [][]byte{header, index.Bytes(), data.Bytes()} {
+		if _, err := file.Write(part); err != nil {
+			file.Close()
+			return 0, err
+		}
+	}
+	if err := file.Close(); err != nil {
+		return 0, err
+	}
+	return len(keys), os.Rename(path+".tmp", path)
+}
+
+/*
+Maps the store file at path into memory and uses it as the cold tier of the node's storage. The
+mapping is released when the node shuts down.
+*/
+func (node *Node) OpenDiskStore(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	data, unmap, err := mmapFile(file)
+	if err != nil {
+		return err
+	}
+	if len(data) < DISK_STORE_HEADER_SIZE || string(data[:len(DISK_STORE_MAGIC)]) != DISK_STORE_MAGIC {
+		unmap()
+		return errCorruptStore
+	}
+	count := binary.BigEndian.Uint64(data[len(DISK_STORE_MAGIC):DISK_STORE_HEADER_SIZE])
+	if count > uint64(len(data)-DISK_STORE_HEADER_SIZE)/DISK_STORE_ENTRY_SIZE {
+		unmap()
+		return errCorruptStore
+	}
+	node.diskStore = &diskStore{data: data, count: int(count), close: unmap, cache: make(map[uint64]*list.Element), lru: list.New()}
+	log.Info().Msgf("Mapped disk store %s with %d keys", path, count)
+	node.spawn("disk_store", func() {
+		<-node.context().Done()
+		node.diskStore.mu.Lock()
+		defer node.diskStore.mu.Unlock()
+		node.diskStore.close()
+		node.diskStore.data = nil
+		node.diskStore.count = 0
+	})
+	return nil
+}
+
+/*
+Returns the stored records of key. Safe to call on a nil store.
+*/
+func (store *diskStore) get(key uint64) ([]Record, bool) {
+	if store == nil {
+		return nil, false
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if element, ok := store.cache[key]; ok {
+		store.lru.MoveToFront(element)
+		return element.Value.(diskStoreEntry).records, true
+	}
+
+	entry := func(i int) []byte {
+		start := DISK_STORE_HEADER_SIZE + i*DISK_STORE_ENTRY_SIZE
+		return store.data[start : start+DISK_STORE_ENTRY_SIZE]
+	}
+	i := sort.Search(store.count, func(i int) bool { return binary.BigEndian.Uint64(entry(i)) >= key })
+	if i == store.count || binary.BigEndian.Uint64(entry(i)) != key {
+		return nil, false
+	}
+	dataStart := uint64(DISK_STORE_HEADER_SIZE + store.count*DISK_STORE_ENTRY_SIZE)
+	offset := dataStart + binary.BigEndian.Uint64(entry(i)[8:])
+	length := uint64(binary.BigEndian.Uint32(entry(i)[16:]))
+	if offset+length > uint64(len(store.data)) {
+		log.Error().Err(errCorruptStore).Msgf("Entry of key %d is out of bounds", key)
+		return nil, false
+	}
+	var records []Record
+	if err := json.Unmarshal(store.data[offset:offset+length], &records); err != nil {
+		log.Error().Err(err).Msgf("Could not decode entry of key %d", key)
+		return nil, false
+	}
+
+	store.cache[key] = store.lru.PushFront(diskStoreEntry{key: key, records: records})
+	if store.lru.Len() > DISK_CACHE_ENTRIES {
+		oldest := store.lru.Remove(store.lru.Back()).(diskStoreEntry)
+		delete(store.cache, oldest.key)
+	}
+	return records, true
+}
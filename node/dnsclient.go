@@ -0,0 +1,217 @@
+/*
+Minimal DNS client for lookups through the configured upstreams. Unlike net.Resolver, it reports
+the TTL of the answers, so that record sets learned from legacy DNS expire when upstream says
+they do, see ttl.go. It asks for A and AAAA records over UDP, and over TCP if an answer is
+truncated, and follows CNAMEs only as far as the upstream does in its answer.
+*/
+package node
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// Constants
+const (
+	DNS_FLAG_RD = 1 << 8 // Recursion desired, set on every query to an upstream.
+)
+
+var errMalformedResponse = errors.New("malformed DNS response")
+
+/*
+Builds a recursive query for name and qtype with the given id, advertising DNS_EDNS_SIZE.
+*/
+func buildDNSQuery(id uint16, name string, qtype uint16) []byte {
+	msg := make([]byte, DNS_HEADER_SIZE, 64)
+	binary.BigEndian.PutUint16(msg[0:2], id)
+	binary.BigEndian.PutUint16(msg[2:4], DNS_FLAG_RD)
+	binary.BigEndian.PutUint16(msg[4:6], 1)
+	binary.BigEndian.PutUint16(msg[10:12], 1)
+	msg = appendDNSName(msg, name)
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	msg = binary.BigEndian.AppendUint16(msg, DNS_CLASS_IN)
+	// OPT: root name, UDP size as class, no extended rcode, version 0, no options.
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, DNS_TYPE_OPT)
+	msg = binary.BigEndian.AppendUint16(msg, DNS_EDNS_SIZE)
+	msg = binary.BigEndian.AppendUint32(msg, 0)
+	return binary.BigEndian.AppendUint16(msg, 0)
+}
+
+/*
+Returns the offset just past the name at offset, which may be compressed.
+*/
+func skipDNSName(msg []byte, offset int) (int, error) {
+	for {
+		if offset >= len(msg) {
+			return 0, errMalformedResponse
+		}
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			return offset + 1, nil
+		case length&0xC0 == 0xC0:
+			// A pointer ends the name where it is stored.
+			if offset+2 > len(msg) {
+				return 0, errMalformedResponse
+			}
+			return offset + 2, nil
+		case length > 63:
+			return 0, errMalformedResponse
+		}
+		offset += 1 + length
+	}
+}
+
+/*
+Parses a response to the query with the given id. Returns its response code, whether it was
+truncated, and the records of its answer section.
+*/
+func parseDNSResponse(msg []byte, id uint16) (uint16, bool, []dnsRR, error) {
+	if len(msg) < DNS_HEADER_SIZE || binary.BigEndian.Uint16(msg[0:2]) != id {
+		return 0, false, nil, errMalformedResponse
+	}
+	flags := binary.BigEndian.Uint16(msg[2:4])
+	if flags&(1<<15) == 0 {
+		return 0, false, nil, errMalformedResponse
+	}
+	rcode, truncated := flags&0xF, flags&DNS_FLAG_TC != 0
+	questions := int(binary.BigEndian.Uint16(msg[4:6]))
+	count := int(binary.BigEndian.Uint16(msg[6:8]))
+	offset := DNS_HEADER_SIZE
+	var err error
+	for i := 0; i < questions; i++ {
+		if offset, err = skipDNSName(msg, offset); err != nil {
+			return rcode, truncated, nil, err
+		}
+		offset += 4
+	}
+	answers := []dnsRR{}
+	for i := 0; i < count; i++ {
+		if offset, err = skipDNSName(msg, offset); err != nil {
+			return rcode, truncated, nil, err
+		}
+		if offset+10 > len(msg) {
+			return rcode, truncated, nil, errMalformedResponse
+		}
+		rr := dnsRR{Type: binary.BigEndian.Uint16(msg[offset : offset+2]), TTL: binary.BigEndian.Uint32(msg[offset+4 : offset+8])}
+		length := int(binary.BigEndian.Uint16(msg[offset+8 : offset+10]))
+		offset += 10
+		if offset+length > len(msg) {
+			return rcode, truncated, nil, errMalformedResponse
+		}
+		rr.Data = msg[offset : offset+length]
+		offset += length
+		answers = append(answers, rr)
+	}
+	return rcode, truncated, answers, nil
+}
+
+/*
+Sends query to the resolver at addr over network, udp or tcp, and returns the response.
+*/
+func exchangeDNS(ctx context.Context, network string, addr string, query []byte) ([]byte, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if network == "udp" {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		response := make([]byte, DNS_EDNS_SIZE)
+		n, err := conn.Read(response)
+		return response[:n], err
+	}
+	if _, err := conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(query)))); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, 2)
+	if _, err := io.ReadFull(conn, prefix); err != nil {
+		return nil, err
+	}
+	response := make([]byte, binary.BigEndian.Uint16(prefix))
+	_, err = io.ReadFull(conn, response)
+	return response, err
+}
+
+/*
+Asks the resolver at addr for the records of name of type qtype. Returns the addresses in the
+answer, the lowest TTL of the answer records, CNAMEs included, and the response code.
+*/
+func queryDNS(ctx context.Context, addr string, name string, qtype uint16) ([]net.IP, uint32, uint16, error) {
+	id := uint16(rand.Intn(1 << 16))
+	query := buildDNSQuery(id, name, qtype)
+	response, err := exchangeDNS(ctx, "udp", addr, query)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	rcode, truncated, answers, err := parseDNSResponse(response, id)
+	if err == nil && truncated {
+		if response, err = exchangeDNS(ctx, "tcp", addr, query); err == nil {
+			rcode, _, answers, err = parseDNSResponse(response, id)
+		}
+	}
+	if err != nil {
+		return nil, 0, rcode, err
+	}
+	ips := []net.IP{}
+	ttl := uint32(0)
+	for i, rr := range answers {
+		if i == 0 || rr.TTL < ttl {
+			ttl = rr.TTL
+		}
+		if (rr.Type == DNS_TYPE_A && len(rr.Data) == net.IPv4len) || (rr.Type == DNS_TYPE_AAAA && len(rr.Data) == net.IPv6len) {
+			ips = append(ips, net.IP(append([]byte{}, rr.Data...)))
+		}
+	}
+	return ips, ttl, rcode, nil
+}
+
+/*
+Looks up the A and AAAA records of name at the resolver at addr, like net.Resolver.LookupIP, and
+returns them with the lowest TTL among the answers. A name without addresses is reported as a
+*net.DNSError that is not found.
+*/
+func lookupIPWithTTL(ctx context.Context, addr string, name string) ([]net.IP, time.Duration, error) {
+	ips := []net.IP{}
+	ttl := time.Duration(-1)
+	for _, qtype := range []uint16{DNS_TYPE_A, DNS_TYPE_AAAA} {
+		found, answerTTL, rcode, err := queryDNS(ctx, addr, name, qtype)
+		if err != nil {
+			return nil, 0, err
+		}
+		switch rcode {
+		case RCODE_NOERROR:
+		case RCODE_NXDOMAIN:
+			return nil, 0, &net.DNSError{Err: "no such host", Name: name, Server: addr, IsNotFound: true}
+		default:
+			return nil, 0, &net.DNSError{Err: fmt.Sprintf("server answered %s", rcodeName(rcode)), Name: name, Server: addr}
+		}
+		if len(found) == 0 {
+			continue
+		}
+		ips = append(ips, found...)
+		if answer := time.Duration(answerTTL) * time.Second; ttl < 0 || answer < ttl {
+			ttl = answer
+		}
+	}
+	if len(ips) == 0 {
+		return nil, 0, &net.DNSError{Err: "no such host", Name: name, Server: addr, IsNotFound: true}
+	}
+	return ips, ttl, nil
+}
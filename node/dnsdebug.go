@@ -0,0 +1,77 @@
+/*
+Debug answers. With DNS_DEBUG set, every answer of the DNS listener carries a TXT record in its
+additional section that tells where the answer came from: the node that answered it, the number of
+hops the ring lookup took, and how long the records had been cached, e.g.
+
+	example.com. 0 IN TXT "node=1103122432" "ip=10.0.0.1:5000" "source=ring" "hops=2" "cache_age=0s"
+
+so that the ring can be demonstrated and checked with plain dig, without the logs of its nodes.
+*/
+package node
+
+import (
+	"fmt"
+	"time"
+)
+
+/*
+How a lookup was answered, as reported in debug answers.
+*/
+type LookupTrace struct {
+	Source   string        // cache, storage, ring, upstream or stale_cache
+	Nodeid   uint64        // Node that answered the lookup, this node unless it came from the ring
+	IP       string        // Address of that node
+	Hops     int           // Hops the ring lookup took, 0 if the node did not look the name up in the ring
+	CacheAge time.Duration // Time the records had been cached for, 0 if they were not cached
+	Fallback string        // Fallback the lookup was answered through after its first path failed, see retry.go
+}
+
+/*
+Records that the lookup it traces was answered by this node from source. A nil trace ignores it.
+*/
+func (trace *LookupTrace) local(node *Node, source string, hops int, cacheAge time.Duration) {
+	trace.remote(source, Pointer{Nodeid: node.Nodeid, IP: node.IP}, hops, cacheAge)
+}
+
+/*
+Records that the lookup it traces was answered by pointer from source. A nil trace ignores it.
+*/
+func (trace *LookupTrace) remote(source string, pointer Pointer, hops int, cacheAge time.Duration) {
+	if trace == nil {
+		return
+	}
+	*trace = LookupTrace{Source: source, Nodeid: pointer.Nodeid, IP: pointer.IP, Hops: hops, CacheAge: cacheAge}
+}
+
+/*
+Records that the lookup it traces was answered through fallback, if not empty. A nil trace ignores it.
+*/
+func (trace *LookupTrace) fellBack(fallback string) {
+	if trace != nil {
+		trace.Fallback = fallback
+	}
+}
+
+/*
+Returns the debug records to add to the additional section of an answer traced by trace, or none
+if DNS_DEBUG is not set.
+*/
+func (node *Node) debugRRs(trace LookupTrace) []dnsRR {
+	if !node.Config.DNSDebug || trace.Source == "" {
+		return nil
+	}
+	data := []byte{}
+	for _, value := range []string{
+		fmt.Sprintf("node=%d", trace.Nodeid),
+		"ip=" + trace.IP,
+		"source=" + trace.Source,
+		fmt.Sprintf("hops=%d", trace.Hops),
+		"cache_age=" + trace.CacheAge.Round(time.Second).String(),
+	} {
+		data = append(data, txtData(value)...)
+	}
+	if trace.Fallback != "" {
+		data = append(data, txtData("fallback="+trace.Fallback)...)
+	}
+	return []dnsRR{{Type: DNS_TYPE_TXT, Data: data}}
+}
@@ -0,0 +1,232 @@
+/*
+DNS listener of a node. Standard resolvers (dig, the OS stub resolver, ...) can query the ring
+directly over UDP and TCP on the configured DNS port; each query is answered through Resolve.
+*/
+package node
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Constants
+const (
+	DNS_UDP_BUFFER_SIZE = 4096
+	DNS_TCP_TIMEOUT     = 10 * time.Second // Upper bound on reading a query from, or writing an answer to, a TCP client.
+	DNS_RESOLVE_TIMEOUT = 2 * time.Second  // Time a recursive query is given before it is answered with degraded data, see deadline.go.
+	DNS_DEGRADED_TTL    = 5                // TTL of degraded answers, in seconds, so that resolvers ask again soon.
+)
+
+/*
+Starts the DNS listener on addr, over both UDP and TCP, in tracked goroutines. Both sockets are
+closed when the node shuts down.
+*/
+func (node *Node) ServeDNS(addr string) {
+	udp, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not listen to UDP address for DNS")
+		return
+	}
+	tcp, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not listen to TCP address for DNS")
+		udp.Close()
+		return
+	}
+	log.Info().Msgf("DNS listener is running at address: %s", addr)
+
+	if node.Config.QueryLogFile != "" {
+		node.queryLog, err = openQueryLog(node.Config.QueryLogFile, node.Config.QueryLogFormat, node.IP)
+		if err != nil {
+			log.Error().Err(err).Msg("Could not open the query log")
+		}
+	}
+
+	node.spawn("dns_udp", func() { node.serveDNSUDP(udp) })
+	node.spawn("dns_tcp", func() { node.serveDNSTCP(tcp) })
+	node.spawn("dns_shutdown", func() {
+		<-node.context().Done()
+		udp.Close()
+		tcp.Close()
+		node.queryLog.Close()
+	})
+}
+
+func (node *Node) serveDNSUDP(conn net.PacketConn) {
+	for {
+		buf := make([]byte, DNS_UDP_BUFFER_SIZE)
+		n, client, err := conn.ReadFrom(buf)
+		if err != nil {
+			if node.context().Err() != nil {
+				return
+			}
+			log.Error().Err(err).Msg("Error reading DNS query")
+			continue
+		}
+		node.spawn("dns_query", func() {
+			start := time.Now()
+			answer := node.answerDNS(buf[:n], true)
+			if _, err := conn.WriteTo(answer, client); err != nil {
+				log.Error().Err(err).Msg("Error writing DNS answer")
+			}
+			node.logQuery(client, "udp", buf[:n], answer, start)
+		})
+	}
+}
+
+func (node *Node) serveDNSTCP(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if node.context().Err() != nil {
+				return
+			}
+			log.Error().Err(err).Msg("Error accepting DNS connection")
+			continue
+		}
+		node.spawn("dns_query", func() {
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(DNS_TCP_TIMEOUT))
+			// Over TCP, every message is prefixed with its length.
+			var length uint16
+			if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+				return
+			}
+			query := make([]byte, length)
+			if _, err := io.ReadFull(conn, query); err != nil {
+				return
+			}
+			start := time.Now()
+			answer := node.answerDNS(query, false)
+			conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(answer))))
+			conn.Write(answer)
+			node.logQuery(conn.RemoteAddr(), "tcp", query, answer, start)
+		})
+	}
+}
+
+/*
+Answers a single DNS query in wire format. A response over UDP that is larger than the client
+accepts, 512 bytes or its EDNS0 buffer size, is sent without records and with the TC bit set, so
+that the client retries over TCP.
+*/
+func (node *Node) answerDNS(query []byte, udp bool) []byte {
+	response, _ := node.respondDNS(query, udp, func(question dnsQuestion) dnsAnswer {
+		if zone, ok := node.authoritativeZone(question.Name); ok {
+			return node.answerAuthoritative(zone, question)
+		}
+		return node.answerRecursive(question)
+	})
+	return response
+}
+
+/*
+Builds the response to a DNS query in wire format with the answer of answer to its question, and
+returns it along with its response code. Malformed and unsupported queries are answered without
+calling answer.
+*/
+func (node *Node) respondDNS(query []byte, udp bool, answer func(dnsQuestion) dnsAnswer) ([]byte, uint16) {
+	id, flags, question, err := parseDNSQuery(query)
+	edns, hasEDNS := parseEDNS(query)
+	if err == nil && hasEDNS && edns.Version > 0 {
+		node.incMetric(`dns_queries_total{rcode="badvers"}`, 1)
+		return buildDNSResponse(id, flags, question, dnsAnswer{Rcode: RCODE_BADVERS, EDNS: true}), RCODE_BADVERS
+	}
+	if err != nil {
+		node.incMetric(`dns_queries_total{rcode="formerr"}`, 1)
+		return buildDNSResponse(id, flags, question, dnsAnswer{Rcode: RCODE_FORMERR}), RCODE_FORMERR
+	}
+	if opcode := (flags >> 11) & 0xF; opcode != 0 || question.Class != DNS_CLASS_IN {
+		node.incMetric(`dns_queries_total{rcode="notimp"}`, 1)
+		return buildDNSResponse(id, flags, question, dnsAnswer{Rcode: RCODE_NOTIMP}), RCODE_NOTIMP
+	}
+
+	result := answer(question)
+	node.incMetric(fmt.Sprintf("dns_queries_total{rcode=%q}", rcodeName(result.Rcode)), 1)
+	result.EDNS = hasEDNS
+	response := buildDNSResponse(id, flags, question, result)
+	if udp && len(response) > udpLimit(edns, hasEDNS) {
+		node.incMetric("dns_truncated_total", 1)
+		response = buildDNSResponse(id, flags, question, dnsAnswer{Rcode: result.Rcode, Authoritative: result.Authoritative, EDNS: hasEDNS, Truncated: true})
+	}
+	return response, result.Rcode
+}
+
+/*
+Answers a query for a name outside the authoritative zones, through the ring and legacy DNS. A
+query the ring can not answer within DNS_RESOLVE_TIMEOUT gets a degraded answer with a short TTL,
+or SERVFAIL if there is none.
+*/
+func (node *Node) answerRecursive(question dnsQuestion) dnsAnswer {
+	resolution, err := node.ResolveBefore(question.Name, time.Now().Add(DNS_RESOLVE_TIMEOUT))
+	if errors.Is(err, context.DeadlineExceeded) {
+		log.Debug().Err(err).Msgf("Could not resolve %s in time", question.Name)
+		return dnsAnswer{Rcode: RCODE_SERVFAIL}
+	}
+	if err != nil {
+		log.Debug().Err(err).Msgf("Could not resolve %s", question.Name)
+		return dnsAnswer{Rcode: RCODE_NXDOMAIN}
+	}
+	answers := recordsToRRs(resolution.Records, question.Type)
+	if resolution.Degraded {
+		for i := range answers {
+			answers[i].TTL = DNS_DEGRADED_TTL
+		}
+	}
+	return dnsAnswer{Rcode: RCODE_NOERROR, Answers: answers, Additional: node.debugRRs(resolution.Trace)}
+}
+
+/*
+Writes an answered query to the query log, if one is configured.
+*/
+func (node *Node) logQuery(client net.Addr, protocol string, query, answer []byte, start time.Time) {
+	if node.queryLog == nil {
+		return
+	}
+	_, _, question, _ := parseDNSQuery(query)
+	entry := queryLogEntry{
+		QueryTime:    start,
+		ResponseTime: time.Now(),
+		Client:       client.String(),
+		Protocol:     protocol,
+		Name:         question.Name,
+		Type:         question.Type,
+		Query:        query,
+		Response:     answer,
+		clientAddr:   client,
+	}
+	if len(answer) >= 4 {
+		entry.Rcode = binary.BigEndian.Uint16(answer[2:4]) & 0xF
+	}
+	node.queryLog.Log(entry)
+}
+
+/*
+Returns the textual name of a response code, for metrics and logs.
+*/
+func rcodeName(rcode uint16) string {
+	switch rcode {
+	case RCODE_NOERROR:
+		return "noerror"
+	case RCODE_FORMERR:
+		return "formerr"
+	case RCODE_SERVFAIL:
+		return "servfail"
+	case RCODE_NXDOMAIN:
+		return "nxdomain"
+	case RCODE_NOTIMP:
+		return "notimp"
+	case RCODE_REFUSED:
+		return "refused"
+	case RCODE_BADVERS:
+		return "badvers"
+	}
+	return "other"
+}
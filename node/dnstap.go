@@ -0,0 +1,195 @@
+/*
+Query logging for the DNS listener, either in the standard dnstap format (protobuf messages in a
+Frame Streams file, as written by BIND, Unbound, CoreDNS, ...) so existing DNS analytics tooling can
+ingest it, or as JSON Lines for ad hoc analysis. Each query produces a CLIENT_RESPONSE message that
+carries both the query and the response.
+*/
+package node
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Query log formats.
+const (
+	QUERY_LOG_DNSTAP = "dnstap"
+	QUERY_LOG_JSON   = "json"
+)
+
+// dnstap protocol constants, see dnstap.proto.
+const (
+	dnstapContentType    = "protobuf:dnstap.Dnstap"
+	dnstapTypeMessage    = 1
+	dnstapClientResponse = 6
+	dnstapFamilyInet     = 1
+	dnstapFamilyInet6    = 2
+	dnstapProtocolUDP    = 1
+	dnstapProtocolTCP    = 2
+	fstrmControlStart    = 2
+	fstrmControlStop     = 3
+	fstrmFieldType       = 1
+)
+
+/*
+A single answered query, as logged.
+*/
+type queryLogEntry struct {
+	QueryTime    time.Time `json:"query_time"`
+	ResponseTime time.Time `json:"response_time"`
+	Client       string    `json:"client"`
+	Protocol     string    `json:"protocol"` // udp | tcp
+	Name         string    `json:"name"`
+	Type         uint16    `json:"type"`
+	Rcode        uint16    `json:"rcode"`
+	Query        []byte    `json:"-"`
+	Response     []byte    `json:"-"`
+	clientAddr   net.Addr
+}
+
+/*
+Writes answered queries to a log file in one of the query log formats.
+*/
+type queryLog struct {
+	mu       sync.Mutex
+	file     *os.File
+	writer   *bufio.Writer
+	format   string
+	identity string
+}
+
+/*
+Opens the query log at path, and writes the Frame Streams START frame if it is a dnstap log.
+*/
+func openQueryLog(path, format, identity string) (*queryLog, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, err
+	}
+	ql := &queryLog{file: file, writer: bufio.NewWriter(file), format: format, identity: identity}
+	if format == QUERY_LOG_DNSTAP {
+		ql.writeControl(fstrmControlStart, []byte(dnstapContentType))
+	}
+	return ql, nil
+}
+
+/*
+Logs a single answered query. A nil query log drops the entry.
+*/
+func (ql *queryLog) Log(entry queryLogEntry) {
+	if ql == nil {
+		return
+	}
+	ql.mu.Lock()
+	defer ql.mu.Unlock()
+	var err error
+	if ql.format == QUERY_LOG_JSON {
+		err = json.NewEncoder(ql.writer).Encode(entry)
+	} else {
+		frame := ql.dnstapFrame(entry)
+		ql.writer.Write(binary.BigEndian.AppendUint32(nil, uint32(len(frame))))
+		_, err = ql.writer.Write(frame)
+	}
+	if err == nil {
+		err = ql.writer.Flush()
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Error writing query log")
+	}
+}
+
+/*
+Writes the Frame Streams STOP frame if needed, and closes the query log.
+*/
+func (ql *queryLog) Close() {
+	if ql == nil {
+		return
+	}
+	ql.mu.Lock()
+	defer ql.mu.Unlock()
+	if ql.format == QUERY_LOG_DNSTAP {
+		ql.writeControl(fstrmControlStop, nil)
+	}
+	ql.writer.Flush()
+	ql.file.Close()
+}
+
+/*
+Writes a Frame Streams control frame: an escape (zero length), the length of the control frame,
+the control type, and optionally a content type field.
+*/
+func (ql *queryLog) writeControl(controlType uint32, contentType []byte) {
+	control := binary.BigEndian.AppendUint32(nil, controlType)
+	if contentType != nil {
+		control = binary.BigEndian.AppendUint32(control, fstrmFieldType)
+		control = binary.BigEndian.AppendUint32(control, uint32(len(contentType)))
+		control = append(control, contentType...)
+	}
+	ql.writer.Write(binary.BigEndian.AppendUint32(nil, 0))
+	ql.writer.Write(binary.BigEndian.AppendUint32(nil, uint32(len(control))))
+	ql.writer.Write(control)
+}
+
+/*
+Encodes entry as a dnstap.Dnstap protobuf message.
+*/
+func (ql *queryLog) dnstapFrame(entry queryLogEntry) []byte {
+	msg := pbVarint(nil, 1, dnstapClientResponse)
+	var ip net.IP
+	var port int
+	switch addr := entry.clientAddr.(type) {
+	case *net.UDPAddr:
+		ip, port = addr.IP, addr.Port
+	case *net.TCPAddr:
+		ip, port = addr.IP, addr.Port
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		msg = pbVarint(msg, 2, dnstapFamilyInet)
+		ip = ip4
+	} else {
+		msg = pbVarint(msg, 2, dnstapFamilyInet6)
+	}
+	if entry.Protocol == "tcp" {
+		msg = pbVarint(msg, 3, dnstapProtocolTCP)
+	} else {
+		msg = pbVarint(msg, 3, dnstapProtocolUDP)
+	}
+	msg = pbBytes(msg, 4, ip)
+	msg = pbVarint(msg, 6, uint64(port))
+	msg = pbVarint(msg, 8, uint64(entry.QueryTime.Unix()))
+	msg = pbFixed32(msg, 9, uint32(entry.QueryTime.Nanosecond()))
+	msg = pbBytes(msg, 10, entry.Query)
+	msg = pbVarint(msg, 12, uint64(entry.ResponseTime.Unix()))
+	msg = pbFixed32(msg, 13, uint32(entry.ResponseTime.Nanosecond()))
+	msg = pbBytes(msg, 14, entry.Response)
+
+	frame := pbBytes(nil, 1, []byte(ql.identity))
+	frame = pbBytes(frame, 2, []byte("dns-chord"))
+	frame = pbBytes(frame, 14, msg)
+	return pbVarint(frame, 15, dnstapTypeMessage)
+}
+
+// Minimal protobuf encoding helpers, for the few wire types dnstap needs.
+
+func pbVarint(buf []byte, field int, value uint64) []byte {
+	buf = binary.AppendUvarint(buf, uint64(field<<3|0))
+	return binary.AppendUvarint(buf, value)
+}
+
+func pbFixed32(buf []byte, field int, value uint32) []byte {
+	buf = binary.AppendUvarint(buf, uint64(field<<3|5))
+	return binary.LittleEndian.AppendUint32(buf, value)
+}
+
+func pbBytes(buf []byte, field int, value []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(field<<3|2))
+	buf = binary.AppendUvarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
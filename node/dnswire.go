@@ -0,0 +1,272 @@
+/*
+Minimal encoder and decoder for the DNS wire format (RFC 1035), covering what the DNS listener
+needs: a single question per query, and answers built from the records stored in the ring.
+*/
+package node
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// DNS record types and classes.
+const (
+	DNS_TYPE_A    = 1
+	DNS_TYPE_NS   = 2
+	DNS_TYPE_SOA  = 6
+	DNS_TYPE_TXT  = 16
+	DNS_TYPE_AAAA = 28
+	DNS_TYPE_OPT  = 41
+	DNS_TYPE_ANY  = 255
+	DNS_CLASS_IN  = 1
+)
+
+// DNS response codes.
+const (
+	RCODE_NOERROR  = 0
+	RCODE_FORMERR  = 1
+	RCODE_SERVFAIL = 2
+	RCODE_NXDOMAIN = 3
+	RCODE_NOTIMP   = 4
+	RCODE_REFUSED  = 5
+	RCODE_BADVERS  = 16 // Extended response code, carried partly in the OPT record.
+)
+
+// Constants
+const (
+	DNS_HEADER_SIZE  = 12
+	DNS_DEFAULT_TTL  = 300  // TTL of answers, in seconds, for record sets that do not declare a max-age.
+	DNS_UDP_MIN_SIZE = 512  // Size of a UDP response to a client without EDNS0 (RFC 1035).
+	DNS_EDNS_SIZE    = 1232 // UDP payload size this listener advertises, and the most it sends, so that responses are not fragmented.
+	DNS_FLAG_TC      = 1 << 9
+)
+
+var errMalformedQuery = errors.New("malformed DNS query")
+
+/*
+The question section of a DNS query.
+*/
+type dnsQuestion struct {
+	Name  string // Queried name, without the trailing dot
+	Type  uint16
+	Class uint16
+}
+
+/*
+A resource record to put in a response.
+*/
+type dnsRR struct {
+	Name string // Owner name. Empty for the name in the question.
+	Type uint16
+	TTL  uint32
+	Data []byte
+}
+
+/*
+The answer to a query, before it is encoded.
+*/
+type dnsAnswer struct {
+	Rcode         uint16
+	Authoritative bool    // Sets the AA bit
+	Answers       []dnsRR // Answer section
+	Authority     []dnsRR // Authority section, e.g. the SOA of a negative answer
+	Additional    []dnsRR // Additional section, e.g. the debug record of dnsdebug.go
+	EDNS          bool    // Adds an OPT record to the additional section, for a query that had one
+	Truncated     bool    // Sets the TC bit, for a response that did not fit into a UDP datagram
+}
+
+/*
+The EDNS0 options of a query (RFC 6891), from its OPT record.
+*/
+type dnsEDNS struct {
+	UDPSize uint16 // Largest UDP response the client accepts
+	Version uint8
+}
+
+/*
+Parses the header and the first question of a DNS query.
+*/
+func parseDNSQuery(msg []byte) (uint16, uint16, dnsQuestion, error) {
+	if len(msg) < DNS_HEADER_SIZE {
+		return 0, 0, dnsQuestion{}, errMalformedQuery
+	}
+	id := binary.BigEndian.Uint16(msg[0:2])
+	flags := binary.BigEndian.Uint16(msg[2:4])
+	if binary.BigEndian.Uint16(msg[4:6]) == 0 {
+		return id, flags, dnsQuestion{}, errMalformedQuery
+	}
+
+	labels := []string{}
+	offset := DNS_HEADER_SIZE
+	for {
+		if offset >= len(msg) {
+			return id, flags, dnsQuestion{}, errMalformedQuery
+		}
+		length := int(msg[offset])
+		offset++
+		if length == 0 {
+			break
+		}
+		// Compression pointers never occur in the question of a well-formed query.
+		if length > 63 || offset+length > len(msg) {
+			return id, flags, dnsQuestion{}, errMalformedQuery
+		}
+		labels = append(labels, string(msg[offset:offset+length]))
+		offset += length
+	}
+	if offset+4 > len(msg) {
+		return id, flags, dnsQuestion{}, errMalformedQuery
+	}
+	question := dnsQuestion{
+		Name:  strings.Join(labels, "."),
+		Type:  binary.BigEndian.Uint16(msg[offset : offset+2]),
+		Class: binary.BigEndian.Uint16(msg[offset+2 : offset+4]),
+	}
+	return id, flags, question, nil
+}
+
+/*
+Returns the name and type of the first question of a DNS query, for servers that embed the ring,
+see the chorddns package.
+*/
+func ParseDNSQuestion(query []byte) (string, uint16, error) {
+	_, _, question, err := parseDNSQuery(query)
+	return question.Name, question.Type, err
+}
+
+/*
+Returns the EDNS0 options of a query, or false if it has no OPT record. The question is skipped
+with parseDNSQuery's rules; a query carries no answer and authority records, so the OPT record is
+the first additional record.
+*/
+func parseEDNS(msg []byte) (dnsEDNS, bool) {
+	if len(msg) < DNS_HEADER_SIZE || binary.BigEndian.Uint16(msg[10:12]) == 0 {
+		return dnsEDNS{}, false
+	}
+	offset := DNS_HEADER_SIZE
+	for offset < len(msg) && msg[offset] != 0 {
+		offset += 1 + int(msg[offset])
+	}
+	// Root label, question type and class, then the OPT record: root name, type, class, TTL.
+	offset += 1 + 4
+	if offset+11 > len(msg) || msg[offset] != 0 || binary.BigEndian.Uint16(msg[offset+1:offset+3]) != DNS_TYPE_OPT {
+		return dnsEDNS{}, false
+	}
+	return dnsEDNS{
+		UDPSize: binary.BigEndian.Uint16(msg[offset+3 : offset+5]),
+		Version: msg[offset+6],
+	}, true
+}
+
+/*
+Returns the largest UDP response a client with the given EDNS0 options accepts.
+*/
+func udpLimit(edns dnsEDNS, ok bool) int {
+	if !ok {
+		return DNS_UDP_MIN_SIZE
+	}
+	return min(max(int(edns.UDPSize), DNS_UDP_MIN_SIZE), DNS_EDNS_SIZE)
+}
+
+/*
+Builds a response to a query with the given id, flags and question.
+*/
+func buildDNSResponse(id, flags uint16, question dnsQuestion, answer dnsAnswer) []byte {
+	// QR=1, keep opcode and RD from the query, RA=1
+	respFlags := uint16(1<<15) | (flags & 0x7900) | uint16(1<<7) | (answer.Rcode & 0xF)
+	if answer.Authoritative {
+		respFlags |= 1 << 10
+	}
+	if answer.Truncated {
+		respFlags |= DNS_FLAG_TC
+	}
+	msg := make([]byte, DNS_HEADER_SIZE, 512)
+	binary.BigEndian.PutUint16(msg[0:2], id)
+	binary.BigEndian.PutUint16(msg[2:4], respFlags)
+	binary.BigEndian.PutUint16(msg[4:6], 1)
+	binary.BigEndian.PutUint16(msg[6:8], uint16(len(answer.Answers)))
+	binary.BigEndian.PutUint16(msg[8:10], uint16(len(answer.Authority)))
+	additional := len(answer.Additional)
+	if answer.EDNS {
+		additional++
+	}
+	binary.BigEndian.PutUint16(msg[10:12], uint16(additional))
+
+	msg = appendDNSName(msg, question.Name)
+	msg = binary.BigEndian.AppendUint16(msg, question.Type)
+	msg = binary.BigEndian.AppendUint16(msg, question.Class)
+	for _, rr := range append(append(answer.Answers, answer.Authority...), answer.Additional...) {
+		if rr.Name == "" {
+			msg = append(msg, 0xC0, DNS_HEADER_SIZE) // pointer to the name in the question
+		} else {
+			msg = appendDNSName(msg, rr.Name)
+		}
+		msg = binary.BigEndian.AppendUint16(msg, rr.Type)
+		msg = binary.BigEndian.AppendUint16(msg, DNS_CLASS_IN)
+		msg = binary.BigEndian.AppendUint32(msg, rr.TTL)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(rr.Data)))
+		msg = append(msg, rr.Data...)
+	}
+	if answer.EDNS {
+		// OPT: root name, advertised UDP size as class, extended rcode and version 0 as TTL, no options.
+		msg = append(msg, 0)
+		msg = binary.BigEndian.AppendUint16(msg, DNS_TYPE_OPT)
+		msg = binary.BigEndian.AppendUint16(msg, DNS_EDNS_SIZE)
+		msg = binary.BigEndian.AppendUint32(msg, uint32(answer.Rcode>>4)<<24)
+		msg = binary.BigEndian.AppendUint16(msg, 0)
+	}
+	return msg
+}
+
+/*
+Appends name in wire format (length prefixed labels, terminated by the root label).
+*/
+func appendDNSName(msg []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	return append(msg, 0)
+}
+
+/*
+Converts stored records into answers matching the query type. Control records, and records that do
+not validate, are left out. Records without a TTL of their own get that of their record set.
+*/
+func recordsToRRs(records []Record, qtype uint16) []dnsRR {
+	answers := []dnsRR{}
+	ttl := recordTTL(records)
+	for _, record := range records {
+		record = decompressRecord(record)
+		if isControlType(record.Type) || validateRecord(record) != nil {
+			continue
+		}
+		if qtype != DNS_TYPE_ANY && qtype != record.Type {
+			continue
+		}
+		rr := dnsRR{Type: record.Type, TTL: record.TTL, Data: record.Rdata}
+		if rr.TTL == 0 {
+			rr.TTL = ttl
+		}
+		answers = append(answers, rr)
+	}
+	return answers
+}
+
+/*
+Encodes a TXT value as a sequence of character strings of at most 255 bytes each.
+*/
+func txtData(value string) []byte {
+	data := []byte{}
+	for len(value) > 255 {
+		data = append(data, 255)
+		data = append(data, value[:255]...)
+		value = value[255:]
+	}
+	data = append(data, byte(len(value)))
+	return append(data, value...)
+}
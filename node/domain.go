@@ -0,0 +1,86 @@
+/*
+Validation and normalization of the names that are hashed into the ring. Names are compared
+case-insensitively and with or without a trailing dot in DNS, so they are brought into a single
+canonical form before hashing: "WWW.Example.com." and "example.com" must land on the same key.
+*/
+package node
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Constants
+const (
+	MAX_LABEL_LENGTH = 63  // Longest label allowed by RFC 1035.
+	MAX_NAME_LENGTH  = 253 // Longest name allowed by RFC 1035, in presentation format without the trailing dot.
+)
+
+var errInvalidName = errors.New("invalid domain name")
+
+/*
+Returns the canonical form of a domain name: lowercase, without the trailing dot and "www." prefix,
+with Unicode labels converted to punycode. Returns errInvalidName for names that can not be valid
+host names, e.g. with empty or overlong labels or characters other than letters, digits, '-' and '_'.
+*/
+func NormalizeName(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	name = strings.TrimSuffix(name, ".")
+	name = strings.TrimPrefix(name, "www.")
+	if name == "" {
+		return "", fmt.Errorf("%w: empty name", errInvalidName)
+	}
+
+	labels := strings.Split(name, ".")
+	for i, label := range labels {
+		ascii, err := labelToASCII(label)
+		if err != nil {
+			return "", fmt.Errorf("%w: %q: %v", errInvalidName, label, err)
+		}
+		if err := validateLabel(ascii); err != nil {
+			return "", fmt.Errorf("%w: %q: %v", errInvalidName, label, err)
+		}
+		labels[i] = ascii
+	}
+	name = strings.Join(labels, ".")
+	if len(name) > MAX_NAME_LENGTH {
+		return "", fmt.Errorf("%w: longer than %d characters", errInvalidName, MAX_NAME_LENGTH)
+	}
+	return name, nil
+}
+
+/*
+Checks a single ASCII label against the host name rules, allowing '_' for service names.
+*/
+func validateLabel(label string) error {
+	if label == "" {
+		return errors.New("empty label")
+	}
+	if len(label) > MAX_LABEL_LENGTH {
+		return fmt.Errorf("longer than %d characters", MAX_LABEL_LENGTH)
+	}
+	if label[0] == '-' || label[len(label)-1] == '-' {
+		return errors.New("starts or ends with '-'")
+	}
+	for _, c := range label {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return fmt.Errorf("invalid character %q", c)
+		}
+	}
+	return nil
+}
+
+/*
+Returns name for display, with punycode labels converted back to Unicode. Labels that do not decode
+are left in their ASCII form.
+*/
+func DisplayName(name string) string {
+	labels := strings.Split(name, ".")
+	for i, label := range labels {
+		if decoded, err := labelToUnicode(label); err == nil {
+			labels[i] = decoded
+		}
+	}
+	return strings.Join(labels, ".")
+}
@@ -0,0 +1,86 @@
+/*
+Graceful drain of the RPC server on shutdown. The node first stops accepting connections, and
+answers every RPC that still arrives on an open connection with SHUTTING_DOWN, hinting at its
+successor, while the RPCs already in flight are given RPC_DRAIN_TIMEOUT to finish. Peers treat
+SHUTTING_DOWN like BUSY and retry at the hint straight away, rather than waiting for a timeout and
+for their failure detection to catch up.
+*/
+package node
+
+import (
+	"time"
+
+	"github.com/fauzxan/dns-chord/v2/message"
+	"github.com/rs/zerolog/log"
+)
+
+// Constants
+const (
+	RPC_DRAIN_TIMEOUT       = 3 * time.Second       // Upper bound on waiting for in-flight RPCs on shutdown.
+	RPC_DRAIN_POLL_INTERVAL = 10 * time.Millisecond // How often the in-flight RPCs are counted while draining.
+)
+
+/*
+Stops accepting RPC connections and waits up to RPC_DRAIN_TIMEOUT for the RPCs in flight to finish.
+RPCs arriving in the meantime are answered with SHUTTING_DOWN.
+*/
+func (node *Node) drainRPCs() {
+	node.context()
+	node.life.mu.Lock()
+	node.life.closing = true
+	if node.life.listener != nil {
+		node.life.listener.Close()
+	}
+	node.life.mu.Unlock()
+
+	deadline := time.Now().Add(RPC_DRAIN_TIMEOUT)
+	for node.inflightRPCs() > 0 {
+		if time.Now().After(deadline) {
+			log.Warn().Msgf("Shutting down with %d RPC(s) still in flight", node.inflightRPCs())
+			return
+		}
+		time.Sleep(RPC_DRAIN_POLL_INTERVAL)
+	}
+	log.Info().Msg("All in-flight RPCs have finished")
+}
+
+/*
+Returns true once the node has started draining its RPC server.
+*/
+func (node *Node) shuttingDown() bool {
+	node.context()
+	node.life.mu.Lock()
+	defer node.life.mu.Unlock()
+	return node.life.closing
+}
+
+/*
+Fills in a SHUTTING_DOWN reply, with this node's successor as the hint of where to go instead.
+*/
+func (node *Node) shuttingDownReply(reply *message.ResponseMessage) {
+	node.incMetric("shutting_down_replies_total", 1)
+	reply.Type = SHUTTING_DOWN
+	successor := node.successor()
+	reply.Nodeid = successor.Nodeid
+	reply.IP = successor.IP
+}
+
+/*
+Returns true if the reply asks the requester to try the node in its hint instead.
+*/
+func redirectable(reply message.ResponseMessage) bool {
+	return reply.Type == BUSY || reply.Type == SHUTTING_DOWN
+}
+
+/*
+Sends msg to IP, following the hints of nodes that are shutting down, at most MAX_BUSY_RETRIES times.
+*/
+func (node *Node) callAvoidingShutdown(msg message.RequestMessage, IP string) message.ResponseMessage {
+	reply := node.CallRPC(msg, IP)
+	for retries := 0; reply.Type == SHUTTING_DOWN && reply.IP != "" && retries < MAX_BUSY_RETRIES; retries++ {
+		log.Debug().Msgf("IP: %s is shutting down, retrying %s at Nodeid: %d IP: %s", IP, msg.Type, reply.Nodeid, reply.IP)
+		IP = reply.IP
+		reply = node.CallRPC(msg, IP)
+	}
+	return reply
+}
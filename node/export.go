@@ -0,0 +1,413 @@
+/*
+Export and import of record sets in JSON Lines, one record set per line:
+
+	{"name":"example.com","key":4004493312,"records":["93.184.216.34","CACHE max-age=60"]}
+
+The format is independent of how nodes store records: records are always uncompressed, and the key
+is only there for record sets whose name is unknown. It can move records between rings, seed a ring
+from scripts, and be analyzed with standard tooling such as jq.
+*/
+package node
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fauzxan/dns-chord/v2/hashing"
+	"github.com/fauzxan/dns-chord/v2/message"
+	"github.com/rs/zerolog/log"
+)
+
+// Constants
+const (
+	EXPORT_FORMAT_JSONL = "jsonl" // The only export format so far, see hosts.go for another import format.
+	IMPORT_BATCH        = 100     // Record sets sent to an owner in one PUT.
+	IMPORT_MAX_LINE     = 1 << 20 // Longest line accepted by an import.
+)
+
+/*
+A line of an export.
+*/
+type ExportedRecords struct {
+	Name    string   `json:"name,omitempty"`
+	Key     uint64   `json:"key"`
+	Records []string `json:"records"` // In text form, see ParseRecordText
+}
+
+/*
+Returns the record sets this node is responsible for, and their names. Replicas are left out, so
+that every record set of a ring is exported once.
+*/
+func (node *Node) localExport() (map[uint64][]Record, map[uint64]string) {
+	node.storageMu.RLock()
+	defer node.storageMu.RUnlock()
+	payload := make(map[uint64][]Record, len(node.HashIPStorage[node.Nodeid]))
+	names := make(map[uint64]string)
+	for key, records := range node.HashIPStorage[node.Nodeid] {
+		payload[key] = records
+		if name, ok := node.names[key]; ok {
+			names[key] = name
+		}
+	}
+	return payload, names
+}
+
+/*
+Writes the record sets of payload as JSON Lines, sorted by name and key. Returns the number of
+lines written.
+*/
+func writeExport(w io.Writer, payload map[uint64][]Record, names map[uint64]string) (int, error) {
+	lines := make([]ExportedRecords, 0, len(payload))
+	for key, records := range payload {
+		lines = append(lines, ExportedRecords{Name: names[key], Key: key, Records: RecordsText(records)})
+	}
+	sort.Slice(lines, func(i, j int) bool {
+		if lines[i].Name != lines[j].Name {
+			return lines[i].Name < lines[j].Name
+		}
+		return lines[i].Key < lines[j].Key
+	})
+	encoder := json.NewEncoder(w)
+	for i, line := range lines {
+		if err := encoder.Encode(line); err != nil {
+			return i, err
+		}
+	}
+	return len(lines), nil
+}
+
+/*
+Exports the record sets this node is responsible for, or with ring set, those of every node of
+the ring, in format. Returns the number of record sets exported.
+*/
+func (node *Node) Export(w io.Writer, format string, ring bool) (int, error) {
+	if format != EXPORT_FORMAT_JSONL {
+		return 0, fmt.Errorf("unknown export format %q", format)
+	}
+	payload, names := node.localExport()
+	if ring {
+		walk, ok := node.walkRing()
+		if !ok {
+			return 0, fmt.Errorf("%w: the ring walk broke off after %d nodes", ErrUnreachable, len(walk))
+		}
+		payload, names = node.collectExport(walk)
+	}
+	return writeExport(w, payload, names)
+}
+
+/*
+Collects the record sets the nodes of walk are responsible for.
+*/
+func (node *Node) collectExport(walk []Pointer) (map[uint64][]Record, map[uint64]string) {
+	payload := make(map[uint64][]Record)
+	names := make(map[uint64]string)
+	for _, pointer := range walk {
+		part, partNames := node.localExport()
+		if pointer.IP != node.IP {
+			reply := node.CallRPC(message.RequestMessage{Type: EXPORT}, pointer.IP)
+			if reply.Type != ACK {
+				log.Warn().Msgf("Nodeid: %d IP: %s did not export its records", pointer.Nodeid, pointer.IP)
+				continue
+			}
+			part, partNames = reply.Payload, reply.Names
+		}
+		for key, records := range part {
+			payload[key] = records
+		}
+		for key, name := range partNames {
+			names[key] = name
+		}
+	}
+	return payload, names
+}
+
+/*
+Exports the record sets of the ring, as seen from helper, for a client, see client.go.
+*/
+func (node *Node) ExportVia(helper string, w io.Writer, format string) (int, error) {
+	if format != EXPORT_FORMAT_JSONL {
+		return 0, fmt.Errorf("unknown export format %q", format)
+	}
+	walk, err := node.clientWalk(helper)
+	if err != nil {
+		return 0, err
+	}
+	payload, names := node.collectExport(walk)
+	return writeExport(w, payload, names)
+}
+
+/*
+Returns the nodes of the ring starting at the successor of helper, found by following successor
+pointers until one comes up again.
+*/
+func (node *Node) clientWalk(helper string) ([]Pointer, error) {
+	reply, err := node.clientCall(message.RequestMessage{Type: GET_SUCCESSOR}, helper)
+	if err != nil {
+		return nil, err
+	}
+	walk := []Pointer{}
+	seen := make(map[string]bool)
+	for current := (Pointer{Nodeid: reply.Nodeid, IP: reply.IP}); current.IP != "" && !seen[current.IP] && len(walk) < RING_WALK_MAX_NODES; {
+		seen[current.IP] = true
+		walk = append(walk, current)
+		if reply, err = node.clientCall(message.RequestMessage{Type: GET_SUCCESSOR}, current.IP); err != nil {
+			return nil, err
+		}
+		current = Pointer{Nodeid: reply.Nodeid, IP: reply.IP}
+	}
+	return walk, nil
+}
+
+/*
+Imports record sets in format, JSON Lines or hosts file syntax (see hosts.go), replacing the
+records of every name imported. Record sets are sent to their owners in batches, see
+importRecords. Returns the number of record sets imported.
+*/
+func (node *Node) Import(r io.Reader, format string) (int, error) {
+	progress := node.StartProgress("import", 0)
+	defer progress.Finish()
+	return node.importRecords(progress, r, format, func(key uint64) (Pointer, error) {
+		owner, _ := node.FindSuccessor(key, 0)
+		if (owner == Pointer{}) {
+			return owner, fmt.Errorf("%w: no owner found for key %d", ErrUnreachable, key)
+		}
+		return owner, nil
+	})
+}
+
+/*
+Imports record sets into the ring through helper, for a client, see client.go.
+*/
+func (node *Node) ImportVia(helper string, r io.Reader, format string) (int, error) {
+	return node.importRecords(nil, r, format, func(key uint64) (Pointer, error) {
+		return node.clientOwner(helper, key)
+	})
+}
+
+/*
+A parsed line of an import.
+*/
+type importLine struct {
+	key     uint64
+	name    string
+	records []Record
+}
+
+/*
+Spaces out the PUTs of an import to every node, so that no node receives more than rate record
+sets per second on average. A rate of 0 does not limit them.
+*/
+type importPacer struct {
+	mu   sync.Mutex
+	rate float64
+	next map[string]time.Time
+}
+
+/*
+Waits until count record sets may be sent to IP.
+*/
+func (pacer *importPacer) wait(IP string, count int) {
+	if pacer.rate <= 0 {
+		return
+	}
+	pacer.mu.Lock()
+	start := time.Now()
+	if next := pacer.next[IP]; next.After(start) {
+		start = next
+	}
+	pacer.next[IP] = start.Add(time.Duration(float64(count) / pacer.rate * float64(time.Second)))
+	pacer.mu.Unlock()
+	time.Sleep(time.Until(start))
+}
+
+/*
+Reads the lines of an import, and sends them to the owners found by owner. IMPORT_WORKERS workers
+look the owners up concurrently. Every line goes to the worker of its key, so that of several lines
+for one name the last one wins. Each owner has a sender of its own, which sends it full batches in
+order, paced to IMPORT_RATE record sets per second. The import stops early if progress, which may
+be nil, is cancelled.
+*/
+func (node *Node) importRecords(progress *Progress, r io.Reader, format string, owner func(uint64) (Pointer, error)) (int, error) {
+	read := readImport
+	switch format {
+	case EXPORT_FORMAT_JSONL:
+	case EXPORT_FORMAT_HOSTS:
+		read = readHosts
+	default:
+		return 0, fmt.Errorf("unknown import format %q", format)
+	}
+	workers := max(1, node.Config.ImportWorkers)
+	pacer := &importPacer{rate: node.Config.ImportRate, next: make(map[string]time.Time)}
+	var imported atomic.Int64
+	var failOnce sync.Once
+	var failure error
+	stop := make(chan struct{})
+	fail := func(err error) {
+		failOnce.Do(func() {
+			failure = err
+			close(stop)
+		})
+	}
+	send := func(target Pointer, msg *message.RequestMessage) error {
+		pacer.wait(target.IP, len(msg.Payload))
+		reply, err := node.clientCall(*msg, target.IP)
+		if err != nil {
+			return err
+		}
+		if reply.Type == DENIED {
+			return ErrAccessDenied
+		}
+		if reply.Type != ACK && reply.Type != REDIRECT {
+			return fmt.Errorf("Nodeid: %d IP: %s did not accept %d record set(s)", target.Nodeid, target.IP, len(msg.Payload))
+		}
+		imported.Add(int64(len(msg.Payload)))
+		if progress != nil {
+			progress.Add(len(msg.Payload))
+		}
+		return nil
+	}
+	if progress != nil {
+		go func() {
+			select {
+			case <-progress.Context().Done():
+				fail(fmt.Errorf("import: %w", context.Canceled))
+			case <-stop:
+			}
+		}()
+		defer fail(nil)
+	}
+
+	var mu sync.Mutex // Guards batches and senders
+	batches := make(map[Pointer]*message.RequestMessage)
+	senders := make(map[Pointer]chan *message.RequestMessage)
+	var sending sync.WaitGroup
+	enqueue := func(target Pointer, msg *message.RequestMessage) {
+		queue, ok := senders[target]
+		if !ok {
+			queue = make(chan *message.RequestMessage, workers)
+			senders[target] = queue
+			sending.Add(1)
+			go func() {
+				defer sending.Done()
+				for msg := range queue {
+					select {
+					case <-stop:
+						continue
+					default:
+					}
+					if err := send(target, msg); err != nil {
+						fail(err)
+					}
+				}
+			}()
+		}
+		queue <- msg
+	}
+
+	queues := make([]chan importLine, workers)
+	var routing sync.WaitGroup
+	for i := range queues {
+		queue := make(chan importLine, IMPORT_BATCH)
+		queues[i] = queue
+		routing.Add(1)
+		go func() {
+			defer routing.Done()
+			for line := range queue {
+				select {
+				case <-stop:
+					continue
+				default:
+				}
+				target, err := owner(line.key)
+				if err != nil {
+					fail(err)
+					continue
+				}
+				mu.Lock()
+				msg, ok := batches[target]
+				if !ok {
+					msg = &message.RequestMessage{Type: PUT, TargetId: target.Nodeid, Payload: make(map[uint64][]Record), Names: make(map[uint64]string)}
+					batches[target] = msg
+				}
+				msg.Payload[line.key] = compressRecords(line.records)
+				if line.name != "" {
+					msg.Names[line.key] = line.name
+				}
+				if len(msg.Payload) >= IMPORT_BATCH {
+					delete(batches, target)
+					enqueue(target, msg)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	err := read(r, func(line importLine) bool {
+		select {
+		case queues[line.key%uint64(workers)] <- line:
+			return true
+		case <-stop:
+			return false
+		}
+	})
+	for _, queue := range queues {
+		close(queue)
+	}
+	routing.Wait()
+	mu.Lock()
+	for target, msg := range batches {
+		enqueue(target, msg)
+	}
+	for _, queue := range senders {
+		close(queue)
+	}
+	mu.Unlock()
+	sending.Wait()
+	if err == nil {
+		err = failure
+	}
+	return int(imported.Load()), err
+}
+
+/*
+Parses the lines of an import from r, and passes them to accept until it returns false.
+*/
+func readImport(r io.Reader, accept func(importLine) bool) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), IMPORT_MAX_LINE)
+	for number := 1; scanner.Scan(); number++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var line ExportedRecords
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return fmt.Errorf("line %d: %v", number, err)
+		}
+		key := line.Key
+		if line.Name != "" {
+			name, err := NormalizeName(line.Name)
+			if err != nil {
+				return fmt.Errorf("line %d: %v", number, err)
+			}
+			line.Name, key = name, hashing.Hash(name)
+		}
+		if len(line.Records) == 0 {
+			return fmt.Errorf("line %d: no records", number)
+		}
+		records, err := ParseRecordsText(line.Records)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", number, err)
+		}
+		if !accept(importLine{key: key, name: line.Name, records: records}) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
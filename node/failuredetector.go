@@ -0,0 +1,191 @@
+/*
+Failure detection of the successor and the predecessor. A single unanswered ping used to be enough
+for a node to drop its predecessor or skip its successor, which misfires on a lost packet or a
+peer that is busy for a moment. Instead, every ping of check predecessor, every stabilize call, and
+every liveness check of a successor list entry is a heartbeat of the peer it goes to, answered or
+missed, and a peer is declared failed only once it missed FAILURE_MISSES heartbeats in a row
+(default 3, 1 for the old behaviour). Heartbeats time out after FAILURE_PING_TIMEOUT rather than
+the full CALL_TIMEOUT, if it is set. A peer that says it is shutting down is failed at once.
+
+Optionally, FAILURE_PHI sets a threshold on the peer's phi-accrual suspicion level: the
+improbability, -log10 of the probability, that a reply is still to come after the time since the
+last one, given the mean and standard deviation of the intervals between its recent replies. A
+peer that missed a heartbeat and is above the threshold is declared failed before FAILURE_MISSES,
+so that a peer that used to reply regularly is replaced sooner than one that never did. 0 leaves
+the level out. The state of every peer is served at /peers/health, and the level is exported as
+dns_chord_peer_phi{ip}.
+*/
+package node
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Constants
+const (
+	DEFAULT_FAILURE_MISSES    = 3                      // FAILURE_MISSES if not set.
+	FAILURE_WINDOW            = 100                    // Intervals between replies kept per peer for its suspicion level.
+	FAILURE_MIN_SAMPLES       = 5                      // Intervals needed before the suspicion level of a peer is computed.
+	FAILURE_MIN_STD_DEVIATION = 100 * time.Millisecond // Least standard deviation assumed, so that regular peers are not suspected at once.
+	FAILURE_MAX_PHI           = 100.0                  // Suspicion level of a peer that can no longer be told from a failed one.
+	FAILURE_FORGET            = 10 * time.Minute       // Time after which the state of a peer no longer sent heartbeats is dropped.
+)
+
+/*
+Heartbeats of a single peer.
+*/
+type PeerHealth struct {
+	IP        string          `json:"ip"`
+	Misses    int             `json:"misses"`     // Heartbeats missed in a row
+	LastReply time.Time       `json:"last_reply"` // When the peer last answered, zero if it never did
+	LastSent  time.Time       `json:"last_sent"`  // When the last heartbeat was sent
+	Phi       float64         `json:"phi"`        // Suspicion level, see the top of this file
+	Failed    bool            `json:"failed"`     // Whether the peer is declared failed
+	intervals []time.Duration // Intervals between recent replies
+}
+
+/*
+Heartbeats of every peer, keyed by IP.
+*/
+type failureDetector struct {
+	mu    sync.Mutex
+	peers map[string]*PeerHealth
+}
+
+/*
+Records a heartbeat sent to IP, answered if alive, and returns whether the peer is declared failed.
+*/
+func (node *Node) heartbeat(IP string, alive bool) bool {
+	node.detector.mu.Lock()
+	defer node.detector.mu.Unlock()
+	if node.detector.peers == nil {
+		node.detector.peers = make(map[string]*PeerHealth)
+	}
+	now := time.Now()
+	for ip, peer := range node.detector.peers {
+		if now.Sub(peer.LastSent) > FAILURE_FORGET {
+			delete(node.detector.peers, ip)
+		}
+	}
+	peer := node.detector.peers[IP]
+	if peer == nil {
+		peer = &PeerHealth{IP: IP}
+		node.detector.peers[IP] = peer
+	}
+	peer.LastSent = now
+	if alive {
+		if !peer.LastReply.IsZero() {
+			peer.intervals = append(peer.intervals, now.Sub(peer.LastReply))
+			if len(peer.intervals) > FAILURE_WINDOW {
+				peer.intervals = peer.intervals[1:]
+			}
+		}
+		peer.LastReply = now
+		peer.Misses = 0
+		return false
+	}
+	wasFailed := node.failed(peer, now)
+	peer.Misses++
+	node.incMetric("heartbeats_missed_total", 1)
+	failed := node.failed(peer, now)
+	if failed && !wasFailed {
+		node.incMetric("peers_declared_failed_total", 1)
+	}
+	return failed
+}
+
+/*
+Returns whether peer is declared failed at now, see the top of this file.
+*/
+func (node *Node) failed(peer *PeerHealth, now time.Time) bool {
+	if peer.Misses == 0 {
+		return false
+	}
+	if peer.Misses >= node.failureMisses() {
+		return true
+	}
+	return node.Config.FailurePhi > 0 && phi(peer, now) >= node.Config.FailurePhi
+}
+
+/*
+Returns the phi-accrual suspicion level of peer at now: -log10 of the probability that a reply
+comes later than now, for normally distributed intervals between replies. 0 until the peer has
+answered FAILURE_MIN_SAMPLES times.
+*/
+func phi(peer *PeerHealth, now time.Time) float64 {
+	if len(peer.intervals) < FAILURE_MIN_SAMPLES {
+		return 0
+	}
+	var sum, squares float64
+	for _, interval := range peer.intervals {
+		sum += float64(interval)
+		squares += float64(interval) * float64(interval)
+	}
+	mean := sum / float64(len(peer.intervals))
+	deviation := math.Max(math.Sqrt(math.Max(squares/float64(len(peer.intervals))-mean*mean, 0)), float64(FAILURE_MIN_STD_DEVIATION))
+	later := 0.5 * math.Erfc((float64(now.Sub(peer.LastReply))-mean)/(deviation*math.Sqrt2))
+	if later <= 0 {
+		return FAILURE_MAX_PHI
+	}
+	return min(-math.Log10(later), FAILURE_MAX_PHI)
+}
+
+/*
+Returns the number of heartbeats a peer must miss in a row to be declared failed.
+*/
+func (node *Node) failureMisses() int {
+	if node.Config.FailureMisses <= 0 {
+		return DEFAULT_FAILURE_MISSES
+	}
+	return node.Config.FailureMisses
+}
+
+/*
+Returns the budget of a heartbeat, FAILURE_PING_TIMEOUT, or 0 for the full CALL_TIMEOUT.
+*/
+func (node *Node) pingBudget() int64 {
+	return int64(max(node.Config.FailurePingTimeout, 0))
+}
+
+/*
+Returns whether the peer at IP is declared failed, without sending it a heartbeat.
+*/
+func (node *Node) peerFailed(IP string) bool {
+	node.detector.mu.Lock()
+	defer node.detector.mu.Unlock()
+	peer := node.detector.peers[IP]
+	return peer != nil && node.failed(peer, time.Now())
+}
+
+/*
+Returns the heartbeat state of every peer, sorted by IP.
+*/
+func (node *Node) PeerHealth() []PeerHealth {
+	node.detector.mu.Lock()
+	defer node.detector.mu.Unlock()
+	now := time.Now()
+	list := make([]PeerHealth, 0, len(node.detector.peers))
+	for _, peer := range node.detector.peers {
+		health := *peer
+		health.Phi = phi(peer, now)
+		health.Failed = node.failed(peer, now)
+		health.intervals = nil
+		list = append(list, health)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].IP < list[j].IP })
+	return list
+}
+
+/*
+Writes the suspicion level of every peer sent heartbeats, as gauges.
+*/
+func (node *Node) writeFailureDetector(w io.Writer) {
+	for _, peer := range node.PeerHealth() {
+		fmt.Fprintf(w, "dns_chord_peer_phi{ip=%q} %g\n", peer.IP, peer.Phi)
+	}
+}
@@ -0,0 +1,138 @@
+/*
+Failure domain aware replica placement. Nodes can be tagged with the zone (host, rack, data
+centre, ...) they run in, and every reply carries the zone of the responder. A node in a zone
+places its replicas on the first REPLICATION_FACTOR of its next REPLICA_CANDIDATES successors that
+are in another zone, and only falls back to successors in its own zone if there are not enough of
+those, so that losing one zone does not take a record set and all of its replicas with it.
+Without a zone, replicas go to the immediate successors, as in plain Chord.
+*/
+package node
+
+import (
+	"sync"
+
+	"github.com/fauzxan/dns-chord/v2/message"
+	"github.com/rs/zerolog/log"
+)
+
+// Constants
+const (
+	REPLICA_CANDIDATES = 2 * REPLICATION_FACTOR // Successors considered for replicas when zones are in use.
+)
+
+/*
+Zones of the peers that replied to this node, keyed by IP.
+*/
+type zoneTable struct {
+	mu    sync.Mutex
+	zones map[string]string
+}
+
+/*
+The replicas of this node's keys, as last placed by replicaTargets.
+*/
+type replicaSet struct {
+	mu      sync.Mutex
+	targets []Pointer
+}
+
+/*
+Records the zone of the peer at IP, as carried by its reply.
+*/
+func (node *Node) learnZone(IP string, zone string) {
+	node.zones.mu.Lock()
+	defer node.zones.mu.Unlock()
+	if node.zones.zones == nil {
+		node.zones.zones = make(map[string]string)
+	}
+	node.zones.zones[IP] = zone
+}
+
+/*
+Returns the number of nodes around this one that may hold replicas of its keys, or of whose keys
+it may hold replicas.
+*/
+func (node *Node) replicaSpan() int {
+	if node.Config.Zone == "" {
+		return REPLICATION_FACTOR
+	}
+	return REPLICA_CANDIDATES
+}
+
+/*
+Returns the nodes to replicate this node's keys to: REPLICATION_FACTOR distinct successors,
+preferring those outside this node's zone.
+*/
+func (node *Node) replicaTargets() []Pointer {
+	candidates := []Pointer{}
+	zones := []string{}
+	seen := map[string]bool{node.IP: true}
+	current := node.successor()
+	for len(candidates) < node.replicaSpan() && (current != Pointer{}) && !seen[current.IP] {
+		seen[current.IP] = true
+		reply := node.CallRPC(message.RequestMessage{Type: GET_SUCCESSOR}, current.IP)
+		if reply.Type == EMPTY {
+			break
+		}
+		candidates = append(candidates, current)
+		zones = append(zones, reply.Zone)
+		current = Pointer{Nodeid: reply.Nodeid, IP: reply.IP}
+	}
+	if node.Config.Zone == "" {
+		node.rememberReplicas(candidates)
+		return candidates
+	}
+	targets := []Pointer{}
+	for i, candidate := range candidates {
+		if len(targets) < REPLICATION_FACTOR && zones[i] != "" && zones[i] != node.Config.Zone {
+			targets = append(targets, candidate)
+		}
+	}
+	for i, candidate := range candidates {
+		if len(targets) < REPLICATION_FACTOR && (zones[i] == "" || zones[i] == node.Config.Zone) {
+			log.Debug().Msgf("No successor outside zone %s left, replicating to %s in zone %q", node.Config.Zone, candidate.IP, zones[i])
+			targets = append(targets, candidate)
+		}
+	}
+	node.rememberReplicas(targets)
+	return targets
+}
+
+func (node *Node) rememberReplicas(targets []Pointer) {
+	node.replicas.mu.Lock()
+	defer node.replicas.mu.Unlock()
+	node.replicas.targets = targets
+}
+
+/*
+Returns the nodes holding replicas of key, Nodeid -> IP, for a GET reply, so that clients can
+retry reads against them directly. Returns nil if key is not one of this node's own keys.
+*/
+func (node *Node) replicasOf(key uint64) map[uint64]string {
+	node.storageMu.RLock()
+	_, own := node.HashIPStorage[node.Nodeid][key]
+	node.storageMu.RUnlock()
+	if !own {
+		return nil
+	}
+	node.replicas.mu.Lock()
+	defer node.replicas.mu.Unlock()
+	replicas := make(map[uint64]string, len(node.replicas.targets))
+	for _, replica := range node.replicas.targets {
+		replicas[replica.Nodeid] = replica.IP
+	}
+	return replicas
+}
+
+/*
+Returns the zone of every peer that replied to this node, keyed by IP.
+*/
+func (node *Node) PeerZones() map[string]string {
+	node.zones.mu.Lock()
+	defer node.zones.mu.Unlock()
+	zones := make(map[string]string, len(node.zones.zones))
+	for IP, zone := range node.zones.zones {
+		zones[IP] = zone
+	}
+	return zones
+}
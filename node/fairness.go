@@ -0,0 +1,149 @@
+/*
+Fair scheduling of lookups between clients and ring maintenance. Every node fixes all of its
+fingers every second, and verifies its keyspace, scrubs and collects replicas with lookups of its
+own, which reach the other nodes in bursts along with the lookups of clients. A node therefore runs
+at most LOOKUP_SLOTS lookups (FIND_SUCCESSOR) at a time (default 32, 0 for no limit), and the rest
+wait in one of two queues, one for client lookups and one for maintenance lookups. The node that
+starts a maintenance lookup marks it as such (Background), and every hop of it keeps the mark. A
+free slot goes to the next client lookup, and to the next maintenance lookup after every
+LOOKUP_CLIENT_WEIGHT (default 4) client lookups in a row that it waited for, so that maintenance
+is slowed down rather than starved. No lookup waits longer than LOOKUP_MAX_WAIT, it then runs
+anyway: lookups hold their slot while the next hop runs, and nodes waiting for slots of each other
+would otherwise deadlock. Lookups are counted per class in lookups_scheduled_total, and their time
+in the queue in lookup_queue_wait_microseconds_total.
+*/
+package node
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Constants
+const (
+	LOOKUP_CLASS_CLIENT      = "client"      // Lookups of names, on behalf of clients.
+	LOOKUP_CLASS_MAINTENANCE = "maintenance" // Lookups of the ring's own upkeep, e.g. FixFingers.
+
+	DEFAULT_LOOKUP_SLOTS         = 32                     // LOOKUP_SLOTS if not set.
+	DEFAULT_LOOKUP_CLIENT_WEIGHT = 4                      // LOOKUP_CLIENT_WEIGHT if not set.
+	LOOKUP_MAX_WAIT              = 500 * time.Millisecond // Most a lookup waits for a slot before it runs anyway.
+)
+
+/*
+The lookups a node is running, and those waiting for a slot, by class.
+*/
+type lookupScheduler struct {
+	mu          sync.Mutex
+	running     int
+	client      []chan struct{}
+	maintenance []chan struct{}
+	streak      int // Client lookups admitted in a row while maintenance lookups waited
+}
+
+/*
+Returns the class of a lookup, LOOKUP_CLASS_MAINTENANCE if background.
+*/
+func lookupClass(background bool) string {
+	if background {
+		return LOOKUP_CLASS_MAINTENANCE
+	}
+	return LOOKUP_CLASS_CLIENT
+}
+
+/*
+Waits for a slot to run a lookup of the class given by background in, see the top of this file.
+The caller runs the lookup, and releases the slot with releaseLookup.
+*/
+func (node *Node) admitLookup(background bool) {
+	class := lookupClass(background)
+	node.incMetric(fmt.Sprintf("lookups_scheduled_total{class=%q}", class), 1)
+	scheduler := &node.lookups
+	scheduler.mu.Lock()
+	if scheduler.running < node.lookupSlots() && len(scheduler.client) == 0 && len(scheduler.maintenance) == 0 {
+		scheduler.running++
+		scheduler.mu.Unlock()
+		return
+	}
+	turn := make(chan struct{}, 1)
+	queue := &scheduler.client
+	if background {
+		queue = &scheduler.maintenance
+	}
+	*queue = append(*queue, turn)
+	scheduler.mu.Unlock()
+
+	start := time.Now()
+	timer := time.NewTimer(LOOKUP_MAX_WAIT)
+	defer timer.Stop()
+	select {
+	case <-turn:
+	case <-timer.C:
+	case <-node.context().Done():
+	}
+	scheduler.mu.Lock()
+	if i := slices.Index(*queue, turn); i >= 0 {
+		// Not given a slot in time, run regardless.
+		*queue = slices.Delete(*queue, i, i+1)
+		scheduler.running++
+		node.incMetric(fmt.Sprintf("lookup_queue_timeouts_total{class=%q}", class), 1)
+	}
+	scheduler.mu.Unlock()
+	node.incMetric(fmt.Sprintf("lookup_queue_wait_microseconds_total{class=%q}", class), uint64(time.Since(start).Microseconds()))
+}
+
+/*
+Releases the slot of a lookup that admitLookup let run, and hands free slots to the waiting
+lookups: client lookups first, and a maintenance lookup after every LOOKUP_CLIENT_WEIGHT of them.
+*/
+func (node *Node) releaseLookup() {
+	scheduler := &node.lookups
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+	scheduler.running--
+	for scheduler.running < node.lookupSlots() && (len(scheduler.client) > 0 || len(scheduler.maintenance) > 0) {
+		var turn chan struct{}
+		if len(scheduler.client) > 0 && (len(scheduler.maintenance) == 0 || scheduler.streak < node.lookupClientWeight()) {
+			turn, scheduler.client = scheduler.client[0], scheduler.client[1:]
+			if len(scheduler.maintenance) > 0 {
+				scheduler.streak++
+			}
+		} else {
+			turn, scheduler.maintenance = scheduler.maintenance[0], scheduler.maintenance[1:]
+			scheduler.streak = 0
+		}
+		scheduler.running++
+		turn <- struct{}{}
+	}
+}
+
+/*
+Returns the number of lookups a node runs at once, unbounded if LOOKUP_SLOTS is 0.
+*/
+func (node *Node) lookupSlots() int {
+	if node.Config.LookupSlots <= 0 {
+		return int(^uint(0) >> 1)
+	}
+	return node.Config.LookupSlots
+}
+
+/*
+Returns the number of client lookups admitted in a row before a waiting maintenance lookup.
+*/
+func (node *Node) lookupClientWeight() int {
+	return max(1, node.Config.LookupClientWeight)
+}
+
+/*
+Writes the lookups running and waiting for a slot, by class, as gauges.
+*/
+func (node *Node) writeLookupQueues(w io.Writer) {
+	node.lookups.mu.Lock()
+	running, client, maintenance := node.lookups.running, len(node.lookups.client), len(node.lookups.maintenance)
+	node.lookups.mu.Unlock()
+	fmt.Fprintf(w, "dns_chord_lookups_running %d\n", running)
+	fmt.Fprintf(w, "dns_chord_lookup_queue_length{class=%q} %d\n", LOOKUP_CLASS_CLIENT, client)
+	fmt.Fprintf(w, "dns_chord_lookup_queue_length{class=%q} %d\n", LOOKUP_CLASS_MAINTENANCE, maintenance)
+}
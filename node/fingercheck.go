@@ -0,0 +1,80 @@
+/*
+Debug mode that checks the finger table against the ground truth. After each FixFingers round, the
+node walks the ring along the successor pointers, computes the true successor of every finger
+target from the walk, and logs each finger that disagrees. This is slow (one RPC per node in the
+ring, every round) and only meant for catching routing table bugs during development.
+*/
+package node
+
+import (
+	"github.com/fauzxan/dns-chord/v2/hashing"
+	"github.com/fauzxan/dns-chord/v2/message"
+	"github.com/rs/zerolog/log"
+)
+
+// Constants
+const (
+	RING_WALK_MAX_NODES = 1024 // Upper bound on the number of nodes visited by a ring walk.
+)
+
+/*
+Returns the nodes of the ring in ring order starting at this node, found by following successor
+pointers. Returns false if the walk did not make it around the ring. An observer is not part of
+the ring, and its walk starts and ends at its successor instead.
+*/
+func (node *Node) walkRing() ([]Pointer, bool) {
+	ring := []Pointer{{Nodeid: node.Nodeid, IP: node.IP}}
+	start := node.IP
+	if node.Observing() {
+		ring, start = ring[:0], node.successor().IP
+	}
+	current := node.successor()
+	for len(ring) < RING_WALK_MAX_NODES {
+		if current.IP == start && (len(ring) > 0 || start == node.IP) {
+			return ring, true
+		}
+		if (current == Pointer{}) {
+			return ring, false
+		}
+		ring = append(ring, current)
+		reply := node.CallRPC(message.RequestMessage{Type: GET_SUCCESSOR}, current.IP)
+		current = Pointer{Nodeid: reply.Nodeid, IP: reply.IP}
+	}
+	return ring, false
+}
+
+/*
+Returns the true successor of id on ring, a walk of the ring in ring order.
+*/
+func ringSuccessor(ring []Pointer, id uint64) Pointer {
+	for j := range ring {
+		if belongsTo(id, ring[(j+len(ring)-1)%len(ring)].Nodeid, ring[j].Nodeid) {
+			return ring[j]
+		}
+	}
+	return ring[0]
+}
+
+/*
+Compares every finger against the true successor of its target, as found by walking the ring.
+Returns the number of wrong fingers.
+*/
+func (node *Node) verifyFingers() int {
+	ring, ok := node.walkRing()
+	if !ok {
+		log.Warn().Msgf("Finger verification skipped, the ring walk broke off after %d nodes", len(ring))
+		return 0
+	}
+	wrong := 0
+	for i, finger := range node.fingers() {
+		target := (node.Nodeid + 1<<i) & hashing.Mask()
+		expected := ringSuccessor(ring, target)
+		if finger.Nodeid != expected.Nodeid {
+			log.Warn().Msgf("Finger[%d] for target %d is Nodeid: %d IP: %s, but the ring walk says Nodeid: %d IP: %s",
+				i+1, target, finger.Nodeid, finger.IP, expected.Nodeid, expected.IP)
+			wrong++
+		}
+	}
+	node.incMetric("finger_discrepancies_total", uint64(wrong))
+	return wrong
+}
@@ -0,0 +1,261 @@
+/*
+Pointer flap detection. Every change of the successor or predecessor pointer is counted, with its
+cause, and a node whose pointers change FLAP_THRESHOLD times or more within FLAP_WINDOW is
+considered to be flapping, which is logged as a warning and counted as an alert. A steady ring
+changes its pointers only when nodes join or leave, so a high rate of changes points at peers that
+time out although they are alive, or pointers that swing back and forth between two nodes.
+
+Timeouts are often caused by the node itself rather than its peers: a process that is starved of
+CPU, or whose wall clock jumps, misses deadlines. The clock watch compares the wall clock with the
+monotonic clock once per CLOCK_WATCH_INTERVAL, and counts jumps and stalls, so that they can be
+named among the likely causes of flapping.
+*/
+package node
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Constants
+const (
+	FLAP_WINDOW          = time.Minute // Window over which pointer changes are counted.
+	FLAP_THRESHOLD       = 6           // Changes of one pointer within FLAP_WINDOW from which it is flapping.
+	FLAP_HISTORY         = 64          // Pointer changes kept for the admin endpoint.
+	CLOCK_WATCH_INTERVAL = time.Second
+	CLOCK_JUMP_THRESHOLD = time.Second // Difference between wall clock and monotonic clock that counts as a jump.
+	CLOCK_STALL_FACTOR   = 3           // Multiple of CLOCK_WATCH_INTERVAL after which a late wakeup counts as a stall.
+)
+
+// Causes of pointer changes.
+const (
+	CAUSE_TIMEOUT  = "timeout"  // The pointed to node did not reply.
+	CAUSE_NEW_NODE = "new_node" // A node closer to this one showed up.
+	CAUSE_REJOIN   = "rejoin"   // The successor list was exhausted, and the node rejoined through the address book.
+	CAUSE_HANDOFF  = "handoff"  // The predecessor was decommissioned and handed its range off.
+	CAUSE_LEAVE    = "leave"    // The successor left the ring and named its own successor.
+)
+
+// Pointers that are watched.
+const (
+	POINTER_SUCCESSOR   = "successor"
+	POINTER_PREDECESSOR = "predecessor"
+)
+
+/*
+A change of a pointer of this node.
+*/
+type PointerChange struct {
+	At      time.Time
+	Pointer string // successor or predecessor
+	From    Pointer
+	To      Pointer
+	Cause   string
+}
+
+/*
+Recent pointer changes and clock anomalies of this node.
+*/
+type flapTable struct {
+	mu       sync.Mutex
+	changes  []PointerChange // Last FLAP_HISTORY changes, oldest first
+	flapping map[string]bool // Pointers currently alerted on
+	jumps    []time.Time     // Clock jumps within FLAP_WINDOW
+	stalls   []time.Time     // Stalls within FLAP_WINDOW
+}
+
+/*
+Flapping state of one pointer.
+*/
+type PointerFlapStatus struct {
+	ChangesPerMinute int
+	Flapping         bool
+	Oscillations     int            // Changes within the window back to a node pointed to before, not counting cleared pointers
+	Causes           map[string]int // Changes within the window by cause
+}
+
+/*
+Flapping state of this node, for the admin endpoint.
+*/
+type FlapStatus struct {
+	Successor    PointerFlapStatus
+	Predecessor  PointerFlapStatus
+	ClockJumps   int      // Within the window
+	Stalls       int      // Within the window
+	LikelyCauses []string // Most likely first, empty unless a pointer is flapping
+	Recent       []PointerChange
+}
+
+/*
+Records that pointer changed from from to to because of cause, and alerts if the pointer starts
+flapping. Changes from or to the empty pointer are counted too, a cleared predecessor is a change.
+*/
+func (node *Node) pointerChanged(pointer string, from, to Pointer, cause string) {
+	if from == to {
+		return
+	}
+	node.incMetric(fmt.Sprintf("pointer_changes_total{pointer=%q,cause=%q}", pointer, cause), 1)
+	node.flaps.mu.Lock()
+	defer node.flaps.mu.Unlock()
+	now := time.Now()
+	node.flaps.changes = append(node.flaps.changes, PointerChange{At: now, Pointer: pointer, From: from, To: to, Cause: cause})
+	if len(node.flaps.changes) > FLAP_HISTORY {
+		node.flaps.changes = node.flaps.changes[len(node.flaps.changes)-FLAP_HISTORY:]
+	}
+	if node.flaps.flapping == nil {
+		node.flaps.flapping = make(map[string]bool)
+	}
+	status := node.pointerStatus(pointer, now)
+	switch {
+	case status.ChangesPerMinute >= FLAP_THRESHOLD && !node.flaps.flapping[pointer]:
+		node.flaps.flapping[pointer] = true
+		node.incMetric(fmt.Sprintf("pointer_flap_alerts_total{pointer=%q}", pointer), 1)
+		log.Warn().Msgf("The %s pointer is flapping: %d changes in the last %s, likely causes: %v", pointer, status.ChangesPerMinute, FLAP_WINDOW, node.likelyCauses(now))
+	case status.ChangesPerMinute < FLAP_THRESHOLD/2 && node.flaps.flapping[pointer]:
+		node.flaps.flapping[pointer] = false
+		log.Info().Msgf("The %s pointer is stable again", pointer)
+	}
+}
+
+/*
+Returns the flapping state of pointer at now. Requires flaps.mu.
+*/
+func (node *Node) pointerStatus(pointer string, now time.Time) PointerFlapStatus {
+	status := PointerFlapStatus{Flapping: node.flaps.flapping[pointer], Causes: make(map[string]int)}
+	seen := map[Pointer]bool{}
+	for _, change := range node.flaps.changes {
+		if change.Pointer != pointer || now.Sub(change.At) > FLAP_WINDOW {
+			continue
+		}
+		status.ChangesPerMinute++
+		status.Causes[change.Cause]++
+		if (change.To != Pointer{}) && seen[change.To] {
+			status.Oscillations++
+		}
+		seen[change.From] = true
+	}
+	return status
+}
+
+/*
+Returns the likely causes of flapping at now, most likely first. Requires flaps.mu.
+*/
+func (node *Node) likelyCauses(now time.Time) []string {
+	causes := []string{}
+	if recent(node.flaps.jumps, now) > 0 {
+		causes = append(causes, "wall clock jumps on this node")
+	}
+	if recent(node.flaps.stalls, now) > 0 {
+		causes = append(causes, "this node is stalled, e.g. starved of CPU")
+	}
+	counts := map[string]int{}
+	oscillations := 0
+	for _, pointer := range []string{POINTER_SUCCESSOR, POINTER_PREDECESSOR} {
+		status := node.pointerStatus(pointer, now)
+		for cause, count := range status.Causes {
+			counts[cause] += count
+		}
+		oscillations += status.Oscillations
+	}
+	if oscillations > 0 && counts[CAUSE_TIMEOUT] > 0 {
+		causes = append(causes, "peers time out although they are alive, e.g. an overloaded or lossy network")
+	}
+	ranked := make([]string, 0, len(counts))
+	for cause := range counts {
+		ranked = append(ranked, cause)
+	}
+	sort.Slice(ranked, func(i, j int) bool { return counts[ranked[i]] > counts[ranked[j]] })
+	for _, cause := range ranked {
+		causes = append(causes, fmt.Sprintf("%s (%d changes)", cause, counts[cause]))
+	}
+	return causes
+}
+
+/*
+Returns how many of times are within FLAP_WINDOW of now.
+*/
+func recent(times []time.Time, now time.Time) int {
+	count := 0
+	for _, at := range times {
+		if now.Sub(at) <= FLAP_WINDOW {
+			count++
+		}
+	}
+	return count
+}
+
+/*
+Keeps only the times within FLAP_WINDOW of now, and appends now.
+*/
+func appendRecent(times []time.Time, now time.Time) []time.Time {
+	kept := times[:0]
+	for _, at := range times {
+		if now.Sub(at) <= FLAP_WINDOW {
+			kept = append(kept, at)
+		}
+	}
+	return append(kept, now)
+}
+
+/*
+Watches the clocks of this node. The monotonic clock measures how long each sleep took, the wall
+clock, stripped of its monotonic reading, how much time it claims passed.
+*/
+func (node *Node) watchClock() {
+	last := time.Now()
+	for node.sleep(CLOCK_WATCH_INTERVAL) {
+		now := time.Now()
+		elapsed := now.Sub(last)
+		skew := now.Round(0).Sub(last.Round(0)) - elapsed
+		last = now
+		if skew > CLOCK_JUMP_THRESHOLD || skew < -CLOCK_JUMP_THRESHOLD {
+			log.Warn().Msgf("The wall clock jumped by %s", skew)
+			node.incMetric("clock_jumps_total", 1)
+			node.flaps.mu.Lock()
+			node.flaps.jumps = appendRecent(node.flaps.jumps, now)
+			node.flaps.mu.Unlock()
+		}
+		if elapsed > CLOCK_STALL_FACTOR*CLOCK_WATCH_INTERVAL {
+			log.Warn().Msgf("A %s sleep took %s", CLOCK_WATCH_INTERVAL, elapsed)
+			node.incMetric("clock_stalls_total", 1)
+			node.flaps.mu.Lock()
+			node.flaps.stalls = appendRecent(node.flaps.stalls, now)
+			node.flaps.mu.Unlock()
+		}
+	}
+}
+
+/*
+Returns the flapping state of this node.
+*/
+func (node *Node) FlapStatus() FlapStatus {
+	node.flaps.mu.Lock()
+	defer node.flaps.mu.Unlock()
+	now := time.Now()
+	status := FlapStatus{
+		Successor:   node.pointerStatus(POINTER_SUCCESSOR, now),
+		Predecessor: node.pointerStatus(POINTER_PREDECESSOR, now),
+		ClockJumps:  recent(node.flaps.jumps, now),
+		Stalls:      recent(node.flaps.stalls, now),
+		Recent:      append([]PointerChange{}, node.flaps.changes...),
+	}
+	status.LikelyCauses = []string{}
+	if status.Successor.Flapping || status.Predecessor.Flapping {
+		status.LikelyCauses = node.likelyCauses(now)
+	}
+	return status
+}
+
+/*
+Writes the pointer change rates as gauges, see WriteMetrics.
+*/
+func (node *Node) writeFlapRates(w io.Writer) {
+	status := node.FlapStatus()
+	fmt.Fprintf(w, "dns_chord_pointer_changes_per_minute{pointer=%q} %d\n", POINTER_SUCCESSOR, status.Successor.ChangesPerMinute)
+	fmt.Fprintf(w, "dns_chord_pointer_changes_per_minute{pointer=%q} %d\n", POINTER_PREDECESSOR, status.Predecessor.ChangesPerMinute)
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin
+
+package node
+
+import "os"
+
+/*
+Returns nil, files are not locked on this platform.
+*/
+func lockFile(file *os.File) error {
+	return nil
+}
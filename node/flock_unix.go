@@ -0,0 +1,16 @@
+//go:build linux || darwin
+
+package node
+
+import (
+	"os"
+	"syscall"
+)
+
+/*
+Takes an exclusive lock on file, which is released when the file is closed or the process exits.
+Fails at once if another process holds it.
+*/
+func lockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
@@ -0,0 +1,129 @@
+/*
+Administrative freeze of the ring topology. While a node is frozen it skips its stabilize, fix
+fingers and check predecessor rounds and refuses new predecessors, and nodes that try to join
+through it wait until it thaws, so that the successor pointers and finger tables of the ring stay
+exactly as they were. Lookups, GETs and PUTs are served as usual, which makes measurements and
+snapshots taken during an experiment consistent. A freeze is set on every node of the ring at once
+through FreezeRing, and lasts until the ring is thawed or the node restarts. A node that fails
+while the ring is frozen is not routed around until the ring thaws.
+*/
+package node
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/fauzxan/dns-chord/v2/message"
+	"github.com/rs/zerolog/log"
+)
+
+// Constants
+const (
+	FREEZE_STATE_FROZEN = "frozen"        // FREEZE argument and reply of a frozen node.
+	FREEZE_STATE_THAWED = "thawed"        // FREEZE argument and reply of a node that maintains its pointers.
+	FREEZE_POLL         = 1 * time.Second // Interval at which a joining node checks whether the ring has thawed.
+)
+
+/*
+Returns true if the topology of this node is frozen.
+*/
+func (node *Node) Frozen() bool {
+	return node.frozen.Load()
+}
+
+/*
+Returns the freeze state of this node, FREEZE_STATE_FROZEN or FREEZE_STATE_THAWED.
+*/
+func (node *Node) freezeState() string {
+	if node.Frozen() {
+		return FREEZE_STATE_FROZEN
+	}
+	return FREEZE_STATE_THAWED
+}
+
+/*
+Freezes or thaws the topology of this node.
+*/
+func (node *Node) setFrozen(frozen bool) {
+	if node.frozen.Swap(frozen) == frozen {
+		return
+	}
+	if frozen {
+		node.incMetric("freezes_total", 1)
+		log.Info().Msg("Ring topology frozen, pausing stabilize, fix fingers, check predecessor and joins")
+	} else {
+		log.Info().Msg("Ring topology thawed, resuming maintenance")
+	}
+}
+
+/*
+Processes a FREEZE message: freezes or thaws this node as named in msg.IP, if set, and replies
+with the state now in effect.
+*/
+func (node *Node) handleFreeze(msg *message.RequestMessage, reply *message.ResponseMessage) {
+	switch msg.IP {
+	case FREEZE_STATE_FROZEN:
+		node.setFrozen(true)
+	case FREEZE_STATE_THAWED:
+		node.setFrozen(false)
+	case "":
+	default:
+		log.Warn().Msgf("Ignoring the freeze state %q of %s", msg.IP, msg.From)
+		return
+	}
+	reply.Type = ACK
+	reply.QueryResponse = []string{node.freezeState()}
+}
+
+/*
+Freezes or thaws every node in the ring, this one included, and returns the state now in effect
+on each node by IP. Nodes that did not reply are left out. With an empty state, only collects the
+state of every node.
+*/
+func (node *Node) FreezeRing(state string) (map[string]string, error) {
+	if state != "" && state != FREEZE_STATE_FROZEN && state != FREEZE_STATE_THAWED {
+		return nil, fmt.Errorf("%q is not a freeze state", state)
+	}
+	// The walk follows successor pointers, which stay put while frozen, so thawing walks the same ring.
+	walk, ok := node.walkRing()
+	if !ok {
+		log.Warn().Msgf("The ring walk broke off after %d nodes, freezing or thawing them only", len(walk))
+	}
+	if node.Observing() {
+		walk = append(walk, Pointer{Nodeid: node.Nodeid, IP: node.IP})
+	}
+	states := make(map[string]string)
+	for _, pointer := range walk {
+		if pointer.IP == node.IP {
+			if state != "" {
+				node.setFrozen(state == FREEZE_STATE_FROZEN)
+			}
+			states[node.IP] = node.freezeState()
+			continue
+		}
+		reply := node.CallRPC(message.RequestMessage{Type: FREEZE, IP: state}, pointer.IP)
+		if reply.Type == ACK && len(reply.QueryResponse) == 1 {
+			states[pointer.IP] = reply.QueryResponse[0]
+		}
+	}
+	return states, nil
+}
+
+/*
+Blocks a joining node while the node at IP, its successor to be, is frozen. Returns false if the
+node shut down while waiting. Nodes that do not know FREEZE are never frozen.
+*/
+func (node *Node) waitForThaw(IP string) bool {
+	for waited := false; ; waited = true {
+		reply := node.CallRPC(message.RequestMessage{Type: FREEZE}, IP)
+		if reply.Type != ACK || len(reply.QueryResponse) != 1 || reply.QueryResponse[0] != FREEZE_STATE_FROZEN {
+			return true
+		}
+		if !waited {
+			log.Info().Msgf("The ring is frozen, waiting for %s to thaw before joining", IP)
+		}
+		if !node.sleep(FREEZE_POLL) {
+			return false
+		}
+	}
+}
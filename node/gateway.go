@@ -0,0 +1,308 @@
+/*
+Gateway mode, for running the query front-end behind a load balancer and scaling it independently
+of the storage nodes. A gateway is a stateless process that holds no keys and takes no place in the
+ring: it accepts DNS queries on DNS_PORT and REST queries on GATEWAY_PORT, and sends each lookup
+into the ring through one of several ring nodes, its entry nodes. It starts from the nodes it is
+given (GATEWAY_NODES), learns more from their fingers, up to GATEWAY_MAX_NODES, and pings them every
+GATEWAY_CHECK_INTERVAL. A lookup goes to the live entry node whose ID most closely precedes the
+key, which saves the hops the lookup would take to get there, and to the next ones if it does not
+reply. The REST endpoints are
+
+	GET /resolve?name=example.com   records of a name, as JSON
+	GET /health                     200 while an entry node is alive, else 503, for load balancer checks
+
+Several gateways behind one load balancer share nothing but the ring, so that any of them can
+answer any query. From the command line:
+
+	dns-chord gateway [ip:port ...]
+*/
+package node
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/fauzxan/dns-chord/v2/hashing"
+	"github.com/fauzxan/dns-chord/v2/message"
+	"github.com/rs/zerolog/log"
+)
+
+// Constants
+const (
+	GATEWAY_MAX_NODES      = 16              // Most entry nodes a gateway keeps.
+	GATEWAY_CHECK_INTERVAL = 2 * time.Second // Time between two health checks of the entry nodes.
+)
+
+/*
+A ring node a gateway sends lookups through.
+*/
+type EntryNode struct {
+	Nodeid   uint64 `json:"nodeid"`
+	IP       string `json:"ip"`
+	Known    bool   `json:"-"` // Set once the ID of the node is known, from the fingers of another
+	Alive    bool   `json:"alive"`
+	Failures uint64 `json:"failures"` // Lookups and health checks it did not reply to
+}
+
+/*
+The entry nodes of a gateway, by IP.
+*/
+type gatewayState struct {
+	mu      sync.Mutex
+	entries map[string]*EntryNode
+}
+
+/*
+Returns a gateway that sends lookups into the ring through nodes, and further nodes it learns of.
+*/
+func NewGateway(config Config, nodes []string) *Node {
+	gateway := &Node{
+		Config:        config,
+		FingerTable:   make([]Pointer, hashing.Bits()),
+		CachedQuery:   make(map[uint64]LRUCache),
+		HashIPStorage: make(map[uint64]map[uint64][]Record),
+		gateway:       &gatewayState{entries: make(map[string]*EntryNode)},
+	}
+	for _, IP := range nodes {
+		gateway.gateway.entries[IP] = &EntryNode{IP: IP, Alive: true}
+	}
+	return gateway
+}
+
+/*
+Returns true if the node is a gateway.
+*/
+func (node *Node) Gateway() bool {
+	return node.gateway != nil
+}
+
+/*
+Starts the health checks of the entry nodes, and the REST listener on addr unless it is empty.
+*/
+func (node *Node) StartGateway(addr string) {
+	log.Info().Msgf("Running as a gateway through %d ring node(s), no keys will be stored here", len(node.EntryNodes()))
+	node.checkEntryNodes()
+	node.spawn("gateway_checks", func() {
+		for node.sleep(GATEWAY_CHECK_INTERVAL) {
+			node.checkEntryNodes()
+		}
+	})
+	if addr != "" {
+		node.serveGateway(addr)
+	}
+}
+
+/*
+Pings every entry node, and learns of more, and of the IDs of those known by address only, from
+the fingers of the live ones.
+*/
+func (node *Node) checkEntryNodes() {
+	alive := []string{}
+	for _, entry := range node.EntryNodes() {
+		reply := node.CallRPC(message.RequestMessage{Type: PING}, entry.IP)
+		up := reply.Type != EMPTY
+		node.gateway.mu.Lock()
+		if current, ok := node.gateway.entries[entry.IP]; ok {
+			if current.Alive != up {
+				log.Info().Msgf("Entry node %s is %s", entry.IP, map[bool]string{true: "up", false: "down"}[up])
+			}
+			current.Alive = up
+			if !up {
+				current.Failures++
+			}
+		}
+		node.gateway.mu.Unlock()
+		if up {
+			alive = append(alive, entry.IP)
+		}
+	}
+	for _, IP := range alive {
+		reply := node.CallRPC(message.RequestMessage{Type: GET_FINGERS}, IP)
+		if reply.Type != ACK {
+			continue
+		}
+		learned := map[uint64]string{reply.Nodeid: reply.IP}
+		for nodeid, fingerIP := range reply.Fingers {
+			learned[nodeid] = fingerIP
+		}
+		node.learnEntryNodes(learned)
+	}
+}
+
+/*
+Adds the nodes in learned, Nodeid -> IP, to the entry nodes while there is room, and records the
+IDs of those known by address only.
+*/
+func (node *Node) learnEntryNodes(learned map[uint64]string) {
+	node.gateway.mu.Lock()
+	defer node.gateway.mu.Unlock()
+	for nodeid, IP := range learned {
+		if IP == "" {
+			continue
+		}
+		if entry, ok := node.gateway.entries[IP]; ok {
+			entry.Nodeid, entry.Known = nodeid, true
+			continue
+		}
+		if len(node.gateway.entries) < GATEWAY_MAX_NODES {
+			log.Info().Msgf("Learned of entry node Nodeid: %d IP: %s", nodeid, IP)
+			node.gateway.entries[IP] = &EntryNode{Nodeid: nodeid, IP: IP, Known: true, Alive: true}
+		}
+	}
+}
+
+/*
+Returns a copy of the entry nodes, by IP.
+*/
+func (node *Node) EntryNodes() []EntryNode {
+	node.gateway.mu.Lock()
+	defer node.gateway.mu.Unlock()
+	entries := make([]EntryNode, 0, len(node.gateway.entries))
+	for _, entry := range node.gateway.entries {
+		entries = append(entries, *entry)
+	}
+	slices.SortFunc(entries, func(a, b EntryNode) int { return cmp.Compare(a.IP, b.IP) })
+	return entries
+}
+
+/*
+Returns the entry nodes to send a lookup of id through, in order: live nodes whose ID is known by
+how closely they precede id, then the live nodes whose ID is not, then those that did not reply
+to the last health check.
+*/
+func (node *Node) entryNodesFor(id uint64) []EntryNode {
+	entries := node.EntryNodes()
+	rank := func(entry EntryNode) int {
+		switch {
+		case entry.Alive && entry.Known:
+			return 0
+		case entry.Alive:
+			return 1
+		}
+		return 2
+	}
+	slices.SortStableFunc(entries, func(a, b EntryNode) int {
+		if c := cmp.Compare(rank(a), rank(b)); c != 0 {
+			return c
+		}
+		// Clockwise distance to id, which wraps around like the ring does.
+		return cmp.Compare((id-a.Nodeid)&hashing.Mask(), (id-b.Nodeid)&hashing.Mask())
+	})
+	return entries
+}
+
+/*
+findSuccessorBefore of a gateway: asks its entry nodes in turn for the successor of id, see
+entryNodesFor.
+*/
+func (node *Node) gatewayFindSuccessor(id uint64, hopCount int, traceId uint64, deadline time.Time) (Pointer, int) {
+	for _, entry := range node.entryNodesFor(id) {
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			break
+		}
+		msg := message.RequestMessage{Type: FIND_SUCCESSOR, TargetId: id, HopCount: hopCount, TraceId: traceId, Budget: int64(node.forwardBudget(deadline, hopCount))}
+		node.incMetric("lookups_forwarded_total", 1)
+		reply := node.CallRPC(msg, entry.IP)
+		for retries := 0; redirectable(reply) && retries < MAX_BUSY_RETRIES; retries++ {
+			reply = node.CallRPC(msg, reply.IP)
+		}
+		if reply.Type != EMPTY && !redirectable(reply) && reply.IP != "" {
+			return Pointer{Nodeid: reply.Nodeid, IP: reply.IP}, max(hopCount, reply.HopCount)
+		}
+		sampledLog().Debug().Msgf("Lookup of %d via entry node %s failed, trying the next one", id, entry.IP)
+		node.incMetric("gateway_entry_failures_total", 1)
+		node.gateway.mu.Lock()
+		if current, ok := node.gateway.entries[entry.IP]; ok {
+			current.Alive = false
+			current.Failures++
+		}
+		node.gateway.mu.Unlock()
+	}
+	return Pointer{}, hopCount
+}
+
+/*
+Starts the REST listener of a gateway on addr in a tracked goroutine, see the top of this file.
+The server is closed when the gateway shuts down.
+*/
+func (node *Node) serveGateway(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/resolve", func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			http.Error(w, "name is required", http.StatusBadRequest)
+			return
+		}
+		node.incMetric(`gateway_requests_total{protocol="rest"}`, 1)
+		resolution, err := node.ResolveBefore(name, time.Now().Add(DNS_RESOLVE_TIMEOUT))
+		var dnsErr *net.DNSError
+		switch {
+		case errors.Is(err, ErrNotFound), errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, ErrAccessDenied):
+			http.Error(w, err.Error(), http.StatusForbidden)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		default:
+			writeJSON(w, struct {
+				Name     string   `json:"name"`
+				Records  []string `json:"records"`
+				Source   string   `json:"source"`
+				Degraded bool     `json:"degraded"`
+			}{name, RecordsText(resolution.Records), resolution.Source, resolution.Degraded})
+		}
+	})
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		entries := node.EntryNodes()
+		status := http.StatusServiceUnavailable
+		for _, entry := range entries {
+			if entry.Alive {
+				status = http.StatusOK
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		writeJSON(w, struct {
+			Instance string      `json:"instance"`
+			Nodes    []EntryNode `json:"nodes"`
+		}{node.InstanceID(), entries})
+	})
+
+	server := &http.Server{Addr: addr, Handler: mux}
+	node.spawn("gateway_http", func() {
+		log.Info().Msgf("Gateway endpoint is running at address: %s", addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Error().Err(err).Msg("Gateway endpoint stopped")
+		}
+	})
+	node.spawn("gateway_shutdown", func() {
+		<-node.context().Done()
+		server.Close()
+	})
+}
+
+/*
+Writes the number of live and dead entry nodes of a gateway as gauges.
+*/
+func (node *Node) writeGateway(w io.Writer) {
+	if !node.Gateway() {
+		return
+	}
+	up, down := 0, 0
+	for _, entry := range node.EntryNodes() {
+		if entry.Alive {
+			up++
+		} else {
+			down++
+		}
+	}
+	fmt.Fprintf(w, "dns_chord_gateway_entry_nodes{state=\"up\"} %d\n", up)
+	fmt.Fprintf(w, "dns_chord_gateway_entry_nodes{state=\"down\"} %d\n", down)
+}
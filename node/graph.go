@@ -0,0 +1,91 @@
+/*
+Export of the routing topology in DOT format, to be rendered with graphviz, e.g.
+"dot -Tsvg ring.dot -o ring.svg". Successor pointers are drawn as solid edges and fingers as dashed
+ones. Fingers pointing at a node that is not on the ring walk are drawn in red, as they are broken.
+*/
+package node
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/fauzxan/dns-chord/v2/message"
+)
+
+/*
+Routing state of one node, as drawn in the graph.
+*/
+type graphNode struct {
+	pointer   Pointer
+	successor Pointer
+	fingers   map[uint64]string // Nodeid -> IP of the distinct fingers
+}
+
+/*
+Returns the distinct fingers of this node.
+*/
+func (node *Node) fingerSet() map[uint64]string {
+	fingers := make(map[uint64]string)
+	for _, finger := range node.fingers() {
+		if finger.IP != "" {
+			fingers[finger.Nodeid] = finger.IP
+		}
+	}
+	return fingers
+}
+
+/*
+Writes the routing topology in DOT format: of the whole ring if ring is set, found by walking it
+and asking every node for its fingers, otherwise of this node only.
+*/
+func (node *Node) WriteGraph(w io.Writer, ring bool) error {
+	nodes := []graphNode{{pointer: Pointer{Nodeid: node.Nodeid, IP: node.IP}, successor: node.successor(), fingers: node.fingerSet()}}
+	if ring {
+		walk, _ := node.walkRing()
+		nodes = nodes[:0]
+		for _, pointer := range walk {
+			if pointer.IP == node.IP {
+				nodes = append(nodes, graphNode{pointer: pointer, successor: node.successor(), fingers: node.fingerSet()})
+				continue
+			}
+			reply := node.CallRPC(message.RequestMessage{Type: GET_FINGERS}, pointer.IP)
+			nodes = append(nodes, graphNode{pointer: pointer, successor: Pointer{Nodeid: reply.Nodeid, IP: reply.IP}, fingers: reply.Fingers})
+		}
+	}
+	onRing := make(map[uint64]bool)
+	for _, n := range nodes {
+		onRing[n.pointer.Nodeid] = true
+	}
+
+	label := func(id uint64, ip string) string { return fmt.Sprintf("%q", fmt.Sprintf("%d\n%s", id, ip)) }
+	fmt.Fprintln(w, "digraph chord {")
+	fmt.Fprintln(w, "\tlayout=circo;")
+	fmt.Fprintln(w, "\tnode [shape=ellipse, fontsize=10];")
+	for _, n := range nodes {
+		fmt.Fprintf(w, "\t%s;\n", label(n.pointer.Nodeid, n.pointer.IP))
+	}
+	for _, n := range nodes {
+		from := label(n.pointer.Nodeid, n.pointer.IP)
+		if n.successor.IP != "" {
+			fmt.Fprintf(w, "\t%s -> %s [label=\"succ\"];\n", from, label(n.successor.Nodeid, n.successor.IP))
+		}
+		ids := make([]uint64, 0, len(n.fingers))
+		for id := range n.fingers {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		for _, id := range ids {
+			if id == n.pointer.Nodeid || id == n.successor.Nodeid {
+				continue
+			}
+			style := "style=dashed"
+			if ring && !onRing[id] {
+				style += ", color=red"
+			}
+			fmt.Fprintf(w, "\t%s -> %s [%s];\n", from, label(id, n.fingers[id]), style)
+		}
+	}
+	_, err := fmt.Fprintln(w, "}")
+	return err
+}
@@ -0,0 +1,116 @@
+/*
+Version history of the record sets written to a node. Every record set a PUT stores is appended
+to the history of its key, together with the time of the write and the node (and identity, where
+signed) it came from, so that an accidental overwrite can be inspected and the previous records
+put back. The history is kept in memory by the node that accepted the write, for the last
+HISTORY_DEPTH versions of each key.
+*/
+package node
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/fauzxan/dns-chord/v2/hashing"
+	"github.com/fauzxan/dns-chord/v2/message"
+	"github.com/rs/zerolog/log"
+)
+
+// Constants
+const (
+	HISTORY_DEPTH = 10 // Number of versions of a record set kept per key, the current one included.
+)
+
+/*
+A version of a record set, as written by one PUT.
+*/
+type RecordVersion struct {
+	Time    time.Time `json:"time"`    // When the version was stored
+	Origin  string    `json:"origin"`  // Node the PUT came from, prefixed with its identity if it was signed
+	Records []Record  `json:"records"` // Records of the version
+}
+
+/*
+Appends the record sets of payload, as written by msg, to the history of their keys.
+*/
+func (node *Node) recordVersions(msg *message.RequestMessage, payload map[uint64][]Record) {
+	origin := msg.From
+	if identity := node.verifiedIdentity(msg); identity != "" {
+		origin = identity + "@" + msg.From
+	}
+	now := time.Now()
+	node.storageMu.Lock()
+	defer node.storageMu.Unlock()
+	if node.history == nil {
+		node.history = make(map[uint64][]RecordVersion)
+	}
+	for key, records := range payload {
+		versions := append(node.history[key], RecordVersion{Time: now, Origin: origin, Records: records})
+		if len(versions) > HISTORY_DEPTH {
+			versions = versions[len(versions)-HISTORY_DEPTH:]
+		}
+		node.history[key] = versions
+	}
+}
+
+/*
+Returns the versions of key this node recorded, oldest first, in the form of a HISTORY reply: the
+records of each version in Payload and its origin in Names, both under the version's time in Unix
+nanoseconds.
+*/
+func (node *Node) localHistory(key uint64) (map[uint64][]Record, map[uint64]string) {
+	node.storageMu.RLock()
+	defer node.storageMu.RUnlock()
+	payload := make(map[uint64][]Record)
+	origins := make(map[uint64]string)
+	for _, version := range node.history[key] {
+		stamp := uint64(version.Time.UnixNano())
+		payload[stamp] = version.Records
+		origins[stamp] = version.Origin
+	}
+	return payload, origins
+}
+
+/*
+Returns the recorded versions of the records of website, oldest first, as kept by the node
+responsible for it.
+*/
+func (node *Node) History(website string) ([]RecordVersion, error) {
+	website, err := NormalizeName(website)
+	if err != nil {
+		return nil, err
+	}
+	key := hashing.Hash(website)
+	succPointer, _ := node.FindSuccessor(key, 0)
+	reply := node.CallRPC(message.RequestMessage{Type: HISTORY, TargetId: key}, succPointer.IP)
+	if reply.Type != ACK {
+		return nil, fmt.Errorf("Nodeid: %d IP: %s did not answer the history request", succPointer.Nodeid, succPointer.IP)
+	}
+	versions := []RecordVersion{}
+	for stamp, records := range reply.Payload {
+		versions = append(versions, RecordVersion{Time: time.Unix(0, int64(stamp)), Origin: reply.Names[stamp], Records: decompressRecords(records)})
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Time.Before(versions[j].Time) })
+	return versions, nil
+}
+
+/*
+Restores the records of website to the given version of its history, as numbered by History
+(0 is the oldest). The version is written as a new PUT, so it becomes the newest version in turn,
+and reaches the replicas with the next replication round of the responsible node.
+*/
+func (node *Node) Rollback(website string, version int) error {
+	versions, err := node.History(website)
+	if err != nil {
+		return err
+	}
+	if version < 0 || version >= len(versions) {
+		return fmt.Errorf("%s has no version %d, it has %d", website, version, len(versions))
+	}
+	if !node.UpdateRecords(website, versions[version].Records) {
+		return fmt.Errorf("the responsible node did not accept the records of %s", website)
+	}
+	log.Info().Msgf("Rolled %s back to version %d of %s", website, version, versions[version].Time.Format(time.RFC3339))
+	return nil
+}
@@ -0,0 +1,78 @@
+/*
+Import of record sets from hosts file syntax, as in /etc/hosts:
+
+	# lab machines
+	10.0.0.7   build.lab   build-alias.lab
+	10.0.0.8   printer.lab
+	fd00::8    printer.lab
+
+Every line maps an address to one or more names, and everything after a # is a comment. The
+addresses of all lines of a name form its record set, A records for IPv4 and AAAA records for IPv6
+addresses, so a name can have addresses of both families. Small static mappings such as lab
+machines or IoT devices can be published into the ring from the file they are already kept in.
+*/
+package node
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/fauzxan/dns-chord/v2/hashing"
+)
+
+// Constants
+const (
+	EXPORT_FORMAT_HOSTS = "hosts" // Hosts file syntax, for imports only.
+)
+
+/*
+Parses a hosts file from r, and passes one line per name to accept until it returns false. Names
+are passed in the order they first appear in, once the whole file is read, since later lines may
+add addresses to them.
+*/
+func readHosts(r io.Reader, accept func(importLine) bool) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), IMPORT_MAX_LINE)
+	order := []string{}
+	records := make(map[string][]Record)
+	for number := 1; scanner.Scan(); number++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			return fmt.Errorf("line %d: %q is not an IP address", number, fields[0])
+		}
+		if len(fields) == 1 {
+			return fmt.Errorf("line %d: no names for %s", number, fields[0])
+		}
+		record := addressRecord(ip)
+		for _, field := range fields[1:] {
+			name, err := NormalizeName(field)
+			if err != nil {
+				return fmt.Errorf("line %d: %v", number, err)
+			}
+			if _, ok := records[name]; !ok {
+				order = append(order, name)
+			}
+			if !slices.ContainsFunc(records[name], func(known Record) bool { return sameRecord(known, record) }) {
+				records[name] = append(records[name], record)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	for _, name := range order {
+		if !accept(importLine{key: hashing.Hash(name), name: name, records: records[name]}) {
+			return nil
+		}
+	}
+	return nil
+}
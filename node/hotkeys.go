@@ -0,0 +1,228 @@
+/*
+Hot key detection. The node responsible for a name counts the GETs for it, and a name read more
+than Config.HotKeyRate times per second over a window is hot for HOT_KEY_DURATION after its rate
+drops again. While a name is hot, its owner boosts it in two ways: replies carry a cache-control
+policy of at least HOT_KEY_CACHE_TTL, so that readers and their DNS clients ask less often, and
+the record set is pushed to HOT_KEY_EXTRA_REPLICAS successors beyond the regular replicas. Those
+answer lookups of the name from their own clients locally, and take over from the owner when it
+sheds load with BUSY.
+*/
+package node
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fauzxan/dns-chord/v2/message"
+	"github.com/rs/zerolog/log"
+)
+
+// Constants
+const (
+	HOT_KEY_WINDOW         = 10 * time.Second // Window over which the read rate of a key is measured.
+	HOT_KEY_DURATION       = 5 * time.Minute  // Time a key stays boosted after its rate was last above the threshold.
+	HOT_KEY_EXTRA_REPLICAS = 2                // Successors beyond the replicas that hold a hot key.
+	HOT_KEY_CACHE_TTL      = 10 * time.Minute // Minimum cache max-age of a hot key, unless its owner forbids caching.
+)
+
+/*
+A key whose read rate was above the threshold.
+*/
+type HotKey struct {
+	Key   uint64    `json:"key"`
+	Name  string    `json:"name"`
+	Rate  float64   `json:"rate"`  // GETs per second in the last window it was hot in
+	Until time.Time `json:"until"` // When the boost ends, unless the key stays hot
+}
+
+/*
+Read counts and boosts of the keys of a node.
+*/
+type hotKeyTable struct {
+	mu      sync.Mutex
+	counts  map[uint64]uint64    // GETs per key in the current window
+	hot     map[uint64]HotKey    // Keys of this node that are boosted
+	boosted map[uint64]time.Time // Keys of other nodes pushed here as extra replicas, and when that ends
+}
+
+/*
+Counts a GET of key.
+*/
+func (node *Node) countRead(key uint64) {
+	if node.Config.HotKeyRate <= 0 {
+		return
+	}
+	node.hotKeys.mu.Lock()
+	defer node.hotKeys.mu.Unlock()
+	if node.hotKeys.counts == nil {
+		node.hotKeys.counts = make(map[uint64]uint64)
+	}
+	node.hotKeys.counts[key]++
+}
+
+/*
+Periodically finds the hot keys among the keys of this node, and pushes them to the extra replicas.
+*/
+func (node *Node) detectHotKeys() {
+	if node.Config.HotKeyRate <= 0 {
+		return
+	}
+	for node.sleep(HOT_KEY_WINDOW) {
+		if hot := node.rollHotKeys(); len(hot) > 0 {
+			node.boostHotKeys(hot)
+		}
+	}
+}
+
+/*
+Closes the current window: marks the keys of this node read more often than the threshold as hot,
+and ends the boost of keys that have cooled down. Returns the record sets of the hot keys.
+*/
+func (node *Node) rollHotKeys() map[uint64][]Record {
+	node.hotKeys.mu.Lock()
+	counts := node.hotKeys.counts
+	node.hotKeys.counts = make(map[uint64]uint64)
+	node.hotKeys.mu.Unlock()
+
+	now := time.Now()
+	node.storageMu.RLock()
+	defer node.storageMu.RUnlock()
+	node.hotKeys.mu.Lock()
+	defer node.hotKeys.mu.Unlock()
+	if node.hotKeys.hot == nil {
+		node.hotKeys.hot = make(map[uint64]HotKey)
+	}
+	for key, count := range counts {
+		rate := float64(count) / HOT_KEY_WINDOW.Seconds()
+		if _, mine := node.HashIPStorage[node.Nodeid][key]; !mine || rate <= node.Config.HotKeyRate {
+			continue
+		}
+		if _, ok := node.hotKeys.hot[key]; !ok {
+			log.Info().Msgf("Key %d (%s) is hot at %.1f reads/s, boosting it", key, node.names[key], rate)
+			node.incMetric("hot_keys_detected_total", 1)
+		}
+		node.hotKeys.hot[key] = HotKey{Key: key, Name: node.names[key], Rate: rate, Until: now.Add(HOT_KEY_DURATION)}
+	}
+	hot := make(map[uint64][]Record)
+	for key, entry := range node.hotKeys.hot {
+		records, mine := node.HashIPStorage[node.Nodeid][key]
+		if !mine || now.After(entry.Until) {
+			delete(node.hotKeys.hot, key)
+			continue
+		}
+		hot[key] = records
+	}
+	return hot
+}
+
+/*
+Pushes the hot record sets to the successors after the regular replicas.
+*/
+func (node *Node) boostHotKeys(hot map[uint64][]Record) {
+	seen := map[string]bool{node.IP: true}
+	targets := node.replicaTargets()
+	for _, target := range targets {
+		seen[target.IP] = true
+	}
+	current := node.successor()
+	if len(targets) > 0 {
+		current = targets[len(targets)-1]
+	}
+	msg := message.RequestMessage{Type: BOOST, TargetId: node.Nodeid, Payload: hot, Names: node.namesFor(hot)}
+	for extra := 0; extra < HOT_KEY_EXTRA_REPLICAS; {
+		reply := node.CallRPC(message.RequestMessage{Type: GET_SUCCESSOR}, current.IP)
+		current = Pointer{Nodeid: reply.Nodeid, IP: reply.IP}
+		if reply.Type == EMPTY || seen[current.IP] {
+			return // Around the ring, every node holds the keys already.
+		}
+		seen[current.IP] = true
+		node.CallRPC(msg, current.IP)
+		extra++
+	}
+}
+
+/*
+Stores the hot record sets pushed by another node, and keeps them from being garbage collected
+until their boost ends.
+*/
+func (node *Node) acceptBoost(msg *message.RequestMessage) {
+	node.learnNames(msg.Names)
+	payload := node.admitKeys(msg.Payload)
+	node.processReplicate(msg.TargetId, payload)
+	node.hotKeys.mu.Lock()
+	defer node.hotKeys.mu.Unlock()
+	if node.hotKeys.boosted == nil {
+		node.hotKeys.boosted = make(map[uint64]time.Time)
+	}
+	for key := range payload {
+		node.hotKeys.boosted[key] = time.Now().Add(HOT_KEY_DURATION)
+	}
+}
+
+/*
+Returns whether key was pushed here as a hot key of another node, and still is.
+*/
+func (node *Node) boosted(key uint64) bool {
+	node.hotKeys.mu.Lock()
+	defer node.hotKeys.mu.Unlock()
+	until, ok := node.hotKeys.boosted[key]
+	if ok && time.Now().After(until) {
+		delete(node.hotKeys.boosted, key)
+		return false
+	}
+	return ok
+}
+
+/*
+Returns the replicated records of key if it is a boosted hot key, so that lookups of it from this
+node need not reach its owner.
+*/
+func (node *Node) boostedRecords(key uint64) ([]Record, bool) {
+	if !node.boosted(key) {
+		return nil, false
+	}
+	node.storageMu.RLock()
+	defer node.storageMu.RUnlock()
+	for _, storage := range node.HashIPStorage {
+		if records, ok := storage[key]; ok {
+			return records, true
+		}
+	}
+	return nil, false
+}
+
+/*
+Returns records with their cache max-age raised to HOT_KEY_CACHE_TTL if key is hot here. Record
+sets whose owner forbids caching are returned unchanged.
+*/
+func (node *Node) boostCachePolicy(key uint64, records []Record) []Record {
+	node.hotKeys.mu.Lock()
+	_, hot := node.hotKeys.hot[key]
+	node.hotKeys.mu.Unlock()
+	if cacheable, maxAge := cachePolicy(records); !hot || !cacheable || maxAge >= HOT_KEY_CACHE_TTL {
+		return records
+	}
+	boosted := []Record{}
+	for _, record := range records {
+		if rtype, _ := ParseRecord(record); rtype != TYPE_CACHE {
+			boosted = append(boosted, record)
+		}
+	}
+	return append(boosted, NewRecord(TYPE_CACHE, "max-age="+strconv.Itoa(int(HOT_KEY_CACHE_TTL.Seconds()))))
+}
+
+/*
+Returns the hot keys of this node, hottest first.
+*/
+func (node *Node) HotKeys() []HotKey {
+	node.hotKeys.mu.Lock()
+	defer node.hotKeys.mu.Unlock()
+	list := []HotKey{}
+	for _, entry := range node.hotKeys.hot {
+		list = append(list, entry)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Rate > list[j].Rate })
+	return list
+}
@@ -0,0 +1,297 @@
+/*
+Node ID assignment. By default the ID of a node is the hash of its address, which moves the node
+to another point of the ring whenever its address changes, and leaves its placement to chance.
+ID_STRATEGY picks another way to assign it:
+
+  - address, the default: the hash of ip:port.
+  - random: a random ID, drawn on the first start and kept in the data directory, so that the
+    node rejoins at the same point after a restart, whatever its address.
+  - fixed: the ID in NODE_ID, for deployments that place their nodes themselves.
+  - name: the hash of NODE_NAME, a stable name for the node independent of its address.
+  - pubkey: the hash of the node's public key, read from NODE_KEY_FILE (default node-key.pem in
+    the data directory). An Ed25519 key pair is generated there on the first start if the file
+    does not exist. The file can also hold only a public key, e.g. one kept in a secret store.
+
+The ID files of random and pubkey are locked for the lifetime of the process, with NODE_ID_FILE's
+or the key file's name and a .lock suffix, so that a second node started with the same data
+directory refuses to start rather than take the same ID.
+
+--node-id and --node-name on the command line select fixed and name.
+*/
+package node
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fauzxan/dns-chord/v2/hashing"
+	"github.com/rs/zerolog/log"
+)
+
+// ID strategies.
+const (
+	ID_STRATEGY_ADDRESS    = "address"
+	ID_STRATEGY_RANDOM     = "random"
+	ID_STRATEGY_FIXED      = "fixed"
+	ID_STRATEGY_NAME       = "name"
+	ID_STRATEGY_PUBLIC_KEY = "pubkey"
+)
+
+// Constants
+const (
+	NODE_ID_FILE  = "node-id"      // File in the data directory a random ID is kept in.
+	NODE_KEY_FILE = "node-key.pem" // Key file in the data directory if NODE_KEY_FILE is not set.
+)
+
+/*
+The ID files locked by this process, see lockIDFile.
+*/
+var idLocks struct {
+	mu    sync.Mutex
+	files map[string]*os.File
+}
+
+/*
+Assigns the ID of a node.
+*/
+type IDStrategy interface {
+	// Returns the ID of the node listening on addr (ip:port), or an error if there is none.
+	NodeID(addr string) (uint64, error)
+}
+
+/*
+The hash of the node's address.
+*/
+type AddressID struct{}
+
+/*
+A random ID, kept in the file at Path.
+*/
+type RandomID struct {
+	Path string
+}
+
+/*
+An ID chosen by the operator.
+*/
+type FixedID struct {
+	ID uint64
+}
+
+/*
+The hash of a name.
+*/
+type NameID struct {
+	Name string
+}
+
+/*
+The hash of the public key in the PEM file at Path, generated if the file does not exist.
+*/
+type PublicKeyID struct {
+	Path string
+}
+
+/*
+Returns the ID strategy configured by config, see the top of this file.
+*/
+func NewIDStrategy(config Config) (IDStrategy, error) {
+	dataDir := config.DataDir
+	if dataDir == "" {
+		dataDir = "./data"
+	}
+	switch config.IDStrategy {
+	case "", ID_STRATEGY_ADDRESS:
+		return AddressID{}, nil
+	case ID_STRATEGY_RANDOM:
+		return RandomID{Path: filepath.Join(dataDir, NODE_ID_FILE)}, nil
+	case ID_STRATEGY_FIXED:
+		if config.NodeID == "" {
+			return nil, errors.New("ID_STRATEGY=fixed needs NODE_ID")
+		}
+		id, err := ParseNodeID(config.NodeID)
+		if err != nil {
+			return nil, err
+		}
+		return FixedID{ID: id}, nil
+	case ID_STRATEGY_NAME:
+		if config.NodeName == "" {
+			return nil, errors.New("ID_STRATEGY=name needs NODE_NAME")
+		}
+		return NameID{Name: config.NodeName}, nil
+	case ID_STRATEGY_PUBLIC_KEY:
+		path := config.NodeKeyFile
+		if path == "" {
+			path = filepath.Join(dataDir, NODE_KEY_FILE)
+		}
+		return PublicKeyID{Path: path}, nil
+	}
+	return nil, fmt.Errorf("unknown ID_STRATEGY %q, want %s, %s, %s, %s or %s", config.IDStrategy,
+		ID_STRATEGY_ADDRESS, ID_STRATEGY_RANDOM, ID_STRATEGY_FIXED, ID_STRATEGY_NAME, ID_STRATEGY_PUBLIC_KEY)
+}
+
+/*
+Parses a node ID given by an operator, which has to fit the keyspace.
+*/
+func ParseNodeID(s string) (uint64, error) {
+	id, err := strconv.ParseUint(strings.TrimSpace(s), 10, 64)
+	if err != nil || id > hashing.Mask() {
+		return 0, fmt.Errorf("node ID %q is not an integer in [0, 2^%d)", s, hashing.Bits())
+	}
+	return id, nil
+}
+
+func (AddressID) NodeID(addr string) (uint64, error) {
+	// The trailing newline is that of the port as typed in at the prompt, which IDs have always kept.
+	return hashing.Hash(addr + "\n"), nil
+}
+
+func (strategy FixedID) NodeID(string) (uint64, error) {
+	if strategy.ID > hashing.Mask() {
+		return 0, fmt.Errorf("node ID %d is outside the keyspace of 2^%d IDs", strategy.ID, hashing.Bits())
+	}
+	return strategy.ID, nil
+}
+
+func (strategy NameID) NodeID(string) (uint64, error) {
+	return hashing.Hash(strategy.Name), nil
+}
+
+func (strategy RandomID) NodeID(string) (uint64, error) {
+	if err := lockIDFile(strategy.Path); err != nil {
+		return 0, err
+	}
+	if data, err := os.ReadFile(strategy.Path); err == nil {
+		id, err := ParseNodeID(string(data))
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", strategy.Path, err)
+		}
+		return id, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+	var random [8]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return 0, err
+	}
+	id := binary.BigEndian.Uint64(random[:]) & hashing.Mask()
+	if err := os.MkdirAll(filepath.Dir(strategy.Path), 0777); err != nil {
+		return 0, err
+	}
+	if err := os.WriteFile(strategy.Path, []byte(strconv.FormatUint(id, 10)+"\n"), 0644); err != nil {
+		return 0, err
+	}
+	log.Info().Msgf("Drew the random node ID %d, kept in %s", id, strategy.Path)
+	return id, nil
+}
+
+func (strategy PublicKeyID) NodeID(string) (uint64, error) {
+	if err := lockIDFile(strategy.Path); err != nil {
+		return 0, err
+	}
+	data, err := os.ReadFile(strategy.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		data, err = generateNodeKey(strategy.Path)
+	}
+	if err != nil {
+		return 0, err
+	}
+	public, err := parsePublicKey(data)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", strategy.Path, err)
+	}
+	return hashing.Hash(string(public)), nil
+}
+
+/*
+Locks the ID file at path for the lifetime of the process, so that no other node shares it. The
+open lock file is kept, as closing it would release the lock. Locking a file this process already
+holds succeeds.
+*/
+func lockIDFile(path string) error {
+	idLocks.mu.Lock()
+	defer idLocks.mu.Unlock()
+	if idLocks.files[path] != nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	if err := lockFile(file); err != nil {
+		file.Close()
+		return fmt.Errorf("%s is in use by another node, give every node a DATA_DIR of its own: %w", path, err)
+	}
+	if idLocks.files == nil {
+		idLocks.files = make(map[string]*os.File)
+	}
+	idLocks.files[path] = file
+	return nil
+}
+
+/*
+Generates an Ed25519 key pair, writes the private key to path as PKCS #8 PEM, and returns the file.
+*/
+func generateNodeKey(path string) ([]byte, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return nil, err
+	}
+	log.Info().Msgf("Generated the node key %s", path)
+	return data, nil
+}
+
+/*
+Returns the DER encoded public key of the first PRIVATE KEY or PUBLIC KEY block in the PEM data.
+*/
+func parsePublicKey(data []byte) ([]byte, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no PRIVATE KEY or PUBLIC KEY block")
+		}
+		switch block.Type {
+		case "PUBLIC KEY":
+			if _, err := x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+				return nil, err
+			}
+			return block.Bytes, nil
+		case "PRIVATE KEY":
+			private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			signer, ok := private.(crypto.Signer)
+			if !ok {
+				return nil, errors.New("private key without a public key")
+			}
+			return x509.MarshalPKIXPublicKey(signer.Public())
+		}
+	}
+}
@@ -0,0 +1,80 @@
+/*
+Instance IDs. Every start of a node gets a random UUID, distinct from its Chord ID, which is
+derived from its address and stays the same across restarts. The instance ID is sent along with
+every RPC and reply, reported in metrics, statistics and /health, and added to the log lines of a
+process, so that logs of experiments tell a restarted node from the one before it, and two nodes
+that ended up with the same Chord ID from each other. A node notices when a peer's instance
+changes, and logs it as a restart.
+*/
+package node
+
+import (
+	"crypto/rand"
+	"fmt"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Constants
+const (
+	INSTANCE_TABLE_SIZE = 1024 // Peers whose instance IDs a node remembers, to notice their restarts.
+)
+
+/*
+The instance ID of a node, and the last instance IDs of its peers by IP.
+*/
+type instanceTable struct {
+	once  sync.Once
+	id    string
+	mu    sync.Mutex
+	peers map[string]string
+}
+
+/*
+Returns a random UUID (RFC 4122, version 4).
+*/
+func newInstanceID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0F | 0x40
+	b[8] = b[8]&0x3F | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+/*
+Returns the instance ID of this node, created the first time it is asked for.
+*/
+func (node *Node) InstanceID() string {
+	node.instances.once.Do(func() {
+		node.instances.id = newInstanceID()
+		node.instances.peers = make(map[string]string)
+	})
+	return node.instances.id
+}
+
+/*
+Records that the peer at IP runs as instance, as carried by one of its messages, and logs a
+restart if it ran as another instance before. Messages of nodes that predate instance IDs carry
+none, and are ignored.
+*/
+func (node *Node) learnInstance(IP string, instance string) {
+	if IP == "" || instance == "" || IP == node.IP {
+		return
+	}
+	node.InstanceID()
+	node.instances.mu.Lock()
+	previous, known := node.instances.peers[IP]
+	if !known && len(node.instances.peers) >= INSTANCE_TABLE_SIZE {
+		for ip := range node.instances.peers {
+			delete(node.instances.peers, ip)
+			break
+		}
+	}
+	node.instances.peers[IP] = instance
+	node.instances.mu.Unlock()
+	if known && previous != instance {
+		node.incMetric("peer_restarts_total", 1)
+		log.Info().Msgf("Peer %s restarted, instance %s replaced %s", IP, instance, previous)
+	}
+}
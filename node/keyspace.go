@@ -0,0 +1,68 @@
+/*
+Self-healing of the keyspace. After churn, a node can end up holding keys in its own storage that
+it is no longer responsible for, e.g. when a node joined in between and the SHIFT missed some keys.
+A background verifier periodically finds such keys and moves them to their current owners.
+*/
+package node
+
+import (
+	"time"
+
+	"github.com/fauzxan/dns-chord/v2/message"
+	"github.com/rs/zerolog/log"
+)
+
+// Constants
+const (
+	KEYSPACE_VERIFY_INTERVAL = 30 * time.Second // Time between two keyspace verification rounds.
+)
+
+/*
+Periodically moves misplaced keys to their owners.
+*/
+func (node *Node) verifyKeyspace() {
+	for node.sleep(KEYSPACE_VERIFY_INTERVAL) {
+		node.healKeyspace()
+	}
+}
+
+/*
+Moves every key in this node's own storage that falls outside (predecessor, node] to the node now
+responsible for it. Returns the number of keys moved.
+*/
+func (node *Node) healKeyspace() int {
+	if (node.predecessor() == Pointer{}) {
+		return 0
+	}
+	predecessor := node.predecessor()
+
+	misplaced := make(map[uint64][]Record)
+	node.storageMu.RLock()
+	for key, ip_cache := range node.HashIPStorage[node.Nodeid] {
+		if !belongsTo(key, predecessor.Nodeid, node.Nodeid) {
+			misplaced[key] = ip_cache
+		}
+	}
+	node.storageMu.RUnlock()
+
+	moved := 0
+	for key, ip_cache := range misplaced {
+		owner, _ := node.backgroundFindSuccessor(key)
+		if (owner == Pointer{} || owner.Nodeid == node.Nodeid) {
+			continue
+		}
+		payload := map[uint64][]Record{key: ip_cache}
+		reply := node.CallRPC(message.RequestMessage{Type: PUT, TargetId: owner.Nodeid, Payload: payload, Names: node.namesFor(payload)}, owner.IP)
+		if reply.Type != ACK && reply.Type != REDIRECT {
+			log.Warn().Msgf("Could not move misplaced key %d to Nodeid: %d IP: %s", key, owner.Nodeid, owner.IP)
+			continue
+		}
+		node.storageMu.Lock()
+		delete(node.HashIPStorage[node.Nodeid], key)
+		node.storageMu.Unlock()
+		log.Info().Msgf("Moved misplaced key %d to its owner Nodeid: %d IP: %s", key, owner.Nodeid, owner.IP)
+		node.incMetric("keyspace_corrections_total", 1)
+		moved++
+	}
+	return moved
+}
@@ -0,0 +1,161 @@
+/*
+Round trip time probing of peers. Each node periodically pings the nodes in its successor list and
+finger table, and keeps an exponentially weighted moving average of the RTT to each of them. The
+averages give a notion of network distance that routing and replica selection take into account:
+a lookup is forwarded to a nearer peer than the closest preceding finger if that peer takes it as
+far along the ring, and replicas are read from, and fallen back to, the nearest first.
+*/
+package node
+
+import (
+	"math/bits"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fauzxan/dns-chord/v2/hashing"
+	"github.com/fauzxan/dns-chord/v2/message"
+)
+
+// Constants
+const (
+	LATENCY_PROBE_INTERVAL = 5 * time.Second // Time between two rounds of RTT probes.
+	LATENCY_EWMA_ALPHA     = 0.3             // Weight of the newest sample in the moving average.
+)
+
+/*
+Smoothed RTT to a single peer.
+*/
+type PeerLatency struct {
+	Nodeid   uint64        `json:"nodeid"`
+	IP       string        `json:"ip"`
+	RTT      time.Duration `json:"rtt_ns"`    // Moving average of the round trip time
+	Samples  int           `json:"samples"`   // Number of successful probes
+	LastSeen time.Time     `json:"last_seen"` // When the last successful probe completed
+}
+
+/*
+Book keeping of the RTT to every probed peer, keyed by IP.
+*/
+type latencyTable struct {
+	mu    sync.Mutex
+	peers map[string]*PeerLatency
+}
+
+/*
+Periodically probes every peer in the successor list and finger table.
+*/
+func (node *Node) probeLatency() {
+	for node.sleep(LATENCY_PROBE_INTERVAL) {
+		for _, peer := range node.probeTargets() {
+			start := time.Now()
+			reply := node.CallRPC(message.RequestMessage{Type: PING}, peer.IP)
+			if reply.Type == ACK {
+				node.recordLatency(peer, time.Since(start))
+			}
+		}
+	}
+}
+
+/*
+Returns the distinct peers (other than this node) from the successor list and finger table.
+*/
+func (node *Node) probeTargets() []Pointer {
+	seen := map[string]bool{node.IP: true, "": true}
+	targets := []Pointer{}
+	candidates := append(node.succList(), node.fingers()...)
+	for _, pointer := range candidates {
+		if !seen[pointer.IP] {
+			seen[pointer.IP] = true
+			targets = append(targets, pointer)
+		}
+	}
+	return targets
+}
+
+/*
+Folds a new RTT sample for peer into its moving average.
+*/
+func (node *Node) recordLatency(peer Pointer, rtt time.Duration) {
+	node.latency.mu.Lock()
+	defer node.latency.mu.Unlock()
+	if node.latency.peers == nil {
+		node.latency.peers = make(map[string]*PeerLatency)
+	}
+	entry, ok := node.latency.peers[peer.IP]
+	if !ok {
+		entry = &PeerLatency{Nodeid: peer.Nodeid, IP: peer.IP, RTT: rtt}
+		node.latency.peers[peer.IP] = entry
+	}
+	entry.Nodeid = peer.Nodeid
+	entry.RTT = time.Duration(LATENCY_EWMA_ALPHA*float64(rtt) + (1-LATENCY_EWMA_ALPHA)*float64(entry.RTT))
+	entry.Samples++
+	entry.LastSeen = time.Now()
+}
+
+/*
+Returns the smoothed RTT to the peer at IP, and whether it has been measured yet.
+*/
+func (node *Node) Latency(IP string) (time.Duration, bool) {
+	node.latency.mu.Lock()
+	defer node.latency.mu.Unlock()
+	entry, ok := node.latency.peers[IP]
+	if !ok {
+		return 0, false
+	}
+	return entry.RTT, true
+}
+
+/*
+Returns the smoothed RTT to all probed peers, closest first.
+*/
+func (node *Node) PeerLatencies() []PeerLatency {
+	node.latency.mu.Lock()
+	defer node.latency.mu.Unlock()
+	peers := []PeerLatency{}
+	for _, entry := range node.latency.peers {
+		peers = append(peers, *entry)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].RTT < peers[j].RTT })
+	return peers
+}
+
+/*
+Returns the peer to forward a lookup of id to in place of closest, the closest preceding finger of
+id: a known peer preceding id with the lowest smoothed RTT among those that leave a distance to id
+of the same power of two as closest does, and so cost no more hops. Returns closest if no such peer
+has been measured to be nearer.
+*/
+func (node *Node) nearestPreceding(closest Pointer, id uint64) Pointer {
+	remaining := func(pointer Pointer) int { return bits.Len64((id - pointer.Nodeid) & hashing.Mask()) }
+	best := closest
+	bestRTT, measured := node.Latency(closest.IP)
+	for _, candidate := range append(node.fingers(), node.succList()...) {
+		if candidate.IP == "" || candidate.IP == best.IP || candidate.Nodeid == node.Nodeid || !between(candidate.Nodeid, node.Nodeid, id) || remaining(candidate) != remaining(closest) {
+			continue
+		}
+		if rtt, ok := node.Latency(candidate.IP); ok && (!measured || rtt < bestRTT) {
+			best, bestRTT, measured = candidate, rtt, true
+		}
+	}
+	return best
+}
+
+/*
+Orders peers by their smoothed RTT, lowest first, with this node itself first of all. Peers whose
+RTT has not been measured keep their order, after the measured ones.
+*/
+func (node *Node) byLatency(peers []Pointer) []Pointer {
+	rtt := func(pointer Pointer) (time.Duration, bool) {
+		if pointer.IP == node.IP {
+			return 0, true
+		}
+		return node.Latency(pointer.IP)
+	}
+	sort.SliceStable(peers, func(i, j int) bool {
+		a, aMeasured := rtt(peers[i])
+		b, bMeasured := rtt(peers[j])
+		return aMeasured && (!bMeasured || a < b)
+	})
+	return peers
+}
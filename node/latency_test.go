@@ -0,0 +1,71 @@
+package node
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/fauzxan/dns-chord/v2/hashing"
+)
+
+func TestClosestPrecedingNodePrefersNearerPeer(t *testing.T) {
+	ring := NewModelRing(0, 1<<20, 1<<31, 1<<31+1<<20, 3<<30)
+	nodes := ring.Nodes()
+	node := nodes[0]
+	for _, id := range ring[1:4] {
+		node.SuccList = append(node.SuccList, Pointer{Nodeid: id, IP: nodes[id].IP})
+	}
+	key := uint64(3<<30 - 1)
+	if got := node.ClosestPrecedingNode(key); got.Nodeid != 1<<31 {
+		t.Fatalf("closest preceding node of %d is %d without RTTs, want the finger %d", key, got.Nodeid, uint64(1<<31))
+	}
+	node.recordLatency(node.SuccList[0], time.Millisecond)
+	node.recordLatency(node.SuccList[1], 50*time.Millisecond)
+	node.recordLatency(node.SuccList[2], 10*time.Millisecond)
+	// 1<<31+1<<20 leaves a distance to key of the same power of two as the finger, 1<<20 does not.
+	if got := node.ClosestPrecedingNode(key); got.Nodeid != 1<<31+1<<20 {
+		t.Errorf("closest preceding node of %d is %d, want the nearer %d", key, got.Nodeid, uint64(1<<31+1<<20))
+	}
+}
+
+func TestRoutingWithLatencies(t *testing.T) {
+	random := rand.New(rand.NewSource(MODEL_SEED))
+	for i := 0; i < MODEL_ITERATIONS/10; i++ {
+		ring, key := randomModelLookup(random)
+		nodes := ring.Nodes()
+		for _, n := range nodes {
+			n.SuccList = []Pointer{n.Successor}
+			for next := n.Successor; len(n.SuccList) < min(len(ring), 4); {
+				next = Pointer{Nodeid: ring.Successor(next.Nodeid + 1), IP: nodes[ring.Successor(next.Nodeid+1)].IP}
+				n.SuccList = append(n.SuccList, next)
+			}
+			for _, peer := range n.probeTargets() {
+				n.recordLatency(peer, time.Duration(random.Intn(100))*time.Millisecond)
+			}
+		}
+		start := ring[random.Intn(len(ring))]
+		found, hops, err := RouteLookup(nodes, start, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := ring.Successor(key); found != want {
+			t.Fatalf("lookup of %d from %d found %d, not %d", key, start, found, want)
+		}
+		if hops > hashing.Bits() {
+			t.Fatalf("lookup of %d from %d took %d hops", key, start, hops)
+		}
+	}
+}
+
+func TestByLatency(t *testing.T) {
+	node := &Node{Nodeid: 1, IP: "self"}
+	node.recordLatency(Pointer{Nodeid: 2, IP: "slow"}, 30*time.Millisecond)
+	node.recordLatency(Pointer{Nodeid: 3, IP: "fast"}, time.Millisecond)
+	peers := node.byLatency([]Pointer{{IP: "unmeasured-a"}, {IP: "slow"}, {IP: "unmeasured-b"}, {IP: "fast"}, {IP: "self"}})
+	want := []string{"self", "fast", "slow", "unmeasured-a", "unmeasured-b"}
+	for i, peer := range peers {
+		if peer.IP != want[i] {
+			t.Fatalf("peers ordered as %v, want %v", peers, want)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+/*
+Lifecycle management for everything a node spawns in the background. Every periodic task
+(stabilize, fix fingers, check predecessor, replicate) and every RPC connection/handler is
+started through the node, so that it can be counted while it is alive and stopped when the
+node shuts down. This keeps long-running nodes from silently leaking goroutines and sockets.
+*/
+package node
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Constants
+const (
+	IDLE_CONN_TIMEOUT = 30 * time.Second // Inbound RPC connections with no traffic for this long are closed.
+	DIAL_TIMEOUT      = 2 * time.Second  // Upper bound on establishing an outbound RPC connection.
+	CALL_TIMEOUT      = 10 * time.Second // Upper bound on an outbound RPC call, including any recursive lookups it triggers.
+	SHUTDOWN_TIMEOUT  = 5 * time.Second  // Upper bound on waiting for goroutines to exit on shutdown.
+	MAX_TIMER_JITTER  = 0.5              // Upper bound on Config.TimerJitter, so that no interval shrinks below half its length.
+)
+
+/*
+Book keeping for the goroutines and listener owned by a node.
+*/
+type lifecycle struct {
+	once     sync.Once
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	counts   map[string]int        // number of live goroutines per task name
+	listener net.Listener          // inbound RPC listener, closed on shutdown
+	conns    map[net.Conn]struct{} // open inbound RPC connections, closed on shutdown
+	closing  bool                  // set once the RPC server drains, see drain.go
+}
+
+/*
+Returns the context of the node, which is cancelled when the node shuts down.
+*/
+func (node *Node) context() context.Context {
+	node.life.once.Do(func() {
+		node.life.ctx, node.life.cancel = context.WithCancel(context.Background())
+		node.life.counts = make(map[string]int)
+		node.life.conns = make(map[net.Conn]struct{})
+	})
+	return node.life.ctx
+}
+
+/*
+Runs fn in a new goroutine that is tracked under the given name until it returns.
+*/
+func (node *Node) spawn(name string, fn func()) {
+	node.context()
+	node.track(name, 1)
+	go func() {
+		defer node.track(name, -1)
+		fn()
+	}()
+}
+
+/*
+Adjusts the live goroutine count for name by delta, and the WaitGroup along with it.
+*/
+func (node *Node) track(name string, delta int) {
+	node.context()
+	node.life.mu.Lock()
+	node.life.counts[name] += delta
+	node.life.mu.Unlock()
+	node.life.wg.Add(delta)
+}
+
+/*
+Counts an RPC handler in, and returns true, unless the RPC server drains, see drain.go. Checking
+the closing flag and adding to the WaitGroup are one step under the lock drainRPCs sets the flag
+with, so that no handler adds to the WaitGroup once Shutdown may be waiting on it.
+*/
+func (node *Node) enterHandler() bool {
+	node.context()
+	node.life.mu.Lock()
+	defer node.life.mu.Unlock()
+	if node.life.closing {
+		return false
+	}
+	node.life.counts["rpc_handler"]++
+	node.life.wg.Add(1)
+	return true
+}
+
+/*
+Sleeps for d, or until the node shuts down. Returns false if the node is shutting down,
+which is the signal for periodic tasks to return.
+*/
+func (node *Node) sleep(d time.Duration) bool {
+	select {
+	case <-node.context().Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+/*
+Returns d, moved by a random amount of up to Config.TimerJitter of it in either direction. Periodic
+control traffic sleeps for jittered intervals, so that the nodes of a ring started at the same
+time do not keep their stabilize and fix fingers rounds in lockstep.
+*/
+func (node *Node) jittered(d time.Duration) time.Duration {
+	jitter := min(max(node.Config.TimerJitter, 0), MAX_TIMER_JITTER)
+	return time.Duration(float64(d) * (1 + jitter*(2*rand.Float64()-1)))
+}
+
+/*
+Returns the configured interval of a maintenance task, or def if it is not set, as for nodes that
+were set up without LoadConfig. Intervals are at least MIN_MAINTENANCE_INTERVAL.
+*/
+func maintenanceInterval(configured, def time.Duration) time.Duration {
+	if configured <= 0 {
+		return def
+	}
+	return max(configured, MIN_MAINTENANCE_INTERVAL)
+}
+
+/*
+Accepts inbound RPC connections on the listener until the node shuts down. Each connection is
+served in a tracked goroutine and is closed after IDLE_CONN_TIMEOUT without any traffic. Every node
+has its own RPC server, so that several nodes can run in one process.
+*/
+func (node *Node) Serve(listener net.Listener) {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Node", node); err != nil {
+		log.Error().Err(err).Msg("Could not register RPC methods")
+		return
+	}
+	node.life.mu.Lock()
+	node.life.listener = listener
+	node.life.mu.Unlock()
+	node.spawn("rpc_accept", func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if node.context().Err() != nil || node.shuttingDown() {
+					return
+				}
+				log.Error().Err(err).Msg("Error accepting connection")
+				continue
+			}
+			node.life.mu.Lock()
+			if node.Config.MaxConns > 0 && len(node.life.conns) >= node.Config.MaxConns {
+				node.life.mu.Unlock()
+				node.shed("conns")
+				conn.Close()
+				continue
+			}
+			node.life.conns[conn] = struct{}{}
+			node.life.mu.Unlock()
+			node.spawn("rpc_conn", func() {
+				node.serveRPCConn(server, &idleConn{Conn: &countingConn{Conn: conn, traffic: &node.traffic}, timeout: IDLE_CONN_TIMEOUT})
+				node.life.mu.Lock()
+				delete(node.life.conns, conn)
+				node.life.mu.Unlock()
+			})
+		}
+	})
+}
+
+/*
+Drains the RPC server, saves the cache if CACHE_PERSIST is set, stops all periodic tasks, closes
+the open connections, and waits up to SHUTDOWN_TIMEOUT for the tracked goroutines to exit. A
+crashed node has stopped already, and saves nothing.
+*/
+func (node *Node) Shutdown() {
+	if node.Crashed() {
+		return
+	}
+	node.drainRPCs()
+	if node.Config.CachePersist {
+		node.saveCache()
+	}
+	node.life.cancel()
+	node.life.mu.Lock()
+	for conn := range node.life.conns {
+		conn.Close()
+	}
+	node.life.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		node.life.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		log.Info().Msg("All goroutines have exited")
+	case <-time.After(SHUTDOWN_TIMEOUT):
+		log.Warn().Msgf("Timed out waiting for goroutines to exit: %v", node.GoroutineCounts())
+	}
+}
+
+/*
+Returns the number of live goroutines per task name, along with the total number of
+goroutines in the process.
+*/
+func (node *Node) GoroutineCounts() map[string]int {
+	node.context()
+	node.life.mu.Lock()
+	defer node.life.mu.Unlock()
+	counts := make(map[string]int, len(node.life.counts)+1)
+	for name, count := range node.life.counts {
+		counts[name] = count
+	}
+	counts["total"] = runtime.NumGoroutine()
+	return counts
+}
+
+/*
+Wraps an inbound connection so that each read must complete within timeout. A peer that holds
+a connection open without sending anything has it closed on them.
+*/
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
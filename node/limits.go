@@ -0,0 +1,138 @@
+/*
+Resource limits. A node can be capped in the RPCs it handles at once, the inbound connections it
+keeps open, the memory its cache takes and the number of keys it stores. When a limit is hit, the
+node sheds the excess work rather than running out of memory or stalling: excess lookups and GETs
+are answered BUSY, excess connections are closed, the cache evicts, and new keys are refused while
+existing ones can still be updated. A PUT with more new keys than fit is answered BUSY as a whole. The maintenance RPCs that keep the ring together (PING and
+stabilization) are never shed. Every limit is off by default, and its saturation is exported on
+the metrics endpoint.
+*/
+package node
+
+import (
+	"fmt"
+	"io"
+)
+
+// Constants
+const (
+	CACHE_ENTRY_OVERHEAD = 64 // Approximate bytes an entry takes in the cache, on top of its name and records.
+)
+
+/*
+Returns true for the messages that are served regardless of the RPC limit, because the ring
+depends on them to stay together.
+*/
+func maintenanceMessage(msgType string) bool {
+	switch msgType {
+	case PING, GET_SUCCESSOR, GET_PREDECESSOR, NOTIFY, STABILIZE, HANDOFF, LEAVE:
+		return true
+	}
+	return false
+}
+
+/*
+Returns true if the RPC limit is configured and reached.
+*/
+func (node *Node) rpcLimitReached() bool {
+	return node.Config.MaxRPCs > 0 && node.inflightRPCs() >= node.Config.MaxRPCs
+}
+
+/*
+Counts a unit of work shed because the limit of resource was hit.
+*/
+func (node *Node) shed(resource string) {
+	node.incMetric(fmt.Sprintf("load_shed_total{resource=%q}", resource), 1)
+}
+
+/*
+Returns the approximate memory taken by a cache entry.
+*/
+func cacheEntrySize(entry LRUCache) int {
+	size := CACHE_ENTRY_OVERHEAD + len(entry.name)
+	for _, record := range entry.value {
+		size += len(record.Rdata)
+	}
+	return size
+}
+
+/*
+Returns the approximate memory taken by the cache. Must be called with the cache lock held.
+*/
+func (node *Node) cacheBytes() int {
+	size := 0
+	for _, entry := range node.CachedQuery {
+		size += cacheEntrySize(entry)
+	}
+	return size
+}
+
+/*
+Returns the number of keys in storage, replicas included.
+*/
+func (node *Node) storageKeys() int {
+	node.storageMu.RLock()
+	defer node.storageMu.RUnlock()
+	keys := 0
+	for _, storage := range node.HashIPStorage {
+		keys += len(storage)
+	}
+	return keys
+}
+
+/*
+Returns the part of payload that fits in storage: updates of keys that are stored already, and as
+many new keys as the storage limit allows.
+*/
+func (node *Node) admitKeys(payload map[uint64][]Record) map[uint64][]Record {
+	if node.Config.MaxStorageKeys <= 0 {
+		return payload
+	}
+	free := node.Config.MaxStorageKeys - node.storageKeys()
+	admitted := make(map[uint64][]Record, len(payload))
+	node.storageMu.RLock()
+	for key, ip_cache := range payload {
+		if len(ip_cache) == 0 {
+			admitted[key] = ip_cache // Drops the key, see replicas.go
+			continue
+		}
+		stored := false
+		for _, storage := range node.HashIPStorage {
+			if _, stored = storage[key]; stored {
+				break
+			}
+		}
+		if !stored && free <= 0 {
+			node.shed("storage")
+			continue
+		}
+		if !stored {
+			free--
+		}
+		admitted[key] = ip_cache
+	}
+	node.storageMu.RUnlock()
+	return admitted
+}
+
+/*
+Writes the saturation of every configured limit, the share of it in use, as gauges.
+*/
+func (node *Node) writeSaturation(w io.Writer) {
+	gauge := func(resource string, used, limit int) {
+		if limit > 0 {
+			fmt.Fprintf(w, "dns_chord_saturation{resource=%q} %g\n", resource, float64(used)/float64(limit))
+		}
+	}
+	node.life.mu.Lock()
+	conns := len(node.life.conns)
+	node.life.mu.Unlock()
+	node.cacheMu.Lock()
+	cacheBytes := node.cacheBytes()
+	node.cacheMu.Unlock()
+
+	gauge("rpcs", node.inflightRPCs(), node.Config.MaxRPCs)
+	gauge("conns", conns, node.Config.MaxConns)
+	gauge("cache", cacheBytes, node.Config.MaxCacheBytes)
+	gauge("storage", node.storageKeys(), node.Config.MaxStorageKeys)
+}
@@ -0,0 +1,92 @@
+/*
+Runtime control of the log level. Protocol-level logs (every message sent and received, every
+stabilize round) are at debug level, and too verbose to leave on, so the level can be changed on a
+live node through the admin endpoint, the menu or a LOG_LEVEL message, and on every node of the
+ring at once, and set back once debugging is done. The level is that of the process, and therefore
+shared by all rings a process takes part in.
+*/
+package node
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/fauzxan/dns-chord/v2/message"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// The level logging is set to, and resumed at after the menu paused it for input.
+var logLevel atomic.Int32
+
+func init() {
+	logLevel.Store(int32(zerolog.InfoLevel))
+}
+
+/*
+Returns the log level of the process.
+*/
+func LogLevel() zerolog.Level {
+	return zerolog.Level(logLevel.Load())
+}
+
+/*
+Sets the log level of the process to the named level (trace, debug, info, warn, error, ...).
+*/
+func SetLogLevel(name string) error {
+	level, err := zerolog.ParseLevel(name)
+	if err != nil || name == "" {
+		return fmt.Errorf("%q is not a log level", name)
+	}
+	logLevel.Store(int32(level))
+	zerolog.SetGlobalLevel(level)
+	log.WithLevel(level).Msgf("Log level set to %s", level)
+	return nil
+}
+
+/*
+Processes a LOG_LEVEL message: sets the level named in msg.IP, if any, and replies with the level
+now in effect.
+*/
+func (node *Node) handleLogLevel(msg *message.RequestMessage, reply *message.ResponseMessage) {
+	if msg.IP != "" {
+		if err := SetLogLevel(msg.IP); err != nil {
+			log.Warn().Err(err).Msgf("Ignoring the log level of %s", msg.From)
+			return
+		}
+	}
+	reply.Type = ACK
+	reply.QueryResponse = []string{LogLevel().String()}
+}
+
+/*
+Sets the log level of every node in the ring, this one included, and returns the level now in
+effect on each node by IP. Nodes that did not accept the level are left out.
+*/
+func (node *Node) SetRingLogLevel(name string) (map[string]string, error) {
+	if _, err := zerolog.ParseLevel(name); err != nil || name == "" {
+		return nil, fmt.Errorf("%q is not a log level", name)
+	}
+	walk, ok := node.walkRing()
+	if !ok {
+		log.Warn().Msgf("The ring walk broke off after %d nodes, setting their log level only", len(walk))
+	}
+	levels := make(map[string]string)
+	if node.Observing() {
+		// An observer is not part of its own walk.
+		walk = append(walk, Pointer{Nodeid: node.Nodeid, IP: node.IP})
+	}
+	for _, pointer := range walk {
+		if pointer.IP == node.IP {
+			if err := SetLogLevel(name); err == nil {
+				levels[node.IP] = LogLevel().String()
+			}
+			continue
+		}
+		reply := node.CallRPC(message.RequestMessage{Type: LOG_LEVEL, IP: name}, pointer.IP)
+		if reply.Type == ACK && len(reply.QueryResponse) == 1 {
+			levels[pointer.IP] = reply.QueryResponse[0]
+		}
+	}
+	return levels, nil
+}
@@ -0,0 +1,100 @@
+/*
+Adaptive sampling of per-query logs. Every lookup logs a handful of lines on its way through the
+ring, and every RPC a few more at debug level, so that under load logging, rather than the ring,
+becomes the bottleneck of a node. Lines of the query path are therefore logged through sampledLog,
+which logs them all as long as there are at most LOG_SAMPLE_THRESHOLD of them in a second (default
+100), and only 1 in LOG_SAMPLE_RATE (default 10) of the rest of that second. Warnings and errors
+are never sampled, and neither are the logs of topology changes, which do not go through sampledLog.
+Lines that are left out are counted in log_lines_sampled_total. Like the log level, sampling is
+that of the process, see loglevel.go.
+*/
+package node
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Constants
+const (
+	DEFAULT_LOG_SAMPLE_THRESHOLD = 100 // LOG_SAMPLE_THRESHOLD if not set, query log lines per second.
+	DEFAULT_LOG_SAMPLE_RATE      = 10  // LOG_SAMPLE_RATE if not set.
+)
+
+/*
+Sampler of the query logs of the process, which lets every line through below the threshold and 1
+in rate above it, counted per second.
+*/
+type querySampler struct {
+	threshold atomic.Int64 // Lines per second logged in full, 0 for no sampling
+	rate      atomic.Int64 // 1 in rate lines logged above the threshold
+	dropped   atomic.Int64 // Lines left out since the process started
+
+	mu     sync.Mutex
+	second int64 // Unix second being counted
+	lines  int64 // Lines of that second, logged or not
+}
+
+var queryLogSampler querySampler
+
+func init() {
+	queryLogSampler.threshold.Store(DEFAULT_LOG_SAMPLE_THRESHOLD)
+	queryLogSampler.rate.Store(DEFAULT_LOG_SAMPLE_RATE)
+}
+
+/*
+Implements zerolog.Sampler.
+*/
+func (sampler *querySampler) Sample(level zerolog.Level) bool {
+	threshold := sampler.threshold.Load()
+	if threshold <= 0 || level >= zerolog.WarnLevel {
+		return true
+	}
+	now := time.Now().Unix()
+	sampler.mu.Lock()
+	if now != sampler.second {
+		sampler.second, sampler.lines = now, 0
+	}
+	sampler.lines++
+	lines := sampler.lines
+	sampler.mu.Unlock()
+	if lines <= threshold {
+		return true
+	}
+	if lines == threshold+1 {
+		log.Info().Msgf("Over %d query log lines this second, logging 1 in %d of the rest", threshold, sampler.rate.Load())
+	}
+	if rate := sampler.rate.Load(); rate <= 1 || (lines-threshold)%rate == 0 {
+		return true
+	}
+	sampler.dropped.Add(1)
+	return false
+}
+
+/*
+Sets the query log lines per second above which they are sampled, 0 to log them all, and the 1 in
+rate of them logged above it.
+*/
+func SetLogSampling(threshold int, rate int) {
+	queryLogSampler.threshold.Store(int64(max(0, threshold)))
+	queryLogSampler.rate.Store(int64(max(1, rate)))
+}
+
+/*
+Returns the number of query log lines left out by sampling since the process started.
+*/
+func SampledLogLines() int64 {
+	return queryLogSampler.dropped.Load()
+}
+
+/*
+Returns the logger for lines logged once or more per query, which samples them under load.
+*/
+func sampledLog() *zerolog.Logger {
+	logger := log.Logger.Sample(&queryLogSampler)
+	return &logger
+}
@@ -0,0 +1,130 @@
+/*
+Routing cost of lookups. Every FIND_SUCCESSOR carries its hop count to the next node, and the
+reply carries back the hop count of the whole lookup and the time the responder spent on it, the
+hops it forwarded to included. The node that started a lookup thus learns how many hops it took,
+rather than counting only its own, and every node that forwards one learns which part of the round
+trip went to the network and which to the rest of the path. Each node accumulates the hops and the
+latency of the ring lookups it started, and of the hops it forwarded, and keeps the last
+LOOKUP_HISTORY lookups for inspection at /lookups. QueryDNS reports the hops and the latency of
+each query it resolves.
+*/
+package node
+
+import (
+	"sync"
+	"time"
+
+	"github.com/fauzxan/dns-chord/v2/message"
+)
+
+// Constants
+const (
+	LOOKUP_HISTORY = 100 // Ring lookups kept per node for /lookups.
+)
+
+/*
+A ring lookup started by this node.
+*/
+type LookupSample struct {
+	At       time.Time     `json:"at"`
+	Key      uint64        `json:"key"`
+	Hops     int           `json:"hops"`
+	Duration time.Duration `json:"duration_ns"`
+}
+
+/*
+The hops and latency of the ring lookups of a node, as served at /lookups.
+*/
+type LookupStats struct {
+	Lookups       uint64         `json:"lookups"`         // Ring lookups this node started that found the node responsible for their key
+	MeanHops      float64        `json:"mean_hops"`       // Mean hops of those lookups
+	MaxHops       int            `json:"max_hops"`        // Most hops one of them took
+	MeanMs        float64        `json:"mean_ms"`         // Mean latency of those lookups
+	MaxMs         float64        `json:"max_ms"`          // Highest latency of one of them
+	Forwards      uint64         `json:"forwards"`        // Hops this node forwarded and got an answer to
+	MeanForwardMs float64        `json:"mean_forward_ms"` // Mean round trip of those hops
+	MeanNetworkMs float64        `json:"mean_network_ms"` // Mean part of the round trip not spent by the rest of the path
+	Recent        []LookupSample `json:"recent"`          // Last ring lookups, oldest first
+}
+
+/*
+Accumulated routing cost of the lookups of a node, see the top of this file.
+*/
+type lookupStatsTable struct {
+	mu          sync.Mutex
+	lookups     uint64
+	hops        uint64
+	maxHops     int
+	duration    time.Duration
+	maxDuration time.Duration
+	forwards    uint64
+	forwardTime time.Duration
+	networkTime time.Duration
+	recent      []LookupSample
+}
+
+/*
+Records a ring lookup of key started by this node, which took hops hops and elapsed.
+*/
+func (node *Node) recordLookup(key uint64, hops int, elapsed time.Duration) {
+	stats := &node.lookupStats
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	stats.lookups++
+	stats.hops += uint64(hops)
+	stats.maxHops = max(stats.maxHops, hops)
+	stats.duration += elapsed
+	stats.maxDuration = max(stats.maxDuration, elapsed)
+	stats.recent = append(stats.recent, LookupSample{At: time.Now(), Key: key, Hops: hops, Duration: elapsed})
+	if len(stats.recent) > LOOKUP_HISTORY {
+		stats.recent = stats.recent[1:]
+	}
+}
+
+/*
+Records the reply to a FIND_SUCCESSOR this node forwarded, which arrived after roundTrip. Replies
+that are not answers, and those of nodes that predate timing in replies, are left out.
+*/
+func (node *Node) recordForward(reply message.ResponseMessage, roundTrip time.Duration) {
+	if reply.Type != ACK || reply.Elapsed <= 0 {
+		return
+	}
+	stats := &node.lookupStats
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	stats.forwards++
+	stats.forwardTime += roundTrip
+	stats.networkTime += max(roundTrip-time.Duration(reply.Elapsed), 0)
+}
+
+/*
+Returns the routing cost of the lookups of this node so far.
+*/
+func (node *Node) LookupStats() LookupStats {
+	stats := &node.lookupStats
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	summary := LookupStats{
+		Lookups:  stats.lookups,
+		MaxHops:  stats.maxHops,
+		MaxMs:    milliseconds(stats.maxDuration),
+		Forwards: stats.forwards,
+		Recent:   append([]LookupSample{}, stats.recent...),
+	}
+	if stats.lookups > 0 {
+		summary.MeanHops = float64(stats.hops) / float64(stats.lookups)
+		summary.MeanMs = milliseconds(stats.duration) / float64(stats.lookups)
+	}
+	if stats.forwards > 0 {
+		summary.MeanForwardMs = milliseconds(stats.forwardTime) / float64(stats.forwards)
+		summary.MeanNetworkMs = milliseconds(stats.networkTime) / float64(stats.forwards)
+	}
+	return summary
+}
+
+/*
+Returns d in milliseconds.
+*/
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
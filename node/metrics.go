@@ -0,0 +1,117 @@
+/*
+Prometheus style metrics for a node. Counters are incremented on the hot paths (incoming messages,
+resolutions, DNS queries), while gauges such as storage and cache size are computed when scraped.
+*/
+package node
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+/*
+Named counters of a node. Names may carry Prometheus labels, e.g. `resolutions_total{source="cache"}`.
+*/
+type metrics struct {
+	mu       sync.Mutex
+	counters map[string]uint64
+}
+
+/*
+Increments the counter name by delta.
+*/
+func (node *Node) incMetric(name string, delta uint64) {
+	node.metrics.mu.Lock()
+	defer node.metrics.mu.Unlock()
+	if node.metrics.counters == nil {
+		node.metrics.counters = make(map[string]uint64)
+	}
+	node.metrics.counters[name] += delta
+}
+
+/*
+Returns a copy of all counters.
+*/
+func (node *Node) Counters() map[string]uint64 {
+	node.metrics.mu.Lock()
+	defer node.metrics.mu.Unlock()
+	counters := make(map[string]uint64, len(node.metrics.counters))
+	for name, value := range node.metrics.counters {
+		counters[name] = value
+	}
+	return counters
+}
+
+/*
+Writes all counters and gauges in the Prometheus text exposition format.
+*/
+func (node *Node) WriteMetrics(w io.Writer) {
+	counters := node.Counters()
+	names := make([]string, 0, len(counters))
+	for name := range counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "dns_chord_%s %d\n", name, counters[name])
+	}
+
+	node.storageMu.RLock()
+	storageKeys := 0
+	for _, storage := range node.HashIPStorage {
+		storageKeys += len(storage)
+	}
+	node.storageMu.RUnlock()
+	node.cacheMu.Lock()
+	cacheEntries := len(node.CachedQuery)
+	node.cacheMu.Unlock()
+
+	fmt.Fprintf(w, "dns_chord_storage_keys %d\n", storageKeys)
+	fmt.Fprintf(w, "dns_chord_cache_entries %d\n", cacheEntries)
+	fmt.Fprintf(w, "dns_chord_goroutines %d\n", node.GoroutineCounts()["total"])
+	fmt.Fprintf(w, "dns_chord_instance_info{instance=%q,nodeid=\"%d\"} 1\n", node.InstanceID(), node.Nodeid)
+	fmt.Fprintf(w, "dns_chord_log_lines_sampled_total %d\n", SampledLogLines())
+	frozen := 0
+	if node.Frozen() {
+		frozen = 1
+	}
+	fmt.Fprintf(w, "dns_chord_frozen %d\n", frozen)
+	node.writeSaturation(w)
+	node.writeScrubProgress(w)
+	node.writeFlapRates(w)
+	node.writeResources(w)
+	node.writeConsistency(w)
+	node.writeGateway(w)
+	node.writeLookupQueues(w)
+	node.writeVirtualNodes(w)
+	node.writeFailureDetector(w)
+}
+
+/*
+Starts the metrics HTTP server on addr in a tracked goroutine. The server is closed when the node
+shuts down.
+*/
+func (node *Node) ServeMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		node.WriteMetrics(w)
+	})
+
+	server := &http.Server{Addr: addr, Handler: mux}
+	node.spawn("metrics_http", func() {
+		log.Info().Msgf("Metrics endpoint is running at address: %s", addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Error().Err(err).Msg("Metrics endpoint stopped")
+		}
+	})
+	node.spawn("metrics_shutdown", func() {
+		<-node.context().Done()
+		server.Close()
+	})
+}
@@ -0,0 +1,19 @@
+//go:build !unix
+
+package node
+
+import (
+	"io"
+	"os"
+)
+
+/*
+Reads the whole file into memory, on platforms without mmap support.
+*/
+func mmapFile(file *os.File) ([]byte, func() error, error) {
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() error { return nil }, nil
+}
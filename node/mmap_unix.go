@@ -0,0 +1,26 @@
+//go:build unix
+
+package node
+
+import (
+	"os"
+	"syscall"
+)
+
+/*
+Maps the whole file read-only into memory. Returns the mapping and the function releasing it.
+*/
+func mmapFile(file *os.File) ([]byte, func() error, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.Size() == 0 {
+		return nil, func() error { return nil }, nil
+	}
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() error { return syscall.Munmap(data) }, nil
+}
@@ -0,0 +1,259 @@
+/*
+Reference model of the Chord keyspace, and property checks of the implementation against it. The
+model states the routing rules in the simplest possible terms (modular distances, and a sorted list
+of node IDs), so that the interval helpers and the lookup algorithm can be checked against it on
+random inputs. Lookups are routed by the real findSuccessor, between in-memory nodes whose RPCs are
+delivered by a transport in place of the network. The properties are tested in model_test.go, and
+the checks are exported, so that routing changes can also be verified with `dns-chord
+check-model`, and so that experiments and tools can reuse the model.
+*/
+package node
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+
+	"github.com/fauzxan/dns-chord/v2/hashing"
+	"github.com/fauzxan/dns-chord/v2/message"
+)
+
+// Constants
+const (
+	MODEL_SEED           = 1    // Default seed of the property checks, so that failures can be reproduced.
+	MODEL_MAX_RING_NODES = 64   // Upper bound on the nodes of the random rings routed in.
+	MODEL_ITERATIONS     = 1000 // Default number of random inputs per property.
+)
+
+/*
+Distance from a to b, clockwise around the ring.
+*/
+func modelDistance(a, b uint64) uint64 {
+	return (b - a) & hashing.Mask()
+}
+
+/*
+Model of belongsTo: id is in (a, b] if it is no further from a than b, and not a itself. An
+interval (a, a] is the whole ring, as in a ring of one node.
+*/
+func ModelBelongsTo(id, a, b uint64) bool {
+	return a == b || (modelDistance(a, id) > 0 && modelDistance(a, id) <= modelDistance(a, b))
+}
+
+/*
+Model of between: id is in (a, b) if it is closer to a than b, and not a itself. An interval (a, a)
+is the whole ring, as in a ring of one node.
+*/
+func ModelBetween(id, a, b uint64) bool {
+	return a == b || (modelDistance(a, id) > 0 && modelDistance(a, id) < modelDistance(a, b))
+}
+
+/*
+Model of a stable ring: the sorted IDs of its nodes.
+*/
+type ModelRing []uint64
+
+/*
+Returns the model of a ring of the given node IDs.
+*/
+func NewModelRing(ids ...uint64) ModelRing {
+	ring := ModelRing{}
+	seen := make(map[uint64]bool)
+	for _, id := range ids {
+		if id &= hashing.Mask(); !seen[id] {
+			seen[id] = true
+			ring = append(ring, id)
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i] < ring[j] })
+	return ring
+}
+
+/*
+Returns the node responsible for key: the first node at or after key, wrapping around.
+*/
+func (ring ModelRing) Successor(key uint64) uint64 {
+	key &= hashing.Mask()
+	i := sort.Search(len(ring), func(i int) bool { return ring[i] >= key })
+	return ring[i%len(ring)]
+}
+
+/*
+Returns the node preceding id in the ring.
+*/
+func (ring ModelRing) Predecessor(id uint64) uint64 {
+	i := sort.Search(len(ring), func(i int) bool { return ring[i] >= id&hashing.Mask() })
+	return ring[(i+len(ring)-1)%len(ring)]
+}
+
+/*
+Returns the nodes of the ring with successors, predecessors and finger tables as a stable ring
+would have them. Addresses are the decimal IDs, and RPCs between the nodes are delivered in memory.
+*/
+func (ring ModelRing) Nodes() map[uint64]*Node {
+	pointer := func(id uint64) Pointer { return Pointer{Nodeid: id, IP: fmt.Sprint(id)} }
+	nodes := make(map[uint64]*Node, len(ring))
+	for _, id := range ring {
+		n := &Node{Nodeid: id, IP: fmt.Sprint(id), FingerTable: make([]Pointer, hashing.Bits())}
+		n.Successor = pointer(ring.Successor(id + 1))
+		n.Predecessor = pointer(ring.Predecessor(id))
+		for i := range n.FingerTable {
+			n.FingerTable[i] = pointer(ring.Successor((id + 1<<i) & hashing.Mask()))
+		}
+		nodes[id] = n
+	}
+	for _, n := range nodes {
+		n.transport = modelTransport(nodes)
+	}
+	return nodes
+}
+
+/*
+Returns a transport that hands every RPC to the HandleIncomingMessage of the node in nodes whose
+address it is sent to. RPCs to addresses outside nodes get an EMPTY reply.
+*/
+func modelTransport(nodes map[uint64]*Node) rpcTransport {
+	return func(msg message.RequestMessage, IP string) message.ResponseMessage {
+		id, err := strconv.ParseUint(IP, 10, 64)
+		if err != nil || nodes[id] == nil {
+			return message.ResponseMessage{Type: EMPTY}
+		}
+		var reply message.ResponseMessage
+		if err := nodes[id].HandleIncomingMessage(&msg, &reply); err != nil {
+			return message.ResponseMessage{Type: EMPTY}
+		}
+		return reply
+	}
+}
+
+/*
+Routes a lookup of key from the node start with findSuccessor, over the in-memory transport of
+the nodes (see Nodes). Returns the node found and the number of hops, or an error if a hop leaves
+the ring or the lookup does not terminate within len(nodes)+hashing.Bits() hops.
+*/
+func RouteLookup(nodes map[uint64]*Node, start uint64, key uint64) (uint64, int, error) {
+	limit := len(nodes) + hashing.Bits()
+	var failure error
+	for _, n := range nodes {
+		deliver := modelTransport(nodes)
+		n.transport = func(msg message.RequestMessage, IP string) message.ResponseMessage {
+			if msg.Type == FIND_SUCCESSOR && msg.HopCount >= limit {
+				failure = fmt.Errorf("lookup of %d from %d does not terminate", key, start)
+				return message.ResponseMessage{Type: EMPTY}
+			}
+			reply := deliver(msg, IP)
+			if reply.Type == EMPTY && failure == nil {
+				failure = fmt.Errorf("hop to %s of the lookup of %d failed", IP, key)
+			}
+			return reply
+		}
+	}
+	found, hops := nodes[start].findSuccessor(key, 0, 0)
+	if failure != nil {
+		return 0, hops, failure
+	}
+	return found.Nodeid, hops, nil
+}
+
+/*
+Checks belongsTo and between against their models on iterations random intervals drawn from a
+source seeded by seed, and on the intervals around the boundaries of the keyspace.
+*/
+func CheckIntervals(seed int64, iterations int) error {
+	random := rand.New(rand.NewSource(seed))
+	for i := 0; i < iterations; i++ {
+		id, a, b := random.Uint64()&hashing.Mask(), random.Uint64()&hashing.Mask(), random.Uint64()&hashing.Mask()
+		if err := checkInterval(id, a, b); err != nil {
+			return err
+		}
+	}
+	// Intervals around the boundaries of the keyspace and of small rings, which random IDs rarely hit.
+	edges := []uint64{0, 1, 2, hashing.Mask() - 1, hashing.Mask()}
+	for _, id := range edges {
+		for _, a := range edges {
+			for _, b := range edges {
+				if err := checkInterval(id, a, b); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+/*
+Checks belongsTo and between against their models for id in the interval from a to b.
+*/
+func checkInterval(id, a, b uint64) error {
+	if belongsTo(id, a, b) != ModelBelongsTo(id, a, b) {
+		return fmt.Errorf("belongsTo disagrees with the model for id %d in (%d, %d]", id, a, b)
+	}
+	if between(id, a, b) != ModelBetween(id, a, b) {
+		return fmt.Errorf("between disagrees with the model for id %d in (%d, %d)", id, a, b)
+	}
+	return nil
+}
+
+/*
+Returns a random ring of 1 to MODEL_MAX_RING_NODES nodes and a key to look up in it. Keys at node
+IDs, and right next to them, are the interesting cases, and are drawn more often.
+*/
+func randomModelLookup(random *rand.Rand) (ModelRing, uint64) {
+	ids := make([]uint64, 1+random.Intn(MODEL_MAX_RING_NODES))
+	for i := range ids {
+		ids[i] = random.Uint64() & hashing.Mask()
+	}
+	ring := NewModelRing(ids...)
+	key := random.Uint64()
+	switch random.Intn(3) {
+	case 0:
+		key = ring[random.Intn(len(ring))]
+	case 1:
+		key = ring[random.Intn(len(ring))] + 1
+	}
+	return ring, key & hashing.Mask()
+}
+
+/*
+Checks a lookup of key from start in ring: that it finds the key's successor in at most
+hashing.Bits() hops.
+*/
+func CheckLookup(ring ModelRing, start uint64, key uint64) error {
+	found, hops, err := RouteLookup(ring.Nodes(), start, key)
+	if err != nil {
+		return err
+	}
+	if want := ring.Successor(key); found != want {
+		return fmt.Errorf("lookup of %d from %d in a ring of %d nodes found %d, not %d", key, start, len(ring), found, want)
+	}
+	if hops > hashing.Bits() {
+		return fmt.Errorf("lookup of %d from %d in a ring of %d nodes took %d hops", key, start, len(ring), hops)
+	}
+	return nil
+}
+
+/*
+Checks iterations lookups of random keys from random nodes of random stable rings, drawn from a
+source seeded by seed, see CheckLookup.
+*/
+func CheckRouting(seed int64, iterations int) error {
+	random := rand.New(rand.NewSource(seed))
+	for i := 0; i < iterations; i++ {
+		ring, key := randomModelLookup(random)
+		if err := CheckLookup(ring, ring[random.Intn(len(ring))], key); err != nil {
+			return fmt.Errorf("routing: %w", err)
+		}
+	}
+	return nil
+}
+
+/*
+Runs every property check with the given seed. Returns the first failure.
+*/
+func CheckModel(seed int64, iterations int) error {
+	if err := CheckIntervals(seed, iterations); err != nil {
+		return err
+	}
+	return CheckRouting(seed, iterations)
+}
@@ -0,0 +1,90 @@
+package node
+
+import (
+	"math/rand"
+	"testing"
+	"testing/quick"
+
+	"github.com/fauzxan/dns-chord/v2/hashing"
+)
+
+/*
+Returns the quick.Config of the property tests, seeded so that failures can be reproduced.
+*/
+func modelConfig() *quick.Config {
+	return &quick.Config{MaxCount: MODEL_ITERATIONS, Rand: rand.New(rand.NewSource(MODEL_SEED))}
+}
+
+func TestIntervals(t *testing.T) {
+	property := func(id, a, b uint64) bool {
+		return checkInterval(id&hashing.Mask(), a&hashing.Mask(), b&hashing.Mask()) == nil
+	}
+	if err := quick.Check(property, modelConfig()); err != nil {
+		t.Error(err)
+	}
+	if err := CheckIntervals(MODEL_SEED, 0); err != nil {
+		t.Error(err) // The boundaries of the keyspace.
+	}
+}
+
+func TestRouting(t *testing.T) {
+	config := modelConfig()
+	config.MaxCount = MODEL_ITERATIONS / 10
+	property := func(seed int64) bool {
+		random := rand.New(rand.NewSource(seed))
+		ring, key := randomModelLookup(random)
+		if err := CheckLookup(ring, ring[random.Intn(len(ring))], key); err != nil {
+			t.Log(err)
+			return false
+		}
+		return true
+	}
+	if err := quick.Check(property, config); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRoutingForwards(t *testing.T) {
+	// A lookup of the key right after the first node, from the node after it, has to go around
+	// the ring, that is over the transport.
+	ring := NewModelRing(1<<20, 1<<24, 1<<28, 1<<30, 3<<30)
+	found, hops, err := RouteLookup(ring.Nodes(), ring[1], ring[0]+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := ring[1]; found != want {
+		t.Errorf("lookup found %d, want %d", found, want)
+	}
+	if hops < 2 {
+		t.Errorf("lookup took %d hops, want it forwarded", hops)
+	}
+}
+
+func TestRouteLookupStopsLoops(t *testing.T) {
+	// Stale pointers of each node that claim IDs the other does not have make the lookup bounce
+	// between the two.
+	ring := NewModelRing(1<<20, 1<<30)
+	nodes := ring.Nodes()
+	key := uint64(1 << 31)
+	for _, n := range nodes {
+		other := nodes[ring.Successor(n.Nodeid+1)]
+		n.Successor = Pointer{Nodeid: n.Nodeid + 1, IP: other.IP}
+		for i := range n.FingerTable {
+			n.FingerTable[i] = Pointer{Nodeid: key - 1, IP: other.IP}
+		}
+	}
+	if _, _, err := RouteLookup(nodes, ring[0], key); err == nil {
+		t.Error("lookup in a looping ring did not fail")
+	}
+}
+
+func FuzzBelongsTo(f *testing.F) {
+	for _, edge := range [][3]uint64{{0, 0, 0}, {1, 0, 1}, {0, 1, 0}, {5, 10, 3}, {hashing.Mask(), hashing.Mask() - 1, 0}} {
+		f.Add(edge[0], edge[1], edge[2])
+	}
+	f.Fuzz(func(t *testing.T, id, a, b uint64) {
+		if err := checkInterval(id&hashing.Mask(), a&hashing.Mask(), b&hashing.Mask()); err != nil {
+			t.Error(err)
+		}
+	})
+}
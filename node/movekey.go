@@ -0,0 +1,124 @@
+/*
+Explicit relocation of names. An operator can move the record set of a name off the node that is
+naturally responsible for it, e.g. to isolate a hot name on a bigger machine. The target keeps the
+records pinned, outside the key ranges that replication, garbage collection and the keyspace
+verifier manage, and the natural owner stores a forwarding tombstone in their place: a record set
+of a single MOVED record naming the target. Readers that find a tombstone follow it once. Moving
+a name to its natural owner moves it back. Pinned records live in memory only, and a later PUT of
+the name at its owner replaces the tombstone, which ends the move.
+*/
+package node
+
+import (
+	"fmt"
+
+	"github.com/fauzxan/dns-chord/v2/hashing"
+	"github.com/fauzxan/dns-chord/v2/message"
+	"github.com/rs/zerolog/log"
+)
+
+// Constants
+const (
+	TYPE_MOVED = "MOVED" // Forwarding tombstone of a moved record set, with the address of the node holding it, e.g. "MOVED 10.0.0.5:8000".
+)
+
+/*
+Returns the address a tombstone forwards to, or false if records are not a tombstone.
+*/
+func movedTo(records []Record) (string, bool) {
+	if len(records) != 1 {
+		return "", false
+	}
+	rtype, value := ParseRecord(records[0])
+	return value, rtype == TYPE_MOVED
+}
+
+/*
+Returns the records a tombstone forwards to, read from the node holding them. Other record sets
+are returned unchanged.
+*/
+func (node *Node) followMove(key uint64, records []Record) []Record {
+	IP, ok := movedTo(records)
+	if !ok {
+		return records
+	}
+	if IP == node.IP {
+		node.storageMu.RLock()
+		pinned := node.pinned[key]
+		node.storageMu.RUnlock()
+		return decompressRecords(pinned)
+	}
+	log.Info().Msgf("> Record was moved to %s, following the tombstone", IP)
+	reply := node.CallRPC(message.RequestMessage{Type: GET, TargetId: key}, IP)
+	if reply.Records == nil {
+		log.Error().Msgf("Moved record is missing at %s", IP)
+	}
+	return decompressRecords(reply.Records)
+}
+
+/*
+Pins the record sets of payload on this node, or unpins the keys whose record set is empty.
+*/
+func (node *Node) pin(payload map[uint64][]Record) {
+	payload = node.dropInvalid(payload)
+	node.storageMu.Lock()
+	defer node.storageMu.Unlock()
+	if node.pinned == nil {
+		node.pinned = make(map[uint64][]Record)
+	}
+	for key, records := range payload {
+		if len(records) == 0 {
+			delete(node.pinned, key)
+			continue
+		}
+		node.pinned[key] = compressRecords(records)
+	}
+}
+
+/*
+Moves the records of website to the node at target, leaving a tombstone with its natural owner.
+A target that is the natural owner moves the records back. Returns an error if a node involved did
+not take part.
+*/
+func (node *Node) MoveKey(website string, target string) error {
+	website, err := NormalizeName(website)
+	if err != nil {
+		return err
+	}
+	key := hashing.Hash(website)
+	owner, _ := node.FindSuccessor(key, 0)
+	reply := node.CallRPC(message.RequestMessage{Type: GET, TargetId: key}, owner.IP)
+	if reply.Records == nil {
+		return fmt.Errorf("%s is not stored at its owner %s", website, owner.IP)
+	}
+	records := decompressRecords(reply.Records)
+	holder, moved := movedTo(records)
+	if moved {
+		records = node.followMove(key, records)
+		if len(records) == 0 {
+			return fmt.Errorf("the records of %s are missing at %s", website, holder)
+		}
+	}
+	names := map[uint64]string{key: website}
+
+	stored := records
+	if target != owner.IP {
+		pin := node.CallRPC(message.RequestMessage{Type: PIN, Payload: map[uint64][]Record{key: records}, Names: names}, target)
+		if pin.Type != ACK {
+			return fmt.Errorf("%s did not accept the records of %s", target, website)
+		}
+		stored = []Record{NewRecord(TYPE_MOVED, target)}
+	}
+	put := node.callAvoidingShutdown(message.RequestMessage{Type: PUT, TargetId: owner.Nodeid, Payload: map[uint64][]Record{key: stored}, Names: names}, owner.IP)
+	if put.Type != ACK && put.Type != REDIRECT {
+		return fmt.Errorf("the owner %s did not accept the tombstone of %s", owner.IP, website)
+	}
+	if moved && holder != target {
+		node.CallRPC(message.RequestMessage{Type: PIN, Payload: map[uint64][]Record{key: nil}}, holder)
+	}
+	node.cacheMu.Lock()
+	delete(node.CachedQuery, key)
+	node.cacheMu.Unlock()
+	log.Info().Msgf("Moved %s to %s", website, target)
+	return nil
+}
@@ -0,0 +1,231 @@
+/*
+Index of the names behind the hashed keys a node stores. Keys are hashes, so the storage alone
+cannot tell which domain names live in the ring; PUT, REPLICATE and SHIFT messages therefore carry
+the names of their keys along, and each node remembers them. The index is the data source for name
+completion in the REPL, and for listing all names under a domain suffix, which the hashed keys
+can not be searched for.
+*/
+package node
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/fauzxan/dns-chord/v2/message"
+)
+
+// Constants
+const (
+	NAMES_SAMPLE_SIZE = 20   // Maximum number of names returned by a NAMES request.
+	LIST_MAX_ENTRIES  = 1000 // Maximum number of record sets returned by a LIST request.
+)
+
+/*
+A name and its records, as listed under a domain suffix.
+*/
+type NamedRecords struct {
+	Name    string   `json:"name"`
+	Records []Record `json:"records"`
+}
+
+/*
+Adds names (hashed key -> name) to the index.
+*/
+func (node *Node) learnNames(names map[uint64]string) {
+	if len(names) == 0 {
+		return
+	}
+	node.storageMu.Lock()
+	defer node.storageMu.Unlock()
+	node.indexNames(names)
+}
+
+/*
+Adds names to the index. Must be called with the storage lock held for writing.
+*/
+func (node *Node) indexNames(names map[uint64]string) {
+	if node.names == nil {
+		node.names = make(map[uint64]string)
+	}
+	if node.suffixes == nil {
+		node.suffixes = make(map[string]map[uint64]struct{})
+	}
+	for key, name := range names {
+		if old, ok := node.names[key]; ok && old != name {
+			node.unindexName(key, old)
+		}
+		node.names[key] = name
+		for _, suffix := range suffixesOf(name) {
+			if node.suffixes[suffix] == nil {
+				node.suffixes[suffix] = make(map[uint64]struct{})
+			}
+			node.suffixes[suffix][key] = struct{}{}
+		}
+	}
+}
+
+/*
+Removes the name of key from the index. Must be called with the storage lock held.
+*/
+func (node *Node) forgetName(key uint64) {
+	if name, ok := node.names[key]; ok {
+		node.unindexName(key, name)
+		delete(node.names, key)
+	}
+}
+
+func (node *Node) unindexName(key uint64, name string) {
+	for _, suffix := range suffixesOf(name) {
+		delete(node.suffixes[suffix], key)
+		if len(node.suffixes[suffix]) == 0 {
+			delete(node.suffixes, suffix)
+		}
+	}
+}
+
+/*
+Returns the name itself and every parent domain of it, e.g. a.example.com, example.com and com.
+*/
+func suffixesOf(name string) []string {
+	suffixes := []string{name}
+	for i := 0; i < len(name); i++ {
+		if name[i] == '.' {
+			suffixes = append(suffixes, name[i+1:])
+		}
+	}
+	return suffixes
+}
+
+/*
+Returns the known names of the keys in payload, to send along with it.
+*/
+func (node *Node) namesFor(payload map[uint64][]Record) map[uint64]string {
+	node.storageMu.RLock()
+	defer node.storageMu.RUnlock()
+	names := make(map[uint64]string)
+	for key := range payload {
+		if name, ok := node.names[key]; ok {
+			names[key] = name
+		}
+	}
+	return names
+}
+
+/*
+Returns up to NAMES_SAMPLE_SIZE names stored on this node that start with prefix, in lexical order.
+Internationalized names match in either their punycode or their Unicode form.
+*/
+func (node *Node) LocalNames(prefix string) []string {
+	node.storageMu.RLock()
+	matches := []string{}
+	for key, name := range node.names {
+		if !strings.HasPrefix(name, prefix) && !strings.HasPrefix(DisplayName(name), prefix) {
+			continue
+		}
+		for _, storage := range node.HashIPStorage {
+			if _, ok := storage[key]; ok {
+				matches = append(matches, name)
+				break
+			}
+		}
+	}
+	node.storageMu.RUnlock()
+	sort.Strings(matches)
+	if len(matches) > NAMES_SAMPLE_SIZE {
+		matches = matches[:NAMES_SAMPLE_SIZE]
+	}
+	return matches
+}
+
+/*
+Returns a sample of names starting with prefix from this node and the nodes in its successor list,
+for completing a partially typed name against the actual contents of the ring.
+*/
+func (node *Node) CompleteNames(prefix string) []string {
+	seen := map[string]bool{}
+	completions := []string{}
+	add := func(names []string) {
+		for _, name := range names {
+			if !seen[name] {
+				seen[name] = true
+				completions = append(completions, name)
+			}
+		}
+	}
+	add(node.LocalNames(prefix))
+
+	succList := node.succList()
+	for _, pointer := range succList {
+		if pointer.IP == node.IP || pointer.IP == "" {
+			continue
+		}
+		reply := node.CallRPC(message.RequestMessage{Type: NAMES, IP: prefix}, pointer.IP)
+		add(reply.QueryResponse)
+	}
+	sort.Strings(completions)
+	if len(completions) > NAMES_SAMPLE_SIZE {
+		completions = completions[:NAMES_SAMPLE_SIZE]
+	}
+	return completions
+}
+
+/*
+Returns the stored record sets of the names under suffix, along with their names, at most
+LIST_MAX_ENTRIES of them. Record sets held as replicas are included.
+*/
+func (node *Node) localSuffix(suffix string) (map[uint64][]Record, map[uint64]string) {
+	node.storageMu.RLock()
+	defer node.storageMu.RUnlock()
+	payload := make(map[uint64][]Record)
+	names := make(map[uint64]string)
+	for key := range node.suffixes[suffix] {
+		if len(payload) >= LIST_MAX_ENTRIES {
+			break
+		}
+		stored, ok := node.HashIPStorage[node.Nodeid][key]
+		for _, storage := range node.HashIPStorage {
+			if ok {
+				break
+			}
+			stored, ok = storage[key]
+		}
+		if ok {
+			payload[key] = stored
+			names[key] = node.names[key]
+		}
+	}
+	return payload, names
+}
+
+/*
+Lists the names under the domain suffix, with their records, sorted by name: those stored on this
+node, or with ring set, those stored anywhere in the ring, found by asking every node in turn.
+*/
+func (node *Node) ListSuffix(suffix string, ring bool) ([]NamedRecords, error) {
+	suffix, err := NormalizeName(suffix)
+	if err != nil {
+		return nil, err
+	}
+	payload, names := node.localSuffix(suffix)
+	if ring {
+		walk, _ := node.walkRing()
+		for _, pointer := range walk {
+			if pointer.IP == node.IP {
+				continue
+			}
+			reply := node.CallRPC(message.RequestMessage{Type: LIST, IP: suffix}, pointer.IP)
+			for key, stored := range reply.Payload {
+				if _, ok := payload[key]; !ok {
+					payload[key] = stored
+					names[key] = reply.Names[key]
+				}
+			}
+		}
+	}
+	list := []NamedRecords{}
+	for key, stored := range payload {
+		list = append(list, NamedRecords{Name: DisplayName(names[key]), Records: decompressRecords(stored)})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
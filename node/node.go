@@ -10,11 +10,14 @@ like finding successors and notifying or updating neighboring nodes.
 package node
 
 import (
-	"math"
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fatih/color"
+	"github.com/fauzxan/dns-chord/v2/capture"
+	"github.com/fauzxan/dns-chord/v2/hashing"
 	"github.com/fauzxan/dns-chord/v2/message"
 	"github.com/rs/zerolog/log"
 )
@@ -24,9 +27,6 @@ var system = color.New(color.FgHiGreen).Add(color.BgBlack)
 var systemcommsin = color.New(color.FgHiMagenta).Add(color.BgBlack)
 var systemcommsout = color.New(color.FgHiYellow).Add(color.BgBlack)
 
-// Mutex to prevent race condition when accessing SuccList
-var mu sync.Mutex
-
 type Pointer struct {
 	Nodeid uint64 // ID of the pointed Node
 	IP     string // IP of the pointed Node
@@ -42,16 +42,68 @@ type Node struct {
 	Successor     Pointer                        // Nodeid of it's direct successor.
 	Predecessor   Pointer                        // Nodeid of it's direct predecessor.
 	CachedQuery   map[uint64]LRUCache            // caching queries on the node locally
-	HashIPStorage map[uint64]map[uint64][]string // storage for hashed ips associated with the node
+	HashIPStorage map[uint64]map[uint64][]Record // storage for hashed ips associated with the node
 	CacheTime     uint64                         // To keep track of scalar timestamp to assign to LRUCache
 	SuccList      []Pointer                      // Maintain a list of successors for fault tolerance
+	ringMu        sync.RWMutex                   // Guards Successor, Predecessor, FingerTable and SuccList, see routing.go
+	storageMu     sync.RWMutex                   // Guards HashIPStorage, so record sets are swapped atomically
+	cacheMu       sync.Mutex                     // Guards CachedQuery and CacheTime
+	names         map[uint64]string              // Names of the hashed keys in HashIPStorage, guarded by storageMu
+	suffixes      map[string]map[uint64]struct{} // Keys by the domain suffixes of their names, guarded by storageMu
+	life          lifecycle                      // Tracks spawned goroutines so they can be counted and stopped
+	progress      progressRegistry               // Long running operations currently in progress
+	latency       latencyTable                   // Smoothed RTT to peers in the successor list and finger table
+	metrics       metrics                        // Counters exported on the metrics endpoint
+	Config        Config                         // Listener ports and tunables, read from the environment
+	Capture       *capture.Recorder              // Records sent and received RPCs if set
+	transport     rpcTransport                   // Delivers RPCs in place of the network if set, e.g. between the nodes of model.go
+	addressBook   addressBook                    // Peers recently seen alive, persisted across restarts
+	queryLog      *queryLog                      // DNS query log (dnstap or JSON), if configured
+	draining      atomic.Bool                    // Set while the node drains traffic before leaving the ring
+	frozen        atomic.Bool                    // Set while the ring topology is frozen, see freeze.go
+	crashed       atomic.Bool                    // Set once the node has crashed, see crash.go
+	diskStore     *diskStore                     // Memory-mapped cold tier of the storage, if configured
+	relay         relayState                     // Connections of the nodes this node relays for
+	commands      commandQueue                   // Interactive commands submitted by the menu
+	upstreams     upstreamPool                   // Health of the upstream resolvers used on cache fills
+	snapshots     snapshotState                  // Ring snapshots this node recorded
+	history       map[uint64][]RecordVersion     // Last versions of the record sets written here, guarded by storageMu
+	breakers      breakerTable                   // Circuit breakers of the peers called
+	detector      failureDetector                // Heartbeats of the successor and predecessor, see failuredetector.go
+	traffic       trafficCounters                // Bytes sent and received on RPC connections
+	zones         zoneTable                      // Failure domains of the peers that replied
+	pinned        map[uint64][]Record            // Record sets moved to this node, see movekey.go, guarded by storageMu
+	hotKeys       hotKeyTable                    // Read rates and boosts of hot keys
+	scrub         scrubTable                     // Checksums of storage entries and the state of the scrubber
+	entropy       antiEntropyState               // Last anti-entropy round with the replicas, see antientropy.go
+	replicas      replicaSet                     // Replicas of this node's keys, for GET replies
+	flaps         flapTable                      // Recent pointer changes and clock anomalies
+	resources     resourceSampler                // CPU time at the previous resource sample
+	transfers     transferThrottle               // When the next throttled bulk transfer may start
+	instances     instanceTable                  // Instance ID of this node and of its peers, see instance.go
+	consistency   consistencyState               // Last consistency score of the node, see consistency.go
+	control       controlState                   // CONTROL commands run recently, to refuse replays
+	signatures    signatureState                 // Signatures of the GETs and PUTs received recently, to refuse replays, see acl.go
+	departure     departure                      // Closed once the node has left the ring, see decommission.go
+	gateway       *gatewayState                  // Entry nodes of a gateway, nil unless the node is one, see gateway.go
+	lookups       lookupScheduler                // Lookups running and waiting for a slot, see fairness.go
+	lookupStats   lookupStatsTable               // Hops and latency of the lookups of this node, see lookupstats.go
+	vnodes        *vnodeGroup                    // Nodes of this process, nil without virtual nodes, see vnodes.go
+	vnodeIndex    int                            // Position of a virtual node in its process, 0 for the primary
 }
 
 // Constants
 const (
-	M                  = 32
 	CACHE_SIZE         = 5
 	REPLICATION_FACTOR = 2
+	MAX_PUT_REDIRECTS  = 3 // Number of times a PUT may be forwarded before it is stored wherever it lands.
+
+	DEFAULT_STABILIZE_INTERVAL         = 1 * time.Second        // STABILIZE_INTERVAL if not set.
+	DEFAULT_FIX_FINGER_INTERVAL        = 250 * time.Millisecond // FIX_FINGER_INTERVAL if not set.
+	DEFAULT_CHECK_PREDECESSOR_INTERVAL = 1 * time.Second        // CHECK_PREDECESSOR_INTERVAL if not set.
+	DEFAULT_REPLICATE_INTERVAL         = 5 * time.Second        // REPLICATE_INTERVAL if not set.
+	MIN_MAINTENANCE_INTERVAL           = 10 * time.Millisecond  // Shortest interval of a maintenance task, whatever is configured.
+	STORAGE_INTERVAL                   = 1 * time.Second        // Time between two writes of the storage to disk.
 )
 
 // Message types.
@@ -68,6 +120,36 @@ const (
 	SHIFT                  = "shift"               	  // Used to shift entries.
 	EMPTY                  = "empty"                  // Placeholder or undefined message type or errenous communications.
 	REPLICATE              = "replicate"              // Used to replicate data.
+	REDIRECT               = "redirect"               // Reply to a PUT that was forwarded to the node now responsible for the key.
+	BUSY                   = "busy"                   // Reply of an overloaded node. Nodeid and IP hint at where to try instead.
+	NAMES                  = "names"                  // Used to get a sample of stored names starting with the prefix in IP.
+	LIST                   = "list"                   // Used to get the stored record sets of the names under the domain suffix in IP.
+	STABILIZE              = "stabilize"              // GET_PREDECESSOR and NOTIFY combined, so each stabilize round costs one RPC.
+	KEY_LOAD               = "key_load"               // Used to get the number of keys of a node, and the ID that would split them in half.
+	SUGGEST_ID             = "suggest_id"             // Used by a joining node to ask for a load balancing placement.
+	HANDOFF                = "handoff"                // Used by a decommissioned node to hand its keys and range off to its successor.
+	LEAVE                  = "leave"                  // Used by a leaving node to link its predecessor to its successor, given in TargetId and IP.
+	GET_FINGERS            = "get_fingers"            // Used to get the successor and distinct fingers of a node, e.g. for the routing graph.
+	DENIED                 = "denied"                 // Reply to a GET or PUT that the ACL of the record set does not allow.
+	SHUTTING_DOWN          = "shutting_down"          // Reply of a node that is shutting down. Nodeid and IP hint at where to try instead.
+	SNAPSHOT               = "snapshot"               // Marker of a ring snapshot, with its epoch in TargetId and the initiator in IP.
+	GET_SNAPSHOT           = "get_snapshot"           // Used to collect the state a node recorded for the snapshot with the epoch in TargetId.
+	HISTORY                = "history"                // Used to get the recorded versions of the record set of the key in TargetId.
+	EXPORT                 = "export"                 // Used to get the record sets a node is responsible for, see export.go.
+	LOG_LEVEL              = "log_level"              // Used to set the log level named in IP, or get the level with an empty IP.
+	SCRUB                  = "scrub"                  // Used to compare the checksums in Checksums with those of the replicas in bucket TargetId.
+	BOOST                  = "boost"                  // Used to push hot keys to successors beyond the replicas, like REPLICATE.
+	PIN                    = "pin"                    // Used to pin the record sets in Payload on a node, or unpin the keys with empty record sets.
+	STATS                  = "stats"                  // Used to collect the statistics of a node, one "name value" line each in QueryResponse.
+	FREEZE                 = "freeze"                 // Used to freeze or thaw the topology of a node as named in IP, or get its state with an empty IP.
+	CRASH                  = "crash"                  // Used to make a node that allows it simulate a crash, see crash.go.
+	CONTROL                = "control"                // Used by a test orchestrator to run the command line in IP, see control.go.
+	REPORT                 = "report"                 // Used to collect the counters and recent pointer changes of a node for a report, see report.go.
+	RING_WALK              = "ring_walk"              // Used to have a node walk the ring and reply with its nodes in ring order, see ringwalk.go.
+	SLOT_DIGESTS           = "slot_digests"           // Used to compare the slot digests in Checksums with those of the replicas in bucket TargetId, see antientropy.go.
+	SLOT_KEYS              = "slot_keys"              // Used to compare the checksums in Checksums of the slots in IP with the replicas in bucket TargetId.
+	ERROR                  = "error"                  // Reply to a CONTROL whose command failed, with the error in QueryResponse.
+	INVALID                = "invalid"                // Reply to a PUT of records that do not validate, with the error in QueryResponse, see rdata.go.
 )
 
 /*
@@ -75,21 +157,75 @@ The default method called by all RPCs. This method receives different
 types of requests, and calls the appropriate functions.
 */
 func (node *Node) HandleIncomingMessage(msg *message.RequestMessage, reply *message.ResponseMessage) error {
-	log.Debug().Msgf("Message of type %s received.", msg.Type)
+	if node.Crashed() {
+		return ErrCrashed
+	}
+	if node.shuttingDown() {
+		node.shuttingDownReply(reply)
+		return nil
+	}
+	if node.rpcLimitReached() && !maintenanceMessage(msg.Type) {
+		node.shed("rpcs")
+		node.busyReply(reply)
+		return nil
+	}
+	if !node.enterHandler() {
+		node.shuttingDownReply(reply)
+		return nil
+	}
+	defer node.track("rpc_handler", -1)
+	node.observeSnapshot(msg)
+	defer func() {
+		reply.SnapshotEpoch = node.snapshotEpoch()
+		reply.Version = WIRE_VERSION
+		reply.Zone = node.Config.Zone
+		reply.Instance = node.InstanceID()
+	}()
+	if node.Capture != nil {
+		defer node.captureReceived(msg, reply, time.Now())
+	}
+	sampledLog().Debug().Msgf("Message of type %s received.", msg.Type)
+	node.rememberPeer(0, msg.From)
+	node.learnInstance(msg.From, msg.Instance)
+	node.breakerReset(msg.From)
+	node.dropReplayedIdentity(msg)
+	node.incMetric(fmt.Sprintf("messages_received_total{type=%q}", msg.Type), 1)
+	node.incMetric(fmt.Sprintf("messages_received_total{wire_version=\"%d\"}", msg.Version), 1)
+	if node.Observing() && observerRefuses(msg.Type) {
+		node.observerReply(msg, reply)
+		return nil
+	}
 	switch msg.Type {
 	case PING:
 		log.Debug().Msg("Received PING message")
 		reply.Type = ACK
 	case GET_SUCCESSOR:
 		log.Debug().Msgf("Received a message to GET SUCCESSOR of %d", node.Nodeid)
-		reply.Nodeid = node.Successor.Nodeid
-		reply.IP = node.Successor.IP
+		successor := node.successor()
+		reply.Nodeid = successor.Nodeid
+		reply.IP = successor.IP
 	case FIND_SUCCESSOR:
-		log.Debug().Msgf("Received a message to FIND SUCCESSOR of %d", msg.TargetId)
-		pointer, _ := node.FindSuccessor(msg.TargetId, msg.HopCount)
+		sampledLog().Debug().Msgf("Received a message to FIND SUCCESSOR of %d", msg.TargetId)
+		if !belongsTo(msg.TargetId, node.Nodeid, node.successor().Nodeid) && (node.overloaded() || node.Decommissioning()) {
+			node.busyReply(reply)
+			break
+		}
+		deadline := budgetDeadline(msg)
+		if !deadline.IsZero() && msg.Budget < int64(time.Millisecond) {
+			// Too little budget left to forward the lookup, and reply in time.
+			node.incMetric("lookup_budget_exhausted_total", 1)
+			reply.Type = EMPTY
+			break
+		}
+		node.admitLookup(msg.Background)
+		start := time.Now()
+		pointer, hops := node.findSuccessorAs(msg.TargetId, msg.HopCount, msg.TraceId, deadline, msg.Background)
+		node.releaseLookup()
 		reply.Type = ACK
 		reply.Nodeid = pointer.Nodeid
 		reply.IP = pointer.IP
+		reply.HopCount = hops
+		reply.Elapsed = int64(time.Since(start))
 	case NOTIFY:
 		log.Debug().Msgf("Received a message to NOTIFY me about a new predecessor %d", msg.TargetId)
 		status := node.Notify(Pointer{Nodeid: msg.TargetId, IP: msg.IP})
@@ -98,23 +234,184 @@ func (node *Node) HandleIncomingMessage(msg *message.RequestMessage, reply *mess
 		}
 	case GET_PREDECESSOR:
 		log.Debug().Msg("Received a message to GET PREDECESSOR")
-		reply.Nodeid = node.Predecessor.Nodeid
-		reply.IP = node.Predecessor.IP
+		predecessor := node.predecessor()
+		reply.Nodeid = predecessor.Nodeid
+		reply.IP = predecessor.IP
+	case STABILIZE:
+		log.Debug().Msgf("Received a message to STABILIZE with a possible new predecessor %d", msg.TargetId)
+		// Reply with the predecessor as it was before the notification, as GET_PREDECESSOR would.
+		predecessor := node.predecessor()
+		reply.Nodeid = predecessor.Nodeid
+		reply.IP = predecessor.IP
+		reply.Type = STABILIZE
+		// The sender already being the predecessor, the steady state of a ring, counts as notified too.
+		if sender := (Pointer{Nodeid: msg.TargetId, IP: msg.IP}); predecessor == sender || node.Notify(sender) {
+			reply.Type = ACK
+		}
 	case GET:
-		log.Debug().Msg("Received a message to GET DNS record")
-		reply.QueryResponse = node.GetQuery(msg.TargetId)
+		sampledLog().Debug().Msg("Received a message to GET DNS record")
+		if node.overloaded() {
+			node.busyReply(reply)
+			break
+		}
+		reply.Records = node.GetQuery(msg.TargetId)
+		if reply.Records != nil && !node.mayRead(msg, reply.Records) {
+			reply.Records = nil
+			reply.Type = DENIED
+		}
+		if reply.Records != nil {
+			node.countRead(msg.TargetId)
+			reply.Records = node.boostCachePolicy(msg.TargetId, reply.Records)
+			reply.Replicas = node.replicasOf(msg.TargetId)
+		}
+		node.attachOwnershipProof(reply)
 	case SHIFT:
 		log.Debug().Msg("Received a message to GET SOME DNS records")
-		reply.Payload = node.GetShiftRecords(msg.TargetId)
+		reply.Payload, reply.KeyCount = node.shiftPage(msg.TargetId, msg.Limit)
+		reply.Names = node.namesFor(reply.Payload)
+		node.incMetric(`keys_transferred_total{kind="shift"}`, uint64(len(reply.Payload)))
 	case PUT:
-		log.Debug().Msg("Received a message to INSERT a query")
-		status := node.PutQuery(msg.TargetId, msg.Payload)
+		sampledLog().Debug().Msg("Received a message to INSERT a query")
+		if err := validatePayload(msg.Payload); err != nil {
+			log.Warn().Err(err).Msg("Refused a PUT of invalid records")
+			node.incMetric(`invalid_records_total{op="put"}`, 1)
+			reply.Type = INVALID
+			reply.QueryResponse = []string{err.Error()}
+			node.attachOwnershipProof(reply)
+			break
+		}
+		node.learnNames(msg.Names)
+		payload, redirected := node.forwardMisroutedPut(msg)
+		if redirected != nil && (redirected.Type != REDIRECT || len(payload) == 0) {
+			// Either every key was forwarded, or an owner refused its keys and the PUT is refused as a whole.
+			*reply = *redirected
+			break
+		}
+		if permitted := node.authorizeWrites(msg, payload); len(permitted) < len(payload) {
+			payload = permitted
+			if len(payload) == 0 {
+				reply.Type = DENIED
+				break
+			}
+		}
+		// A PUT that does not fit as a whole is refused as a whole, so that the sender keeps every
+		// key of it, rather than taking an ACK for keys that were shed.
+		if admitted := node.admitKeys(payload); len(admitted) < len(payload) {
+			node.busyReply(reply)
+			break
+		}
+		status := node.PutQuery(msg.TargetId, payload)
 		if status {
+			node.recordVersions(msg, payload)
+			node.replicateWrite(msg.TargetId, payload)
 			reply.Type = ACK
+			if redirected != nil {
+				reply.Type = REDIRECT
+			}
 		}
+		node.attachOwnershipProof(reply)
 	case REPLICATE:
 		log.Debug().Msg("Received a message to REPLICATE data")
-		node.processReplicate(msg.TargetId, msg.Payload)
+		node.learnNames(msg.Names)
+		node.processReplicate(msg.TargetId, node.admitKeys(msg.Payload))
+		reply.Type = ACK
+	case KEY_LOAD:
+		log.Debug().Msg("Received a message to get my KEY LOAD")
+		reply.KeyCount, reply.SuggestedId = node.splitPoint()
+		reply.Type = ACK
+	case SUGGEST_ID:
+		log.Debug().Msg("Received a message to SUGGEST an ID for a joining node")
+		if id, count, ok := node.suggestId(); ok {
+			reply.SuggestedId = id
+			reply.KeyCount = count
+			reply.Type = ACK
+		}
+	case GET_FINGERS:
+		log.Debug().Msg("Received a message to GET FINGERS")
+		successor := node.successor()
+		reply.Nodeid = successor.Nodeid
+		reply.IP = successor.IP
+		reply.Fingers = node.fingerSet()
+		reply.Type = ACK
+	case HANDOFF:
+		log.Debug().Msgf("Received a message to take over the keys of my predecessor, with new predecessor %d", msg.TargetId)
+		if node.takeOver(msg) {
+			reply.Type = ACK
+		}
+	case LEAVE:
+		log.Debug().Msgf("Received a message that my successor is leaving, with new successor %d", msg.TargetId)
+		if node.relink(msg) {
+			reply.Type = ACK
+		}
+	case SNAPSHOT:
+		log.Debug().Msgf("Received the marker of snapshot %d", msg.TargetId)
+		node.forwardSnapshotMarker(msg)
+		reply.Type = ACK
+	case GET_SNAPSHOT:
+		log.Debug().Msgf("Received a message to GET SNAPSHOT %d", msg.TargetId)
+		if reply.Snapshot = node.encodedSnapshot(msg.TargetId); reply.Snapshot != nil {
+			reply.Type = ACK
+		}
+	case NAMES:
+		log.Debug().Msg("Received a message to get stored NAMES")
+		reply.QueryResponse = node.LocalNames(msg.IP)
+		reply.Type = ACK
+	case LIST:
+		log.Debug().Msgf("Received a message to LIST the names under %s", msg.IP)
+		reply.Payload, reply.Names = node.localSuffix(msg.IP)
+		reply.Type = ACK
+	case EXPORT:
+		log.Debug().Msg("Received a message to EXPORT my record sets")
+		reply.Payload, reply.Names = node.localExport()
+		reply.Type = ACK
+	case LOG_LEVEL:
+		log.Debug().Msgf("Received a message to set the LOG LEVEL to %q", msg.IP)
+		node.handleLogLevel(msg, reply)
+	case FREEZE:
+		log.Debug().Msgf("Received a message to FREEZE the topology with state %q", msg.IP)
+		node.handleFreeze(msg, reply)
+	case CRASH:
+		log.Debug().Msg("Received a message to CRASH")
+		node.handleCrash(msg, reply)
+	case CONTROL:
+		log.Debug().Msgf("Received a message to run the CONTROL command %q", msg.IP)
+		node.handleControl(msg, reply)
+	case SCRUB:
+		log.Debug().Msgf("Received a message to SCRUB %d replicated keys of %d", len(msg.Checksums), msg.TargetId)
+		reply.QueryResponse = node.compareChecksums(msg.TargetId, msg.Checksums)
+		reply.Type = ACK
+	case SLOT_DIGESTS:
+		log.Debug().Msgf("Received a message to compare %d SLOT DIGESTS of the replicated keys of %d", len(msg.Checksums), msg.TargetId)
+		reply.QueryResponse = node.compareSlots(msg.TargetId, msg.Checksums)
+		reply.Type = ACK
+	case SLOT_KEYS:
+		log.Debug().Msgf("Received a message to compare the SLOT KEYS %s of the replicated keys of %d", msg.IP, msg.TargetId)
+		node.compareSlotKeys(msg, reply)
+		reply.Type = ACK
+	case BOOST:
+		log.Debug().Msgf("Received a message to BOOST %d hot keys", len(msg.Payload))
+		node.acceptBoost(msg)
+		reply.Type = ACK
+	case PIN:
+		log.Debug().Msgf("Received a message to PIN %d record sets", len(msg.Payload))
+		node.learnNames(msg.Names)
+		node.pin(msg.Payload)
+		reply.Type = ACK
+	case STATS:
+		log.Debug().Msg("Received a message to get the STATS")
+		reply.QueryResponse = node.statsReply()
+		reply.Type = ACK
+	case REPORT:
+		log.Debug().Msg("Received a message to get the REPORT data")
+		reply.QueryResponse = node.reportReply()
+		reply.Type = ACK
+	case RING_WALK:
+		log.Debug().Msg("Received a message to WALK the ring")
+		reply.QueryResponse = node.ringWalkReply()
+		reply.Type = ACK
+	case HISTORY:
+		log.Debug().Msgf("Received a message to get the HISTORY of key %d", msg.TargetId)
+		reply.Payload, reply.Names = node.localHistory(msg.TargetId)
 		reply.Type = ACK
 	default:
 		time.Sleep(100 * time.Millisecond)
@@ -125,55 +422,80 @@ func (node *Node) HandleIncomingMessage(msg *message.RequestMessage, reply *mess
 // Create new network (genesis node)
 func (node *Node) CreateNetwork() {
 	log.Info().Msg("> Creating a new network...")
-	node.Successor = Pointer{Nodeid: node.Nodeid, IP: node.IP}
-	node.Predecessor = Pointer{}
-	node.FingerTable = make([]Pointer, M)
-	go node.FixFingers()
+	// Initialize SuccList with self.
+	node.resetRouting(Pointer{Nodeid: node.Nodeid, IP: node.IP})
+	node.spawn("fix_fingers", node.FixFingers)
+	node.spawn("storage", node.persistStorage)
 	log.Info().Msg("> Finger table has been updated...")
-	for i := 0; i < len(node.FingerTable); i++ {
-		log.Info().Msgf("> Finger[%d]: Nodeid: %d IP: %s", i+1, node.FingerTable[i].Nodeid, node.FingerTable[i].IP)
+	for i, finger := range node.fingers() {
+		log.Info().Msgf("> Finger[%d]: Nodeid: %d IP: %s", i+1, finger.Nodeid, finger.IP)
 	}
 
-	// Initialize SuccList with self.
-	myPointer := Pointer{node.Nodeid, node.IP}
-	node.SuccList = []Pointer{myPointer}
-
-	go node.stabilize()
-	go node.CheckPredecessor()
-	go node.replicate()
+	node.startMaintenance()
 }
 
 // Join existing chord network
 func (node *Node) JoinNetwork(helper string) {
 	log.Info().Msgf("Contacting node in existing network at address: %s", helper)
 	reply := node.CallRPC(message.RequestMessage{Type: FIND_SUCCESSOR, TargetId: node.Nodeid}, helper)
-	node.Successor = Pointer{Nodeid: reply.Nodeid, IP: reply.IP}
-	log.Info().Msgf("My successor is: Nodeid: %d IP: %s", node.Successor.Nodeid, node.Successor.IP)
-	node.Predecessor = Pointer{}
-	node.FingerTable = make([]Pointer, M)
-	go node.FixFingers()
+	if reply.Type == EMPTY {
+		if peer, ok := node.findLivePeer(helper); ok {
+			log.Warn().Msgf("Could not reach %s, joining through %s from the address book instead", helper, peer.IP)
+			reply = node.CallRPC(message.RequestMessage{Type: FIND_SUCCESSOR, TargetId: node.Nodeid}, peer.IP)
+		}
+	}
+	// A frozen ring takes no new nodes. Observers are not part of the ring, and follow it regardless.
+	if reply.Type != EMPTY && !node.Observing() && !node.waitForThaw(reply.IP) {
+		return
+	}
+	// Initialize SuccList with self, and the successors the successor knows of, see warmstart.go
+	node.resetRouting(Pointer{Nodeid: reply.Nodeid, IP: reply.IP})
+	log.Info().Msgf("My successor is: Nodeid: %d IP: %s", reply.Nodeid, reply.IP)
+	node.warmStart()
+	node.spawn("fix_fingers", node.FixFingers)
+	node.spawn("storage", node.persistStorage)
 	log.Info().Msg("> Finger table has been updated...")
-	for i := 0; i < len(node.FingerTable); i++ {
-		log.Info().Msgf("> Finger[%d]: Nodeid: %d IP: %s", i+1, node.FingerTable[i].Nodeid, node.FingerTable[i].IP)
+	for i, finger := range node.fingers() {
+		log.Info().Msgf("> Finger[%d]: Nodeid: %d IP: %s", i+1, finger.Nodeid, finger.IP)
+	}
+	if node.Observing() {
+		node.startObserving()
+		return
 	}
 
 	log.Info().Msg("Performing key re-distribution")
-	reply = node.CallRPC(message.RequestMessage{Type: SHIFT, TargetId: node.Successor.Nodeid}, node.Successor.IP)
-	_, ok := node.HashIPStorage[node.Nodeid]
-	if !ok {
-		node.HashIPStorage[node.Nodeid] = map[uint64][]string{}
-	}
-	for hashedWebsite := range reply.Payload {
-		node.HashIPStorage[node.Nodeid][hashedWebsite] = reply.Payload[hashedWebsite]
-	}
+	node.shiftKeys()
 
-	// Initialize SuccList with self.
-	myPointer := Pointer{node.Nodeid, node.IP}
-	node.SuccList = []Pointer{myPointer}
+	node.startMaintenance()
+}
+
+/*
+Starts the periodic tasks that keep the node's view of the ring up to date.
+*/
+func (node *Node) startMaintenance() {
+	node.spawn("stabilize", node.stabilize)
+	node.spawn("check_predecessor", node.CheckPredecessor)
+	node.spawn("replicate", node.replicate)
+	node.spawn("probe_latency", node.probeLatency)
+	node.spawn("verify_keyspace", node.verifyKeyspace)
+	node.spawn("storage_gc", node.collectGarbage)
+	node.spawn("refresh_records", node.refreshLearned)
+	node.spawn("address_book", node.maintainAddressBook)
+	node.spawn("ring_metadata", node.publishRingMetadata)
+	node.spawn("hot_keys", node.detectHotKeys)
+	node.spawn("scrub", node.scrubStorage)
+	node.spawn("anti_entropy", node.antiEntropy)
+	node.spawn("clock_watch", node.watchClock)
+	node.spawn("consistency", node.scoreConsistency)
+}
 
-	go node.stabilize()
-	go node.CheckPredecessor()
-	go node.replicate()
+/*
+Returns the address of a remembered peer that is still alive, to rejoin the ring through after
+a restart.
+*/
+func (node *Node) RejoinAddress() (string, bool) {
+	peer, ok := node.findLivePeer()
+	return peer.IP, ok
 }
 
 /*
@@ -183,17 +505,90 @@ node whose ID most immediately precedes id, and then invokes find successor
 at that ID
 */
 func (node *Node) FindSuccessor(id uint64, hopCount int) (Pointer, int) {
+	return node.findSuccessor(id, hopCount, 0)
+}
+
+/*
+FindSuccessor, tagging every message it sends with the given trace id.
+*/
+func (node *Node) findSuccessor(id uint64, hopCount int, traceId uint64) (Pointer, int) {
+	return node.findSuccessorBefore(id, hopCount, traceId, time.Time{})
+}
+
+/*
+findSuccessor for a lookup that has to complete by deadline, see deadline.go. A zero deadline does
+not bound the lookup.
+*/
+func (node *Node) findSuccessorBefore(id uint64, hopCount int, traceId uint64, deadline time.Time) (Pointer, int) {
+	return node.findSuccessorAs(id, hopCount, traceId, deadline, false)
+}
+
+/*
+FindSuccessor for the lookups of ring maintenance, which yield to those of clients on every node
+they pass, see fairness.go.
+*/
+func (node *Node) backgroundFindSuccessor(id uint64) (Pointer, int) {
+	return node.findSuccessorAs(id, 0, 0, time.Time{}, true)
+}
+
+/*
+findSuccessorBefore, marking the messages it sends as part of a maintenance lookup if background.
+*/
+func (node *Node) findSuccessorAs(id uint64, hopCount int, traceId uint64, deadline time.Time, background bool) (Pointer, int) {
+	if hopCount == 0 {
+		node.incMetric("lookups_initiated_total", 1)
+	}
 	hopCount++
-	if belongsTo(id, node.Nodeid, node.Successor.Nodeid) {
-		return Pointer{Nodeid: node.Successor.Nodeid, IP: node.Successor.IP}, hopCount // Case when this is the first node.
+	if node.Gateway() {
+		return node.gatewayFindSuccessor(id, hopCount, traceId, deadline)
+	}
+	return node.routeSuccessor(id, hopCount, traceId, deadline, background)
+}
+
+/*
+The hops of findSuccessorAs, which hands the lookup to another virtual node of this process if it
+is closer to id than any finger, see vnodes.go.
+*/
+func (node *Node) routeSuccessor(id uint64, hopCount int, traceId uint64, deadline time.Time, background bool) (Pointer, int) {
+	if successor := node.successor(); belongsTo(id, node.Nodeid, successor.Nodeid) {
+		node.incMetric("lookups_answered_total", 1)
+		return successor, hopCount // Case when this is the first node.
 	}
 	p := node.ClosestPrecedingNode(id)
+	if sibling := node.closerSibling(id, p); sibling != nil {
+		node.incMetric("lookups_handed_to_vnode_total", 1)
+		return sibling.routeSuccessor(id, hopCount, traceId, deadline, background)
+	}
 	if (p != Pointer{} && p.Nodeid != node.Nodeid) {
 
-		reply := node.CallRPC(message.RequestMessage{Type: FIND_SUCCESSOR, TargetId: id, HopCount: hopCount}, p.IP)
-		return Pointer{Nodeid: reply.Nodeid, IP: reply.IP}, hopCount
+		msg := message.RequestMessage{Type: FIND_SUCCESSOR, TargetId: id, HopCount: hopCount, TraceId: traceId, Budget: int64(node.forwardBudget(deadline, hopCount)), Background: background}
+		node.incMetric("lookups_forwarded_total", 1)
+		sent := time.Now()
+		reply := node.CallRPC(msg, p.IP)
+		node.recordForward(reply, time.Since(sent))
+		// An overloaded node hints at its successor, which also precedes id, to carry on the lookup.
+		for retries := 0; redirectable(reply) && retries < MAX_BUSY_RETRIES; retries++ {
+			sampledLog().Debug().Msgf("Nodeid: %d is busy, retrying lookup via Nodeid: %d IP: %s", p.Nodeid, reply.Nodeid, reply.IP)
+			p = Pointer{Nodeid: reply.Nodeid, IP: reply.IP}
+			msg.Budget = int64(node.forwardBudget(deadline, hopCount))
+			reply = node.CallRPC(msg, p.IP)
+		}
+		// The hop ran out of its share of the budget, spend the share kept for it on the slower
+		// route through the successor.
+		if reply.Type == EMPTY && !deadline.IsZero() && time.Now().Before(deadline) && node.successor().IP != p.IP {
+			sampledLog().Debug().Msgf("Lookup of %d via Nodeid: %d failed, retrying via the successor with %s left", id, p.Nodeid, time.Until(deadline))
+			node.incMetric("lookup_budget_retries_total", 1)
+			msg.Budget = int64(max(1, time.Until(deadline)))
+			reply = node.CallRPC(msg, node.successor().IP)
+		}
+		if redirectable(reply) {
+			return Pointer{}, hopCount
+		}
+		// The reply counts the hops after this one, nodes that predate hop counts in replies do not.
+		return Pointer{Nodeid: reply.Nodeid, IP: reply.IP}, max(hopCount, reply.HopCount)
 	} else {
-		return node.Successor, hopCount
+		node.incMetric("lookups_answered_total", 1)
+		return node.successor(), hopCount
 	}
 }
 
@@ -201,11 +596,14 @@ func (node *Node) FindSuccessor(id uint64, hopCount int) (Pointer, int) {
 Works jointly with FindSuccessor(id). If id doesn't fall between
 my id, and my immediate successors id, then we find the closest
 preceding node, so we can call find successor on that node.
+The interval is open: a finger at id itself does not precede it, and
+forwarding to it would loop when id is the ID of a node.
+Of the peers that take the lookup as far, the nearest by RTT is chosen, see latency.go.
 */
 func (node *Node) ClosestPrecedingNode(id uint64) Pointer {
-	for i := M - 1; i >= 0; i-- {
-		if belongsTo(node.FingerTable[i].Nodeid, node.Nodeid, id) {
-			return node.FingerTable[i]
+	for i := hashing.Bits() - 1; i >= 0; i-- {
+		if finger := node.finger(i).Nodeid; finger != node.Nodeid && between(finger, node.Nodeid, id) {
+			return node.nearestPreceding(node.finger(i), id)
 		}
 	}
 	log.Info().Msgf("Closest Preceding node outside fingertable: Nodeid: %d IP: %s", node.Nodeid, node.IP)
@@ -217,28 +615,55 @@ Each node periodically calls fix fingers to make sure its finger
 table entries are correct; this is how new nodes initialize
 their finger tables, and it is how existing nodes incorporate
 new nodes into their finger tables.
+Every FIX_FINGER_INTERVAL one finger is fixed, the next one each time, so
+that the lookups of a round are spread out rather than sent in a burst.
+A node whose finger table is still empty fixes all of it at once first.
 */
 func (node *Node) FixFingers() {
-
-	for {
-		time.Sleep(1 * time.Second)
-		log.Debug().Msg("Fixing fingers...")
-		for id := range node.FingerTable {
-			nodePlusTwoI := (node.Nodeid + uint64(math.Pow(2, float64(id))))
-			power := uint64(math.Pow(2, float64(M)))
-			if nodePlusTwoI > power {
-				nodePlusTwoI -= power
-			}
-			node.FingerTable[id], _ = node.FindSuccessor(uint64(nodePlusTwoI), 0)
+	if node.finger(0) == (Pointer{}) && !node.Frozen() {
+		node.FixAllFingers()
+	}
+	next := 0
+	for node.sleep(node.jittered(maintenanceInterval(node.Config.FixFingerInterval, DEFAULT_FIX_FINGER_INTERVAL))) {
+		if node.Frozen() {
+			continue
 		}
-		// it has just restarted, so it needs to read from storage
-		if len(node.HashIPStorage) == 0 {
-			go node.readFromStorage()
+		node.fixFinger(next)
+		next = (next + 1) % hashing.Bits()
+		if next == 0 && node.Config.VerifyFingers {
+			node.verifyFingers()
 		}
+	}
+}
 
-		go node.writeToStorage()
-
+/*
+Fixes every finger at once, and returns the number of fingers that changed. Used when a node has no
+fingers yet, and by operators who want the table right after a change to the ring.
+*/
+func (node *Node) FixAllFingers() int {
+	log.Debug().Msg("Fixing fingers...")
+	changed := 0
+	for id := 0; id < hashing.Bits(); id++ {
+		if node.fixFinger(id) {
+			changed++
+		}
+	}
+	if node.Config.VerifyFingers {
+		node.verifyFingers()
 	}
+	return changed
+}
+
+/*
+Fixes finger i, the successor of node.Nodeid + 2^i. Returns true if the finger changed.
+*/
+func (node *Node) fixFinger(i int) bool {
+	nodePlusTwoI := (node.Nodeid + 1<<i) & hashing.Mask()
+	finger, _ := node.backgroundFindSuccessor(nodePlusTwoI)
+	node.incMetric("fingers_fixed_total", 1)
+	changed := node.finger(i) != finger
+	node.setFinger(i, finger)
+	return changed
 }
 
 /*
@@ -252,56 +677,122 @@ to change its predecessor to n. The successor does this only if it
 knows of no closer predecessor than n.
 */
 func (node *Node) stabilize() {
-	for {
-		time.Sleep(1 * time.Second)
-		reply := node.CallRPC(
-			message.RequestMessage{Type: GET_PREDECESSOR, TargetId: node.Successor.Nodeid, IP: node.Successor.IP},
-			node.Successor.IP,
+	for node.sleep(node.jittered(maintenanceInterval(node.Config.StabilizeInterval, DEFAULT_STABILIZE_INTERVAL))) {
+		node.stabilizeOnce()
+	}
+}
+
+/*
+One round of stabilize.
+*/
+func (node *Node) stabilizeOnce() {
+	if node.Frozen() {
+		return
+	}
+	// Ask for the successor's predecessor and notify it in a single round trip.
+	// A decommissioning node stops advertising itself, and only asks.
+	successor := node.successor()
+	reply := message.ResponseMessage{}
+	if !node.Decommissioning() && !node.Observing() {
+		reply = node.CallRPC(
+			message.RequestMessage{Type: STABILIZE, TargetId: node.Nodeid, IP: node.IP, Budget: node.pingBudget()},
+			successor.IP,
+		)
+	}
+	notified := reply.Type == ACK
+	if reply.Type == "" {
+		// The successor does not know STABILIZE yet, fall back to GET_PREDECESSOR + NOTIFY.
+		reply = node.CallRPC(
+			message.RequestMessage{Type: GET_PREDECESSOR, TargetId: successor.Nodeid, IP: successor.IP},
+			successor.IP,
 		)
+	}
+	// The successor already has this node as its predecessor, so there is nothing to notify it of.
+	if reply.Type != EMPTY && reply.Type != SHUTTING_DOWN && reply.Nodeid == node.Nodeid && reply.IP == node.IP {
+		notified = true
+	}
 
-		// [3000, 3001, 3000]
+	// [3000, 3001, 3000]
 
-		// Current successor is dead. Look at successor list for next successor.
-		if reply.Type == EMPTY {
-			// get next successor from SuccList and make it your successor
-			for _, pointer := range node.SuccList[1:] {
-				if node.checkSuccessorAlive(pointer) {
-					node.Successor = pointer
-				}
+	// One missed reply is not enough to give up on the successor, see failuredetector.go
+	if failed := node.heartbeat(successor.IP, reply.Type != EMPTY); reply.Type == EMPTY && !failed {
+		log.Debug().Msgf("Successor %s missed a heartbeat, keeping it for now", successor.IP)
+		return
+	}
+
+	// Current successor is dead, or about to be. Look at successor list for next successor.
+	if reply.Type == EMPTY || reply.Type == SHUTTING_DOWN {
+		notified = false
+		// get next successor from SuccList and make it your successor
+		found := false
+		for _, pointer := range node.succList()[1:] {
+			if pointer.IP != successor.IP && node.checkSuccessorAlive(pointer) {
+				node.setSuccessor(pointer, CAUSE_TIMEOUT)
+				successor = pointer
+				found = true
+				break
 			}
+		}
+		// The whole successor list is gone, look for another way into the ring
+		if !found {
+			node.rejoinFromAddressBook()
+		}
 
-			// Current successor is alive. Check if it's predecessor lies between you and your current successor. If yes, node.Successor = the middle fella
-		} else {
-			sucessorsPredecessor := Pointer{Nodeid: reply.Nodeid, IP: reply.IP}
-			if (sucessorsPredecessor != Pointer{}) {
-				// The new dude in between you and your successor is not dead, then my true successor is the new dude. Or you're the only dude.
-				if between(sucessorsPredecessor.Nodeid, node.Nodeid, node.Successor.Nodeid) {
-					node.Successor = Pointer{Nodeid: sucessorsPredecessor.Nodeid, IP: sucessorsPredecessor.IP}
-				}
+		// Current successor is alive. Check if it's predecessor lies between you and your current successor. If yes, node.Successor = the middle fella
+	} else {
+		sucessorsPredecessor := Pointer{Nodeid: reply.Nodeid, IP: reply.IP}
+		if (sucessorsPredecessor != Pointer{}) {
+			// The new dude in between you and your successor is not dead, then my true successor is the new dude. Or you're the only dude.
+			if between(sucessorsPredecessor.Nodeid, node.Nodeid, successor.Nodeid) && sucessorsPredecessor.Nodeid != node.Nodeid {
+				node.setSuccessor(sucessorsPredecessor, CAUSE_NEW_NODE)
+				successor = sucessorsPredecessor
+				notified = false
 			}
 		}
+	}
 
-		// Notify your new successor (whoever it is) that you are it's predecessor
+	// Notify your new successor (whoever it is) that you are it's predecessor, unless STABILIZE already did
+	if !notified && !node.Decommissioning() && !node.Observing() {
 		reply = node.CallRPC(
 			message.RequestMessage{Type: NOTIFY, TargetId: node.Nodeid, IP: node.IP},
-			node.Successor.IP,
+			node.successor().IP,
 		)
-		if reply.Type == ACK {
-			log.Debug().Msgf("Successfully notified successor of it's new predecessor Nodeid: %d IP: %s\n", node.Nodeid, node.IP)
-		}
-
-		// Recompute SuccList
-		node.maintainSuccList()
-		// replicate
+		notified = reply.Type == ACK
+	}
+	if notified {
+		log.Debug().Msgf("Successfully notified successor of it's new predecessor Nodeid: %d IP: %s\n", node.Nodeid, node.IP)
 	}
+
+	// Recompute SuccList
+	node.maintainSuccList()
+	// replicate
 }
 
 /*
 x thinks it might be nodes predecessor
 */
 func (node *Node) Notify(x Pointer) bool {
+	if node.Frozen() {
+		return false
+	}
+	if x.Nodeid > hashing.Mask() {
+		// x hashes into a wider keyspace, see RING_BITS, and would own keys no node of this ring looks up.
+		node.incMetric("keyspace_mismatches_total", 1)
+		sampledLog().Warn().Msgf("Refusing predecessor %s, its ID %d is outside the %d bit keyspace", x.IP, x.Nodeid, hashing.Bits())
+		return false
+	}
+	// The check and the update are one step, so that two nodes notifying at once cannot both win.
+	node.ringMu.Lock()
+	defer node.ringMu.Unlock()
 	if (node.Predecessor == Pointer{} || between(x.Nodeid, node.Predecessor.Nodeid, node.Nodeid)) {
+		node.pointerChanged(POINTER_PREDECESSOR, node.Predecessor, x, CAUSE_NEW_NODE)
 		node.Predecessor = Pointer{Nodeid: x.Nodeid, IP: x.IP}
+		// A node that was alone in the ring now forms a ring of two with x, which is therefore its
+		// successor too. Without this, it would claim the whole keyspace until its next stabilize.
+		if node.Successor.Nodeid == node.Nodeid {
+			node.pointerChanged(POINTER_SUCCESSOR, node.Successor, x, CAUSE_NEW_NODE)
+			node.Successor = Pointer{Nodeid: x.Nodeid, IP: x.IP}
+		}
 		return true
 	}
 	return false
@@ -313,47 +804,56 @@ predecessor pointer if n.predecessor has failed; this allows it to accept
 a new predecessor in notify.
 */
 func (node *Node) CheckPredecessor() {
-	for {
-		time.Sleep(1 * time.Second)
-		if (node.Predecessor == Pointer{}) {
+	for node.sleep(node.jittered(maintenanceInterval(node.Config.CheckPredecessorInterval, DEFAULT_CHECK_PREDECESSOR_INTERVAL))) {
+		predecessor := node.predecessor()
+		if (predecessor == Pointer{}) || node.Frozen() {
 			continue
 		}
-		reply := node.CallRPC(message.RequestMessage{Type: PING}, node.Predecessor.IP)
-		if reply.Type == EMPTY {
-			hashMap, ok := node.HashIPStorage[node.Predecessor.Nodeid]
+		reply := node.CallRPC(message.RequestMessage{Type: PING, Budget: node.pingBudget()}, predecessor.IP)
+		failed := node.heartbeat(predecessor.IP, reply.Type != EMPTY)
+		if reply.Type == EMPTY && !failed {
+			log.Debug().Msgf("Predecessor Nodeid: %d IP: %s missed a heartbeat", predecessor.Nodeid, predecessor.IP)
+		} else if failed || reply.Type == SHUTTING_DOWN {
+			node.storageMu.Lock()
+			hashMap, ok := node.HashIPStorage[predecessor.Nodeid]
 			if ok {
 				for id, ip_cache := range hashMap {
 					_, ok := node.HashIPStorage[node.Nodeid]
 					if !ok {
-						node.HashIPStorage[node.Nodeid] = make(map[uint64][]string)
+						node.HashIPStorage[node.Nodeid] = make(map[uint64][]Record)
 					}
 					node.HashIPStorage[node.Nodeid][id] = ip_cache
+					node.stampChecksum(node.Nodeid, id, ip_cache)
 				}
-				delete(node.HashIPStorage, node.Predecessor.Nodeid)
-				node.Predecessor = Pointer{}
+				delete(node.HashIPStorage, predecessor.Nodeid)
+			}
+			node.storageMu.Unlock()
+			if ok {
+				node.setPredecessor(Pointer{}, CAUSE_TIMEOUT)
 			}
 
 		} else {
-			log.Debug().Msgf("Predecessor Nodeid: %d IP: %s is alive", node.Predecessor.Nodeid, node.Predecessor.IP)
+			log.Debug().Msgf("Predecessor Nodeid: %d IP: %s is alive", predecessor.Nodeid, predecessor.IP)
 		}
 	}
 }
 
 func (node *Node) maintainSuccList() {
 
-	mu.Lock()
+	// Built aside, the RPCs are not made under the lock.
 	myPointer := Pointer{Nodeid: node.Nodeid, IP: node.IP}
-	node.SuccList = []Pointer{myPointer}
+	succList := []Pointer{myPointer}
 	for i := 0; i < REPLICATION_FACTOR; i++ {
-		lastSucc := node.SuccList[len(node.SuccList)-1]
+		lastSucc := succList[len(succList)-1]
 		reply := node.CallRPC(message.RequestMessage{Type: GET_SUCCESSOR}, lastSucc.IP)
 		nextSucc := Pointer{Nodeid: reply.Nodeid, IP: reply.IP}
-		node.SuccList = append(node.SuccList, nextSucc)
+		succList = append(succList, nextSucc)
 	}
-	mu.Unlock()
+	node.setSuccList(succList)
 }
 
 func (node *Node) checkSuccessorAlive(pointer Pointer) bool {
-	reply := node.CallRPC(message.RequestMessage{Type: PING}, pointer.IP)
+	reply := node.CallRPC(message.RequestMessage{Type: PING, Budget: node.pingBudget()}, pointer.IP)
+	node.heartbeat(pointer.IP, reply.Type != EMPTY)
 	return reply.Type == ACK
 }
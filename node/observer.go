@@ -0,0 +1,56 @@
+/*
+Observer mode. An observer finds its place in the ring and follows it, keeping its successor,
+successor list and fingers up to date, but never notifies its successor, so that no node takes it
+for its predecessor and no part of the keyspace is ever assigned to it. It can therefore look names
+up, draw the routing graph and collect statistics of a running ring without changing it, which is
+what dashboards and graders watching a demo need.
+*/
+package node
+
+import (
+	"fmt"
+
+	"github.com/fauzxan/dns-chord/v2/message"
+	"github.com/rs/zerolog/log"
+)
+
+/*
+Returns true if the node is an observer.
+*/
+func (node *Node) Observing() bool {
+	return node.Config.Observer
+}
+
+/*
+Returns true if an observer must refuse messages of type msgType, as they would make it store keys
+or take a place in the ring.
+*/
+func observerRefuses(msgType string) bool {
+	switch msgType {
+	case PUT, REPLICATE, SHIFT, HANDOFF, BOOST, PIN, NOTIFY, STABILIZE:
+		return true
+	}
+	return false
+}
+
+/*
+Answers a message an observer refuses with a BUSY hint at its successor, so that senders that
+follow hints, see redirectable, try there instead.
+*/
+func (node *Node) observerReply(msg *message.RequestMessage, reply *message.ResponseMessage) {
+	log.Debug().Msgf("Refusing %s from %s, this node is an observer", msg.Type, msg.From)
+	node.incMetric(fmt.Sprintf("observer_refused_total{type=%q}", msg.Type), 1)
+	node.busyReply(reply)
+}
+
+/*
+Starts the background work of an observer: following the ring, and keeping track of the latency
+and addresses of its peers. None of the storage maintenance of a member runs.
+*/
+func (node *Node) startObserving() {
+	log.Info().Msgf("Observing the ring from Nodeid: %d, no keys will be stored here", node.Nodeid)
+	node.spawn("stabilize", node.stabilize)
+	node.spawn("probe_latency", node.probeLatency)
+	node.spawn("address_book", node.maintainAddressBook)
+	node.spawn("clock_watch", node.watchClock)
+}
@@ -0,0 +1,73 @@
+/*
+Overload signalling. When a node has too many RPCs in flight, or the host is too busy, it stops
+forwarding lookups and serving GETs, and instead replies BUSY with a hint (its successor, which
+precedes the target of a forwarded lookup and holds replicas of its keys). The requester then tries
+the hint, so that a hot node does not drag down every lookup routed through it.
+*/
+package node
+
+import (
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/fauzxan/dns-chord/v2/message"
+)
+
+// Constants
+const (
+	MAX_BUSY_RETRIES = 3 // Number of BUSY hints a requester follows before giving up.
+)
+
+/*
+Returns the number of RPC handlers currently running.
+*/
+func (node *Node) inflightRPCs() int {
+	node.context()
+	node.life.mu.Lock()
+	defer node.life.mu.Unlock()
+	return node.life.counts["rpc_handler"]
+}
+
+/*
+Returns true if the node is over one of its configured load thresholds.
+*/
+func (node *Node) overloaded() bool {
+	if node.Config.MaxInflightRPCs > 0 && node.inflightRPCs() > node.Config.MaxInflightRPCs {
+		return true
+	}
+	if node.Config.MaxLoadPerCPU > 0 {
+		if load, ok := loadAverage(); ok && load/float64(runtime.NumCPU()) > node.Config.MaxLoadPerCPU {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Fills in a BUSY reply, with this node's successor as the hint of where to go instead.
+*/
+func (node *Node) busyReply(reply *message.ResponseMessage) {
+	node.incMetric("busy_replies_total", 1)
+	reply.Type = BUSY
+	successor := node.successor()
+	reply.Nodeid = successor.Nodeid
+	reply.IP = successor.IP
+}
+
+/*
+Returns the one minute load average of the host. Only available where /proc/loadavg exists.
+*/
+func loadAverage() (float64, bool) {
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, false
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, false
+	}
+	load, err := strconv.ParseFloat(fields[0], 64)
+	return load, err == nil
+}
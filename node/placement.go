@@ -0,0 +1,68 @@
+/*
+Load aware placement of joining nodes. Hashing a node's address places it at a random point of the
+ring, which with few nodes leaves some of them with most of the keys. Instead, a joining node can
+ask its helper for a suggested ID: the helper asks the nodes around it how many keys they hold, and
+suggests the ID that splits the keys of the most loaded one in half.
+*/
+package node
+
+import (
+	"sort"
+
+	"github.com/fauzxan/dns-chord/v2/hashing"
+	"github.com/fauzxan/dns-chord/v2/message"
+	"github.com/rs/zerolog/log"
+)
+
+/*
+Returns the number of keys this node is responsible for, and the ID a new node would need to take
+over the first half of them, i.e. the median key in ring order after the predecessor.
+*/
+func (node *Node) splitPoint() (int, uint64) {
+	node.storageMu.RLock()
+	keys := make([]uint64, 0, len(node.HashIPStorage[node.Nodeid]))
+	for key := range node.HashIPStorage[node.Nodeid] {
+		keys = append(keys, key)
+	}
+	node.storageMu.RUnlock()
+	if len(keys) < 2 {
+		return len(keys), 0
+	}
+	// Distance from the predecessor, clockwise around the ring.
+	start := node.predecessor().Nodeid
+	distance := func(key uint64) uint64 { return (key - start) & hashing.Mask() }
+	sort.Slice(keys, func(i, j int) bool { return distance(keys[i]) < distance(keys[j]) })
+	return len(keys), keys[(len(keys)-1)/2]
+}
+
+/*
+Handles a SUGGEST_ID request: asks this node and the nodes in its successor list for their load,
+and returns the split point and key count of the most loaded one. Returns false if no node holds enough keys for
+the placement to matter.
+*/
+func (node *Node) suggestId() (uint64, int, bool) {
+	bestCount, bestId := node.splitPoint()
+	succList := node.succList()
+	for _, pointer := range succList {
+		if pointer.IP == node.IP || pointer.IP == "" {
+			continue
+		}
+		reply := node.CallRPC(message.RequestMessage{Type: KEY_LOAD}, pointer.IP)
+		if reply.Type == ACK && reply.KeyCount > bestCount {
+			bestCount, bestId = reply.KeyCount, reply.SuggestedId
+		}
+	}
+	return bestId, bestCount, bestCount >= 2
+}
+
+/*
+Asks helper where in the ring a new node should be placed to best balance the current key load.
+*/
+func (node *Node) SuggestedId(helper string) (uint64, bool) {
+	reply := node.CallRPC(message.RequestMessage{Type: SUGGEST_ID}, helper)
+	if reply.Type != ACK {
+		return 0, false
+	}
+	log.Info().Msgf("Helper suggests placing this node at ID %d, to take over half of %d keys", reply.SuggestedId, reply.KeyCount)
+	return reply.SuggestedId, true
+}
@@ -0,0 +1,174 @@
+/*
+Progress reporting for long running operations such as bulk queries, key transfers and ring walks.
+Each operation registers a Progress on the node, which periodically logs the number of items
+processed and an ETA, and which can be inspected through the admin endpoint while it runs.
+
+Every operation has an ID, by which an operator can cancel it, e.g. a transfer stuck on a hung
+peer, without restarting the node. Cancelling asks the operation to stop: it watches its Context
+and stops before its next item. A cancelled lookup returns at once, and leaves the RPC it waits
+for to time out in the background.
+DNS lookups in the ring are registered too, quietly, so that they can be listed and cancelled
+like any other operation but do not log every start and finish.
+*/
+package node
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Constants
+const (
+	PROGRESS_LOG_INTERVAL = 2 * time.Second // Minimum time between two progress log lines of the same operation.
+)
+
+/*
+Tracks how far a single long running operation has come.
+*/
+type Progress struct {
+	mu        sync.Mutex
+	node      *Node
+	ID        uint64    `json:"id"`
+	Name      string    `json:"name"`      // Name of the operation, e.g. "key transfer"
+	Done      int       `json:"done"`      // Number of items processed so far
+	Total     int       `json:"total"`     // Number of items to process, 0 if unknown
+	Started   time.Time `json:"started"`   // When the operation started
+	ETA       string    `json:"eta"`       // Estimated time remaining, empty if unknown
+	Cancelled bool      `json:"cancelled"` // Set once the operation was asked to stop
+	lastPrint time.Time
+	quiet     bool // Does not log, for short operations such as lookups
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+/*
+Book keeping of the operations currently in progress on a node.
+*/
+type progressRegistry struct {
+	mu     sync.Mutex
+	nextId uint64
+	active map[uint64]*Progress
+}
+
+/*
+Registers a new operation with the given number of items (0 if unknown). Finish must be called
+once the operation is over.
+*/
+func (node *Node) StartProgress(name string, total int) *Progress {
+	p := node.startOperation(name, total, false)
+	log.Info().Msgf("Started %s (%d items), cancel with ID %d", name, total, p.ID)
+	return p
+}
+
+/*
+Registers a new operation, which does not log its progress if quiet.
+*/
+func (node *Node) startOperation(name string, total int, quiet bool) *Progress {
+	node.progress.mu.Lock()
+	defer node.progress.mu.Unlock()
+	if node.progress.active == nil {
+		node.progress.active = make(map[uint64]*Progress)
+	}
+	node.progress.nextId++
+	p := &Progress{node: node, ID: node.progress.nextId, Name: name, Total: total, Started: time.Now(), quiet: quiet}
+	p.ctx, p.cancel = context.WithCancel(node.context())
+	node.progress.active[p.ID] = p
+	return p
+}
+
+/*
+Returns the context of the operation, which is done once it is cancelled or the node shuts down.
+*/
+func (p *Progress) Context() context.Context {
+	return p.ctx
+}
+
+/*
+Reports whether the operation has been cancelled, or the node is shutting down.
+*/
+func (p *Progress) Stopped() bool {
+	return p.ctx.Err() != nil
+}
+
+/*
+Asks the operation with the given ID to stop. Returns an error if no such operation is in progress.
+*/
+func (node *Node) CancelOperation(id uint64) error {
+	node.progress.mu.Lock()
+	p, ok := node.progress.active[id]
+	node.progress.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no operation with ID %d is in progress", id)
+	}
+	p.mu.Lock()
+	p.Cancelled = true
+	p.mu.Unlock()
+	p.cancel()
+	node.incMetric("operations_cancelled_total", 1)
+	log.Warn().Msgf("Cancelled %s (ID %d)", p.Name, id)
+	return nil
+}
+
+/*
+Records that n more items have been processed, and logs the progress if it has not been logged
+for PROGRESS_LOG_INTERVAL.
+*/
+func (p *Progress) Add(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Done += n
+	if p.Total > 0 && p.Done > 0 {
+		elapsed := time.Since(p.Started)
+		remaining := time.Duration(float64(elapsed) / float64(p.Done) * float64(p.Total-p.Done))
+		p.ETA = remaining.Round(time.Second).String()
+	}
+	if !p.quiet && time.Since(p.lastPrint) >= PROGRESS_LOG_INTERVAL {
+		p.lastPrint = time.Now()
+		if p.Total > 0 {
+			log.Info().Msgf("%s: %d/%d processed, ETA %s", p.Name, p.Done, p.Total, p.ETA)
+		} else {
+			log.Info().Msgf("%s: %d processed", p.Name, p.Done)
+		}
+	}
+}
+
+/*
+Unregisters the operation and logs a summary.
+*/
+func (p *Progress) Finish() {
+	p.node.progress.mu.Lock()
+	delete(p.node.progress.active, p.ID)
+	p.node.progress.mu.Unlock()
+	p.cancel()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.quiet {
+		return
+	}
+	if p.Cancelled {
+		log.Info().Msgf("Stopped %s after %d processed in %s", p.Name, p.Done, time.Since(p.Started).Round(time.Millisecond))
+		return
+	}
+	log.Info().Msgf("Finished %s: %d processed in %s", p.Name, p.Done, time.Since(p.Started).Round(time.Millisecond))
+}
+
+/*
+Returns a snapshot of all operations currently in progress.
+*/
+func (node *Node) ActiveProgress() []Progress {
+	node.progress.mu.Lock()
+	defer node.progress.mu.Unlock()
+	snapshot := []Progress{}
+	for _, p := range node.progress.active {
+		p.mu.Lock()
+		snapshot = append(snapshot, Progress{ID: p.ID, Name: p.Name, Done: p.Done, Total: p.Total, Started: p.Started, ETA: p.ETA, Cancelled: p.Cancelled})
+		p.mu.Unlock()
+	}
+	sort.Slice(snapshot, func(i, j int) bool { return snapshot[i].ID < snapshot[j].ID })
+	return snapshot
+}
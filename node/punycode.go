@@ -0,0 +1,180 @@
+/*
+Punycode (RFC 3492), the encoding internationalized domain name labels use on the wire: a label like
+"bücher" is carried as "xn--bcher-kva". Names are converted to punycode on input, so that they hash
+and resolve like any other name, and back to Unicode for display. Only the bootstring algorithm itself
+is implemented here; labels are lowercased before encoding, but no further Unicode normalization is applied.
+*/
+package node
+
+import (
+	"errors"
+	"strings"
+)
+
+// Constants
+const (
+	ACE_PREFIX = "xn--" // Prefix of punycode encoded labels.
+
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+)
+
+var errPunycode = errors.New("invalid punycode")
+
+/*
+Encodes a Unicode label as an ASCII label, adding the ACE prefix. ASCII labels are returned as is.
+*/
+func labelToASCII(label string) (string, error) {
+	runes := []rune(label)
+	var out strings.Builder
+	for _, r := range runes {
+		if r < 0x80 {
+			out.WriteRune(r)
+		}
+	}
+	basic := out.Len()
+	if basic == len(runes) {
+		return label, nil
+	}
+	if basic > 0 {
+		out.WriteByte('-')
+	}
+
+	n, delta, bias := rune(punyInitialN), 0, punyInitialBias
+	for handled := basic; handled < len(runes); {
+		next := rune(0x10FFFF)
+		for _, r := range runes {
+			if r >= n && r < next {
+				next = r
+			}
+		}
+		if int(next-n) > (1<<31-1-delta)/(handled+1) {
+			return "", errPunycode
+		}
+		delta += int(next-n) * (handled + 1)
+		n = next
+		for _, r := range runes {
+			if r < n {
+				delta++
+			}
+			if r != n {
+				continue
+			}
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := punyThreshold(k, bias)
+				if q < t {
+					break
+				}
+				out.WriteByte(punyDigit(t + (q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			out.WriteByte(punyDigit(q))
+			bias = punyAdapt(delta, handled+1, handled == basic)
+			delta = 0
+			handled++
+		}
+		delta++
+		n++
+	}
+	return ACE_PREFIX + out.String(), nil
+}
+
+func punyThreshold(k, bias int) int {
+	switch {
+	case k <= bias:
+		return punyTMin
+	case k >= bias+punyTMax:
+		return punyTMax
+	}
+	return k - bias
+}
+
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+func punyAdapt(delta, points int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / points
+	k := 0
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
+
+/*
+Decodes an ACE label back to Unicode. Labels without the ACE prefix are returned as is.
+*/
+func labelToUnicode(label string) (string, error) {
+	if !strings.HasPrefix(label, ACE_PREFIX) {
+		return label, nil
+	}
+	encoded := label[len(ACE_PREFIX):]
+	var output []rune
+	if i := strings.LastIndexByte(encoded, '-'); i >= 0 {
+		for _, r := range encoded[:i] {
+			if r >= 0x80 {
+				return "", errPunycode
+			}
+			output = append(output, r)
+		}
+		encoded = encoded[i+1:]
+	}
+
+	n, i, bias := rune(punyInitialN), 0, punyInitialBias
+	for pos := 0; pos < len(encoded); {
+		oldi, w := i, 1
+		for k := punyBase; ; k += punyBase {
+			if pos >= len(encoded) {
+				return "", errPunycode
+			}
+			digit, ok := punyValue(encoded[pos])
+			pos++
+			if !ok || digit > (1<<31-1-i)/w {
+				return "", errPunycode
+			}
+			i += digit * w
+			t := punyThreshold(k, bias)
+			if digit < t {
+				break
+			}
+			w *= punyBase - t
+		}
+		bias = punyAdapt(i-oldi, len(output)+1, oldi == 0)
+		n += rune(i / (len(output) + 1))
+		if n > 0x10FFFF {
+			return "", errPunycode
+		}
+		i %= len(output) + 1
+		output = append(output[:i], append([]rune{n}, output[i:]...)...)
+		i++
+	}
+	return string(output), nil
+}
+
+func punyValue(c byte) (int, bool) {
+	switch {
+	case c >= 'a' && c <= 'z':
+		return int(c - 'a'), true
+	case c >= 'A' && c <= 'Z':
+		return int(c - 'A'), true
+	case c >= '0' && c <= '9':
+		return int(c-'0') + 26, true
+	}
+	return 0, false
+}
@@ -0,0 +1,117 @@
+package node
+
+import (
+	"strings"
+	"testing"
+)
+
+/*
+The sample strings of RFC 3492, section 7.1, without the ACE prefix. The Russian sample is in
+lower case, as the encoder does not emit mixed-case annotations.
+*/
+var punycodeSamples = []struct {
+	name    string
+	unicode string
+	ascii   string
+}{
+	{"Arabic (Egyptian)", "ليهمابتكلموشعربي؟", "egbpdaj6bu4bxfgehfvwxn"},
+	{"Chinese (simplified)", "他们为什么不说中文", "ihqwcrb4cv8a8dqg056pqjye"},
+	{"Chinese (traditional)", "他們爲什麽不說中文", "ihqwctvzc91f659drss3x8bo0yb"},
+	{"Czech", "Pročprostěnemluvíčesky", "Proprostnemluvesky-uyb24dma41a"},
+	{"Hebrew", "למההםפשוטלאמדבריםעברית", "4dbcagdahymbxekheh6e0a7fei0b"},
+	{"Hindi (Devanagari)", "यहलोगहिन्दीक्योंनहींबोलसकतेहैं", "i1baa7eci9glrd9b2ae1bj0hfcgg6iyaf8o0a1dig0cd"},
+	{"Japanese (kanji and hiragana)", "なぜみんな日本語を話してくれないのか", "n8jok5ay5dzabd5bym9f0cm5685rrjetr6pdxa"},
+	{"Korean (Hangul syllables)", "세계의모든사람들이한국어를이해한다면얼마나좋을까", "989aomsvi5e83db1d2a355cv1e0vak1dwrv93d5xbh15a0dt30a5jpsd879ccm6fea98c"},
+	{"Russian (Cyrillic)", "почемужеонинеговорятпорусски", "b1abfaaepdrnnbgefbadotcwatmq2g4l"},
+	{"Spanish", "PorquénopuedensimplementehablarenEspañol", "PorqunopuedensimplementehablarenEspaol-fmd56a"},
+	{"Vietnamese", "TạisaohọkhôngthểchỉnóitiếngViệt", "TisaohkhngthchnitingVit-kjcr8268qyxafd2f1b9g"},
+	{"3<nen>B<gumi><kinpachi><sensei>", "3年B組金八先生", "3B-ww4c5e180e575a65lsy2b"},
+	{"<amuro><namie>-with-SUPER-MONKEYS", "安室奈美恵-with-SUPER-MONKEYS", "-with-SUPER-MONKEYS-pc58ag80a8qai00g7n9n"},
+	{"Hello-Another-Way-<sorezore><no><basho>", "Hello-Another-Way-それぞれの場所", "Hello-Another-Way--fc4qua05auwb3674vfr0b"},
+	{"<hitotsu><yane><no><shita>2", "ひとつ屋根の下2", "2-u9tlzr9756bt3uc0v"},
+	{"Maji<de>Koi<suru>5<byou><mae>", "MajiでKoiする5秒前", "MajiKoi5-783gue6qz075azm5e"},
+	{"<pafii>de<runba>", "パフィーdeルンバ", "de-jg4avhby1noc0d"},
+	{"<sono><supiido><de>", "そのスピードで", "d9juau41awczczp"},
+}
+
+func TestPunycodeSamples(t *testing.T) {
+	for _, sample := range punycodeSamples {
+		ascii, err := labelToASCII(sample.unicode)
+		if err != nil {
+			t.Errorf("%s: encoding failed: %v", sample.name, err)
+		} else if want := ACE_PREFIX + sample.ascii; ascii != want {
+			t.Errorf("%s: encoded as %q, want %q", sample.name, ascii, want)
+		}
+		unicode, err := labelToUnicode(ACE_PREFIX + sample.ascii)
+		if err != nil {
+			t.Errorf("%s: decoding failed: %v", sample.name, err)
+		} else if unicode != sample.unicode {
+			t.Errorf("%s: decoded as %q, want %q", sample.name, unicode, sample.unicode)
+		}
+	}
+}
+
+func TestPunycodeASCII(t *testing.T) {
+	for _, label := range []string{"example", "a-b", "_sip", "xn"} {
+		if ascii, err := labelToASCII(label); err != nil || ascii != label {
+			t.Errorf("labelToASCII(%q) = %q, %v, want it unchanged", label, ascii, err)
+		}
+		if unicode, err := labelToUnicode(label); err != nil || unicode != label {
+			t.Errorf("labelToUnicode(%q) = %q, %v, want it unchanged", label, unicode, err)
+		}
+	}
+}
+
+func TestPunycodeMalformed(t *testing.T) {
+	for _, label := range []string{"xn--bcher-kv!", "xn--ü-kva", "xn--99999999999"} {
+		if unicode, err := labelToUnicode(label); err == nil {
+			t.Errorf("labelToUnicode(%q) = %q, want an error", label, unicode)
+		}
+	}
+}
+
+func TestNormalizeInternationalNames(t *testing.T) {
+	tests := []struct {
+		input, normalized, display string
+	}{
+		{"bücher.example", "xn--bcher-kva.example", "bücher.example"},
+		{"BÜCHER.Example.", "xn--bcher-kva.example", "bücher.example"},
+		{"xn--bcher-kva.example", "xn--bcher-kva.example", "bücher.example"},
+		{"www.münchen.de", "xn--mnchen-3ya.de", "münchen.de"},
+		// Mixed Latin and Cyrillic in one label, and a Cyrillic and a CJK label in one name.
+		{"paypаl.com", "xn--paypl-7ve.com", "paypаl.com"},
+		{"пример.испытание", "xn--e1afmkfd.xn--80akhbyknj4f", "пример.испытание"},
+		{"例え.テスト", "xn--r8jz45g.xn--zckzah", "例え.テスト"},
+		{"中文.example", "xn--fiq228c.example", "中文.example"},
+	}
+	for _, test := range tests {
+		normalized, err := NormalizeName(test.input)
+		if err != nil {
+			t.Errorf("NormalizeName(%q) failed: %v", test.input, err)
+			continue
+		}
+		if normalized != test.normalized {
+			t.Errorf("NormalizeName(%q) = %q, want %q", test.input, normalized, test.normalized)
+		}
+		if display := DisplayName(normalized); display != test.display {
+			t.Errorf("DisplayName(%q) = %q, want %q", normalized, display, test.display)
+		}
+		// Normalizing the display form again leads back to the same name.
+		if again, err := NormalizeName(DisplayName(normalized)); err != nil || again != normalized {
+			t.Errorf("NormalizeName(DisplayName(%q)) = %q, %v", normalized, again, err)
+		}
+	}
+}
+
+func TestPunycodeRoundTrip(t *testing.T) {
+	for _, label := range []string{"ü", "äöü", "日本", "a日b本c", strings.Repeat("я", 20), "😀"} {
+		ascii, err := labelToASCII(label)
+		if err != nil {
+			t.Errorf("labelToASCII(%q) failed: %v", label, err)
+			continue
+		}
+		if unicode, err := labelToUnicode(ascii); err != nil || unicode != label {
+			t.Errorf("labelToUnicode(labelToASCII(%q)) = %q, %v", label, unicode, err)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+/*
+Records of any DNS type. A record is kept as it is in wire format, with its type, class, TTL and
+rdata, so records of types this node knows nothing about, such as SVCB and HTTPS or ones defined
+in the future, pass through storage, RPCs and DNS answers unchanged. Records are converted to and
+from text only at the edges, the CLI, imports and exports: A and AAAA records are written as bare
+addresses, TXT records and the control records of the ring as "<TYPE> <value>", and records of any
+other type in the generic notation of RFC 3597: "<TYPE> \# <length> <hex rdata>", where TYPE is a
+type name, e.g. "HTTPS \# 3 000100", or its number, e.g. "TYPE65 \# 3 000100".
+*/
+package node
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/fauzxan/dns-chord/v2/message"
+	"github.com/rs/zerolog/log"
+)
+
+// Constants
+const (
+	RDATA_GENERIC   = `\#`   // Marks a record value in the generic notation of RFC 3597.
+	RR_TYPE_PRIVATE = 0xFF00 // First of the private-use types (RFC 6895), given to the control records.
+)
+
+/*
+A DNS record of a record set, see message.Record.
+*/
+type Record = message.Record
+
+/*
+Numbers of the record types known by name. Records of other types are named TYPE<number>.
+*/
+var rrTypes = map[string]uint16{
+	"A":     DNS_TYPE_A,
+	"NS":    DNS_TYPE_NS,
+	"CNAME": 5,
+	"SOA":   DNS_TYPE_SOA,
+	"PTR":   12,
+	"MX":    15,
+	"TXT":   DNS_TYPE_TXT,
+	"AAAA":  DNS_TYPE_AAAA,
+	"SRV":   33,
+	"SVCB":  64,
+	"HTTPS": 65,
+	"CAA":   257,
+}
+
+/*
+Numbers of the records that only control how the ring treats a record set. They are never served
+in DNS answers, and their rdata is the text of their value.
+*/
+var controlTypes = map[string]uint16{
+	TYPE_CACHE:    RR_TYPE_PRIVATE,
+	TYPE_ACL:      RR_TYPE_PRIVATE + 1,
+	TYPE_MOVED:    RR_TYPE_PRIVATE + 2,
+	TYPE_LEARNED:  RR_TYPE_PRIVATE + 3,
+	TYPE_REPLICAS: RR_TYPE_PRIVATE + 4,
+}
+
+/*
+Returns the number of a record type, given by name or as TYPE<number>.
+*/
+func RRTypeCode(name string) (uint16, bool) {
+	name = strings.ToUpper(name)
+	if code, ok := rrTypes[name]; ok {
+		return code, true
+	}
+	if code, ok := controlTypes[name]; ok {
+		return code, true
+	}
+	if number, ok := strings.CutPrefix(name, "TYPE"); ok {
+		code, err := strconv.ParseUint(number, 10, 16)
+		return uint16(code), err == nil
+	}
+	return 0, false
+}
+
+/*
+Returns the name of a record type, TYPE<number> if it is not known by name.
+*/
+func RRTypeName(code uint16) string {
+	for _, types := range []map[string]uint16{rrTypes, controlTypes} {
+		for name, known := range types {
+			if known == code {
+				return name
+			}
+		}
+	}
+	return "TYPE" + strconv.Itoa(int(code))
+}
+
+/*
+Reports whether records of type code only control how the ring treats a record set.
+*/
+func isControlType(code uint16) bool {
+	for _, known := range controlTypes {
+		if known == code {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Returns a record of type rtype holding value, in the text form ParseRecord returns. The rdata of a
+value that does not fit the type, e.g. an A record without an IPv4 address, is left empty, which
+validateRecord rejects.
+*/
+func NewRecord(rtype, value string) Record {
+	code, _ := RRTypeCode(rtype)
+	record := Record{Type: code, Class: DNS_CLASS_IN}
+	if generic, ok := strings.CutPrefix(value, RDATA_GENERIC+" "); ok {
+		length, data, _ := strings.Cut(generic, " ")
+		rdata, err := hex.DecodeString(strings.ReplaceAll(data, " ", ""))
+		if err == nil && strconv.Itoa(len(rdata)) == length {
+			record.Rdata = rdata
+		}
+		return record
+	}
+	switch ip := net.ParseIP(value); {
+	case code == DNS_TYPE_A && ip.To4() != nil:
+		record.Rdata = ip.To4()
+	case code == DNS_TYPE_AAAA && ip != nil && ip.To4() == nil:
+		record.Rdata = ip.To16()
+	case code == DNS_TYPE_TXT:
+		record.Rdata = txtData(value)
+	case isControlType(code):
+		record.Rdata = []byte(value)
+	}
+	return record
+}
+
+/*
+Returns the A record of an IPv4 address, or the AAAA record of an IPv6 address.
+*/
+func addressRecord(ip net.IP) Record {
+	if ip4 := ip.To4(); ip4 != nil {
+		return Record{Type: DNS_TYPE_A, Class: DNS_CLASS_IN, Rdata: ip4}
+	}
+	return Record{Type: DNS_TYPE_AAAA, Class: DNS_CLASS_IN, Rdata: ip.To16()}
+}
+
+/*
+Reports whether two records are the same.
+*/
+func sameRecord(a, b Record) bool {
+	return a.Type == b.Type && a.Class == b.Class && a.TTL == b.TTL && bytes.Equal(a.Rdata, b.Rdata)
+}
+
+/*
+Returns the type name and the value of a record in text form: the address of A and AAAA records,
+the text of TXT records of a single string and of control records, and the generic notation for
+every other record.
+*/
+func ParseRecord(record Record) (string, string) {
+	rtype := RRTypeName(record.Type)
+	switch {
+	case record.Type == DNS_TYPE_A && len(record.Rdata) == net.IPv4len:
+		return rtype, net.IP(record.Rdata).String()
+	case record.Type == DNS_TYPE_AAAA && len(record.Rdata) == net.IPv6len && net.IP(record.Rdata).To4() == nil:
+		return rtype, net.IP(record.Rdata).String()
+	case record.Type == DNS_TYPE_TXT:
+		if value := txtValue(record.Rdata); bytes.Equal(txtData(value), record.Rdata) && !strings.HasPrefix(value, RDATA_GENERIC) {
+			return rtype, value
+		}
+	case isControlType(record.Type):
+		return rtype, string(record.Rdata)
+	}
+	return rtype, fmt.Sprintf("%s %d %x", RDATA_GENERIC, len(record.Rdata), record.Rdata)
+}
+
+/*
+Returns the record a line of text stands for: a bare IP address for an A or AAAA record,
+"<TYPE> <value>" for a record of any type known by name or number, or a bare value for a TXT
+record. Returns an error if the record is of no known type or does not validate.
+*/
+func ParseRecordText(text string) (Record, error) {
+	rtype, value := TYPE_TXT, text
+	if ip := net.ParseIP(text); ip != nil && ip.To4() != nil {
+		rtype = TYPE_A
+	} else if ip != nil {
+		rtype = TYPE_AAAA
+	} else if name, rest, found := strings.Cut(text, " "); found {
+		rtype, value = name, rest
+	}
+	if _, known := RRTypeCode(rtype); !known {
+		return Record{}, fmt.Errorf("record %q is of no known type", text)
+	}
+	record := NewRecord(rtype, value)
+	if err := validateRecord(record); err != nil {
+		return Record{}, fmt.Errorf("record %q: %w", text, err)
+	}
+	return record, nil
+}
+
+/*
+Returns the text form of a record, see ParseRecordText.
+*/
+func RecordText(record Record) string {
+	rtype, value := ParseRecord(decompressRecord(record))
+	if (rtype == TYPE_A || rtype == TYPE_AAAA) && !strings.HasPrefix(value, RDATA_GENERIC) {
+		return value
+	}
+	return rtype + " " + value
+}
+
+/*
+Applies ParseRecordText to every line of a record set.
+*/
+func ParseRecordsText(lines []string) ([]Record, error) {
+	records := make([]Record, 0, len(lines))
+	for _, line := range lines {
+		record, err := ParseRecordText(line)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+/*
+Applies RecordText to every record of a record set.
+*/
+func RecordsText(records []Record) []string {
+	lines := make([]string, len(records))
+	for i, record := range records {
+		lines[i] = RecordText(record)
+	}
+	return lines
+}
+
+/*
+Checks that a record can be stored and, unless it is a control record, served as a DNS record:
+that it is of the IN class, of a type other than 0, that A and AAAA records hold an address of
+their family and that TXT records consist of well-formed character strings.
+*/
+func validateRecord(record Record) error {
+	rtype := RRTypeName(record.Type)
+	switch {
+	case record.Class != DNS_CLASS_IN:
+		return fmt.Errorf("%s record of class %d, not IN", rtype, record.Class)
+	case record.Type == 0:
+		return fmt.Errorf("record of type 0")
+	case len(record.Rdata) > 0xFFFF:
+		return fmt.Errorf("%s record of %d bytes of rdata", rtype, len(record.Rdata))
+	case record.Type == DNS_TYPE_A && len(record.Rdata) != net.IPv4len:
+		return fmt.Errorf("A record does not hold an IPv4 address")
+	case record.Type == DNS_TYPE_AAAA && len(record.Rdata) != net.IPv6len:
+		return fmt.Errorf("AAAA record does not hold an IPv6 address")
+	case record.Type == DNS_TYPE_TXT && !validTXT(record.Rdata):
+		return fmt.Errorf("TXT record of malformed character strings")
+	}
+	return nil
+}
+
+/*
+Applies validateRecord to every record of a record set, compressed ones included.
+*/
+func validateRecords(records []Record) error {
+	for _, record := range records {
+		if err := validateRecord(decompressRecord(record)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Returns the error of the first record set of payload, in ascending key order, that does not
+validate, or nil if all do. Empty record sets, which remove their key, validate.
+*/
+func validatePayload(payload map[uint64][]Record) error {
+	for _, key := range sortedKeys(payload) {
+		if err := validateRecords(payload[key]); err != nil {
+			return fmt.Errorf("key %d: %w", key, err)
+		}
+	}
+	return nil
+}
+
+/*
+Returns payload without the record sets that do not validate, which are logged and counted as
+invalid_records_total. Used for the record sets pushed by other nodes, e.g. replicas.
+*/
+func (node *Node) dropInvalid(payload map[uint64][]Record) map[uint64][]Record {
+	if validatePayload(payload) == nil {
+		return payload
+	}
+	valid := make(map[uint64][]Record, len(payload))
+	for key, records := range payload {
+		if err := validateRecords(records); err != nil {
+			log.Warn().Err(err).Msgf("Dropped the invalid record set of key %d", key)
+			node.incMetric(`invalid_records_total{op="replicate"}`, 1)
+			continue
+		}
+		valid[key] = records
+	}
+	return valid
+}
+
+/*
+Reports whether rdata is a sequence of one or more character strings, as TXT rdata has to be.
+*/
+func validTXT(rdata []byte) bool {
+	if len(rdata) == 0 {
+		return false
+	}
+	for len(rdata) > 0 {
+		length := int(rdata[0]) + 1
+		if length > len(rdata) {
+			return false
+		}
+		rdata = rdata[length:]
+	}
+	return true
+}
+
+/*
+Returns the concatenated character strings of TXT rdata, see txtData.
+*/
+func txtValue(rdata []byte) string {
+	var value strings.Builder
+	for len(rdata) > 0 {
+		length := int(rdata[0]) + 1
+		if length > len(rdata) {
+			length = len(rdata)
+		}
+		value.Write(rdata[1:length])
+		rdata = rdata[length:]
+	}
+	return value.String()
+}
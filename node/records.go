@@ -0,0 +1,152 @@
+/*
+Records stored for a name are kept together as one record set: a list of DNS records in wire
+format, see rdata.go, e.g. an A record, a TXT record and the control records (CACHE, ACL, ...)
+that tell the ring how to treat the set. A record set is always written as a whole, so readers
+observe either the old set or the new set of a name, never a mix of both.
+*/
+package node
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fauzxan/dns-chord/v2/hashing"
+	"github.com/fauzxan/dns-chord/v2/message"
+	"github.com/rs/zerolog/log"
+)
+
+// Record types.
+const (
+	TYPE_A     = "A"
+	TYPE_AAAA  = "AAAA"
+	TYPE_TXT   = "TXT"
+	TYPE_CACHE = "CACHE" // Cache-control policy of the record set, e.g. "CACHE max-age=60" or "CACHE no-cache".
+)
+
+/*
+Node utility function to print a record set in zone file notation.
+*/
+func printRecords(website string, records []Record) {
+	for _, record := range records {
+		rtype, value := ParseRecord(record)
+		log.Info().Msgf("> %s. IN %s %s", website, rtype, value)
+	}
+}
+
+/*
+Atomically replaces all records of website (A, AAAA, TXT, ...) with records. The whole set is sent
+in a single PUT to the responsible node, which swaps it in under its storage lock.
+*/
+func (node *Node) UpdateRecords(website string, records []Record) bool {
+	website, err := NormalizeName(website)
+	if err == nil {
+		err = validateRecords(records)
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Could not update records")
+		return false
+	}
+	hashedWebsite := hashing.Hash(website)
+	succPointer, _ := node.FindSuccessor(hashedWebsite, 0)
+	put := message.RequestMessage{Type: PUT, TargetId: succPointer.Nodeid, Payload: map[uint64][]Record{hashedWebsite: compressRecords(records)}, Names: map[uint64]string{hashedWebsite: website}}
+	reply := node.callAvoidingShutdown(put, succPointer.IP)
+	reply, _, owned := node.checkOwnership(hashedWebsite, reply, func(owner Pointer) message.ResponseMessage {
+		put.TargetId = owner.Nodeid
+		return node.callAvoidingShutdown(put, owner.IP)
+	})
+	if !owned || (reply.Type != ACK && reply.Type != REDIRECT) {
+		log.Error().Msgf("Could not update records of %s", website)
+		return false
+	}
+	node.cacheMu.Lock()
+	delete(node.CachedQuery, hashedWebsite)
+	node.cacheMu.Unlock()
+	return true
+}
+
+/*
+Publishes a manual address record for website, replacing all of its records. A positive ttl, in
+seconds, is stored as the cache-control policy of the record set, and is the TTL of DNS answers for
+it. A positive replicas overrides the replication factor of the record set, see replicas.go. Returns
+an error if the name, address or factor is malformed, or the responsible node refused the PUT.
+*/
+func (node *Node) PutRecord(website string, ip string, ttl int, replicas int) error {
+	if _, err := NormalizeName(website); err != nil {
+		return err
+	}
+	records, err := addressRecords(ip, ttl, replicas)
+	if err != nil {
+		return err
+	}
+	if !node.UpdateRecords(website, records) {
+		return fmt.Errorf("the responsible node did not accept the records of %s", website)
+	}
+	log.Info().Msgf("Published %s %s with TTL %d", website, ip, ttl)
+	return nil
+}
+
+/*
+Returns the record set of a manual address record, see PutRecord.
+*/
+func addressRecords(ip string, ttl int, replicas int) ([]Record, error) {
+	address := net.ParseIP(ip)
+	if address == nil {
+		return nil, fmt.Errorf("%q is not an IP address", ip)
+	}
+	if ttl < 0 {
+		return nil, fmt.Errorf("TTL %d is negative", ttl)
+	}
+	records := []Record{addressRecord(address)}
+	if ttl > 0 {
+		records = append(records, NewRecord(TYPE_CACHE, "max-age="+strconv.Itoa(ttl)))
+	}
+	if replicas > 0 {
+		record, err := replicasRecord(replicas)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+/*
+Returns the TTL of DNS answers for a record set: the max-age of its cache-control policy, or
+DNS_DEFAULT_TTL if it does not declare one.
+*/
+func recordTTL(records []Record) uint32 {
+	if cacheable, maxAge := cachePolicy(records); cacheable {
+		return uint32(maxAge / time.Second)
+	}
+	return DNS_DEFAULT_TTL
+}
+
+/*
+Returns the cache-control policy declared by the owner of a record set: whether other nodes may
+cache it, and for how long. A record set without a CACHE record may be cached for DNS_DEFAULT_TTL.
+*/
+func cachePolicy(records []Record) (bool, time.Duration) {
+	for _, record := range records {
+		rtype, value := ParseRecord(record)
+		if rtype != TYPE_CACHE {
+			continue
+		}
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.TrimSpace(strings.ToLower(directive))
+			if directive == "no-cache" || directive == "no-store" {
+				return false, 0
+			}
+			if seconds, ok := strings.CutPrefix(directive, "max-age="); ok {
+				maxAge, err := strconv.Atoi(seconds)
+				if err != nil || maxAge <= 0 {
+					return false, 0
+				}
+				return true, time.Duration(maxAge) * time.Second
+			}
+		}
+	}
+	return true, DNS_DEFAULT_TTL * time.Second
+}
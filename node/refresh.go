@@ -0,0 +1,112 @@
+/*
+Refreshing of records learned from legacy DNS. A record set that was resolved upstream on a cache
+fill is stamped with a LEARNED record carrying the time it was resolved. The node responsible for
+the name resolves it again shortly before its TTL runs out, so that answers stored in the ring stay
+current without waiting for a client to run into a miss. Record sets published into the ring
+directly carry no stamp, and are never touched.
+*/
+package node
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Constants
+const (
+	TYPE_LEARNED          = "LEARNED"        // Unix time a record set was resolved from legacy DNS, e.g. "LEARNED 1700000000".
+	REFRESH_INTERVAL      = 30 * time.Second // Time between two refresh rounds.
+	REFRESH_AHEAD         = 60 * time.Second // How long before its TTL runs out a record set is refreshed.
+	REFRESH_MAX_PER_ROUND = 100              // Upper bound on the names resolved upstream per round.
+)
+
+/*
+Returns the LEARNED record of a record set resolved from legacy DNS at the given time.
+*/
+func learnedRecord(at time.Time) Record {
+	return NewRecord(TYPE_LEARNED, strconv.FormatInt(at.Unix(), 10))
+}
+
+/*
+Returns the time the record set was resolved from legacy DNS, or false if it was not.
+*/
+func learnedAt(records []Record) (time.Time, bool) {
+	for _, record := range records {
+		if rtype, value := ParseRecord(record); rtype == TYPE_LEARNED {
+			seconds, err := strconv.ParseInt(value, 10, 64)
+			return time.Unix(seconds, 0), err == nil
+		}
+	}
+	return time.Time{}, false
+}
+
+/*
+Periodically refreshes the learned record sets this node is responsible for.
+*/
+func (node *Node) refreshLearned() {
+	for node.sleep(REFRESH_INTERVAL) {
+		node.refreshRound()
+	}
+}
+
+/*
+Resolves the learned record sets nearing the end of their TTL again, and swaps in the new records.
+Returns the number of record sets refreshed.
+*/
+func (node *Node) refreshRound() int {
+	type due struct {
+		key     uint64
+		name    string
+		learned time.Time
+	}
+	now := time.Now()
+	pending := []due{}
+	node.storageMu.RLock()
+	for key, stored := range node.HashIPStorage[node.Nodeid] {
+		if len(pending) >= REFRESH_MAX_PER_ROUND {
+			break
+		}
+		records := decompressRecords(stored)
+		learned, ok := learnedAt(records)
+		name, known := node.names[key]
+		if !ok || !known {
+			continue
+		}
+		// Short TTLs are refreshed halfway through, rather than before they were learned.
+		if _, ttl := cachePolicy(records); now.Add(min(REFRESH_AHEAD, ttl/2)).After(learned.Add(ttl)) {
+			pending = append(pending, due{key, name, learned})
+		}
+	}
+	node.storageMu.RUnlock()
+
+	refreshed := 0
+	for _, entry := range pending {
+		ips, ttl, err := node.lookupUpstreamTTL(entry.name)
+		if err != nil {
+			log.Debug().Err(err).Msgf("Could not refresh %s", entry.name)
+			node.incMetric(`records_refreshed_total{result="failed"}`, 1)
+			continue
+		}
+		records := append(upstreamRecords(ips, ttl), learnedRecord(time.Now()))
+
+		node.storageMu.Lock()
+		stored, ok := node.HashIPStorage[node.Nodeid][entry.key]
+		// The set may have been replaced while upstream was asked, e.g. by an update of its owner.
+		if learned, _ := learnedAt(decompressRecords(stored)); ok && learned.Equal(entry.learned) {
+			node.HashIPStorage[node.Nodeid][entry.key] = compressRecords(records)
+			node.stampChecksum(node.Nodeid, entry.key, node.HashIPStorage[node.Nodeid][entry.key])
+			refreshed++
+		}
+		node.storageMu.Unlock()
+		node.cacheMu.Lock()
+		delete(node.CachedQuery, entry.key)
+		node.cacheMu.Unlock()
+	}
+	if refreshed > 0 {
+		log.Info().Msgf("Refreshed %d record set(s) learned from legacy DNS", refreshed)
+		node.incMetric(`records_refreshed_total{result="ok"}`, uint64(refreshed))
+	}
+	return refreshed
+}
@@ -0,0 +1,334 @@
+/*
+Relay mode for nodes behind NAT or a firewall, which can not accept inbound connections. Such a
+node keeps an outbound connection open to a publicly reachable relay node and advertises the
+address "<relay>/<name>". Peers send RPCs for it to the relay, which forwards them over the open
+connection, on which the relayed node serves its RPC methods in reverse.
+
+The relay handshake on the relay listener authenticates the relayed node with its node identity and
+key (NODE_IDENTITY, NODE_KEYS, see acl.go), which the relay has to know as well:
+
+	relay -> relayed node: "RELAY <nonce>\n"
+	relayed node -> relay: "<identity> <name> <HMAC of nonce and name with the key of identity>\n"
+	relay -> relayed node: "OK <relay RPC address> <name>\n", or "ERR <reason>\n"
+
+The relay gives out the names: a node that registers for the first time asks for the name "-", and
+is given "<identity>.<random suffix>", which is unique even for nodes behind different NATs that
+share a private address. A node that reconnects asks for the name it was given, which the relay
+grants to its identity only, and only while no live connection is registered under it, so that
+neither another node nor a stale handshake can take over the address of a relayed node.
+*/
+package node
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fauzxan/dns-chord/v2/message"
+	"github.com/rs/zerolog/log"
+)
+
+// Constants
+const (
+	RELAY_SEPARATOR       = "/"             // Separates the relay address from the name in the address of a relayed node.
+	RELAY_RETRY_INTERVAL  = 2 * time.Second // Time between attempts to reconnect to the relay.
+	RELAY_MAX_NAME_LENGTH = 256             // Longest name a relayed node may register with.
+	RELAY_NEW_NAME        = "-"             // Name a relayed node asks for to be given a new one.
+	RELAY_CHALLENGE       = "RELAY"         // First word of the relay's first handshake line, followed by the nonce.
+)
+
+var errNotRelayed = errors.New("no relayed node registered under this name")
+
+/*
+Connections of the nodes relayed by this node, by name.
+*/
+type relayState struct {
+	mu      sync.Mutex
+	clients map[string]*rpc.Client
+}
+
+/*
+Accepts connections of relayed nodes on addr until the node shuts down.
+*/
+func (node *Node) ServeRelay(addr string) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not start the relay listener")
+		return
+	}
+	log.Info().Msgf("Relay listener is running at address: %s", addr)
+	node.spawn("relay_accept", func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if node.context().Err() != nil {
+					return
+				}
+				log.Error().Err(err).Msg("Error accepting relay connection")
+				continue
+			}
+			node.spawn("relay_register", func() { node.registerRelayed(conn) })
+		}
+	})
+	node.spawn("relay_shutdown", func() {
+		<-node.context().Done()
+		listener.Close()
+		node.relay.mu.Lock()
+		for _, client := range node.relay.clients {
+			client.Close()
+		}
+		node.relay.mu.Unlock()
+	})
+}
+
+/*
+Returns the MAC a relayed node proves its identity with, over the relay's nonce and the name it
+asks for, keyed with the key of the identity.
+*/
+func relaySignature(key string, nonce string, name string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(RELAY_CHALLENGE))
+	mac.Write([]byte{0})
+	mac.Write([]byte(nonce))
+	mac.Write([]byte{0})
+	mac.Write([]byte(name))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+/*
+Performs the relay handshake on conn, see the top of this file, and registers the connection under
+the name given to the node.
+*/
+func (node *Node) registerRelayed(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(CALL_TIMEOUT))
+	refuse := func(reason string) {
+		log.Warn().Msgf("Refused the relay registration of %s: %s", conn.RemoteAddr(), reason)
+		node.incMetric("relay_registrations_refused_total", 1)
+		fmt.Fprintf(conn, "ERR %s\n", reason)
+		conn.Close()
+	}
+	nonce, err := randomHex(16)
+	if err != nil {
+		refuse("no nonce")
+		return
+	}
+	if _, err := fmt.Fprintf(conn, "%s %s\n", RELAY_CHALLENGE, nonce); err != nil {
+		conn.Close()
+		return
+	}
+	line, err := readLine(conn)
+	fields := strings.Fields(line)
+	if err != nil || len(fields) != 3 {
+		refuse("invalid handshake")
+		return
+	}
+	identity, name, mac := fields[0], fields[1], fields[2]
+	key, ok := node.Config.NodeKeys[identity]
+	if !ok || !hmac.Equal([]byte(mac), []byte(relaySignature(key, nonce, name))) {
+		refuse("unknown identity or invalid signature")
+		return
+	}
+	if name == RELAY_NEW_NAME {
+		suffix, err := randomHex(8)
+		if err != nil {
+			refuse("no name")
+			return
+		}
+		name = identity + "." + suffix
+	} else if !strings.HasPrefix(name, identity+".") || strings.Contains(name, RELAY_SEPARATOR) {
+		refuse("name " + name + " was not given to " + identity)
+		return
+	}
+
+	node.relay.mu.Lock()
+	if node.relay.clients == nil {
+		node.relay.clients = make(map[string]*rpc.Client)
+	}
+	old, registered := node.relay.clients[name]
+	node.relay.mu.Unlock()
+	if registered && relayAlive(old) {
+		refuse("name " + name + " has a live connection")
+		return
+	}
+	if _, err := fmt.Fprintf(conn, "OK %s %s\n", node.IP, name); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	client := node.newRPCClient(conn)
+	node.relay.mu.Lock()
+	if current := node.relay.clients[name]; current != old {
+		// Another connection registered the name in the meantime.
+		node.relay.mu.Unlock()
+		client.Close()
+		return
+	}
+	if old != nil {
+		old.Close()
+	}
+	node.relay.clients[name] = client
+	node.relay.mu.Unlock()
+	log.Info().Msgf("Relaying for %s at %s", identity, node.IP+RELAY_SEPARATOR+name)
+}
+
+/*
+Returns true if the relayed node behind client still answers on its connection.
+*/
+func relayAlive(client *rpc.Client) bool {
+	call := client.Go("Node.HandleIncomingMessage", message.RequestMessage{Type: PING}, new(message.ResponseMessage), nil)
+	select {
+	case <-call.Done:
+		return call.Error == nil
+	case <-time.After(CALL_TIMEOUT):
+		return false
+	}
+}
+
+/*
+Returns n random bytes in hex.
+*/
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+/*
+RPC method forwarding a message to a relayed node. Registered alongside HandleIncomingMessage.
+*/
+func (node *Node) Relay(req *message.RelayRequest, reply *message.ResponseMessage) error {
+	node.relay.mu.Lock()
+	client, ok := node.relay.clients[req.Target]
+	node.relay.mu.Unlock()
+	if !ok {
+		return errNotRelayed
+	}
+	node.incMetric("relayed_messages_total", 1)
+	relayed := new(message.ResponseMessage)
+	call := client.Go("Node.HandleIncomingMessage", req.Message, relayed, nil)
+	select {
+	case <-call.Done:
+		*reply = *relayed
+	case <-time.After(CALL_TIMEOUT):
+		return errors.New("relayed call timed out")
+	}
+	if errors.Is(call.Error, rpc.ErrShutdown) {
+		node.relay.mu.Lock()
+		if node.relay.clients[req.Target] == client {
+			delete(node.relay.clients, req.Target)
+		}
+		node.relay.mu.Unlock()
+	}
+	return call.Error
+}
+
+/*
+Connects to the relay listening at via, and switches this node's address to its relayed address.
+Serves RPCs arriving over the relay connection in a tracked goroutine, reconnecting whenever the
+connection drops. Must be called before the node joins the ring.
+*/
+func (node *Node) ConnectRelay(via string) error {
+	identity := node.Config.NodeIdentity
+	key, ok := node.Config.NodeKeys[identity]
+	if identity == "" || !ok {
+		return errors.New("RELAY_VIA needs NODE_IDENTITY and its key in NODE_KEYS, which the relay authenticates the node with")
+	}
+	conn, relayAddr, name, err := dialRelay(via, identity, key, RELAY_NEW_NAME)
+	if err != nil {
+		return err
+	}
+	node.IP = relayAddr + RELAY_SEPARATOR + name
+	log.Info().Msgf("Reachable through relay %s as %s", via, node.IP)
+
+	server := rpc.NewServer()
+	if err := server.RegisterName("Node", node); err != nil {
+		conn.Close()
+		return err
+	}
+	node.spawn("relay_client", func() {
+		for {
+			done := make(chan struct{})
+			go func() {
+				node.serveRPCConn(server, conn)
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-node.context().Done():
+				conn.Close()
+				<-done
+				return
+			}
+			log.Warn().Msgf("Lost the connection to relay %s, reconnecting", via)
+			for {
+				if !node.sleep(RELAY_RETRY_INTERVAL) {
+					return
+				}
+				if conn, _, _, err = dialRelay(via, identity, key, name); err == nil {
+					break
+				}
+				log.Debug().Err(err).Msgf("Could not reconnect to relay %s", via)
+			}
+		}
+	})
+	return nil
+}
+
+/*
+Dials the relay and performs the handshake as identity, asking for name. Returns the connection,
+the RPC address of the relay and the name given.
+*/
+func dialRelay(via, identity, key, name string) (net.Conn, string, string, error) {
+	conn, err := net.DialTimeout("tcp", via, DIAL_TIMEOUT)
+	if err != nil {
+		return nil, "", "", err
+	}
+	conn.SetDeadline(time.Now().Add(CALL_TIMEOUT))
+	line, err := readLine(conn)
+	nonce, ok := strings.CutPrefix(line, RELAY_CHALLENGE+" ")
+	if err != nil || !ok {
+		conn.Close()
+		return nil, "", "", fmt.Errorf("relay %s sent no challenge: %q", via, line)
+	}
+	if _, err := fmt.Fprintf(conn, "%s %s %s\n", identity, name, relaySignature(key, nonce, name)); err != nil {
+		conn.Close()
+		return nil, "", "", err
+	}
+	line, err = readLine(conn)
+	fields := strings.Fields(line)
+	if err != nil || len(fields) != 3 || fields[0] != "OK" {
+		conn.Close()
+		return nil, "", "", fmt.Errorf("relay %s refused the connection: %q", via, line)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, fields[1], fields[2], nil
+}
+
+/*
+Reads a single line from conn a byte at a time, so that nothing after the line is consumed.
+*/
+func readLine(conn net.Conn) (string, error) {
+	var line []byte
+	buf := make([]byte, 1)
+	for len(line) < RELAY_MAX_NAME_LENGTH {
+		if _, err := conn.Read(buf); err != nil {
+			return "", err
+		}
+		if buf[0] == '\n' {
+			return string(line), nil
+		}
+		line = append(line, buf[0])
+	}
+	return "", errors.New("line too long")
+}
@@ -0,0 +1,131 @@
+/*
+Per-record replication factors, so that critical names can be given more replicas than bulk
+imported ones, and low-value names fewer. A record set can carry a REPLICAS record, e.g.
+
+	REPLICAS 4
+
+and its owner then replicates it to that many successors instead of REPLICATION_FACTOR, between 1
+and MAX_REPLICATION_FACTOR. Replicas beyond the regular ones go to the successors after them, like
+boosted hot keys do (see hotkeys.go), and a ring with fewer nodes than that holds the record set on
+every node. The regular replicas a lowered factor no longer asks for are dropped with the next
+replication round, by an empty record set in the REPLICATE message. The replica holders take the
+factor into account when collecting garbage (see storagegc.go), so that extra replicas are kept,
+and dropped once the owner no longer asks for them. With zones, the range a node replicates is
+widened as for the regular replicas.
+*/
+package node
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/fauzxan/dns-chord/v2/message"
+)
+
+// Record types.
+const (
+	TYPE_REPLICAS = "REPLICAS" // Replication factor of the record set, e.g. "REPLICAS 4".
+)
+
+// Constants
+const (
+	MAX_REPLICATION_FACTOR = 8 // Most replicas a record set may ask for.
+)
+
+/*
+Returns the replication factor of a record set: that of its REPLICAS record, clamped to
+[1, MAX_REPLICATION_FACTOR], or REPLICATION_FACTOR if it has none.
+*/
+func replicationFactor(records []Record) int {
+	for _, record := range records {
+		rtype, value := ParseRecord(record)
+		if rtype != TYPE_REPLICAS {
+			continue
+		}
+		factor, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return REPLICATION_FACTOR
+		}
+		return min(max(factor, 1), MAX_REPLICATION_FACTOR)
+	}
+	return REPLICATION_FACTOR
+}
+
+/*
+Returns the REPLICAS record asking for factor replicas, or an error if factor is out of range.
+*/
+func replicasRecord(factor int) (Record, error) {
+	if factor < 1 || factor > MAX_REPLICATION_FACTOR {
+		return Record{}, fmt.Errorf("replication factor %d is not between 1 and %d", factor, MAX_REPLICATION_FACTOR)
+	}
+	return NewRecord(TYPE_REPLICAS, strconv.Itoa(factor)), nil
+}
+
+/*
+Returns the number of predecessors whose keys a node holds replicas of, for keys with the
+replication factor factor, see replicaSpan.
+*/
+func (node *Node) replicaSpanOf(factor int) int {
+	return factor + node.replicaSpan() - REPLICATION_FACTOR
+}
+
+/*
+Returns the highest replication factor of the keys this node owns.
+*/
+func (node *Node) mostReplicas() int {
+	node.storageMu.RLock()
+	defer node.storageMu.RUnlock()
+	most := REPLICATION_FACTOR
+	for _, records := range node.HashIPStorage[node.Nodeid] {
+		most = max(most, replicationFactor(records))
+	}
+	return most
+}
+
+/*
+Returns a copy of the keys this node owns that the index-th of its replica targets, counting from
+0, is to hold: those whose replication factor is above index. The regular targets also get the
+keys they would hold by default with empty record sets, which drops them, so that a lowered
+factor takes effect right away.
+*/
+func (node *Node) replicaPayload(index int) map[uint64][]Record {
+	node.storageMu.RLock()
+	defer node.storageMu.RUnlock()
+	payload := make(map[uint64][]Record, len(node.HashIPStorage[node.Nodeid]))
+	for key, records := range node.HashIPStorage[node.Nodeid] {
+		switch {
+		case replicationFactor(records) > index:
+			payload[key] = records
+		case index < REPLICATION_FACTOR:
+			payload[key] = []Record{}
+		}
+	}
+	return payload
+}
+
+/*
+Returns up to count distinct successors after targets, the regular replica targets, for the
+replicas of keys with a higher replication factor. Returns fewer once the walk gets around the ring.
+*/
+func (node *Node) extraReplicaTargets(targets []Pointer, count int) []Pointer {
+	seen := map[string]bool{node.IP: true}
+	for _, target := range targets {
+		seen[target.IP] = true
+	}
+	current := node.successor()
+	if len(targets) > 0 {
+		current = targets[len(targets)-1]
+	}
+	extra := []Pointer{}
+	for len(extra) < count && current.IP != "" {
+		reply := node.CallRPC(message.RequestMessage{Type: GET_SUCCESSOR}, current.IP)
+		current = Pointer{Nodeid: reply.Nodeid, IP: reply.IP}
+		if reply.Type == EMPTY || seen[current.IP] {
+			break // Around the ring, every node holds the keys already.
+		}
+		seen[current.IP] = true
+		extra = append(extra, current)
+	}
+	return extra
+}
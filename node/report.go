@@ -0,0 +1,445 @@
+/*
+End-of-run reports, the artifacts an evaluation of an experiment needs in one document. A report
+gathers the counters and the recent pointer changes of every node in the ring, and renders them as
+Markdown or HTML: percentiles of the lookup latency, the distribution of hop counts, a timeline of
+the churn of the ring, and the cache hit rate of every node. To that end, every node counts the
+lookups it resolves in the latency buckets of latencyBuckets (lookup_duration_seconds_bucket), and
+the lookups it sends into the ring by their hop count (lookup_hops_total), so that percentiles are
+estimated from the buckets as Prometheus would. The timeline holds the last FLAP_HISTORY pointer
+changes of each node, see flapping.go. From the command line:
+
+	dns-chord report [-format markdown|html] [-timeout 30s] ip:port [report.md]
+*/
+package node
+
+import (
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/fauzxan/dns-chord/v2/message"
+	"github.com/rs/zerolog/log"
+)
+
+// Constants
+const (
+	REPORT_FORMAT_MARKDOWN = "markdown"
+	REPORT_FORMAT_HTML     = "html"
+
+	REPORT_TIMEOUT = 30 * time.Second // Default time collecting a report from the command line may take.
+)
+
+/*
+Upper bounds of the lookup latency buckets.
+*/
+var latencyBuckets = []time.Duration{
+	100 * time.Microsecond, 250 * time.Microsecond, 500 * time.Microsecond, time.Millisecond, 2 * time.Millisecond, 5 * time.Millisecond, 10 * time.Millisecond,
+	25 * time.Millisecond, 50 * time.Millisecond, 100 * time.Millisecond, 250 * time.Millisecond,
+	500 * time.Millisecond, time.Second, 2500 * time.Millisecond, 5 * time.Second,
+}
+
+/*
+Percentiles of the lookup latency in a report.
+*/
+var reportPercentiles = []float64{0.5, 0.9, 0.95, 0.99}
+
+/*
+Counts a lookup that started at start in the latency buckets.
+*/
+func (node *Node) observeLookup(start time.Time) {
+	elapsed := time.Since(start)
+	for _, bucket := range latencyBuckets {
+		if elapsed <= bucket {
+			node.incMetric(fmt.Sprintf("lookup_duration_seconds_bucket{le=\"%g\"}", bucket.Seconds()), 1)
+		}
+	}
+	node.incMetric(`lookup_duration_seconds_bucket{le="+Inf"}`, 1)
+	node.incMetric("lookup_duration_microseconds_total", uint64(elapsed.Microseconds()))
+}
+
+/*
+Counts a lookup that reached the node responsible for its key in hops hops.
+*/
+func (node *Node) observeHops(hops int) {
+	node.incMetric(fmt.Sprintf("lookup_hops_total{hops=\"%d\"}", hops), 1)
+}
+
+/*
+Counters and recent pointer changes of one node, as collected for a report.
+*/
+type NodeReport struct {
+	Nodeid   uint64
+	IP       string
+	Instance string            // Empty if the node did not answer
+	Counters map[string]uint64 // Nil if the node did not answer
+	Changes  []PointerChange   // Oldest first
+}
+
+/*
+The state of a ring at the end of a run, one entry per node in ring order.
+*/
+type Report struct {
+	Collected time.Time
+	Nodes     []NodeReport
+}
+
+/*
+Returns the counters and the recent pointer changes of this node in the form of a REPORT reply:
+"counter <name> <value>" and "change <unix nanoseconds> <pointer> <cause> <from id> <from IP>
+<to id> <to IP>" lines, with "-" for the IP of an empty pointer.
+*/
+func (node *Node) reportReply() []string {
+	lines := []string{}
+	for name, value := range node.Counters() {
+		lines = append(lines, "counter "+name+" "+strconv.FormatUint(value, 10))
+	}
+	ip := func(pointer Pointer) string {
+		if pointer.IP == "" {
+			return "-"
+		}
+		return pointer.IP
+	}
+	node.flaps.mu.Lock()
+	for _, change := range node.flaps.changes {
+		lines = append(lines, fmt.Sprintf("change %d %s %s %d %s %d %s", change.At.UnixNano(), change.Pointer, change.Cause,
+			change.From.Nodeid, ip(change.From), change.To.Nodeid, ip(change.To)))
+	}
+	node.flaps.mu.Unlock()
+	return lines
+}
+
+/*
+Parses a REPORT reply into entry, see reportReply.
+*/
+func parseReportReply(entry *NodeReport, lines []string) {
+	entry.Counters = make(map[string]uint64)
+	pointer := func(id string, ip string) Pointer {
+		if ip == "-" {
+			return Pointer{}
+		}
+		nodeid, _ := strconv.ParseUint(id, 10, 64)
+		return Pointer{Nodeid: nodeid, IP: ip}
+	}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 3 && fields[0] == "counter":
+			entry.Counters[fields[1]], _ = strconv.ParseUint(fields[2], 10, 64)
+		case len(fields) == 8 && fields[0] == "change":
+			at, _ := strconv.ParseInt(fields[1], 10, 64)
+			entry.Changes = append(entry.Changes, PointerChange{At: time.Unix(0, at), Pointer: fields[2], Cause: fields[3],
+				From: pointer(fields[4], fields[5]), To: pointer(fields[6], fields[7])})
+		}
+	}
+}
+
+/*
+Collects the report of the ring this node is part of, asking every node in ring order.
+*/
+func (node *Node) CollectReport() Report {
+	walk, ok := node.walkRing()
+	if !ok {
+		log.Warn().Msgf("The ring walk broke off after %d nodes, reporting on them only", len(walk))
+	}
+	report := Report{Collected: time.Now()}
+	for _, pointer := range walk {
+		entry := NodeReport{Nodeid: pointer.Nodeid, IP: pointer.IP}
+		if pointer.IP == node.IP {
+			entry.Instance = node.InstanceID()
+			parseReportReply(&entry, node.reportReply())
+		} else if reply := node.CallRPC(message.RequestMessage{Type: REPORT}, pointer.IP); reply.Type == ACK {
+			entry.Instance = reply.Instance
+			parseReportReply(&entry, reply.QueryResponse)
+		}
+		report.Nodes = append(report.Nodes, entry)
+	}
+	return report
+}
+
+/*
+Collects the report of the ring through helper, as a client that is not part of the ring. Returns
+ErrUnreachable if helper does not reply, or ErrTimeout after timeout. Nodes that do not reply are
+listed without counters.
+*/
+func (node *Node) CollectReportVia(helper string, timeout time.Duration) (Report, error) {
+	report := Report{}
+	err := withTimeout(timeout, func() error {
+		walk, err := node.clientWalk(helper)
+		if err != nil {
+			return err
+		}
+		nodes := []NodeReport{}
+		for _, pointer := range walk {
+			entry := NodeReport{Nodeid: pointer.Nodeid, IP: pointer.IP}
+			if reply, err := node.clientCall(message.RequestMessage{Type: REPORT}, pointer.IP); err == nil && reply.Type == ACK {
+				entry.Instance = reply.Instance
+				parseReportReply(&entry, reply.QueryResponse)
+			}
+			nodes = append(nodes, entry)
+		}
+		report = Report{Collected: time.Now(), Nodes: nodes}
+		return nil
+	})
+	return report, err
+}
+
+/*
+A report, boiled down to the rows of its tables.
+*/
+type reportSummary struct {
+	Collected   string
+	Nodes       int
+	Reached     int
+	Missing     []string // Nodes that did not answer
+	Lookups     uint64
+	MeanLatency string
+	Percentiles []struct{ Name, Value string }
+	Hops        []struct {
+		Hops    int
+		Lookups uint64
+		Share   string
+	}
+	RingLookups uint64
+	MeanHops    string
+	Churn       []struct{ Offset, Time, Node, Pointer, From, To, Cause string }
+	Cache       []cacheRow
+	CacheTotal  cacheRow
+}
+
+type cacheRow struct {
+	Node         string
+	Hits, Misses uint64
+	Rate         string
+}
+
+/*
+Returns the summary of report, with the counters of all nodes added up.
+*/
+func summarize(report Report) reportSummary {
+	summary := reportSummary{Collected: report.Collected.Format(time.RFC3339), Nodes: len(report.Nodes), CacheTotal: cacheRow{Node: "all"}}
+	buckets := make([]uint64, len(latencyBuckets)+1) // Cumulative, the last one is +Inf
+	hops := make(map[int]uint64)
+	var latencySum uint64
+	type change struct {
+		PointerChange
+		node string
+	}
+	changes := []change{}
+	for _, entry := range report.Nodes {
+		if entry.Counters == nil {
+			summary.Missing = append(summary.Missing, entry.IP)
+			continue
+		}
+		summary.Reached++
+		for i, bucket := range latencyBuckets {
+			buckets[i] += entry.Counters[fmt.Sprintf("lookup_duration_seconds_bucket{le=\"%g\"}", bucket.Seconds())]
+		}
+		buckets[len(latencyBuckets)] += entry.Counters[`lookup_duration_seconds_bucket{le="+Inf"}`]
+		latencySum += entry.Counters["lookup_duration_microseconds_total"]
+		for name, value := range entry.Counters {
+			if count, ok := strings.CutPrefix(name, `lookup_hops_total{hops="`); ok {
+				if n, err := strconv.Atoi(strings.TrimSuffix(count, `"}`)); err == nil {
+					hops[n] += value
+				}
+			}
+		}
+		row := cacheRow{Node: entry.IP, Hits: entry.Counters[`resolutions_total{source="cache"}`], Misses: entry.Counters["cache_misses_total"]}
+		row.Rate = share(row.Hits, row.Hits+row.Misses)
+		summary.Cache = append(summary.Cache, row)
+		summary.CacheTotal.Hits += row.Hits
+		summary.CacheTotal.Misses += row.Misses
+		for _, c := range entry.Changes {
+			changes = append(changes, change{c, entry.IP})
+		}
+	}
+	summary.CacheTotal.Rate = share(summary.CacheTotal.Hits, summary.CacheTotal.Hits+summary.CacheTotal.Misses)
+
+	summary.Lookups = buckets[len(latencyBuckets)]
+	if summary.Lookups > 0 {
+		summary.MeanLatency = formatLatency(time.Duration(latencySum/summary.Lookups) * time.Microsecond)
+		for _, q := range reportPercentiles {
+			summary.Percentiles = append(summary.Percentiles, struct{ Name, Value string }{
+				fmt.Sprintf("p%g", q*100), bucketQuantile(q, buckets),
+			})
+		}
+	}
+
+	counts := []int{}
+	var hopSum uint64
+	for n, count := range hops {
+		counts = append(counts, n)
+		summary.RingLookups += count
+		hopSum += uint64(n) * count
+	}
+	sort.Ints(counts)
+	for _, n := range counts {
+		summary.Hops = append(summary.Hops, struct {
+			Hops    int
+			Lookups uint64
+			Share   string
+		}{n, hops[n], share(hops[n], summary.RingLookups)})
+	}
+	if summary.RingLookups > 0 {
+		summary.MeanHops = fmt.Sprintf("%.2f", float64(hopSum)/float64(summary.RingLookups))
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].At.Before(changes[j].At) })
+	name := func(pointer Pointer) string {
+		if pointer.IP == "" {
+			return "none"
+		}
+		return pointer.IP
+	}
+	for _, c := range changes {
+		summary.Churn = append(summary.Churn, struct{ Offset, Time, Node, Pointer, From, To, Cause string }{
+			fmt.Sprintf("+%.1fs", c.At.Sub(changes[0].At).Seconds()), c.At.Format("15:04:05.000"),
+			c.node, c.Pointer, name(c.From), name(c.To), c.Cause,
+		})
+	}
+	return summary
+}
+
+/*
+Returns the estimate of the q-quantile of the lookup latency from the cumulative buckets, by
+linear interpolation within the bucket it falls in.
+*/
+func bucketQuantile(q float64, buckets []uint64) string {
+	total := buckets[len(buckets)-1]
+	rank := q * float64(total)
+	lower, below := time.Duration(0), uint64(0)
+	for i, bound := range latencyBuckets {
+		if float64(buckets[i]) >= rank {
+			inBucket := float64(buckets[i] - below)
+			fraction := 1.0
+			if inBucket > 0 {
+				fraction = (rank - float64(below)) / inBucket
+			}
+			return formatLatency(lower + time.Duration(fraction*float64(bound-lower)))
+		}
+		lower, below = bound, buckets[i]
+	}
+	return "> " + formatLatency(lower)
+}
+
+func formatLatency(d time.Duration) string {
+	return fmt.Sprintf("%.1f ms", float64(d.Microseconds())/1000)
+}
+
+func share(part, total uint64) string {
+	if total == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", 100*float64(part)/float64(total))
+}
+
+const reportMarkdown = `# dns-chord run report
+
+Collected {{.Collected}} from {{.Reached}} of {{.Nodes}} node(s).{{if .Missing}} No answer from: {{range $i, $ip := .Missing}}{{if $i}}, {{end}}{{$ip}}{{end}}.{{end}}
+
+## Lookup latency
+{{if .Lookups}}
+{{.Lookups}} lookup(s), {{.MeanLatency}} on average.
+
+| Percentile | Latency |
+|---|---|
+{{range .Percentiles}}| {{.Name}} | {{.Value}} |
+{{end}}{{else}}
+No lookups were recorded.
+{{end}}
+## Hop counts
+{{if .Hops}}
+{{.RingLookups}} lookup(s) went to the ring, {{.MeanHops}} hops on average.
+
+| Hops | Lookups | Share |
+|---|---|---|
+{{range .Hops}}| {{.Hops}} | {{.Lookups}} | {{.Share}} |
+{{end}}{{else}}
+No lookups went to the ring.
+{{end}}
+## Churn timeline
+{{if .Churn}}
+| Offset | Time | Node | Pointer | From | To | Cause |
+|---|---|---|---|---|---|---|
+{{range .Churn}}| {{.Offset}} | {{.Time}} | {{.Node}} | {{.Pointer}} | {{.From}} | {{.To}} | {{.Cause}} |
+{{end}}{{else}}
+No pointer changes were recorded.
+{{end}}
+## Cache hit rates
+
+| Node | Hits | Misses | Hit rate |
+|---|---|---|---|
+{{range .Cache}}| {{.Node}} | {{.Hits}} | {{.Misses}} | {{.Rate}} |
+{{end}}| **{{.CacheTotal.Node}}** | **{{.CacheTotal.Hits}}** | **{{.CacheTotal.Misses}}** | **{{.CacheTotal.Rate}}** |
+`
+
+const reportHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>dns-chord run report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; text-align: left; }
+th { background: #eee; }
+</style>
+</head>
+<body>
+<h1>dns-chord run report</h1>
+<p>Collected {{.Collected}} from {{.Reached}} of {{.Nodes}} node(s).{{if .Missing}} No answer from: {{range $i, $ip := .Missing}}{{if $i}}, {{end}}{{$ip}}{{end}}.{{end}}</p>
+
+<h2>Lookup latency</h2>
+{{if .Lookups}}<p>{{.Lookups}} lookup(s), {{.MeanLatency}} on average.</p>
+<table>
+<tr><th>Percentile</th><th>Latency</th></tr>
+{{range .Percentiles}}<tr><td>{{.Name}}</td><td>{{.Value}}</td></tr>
+{{end}}</table>
+{{else}}<p>No lookups were recorded.</p>
+{{end}}
+<h2>Hop counts</h2>
+{{if .Hops}}<p>{{.RingLookups}} lookup(s) went to the ring, {{.MeanHops}} hops on average.</p>
+<table>
+<tr><th>Hops</th><th>Lookups</th><th>Share</th></tr>
+{{range .Hops}}<tr><td>{{.Hops}}</td><td>{{.Lookups}}</td><td>{{.Share}}</td></tr>
+{{end}}</table>
+{{else}}<p>No lookups went to the ring.</p>
+{{end}}
+<h2>Churn timeline</h2>
+{{if .Churn}}<table>
+<tr><th>Offset</th><th>Time</th><th>Node</th><th>Pointer</th><th>From</th><th>To</th><th>Cause</th></tr>
+{{range .Churn}}<tr><td>{{.Offset}}</td><td>{{.Time}}</td><td>{{.Node}}</td><td>{{.Pointer}}</td><td>{{.From}}</td><td>{{.To}}</td><td>{{.Cause}}</td></tr>
+{{end}}</table>
+{{else}}<p>No pointer changes were recorded.</p>
+{{end}}
+<h2>Cache hit rates</h2>
+<table>
+<tr><th>Node</th><th>Hits</th><th>Misses</th><th>Hit rate</th></tr>
+{{range .Cache}}<tr><td>{{.Node}}</td><td>{{.Hits}}</td><td>{{.Misses}}</td><td>{{.Rate}}</td></tr>
+{{end}}<tr><th>{{.CacheTotal.Node}}</th><th>{{.CacheTotal.Hits}}</th><th>{{.CacheTotal.Misses}}</th><th>{{.CacheTotal.Rate}}</th></tr>
+</table>
+</body>
+</html>
+`
+
+var (
+	reportMarkdownTemplate = template.Must(template.New("report").Parse(reportMarkdown))
+	reportHTMLTemplate     = htmltemplate.Must(htmltemplate.New("report").Parse(reportHTML))
+)
+
+/*
+Writes report to w in format, REPORT_FORMAT_MARKDOWN or REPORT_FORMAT_HTML.
+*/
+func WriteReport(w io.Writer, report Report, format string) error {
+	switch format {
+	case REPORT_FORMAT_MARKDOWN:
+		return reportMarkdownTemplate.Execute(w, summarize(report))
+	case REPORT_FORMAT_HTML:
+		return reportHTMLTemplate.Execute(w, summarize(report))
+	}
+	return fmt.Errorf("unknown report format %q", format)
+}
@@ -0,0 +1,151 @@
+/*
+Resource usage of a node: CPU, memory, goroutines, open connections and the disk used by its data
+directory. Resources are reported with the statistics of every node (see stats.go), on the
+metrics endpoint and on /health, so that a dashboard can spot nodes starved of resources before
+their slow replies destabilize the ring.
+*/
+package node
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Constants
+const (
+	RESOURCE_CPU_WINDOW = 10 * time.Second // CPU usage is averaged over at least this long, since the previous sample.
+)
+
+// Start of the process, for the CPU usage of the first sample.
+var processStart = time.Now()
+
+/*
+Resource usage of a node when it was sampled.
+*/
+type ResourceUsage struct {
+	CPUPercent    float64 `json:"cpu_percent"`     // CPU time of the process over wall time since the previous sample, 100 per core
+	MemoryBytes   uint64  `json:"memory_bytes"`    // Memory obtained from the OS by the Go runtime
+	HeapBytes     uint64  `json:"heap_bytes"`      // Bytes of allocated heap objects
+	Goroutines    int     `json:"goroutines"`      // Goroutines of the process
+	OpenConns     int     `json:"open_conns"`      // Open inbound RPC connections
+	DataDirBytes  uint64  `json:"data_dir_bytes"`  // Size of the files in the data directory
+	DiskFreeBytes uint64  `json:"disk_free_bytes"` // Space left on the file system of the data directory, 0 if unknown
+}
+
+/*
+CPU time of the process at the previous sample, to compute the CPU usage since.
+*/
+type resourceSampler struct {
+	mu      sync.Mutex
+	cpu     time.Duration
+	at      time.Time
+	percent float64
+}
+
+/*
+Returns the CPU usage of the process in percent of one core, averaged since the previous sample, or
+since the start of the process for the first one. Samples taken within RESOURCE_CPU_WINDOW of the
+previous one return its usage, so that frequent scrapes do not measure noise.
+*/
+func (node *Node) cpuPercent() float64 {
+	used, ok := cpuTime()
+	if !ok {
+		return 0
+	}
+	sampler := &node.resources
+	sampler.mu.Lock()
+	defer sampler.mu.Unlock()
+	now := time.Now()
+	first := sampler.at.IsZero()
+	if first {
+		sampler.at = processStart
+	}
+	if elapsed := now.Sub(sampler.at); (first || elapsed >= RESOURCE_CPU_WINDOW) && elapsed > 0 {
+		sampler.percent = 100 * float64(used-sampler.cpu) / float64(elapsed)
+		sampler.cpu, sampler.at = used, now
+	}
+	return sampler.percent
+}
+
+/*
+Returns the total size of the regular files under dir.
+*/
+func dirSize(dir string) uint64 {
+	var size uint64
+	filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil {
+			size += uint64(info.Size())
+		}
+		return nil
+	})
+	return size
+}
+
+/*
+Samples the resource usage of this node.
+*/
+func (node *Node) ResourceUsage() ResourceUsage {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	node.life.mu.Lock()
+	conns := len(node.life.conns)
+	node.life.mu.Unlock()
+	// The data directory may not have been created yet, the file system is that of its parent then.
+	free, ok := uint64(0), false
+	for dir := filepath.Clean(node.Config.DataDir); !ok; dir = filepath.Dir(dir) {
+		if free, ok = diskFree(dir); dir == filepath.Dir(dir) {
+			break
+		}
+	}
+	return ResourceUsage{
+		CPUPercent:    node.cpuPercent(),
+		MemoryBytes:   mem.Sys,
+		HeapBytes:     mem.HeapAlloc,
+		Goroutines:    runtime.NumGoroutine(),
+		OpenConns:     conns,
+		DataDirBytes:  dirSize(node.Config.DataDir),
+		DiskFreeBytes: free,
+	}
+}
+
+/*
+Returns the resource usage as gauges by metric name, without the dns_chord_ prefix. The goroutines
+gauge is written by WriteMetrics already.
+*/
+func (usage ResourceUsage) gauges() map[string]float64 {
+	return map[string]float64{
+		"cpu_percent":     usage.CPUPercent,
+		"memory_bytes":    float64(usage.MemoryBytes),
+		"heap_bytes":      float64(usage.HeapBytes),
+		"goroutines":      float64(usage.Goroutines),
+		"open_conns":      float64(usage.OpenConns),
+		"data_dir_bytes":  float64(usage.DataDirBytes),
+		"disk_free_bytes": float64(usage.DiskFreeBytes),
+	}
+}
+
+/*
+Writes the resource usage gauges in the Prometheus text exposition format.
+*/
+func (node *Node) writeResources(w io.Writer) {
+	gauges := node.ResourceUsage().gauges()
+	delete(gauges, "goroutines")
+	names := make([]string, 0, len(gauges))
+	for name := range gauges {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "dns_chord_%s %s\n", name, strconv.FormatFloat(gauges[name], 'f', -1, 64))
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !linux && !darwin
+
+package node
+
+import "time"
+
+/*
+Returns false, the CPU time of the process is not read on this platform.
+*/
+func cpuTime() (time.Duration, bool) {
+	return 0, false
+}
+
+/*
+Returns false, the free space of file systems is not read on this platform.
+*/
+func diskFree(path string) (uint64, bool) {
+	return 0, false
+}
@@ -0,0 +1,30 @@
+//go:build linux || darwin
+
+package node
+
+import (
+	"syscall"
+	"time"
+)
+
+/*
+Returns the CPU time, user and system, the process has used so far.
+*/
+func cpuTime() (time.Duration, bool) {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0, false
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano()), true
+}
+
+/*
+Returns the space available to unprivileged users on the file system holding path.
+*/
+func diskFree(path string) (uint64, bool) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, false
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), true
+}
@@ -0,0 +1,172 @@
+/*
+Retry budget of client-facing lookups. When the path of a resolution fails, because the node the
+lookup was forwarded to or the owner of the name did not reply, the node tries other paths, up to
+LOOKUP_RETRIES times (default 2) and within the deadline of the lookup, if it has one. A lookup
+that never reached the owner is forwarded through another finger that precedes the key, and an
+owner that does not reply is bypassed by reading the replica of its keys from the nodes this node
+knows to follow it, the nearest first. The fallback that answered is recorded in the trace of the lookup, shown as
+fallback=finger or fallback=replica in debug answers, and counted in lookup_fallbacks_total.
+*/
+package node
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/fauzxan/dns-chord/v2/hashing"
+	"github.com/fauzxan/dns-chord/v2/message"
+)
+
+// Constants
+const (
+	FALLBACK_FINGER  = "finger"  // The lookup was forwarded through another finger that precedes the key.
+	FALLBACK_REPLICA = "replica" // The records were read from a replica of the owner.
+)
+
+/*
+A lookup answered on another path than the first.
+*/
+type lookupRetry struct {
+	reply     message.ResponseMessage // Reply to the GET, EMPTY if every retry failed
+	answering Pointer                 // Node that sent the reply
+	owner     Pointer                 // Owner of the key, if one of the retries found it
+	fallback  string                  // FALLBACK_FINGER or FALLBACK_REPLICA, empty if every retry failed
+}
+
+/*
+Retries msg, a GET whose path through owner failed, along other paths; owner is empty if the
+lookup did not find one. Gives up after LOOKUP_RETRIES attempts or at the deadline, if not zero.
+*/
+func (node *Node) retryLookup(msg message.RequestMessage, owner Pointer, deadline time.Time) lookupRetry {
+	retry := lookupRetry{owner: owner}
+	failed := map[string]bool{}
+	if owner.IP != "" {
+		failed[owner.IP] = true
+	}
+	fingers := node.alternativeFingers(msg.TargetId)
+	var replicas []Pointer
+	for attempt := 0; attempt < node.Config.LookupRetries; attempt++ {
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			break
+		}
+		fallback := FALLBACK_FINGER
+		if retry.owner.IP == "" {
+			if len(fingers) == 0 {
+				break
+			}
+			via := fingers[0]
+			fingers = fingers[1:]
+			find := message.RequestMessage{Type: FIND_SUCCESSOR, TargetId: msg.TargetId, HopCount: 1, TraceId: msg.TraceId, Budget: int64(node.forwardBudget(deadline, 1))}
+			reply := node.CallRPC(find, via.IP)
+			if reply.Type == EMPTY || redirectable(reply) || reply.IP == "" {
+				sampledLog().Debug().Msgf("Retry %d of the lookup of %d via Nodeid: %d failed", attempt+1, msg.TargetId, via.Nodeid)
+				node.countFallback(fallback, false)
+				continue
+			}
+			retry.owner = Pointer{Nodeid: reply.Nodeid, IP: reply.IP}
+		}
+		target := retry.owner
+		if failed[target.IP] {
+			if replicas == nil {
+				replicas = node.followersOf(retry.owner)
+			}
+			for len(replicas) > 0 && failed[replicas[0].IP] {
+				replicas = replicas[1:]
+			}
+			if len(replicas) == 0 {
+				break
+			}
+			fallback = FALLBACK_REPLICA
+			target = replicas[0]
+			replicas = replicas[1:]
+		}
+		if !deadline.IsZero() {
+			msg.Budget = int64(max(1, time.Until(deadline)))
+		}
+		reply := node.getFrom(msg, target)
+		// A replica holder without the key may be missing the replica, rather than know the key does not exist.
+		if reply.Type == EMPTY || redirectable(reply) || (fallback == FALLBACK_REPLICA && reply.Records == nil && reply.Type != DENIED) {
+			sampledLog().Debug().Msgf("Retry %d of the lookup of %d via the %s Nodeid: %d failed", attempt+1, msg.TargetId, fallback, target.Nodeid)
+			failed[target.IP] = true
+			node.countFallback(fallback, false)
+			continue
+		}
+		sampledLog().Info().Msgf("> Lookup of %d answered by Nodeid: %d IP: %s after %d retries, via %s fallback", msg.TargetId, target.Nodeid, target.IP, attempt+1, fallback)
+		node.countFallback(fallback, true)
+		retry.reply, retry.answering, retry.fallback = reply, target, fallback
+		return retry
+	}
+	node.incMetric("lookup_retries_exhausted_total", 1)
+	return retry
+}
+
+/*
+Sends the GET msg to target, or answers it from the replicas of this node if it is the target.
+*/
+func (node *Node) getFrom(msg message.RequestMessage, target Pointer) message.ResponseMessage {
+	if target.IP != node.IP {
+		return node.CallRPC(msg, target.IP)
+	}
+	// Signed as if it had been sent, for the ACL of the records.
+	node.signRequest(&msg)
+	reply := message.ResponseMessage{Type: ACK, Records: node.GetQuery(msg.TargetId)}
+	if reply.Records != nil && !node.mayRead(&msg, reply.Records) {
+		reply = message.ResponseMessage{Type: DENIED}
+	}
+	return reply
+}
+
+/*
+Returns the fingers of this node that precede id, closest to it first, without the one the first
+path of a lookup of id goes through.
+*/
+func (node *Node) alternativeFingers(id uint64) []Pointer {
+	first := node.ClosestPrecedingNode(id)
+	seen := map[string]bool{node.IP: true, first.IP: true}
+	fingers := []Pointer{}
+	for i := hashing.Bits() - 1; i >= 0; i-- {
+		finger := node.finger(i)
+		if finger.IP != "" && !seen[finger.IP] && between(finger.Nodeid, node.Nodeid, id) {
+			seen[finger.IP] = true
+			fingers = append(fingers, finger)
+		}
+	}
+	if successor := node.successor(); successor.IP != "" && !seen[successor.IP] {
+		fingers = append(fingers, successor)
+	}
+	return fingers
+}
+
+/*
+Returns the nodes this node knows of that follow owner on the ring, at most as many as hold
+replicas of its keys, nearest by RTT first, see latency.go. This node is among them if it follows
+owner closely enough.
+*/
+func (node *Node) followersOf(owner Pointer) []Pointer {
+	seen := map[string]bool{owner.IP: true}
+	known := []Pointer{}
+	for _, pointer := range append([]Pointer{node.successor(), node.predecessor(), {Nodeid: node.Nodeid, IP: node.IP}}, node.fingers()...) {
+		if pointer.IP != "" && !seen[pointer.IP] {
+			seen[pointer.IP] = true
+			known = append(known, pointer)
+		}
+	}
+	// Clockwise distance from owner, which wraps around like the ring does.
+	slices.SortFunc(known, func(a, b Pointer) int {
+		return cmp.Compare(a.Nodeid-owner.Nodeid, b.Nodeid-owner.Nodeid)
+	})
+	return node.byLatency(known[:min(len(known), node.replicaSpan())])
+}
+
+/*
+Counts a retry of a lookup along fallback, and whether it answered.
+*/
+func (node *Node) countFallback(fallback string, answered bool) {
+	result := "failed"
+	if answered {
+		result = "answered"
+	}
+	node.incMetric(fmt.Sprintf("lookup_fallbacks_total{kind=%q,result=%q}", fallback, result), 1)
+}
@@ -0,0 +1,147 @@
+/*
+Ring metadata published in the ring itself. The node responsible for the reserved name "_ring"
+periodically stores a TXT record set under it, with an estimate of the ring size, the protocol
+version and a few seed nodes. Any client or joining node can then fetch it from any member with an
+ordinary lookup, e.g. "dig @node _ring TXT" against the DNS listener. The width of the keyspace is
+part of it, as is its rounding, so that clients can tell which RING_BITS and LEGACY_HASH to use.
+*/
+package node
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fauzxan/dns-chord/v2/hashing"
+	"github.com/rs/zerolog/log"
+)
+
+// Constants
+const (
+	RING_METADATA_NAME     = "_ring"          // Reserved name the ring metadata is stored under.
+	RING_METADATA_INTERVAL = 30 * time.Second // Time between two publications of the ring metadata.
+	RING_METADATA_MAX_AGE  = 30               // Seconds other nodes may cache the ring metadata for.
+	RING_MAX_SEEDS         = 5                // Maximum number of seed nodes listed in the ring metadata.
+	PROTOCOL_VERSION       = "1"              // Version of the RPC protocol spoken by this node.
+)
+
+/*
+Ring metadata, as published under RING_METADATA_NAME.
+*/
+type RingMetadata struct {
+	Size      int      `json:"size"`      // Estimated number of nodes in the ring
+	Version   string   `json:"version"`   // Protocol version of the publishing node
+	Bits      int      `json:"bits"`      // Width of the keyspace in bits
+	Legacy    bool     `json:"legacy"`    // IDs are rounded as nodes that predate integer hashing did, see LEGACY_HASH
+	Seeds     []string `json:"seeds"`     // Addresses of nodes to join the ring through
+	Published int64    `json:"published"` // Unix time of the publication
+}
+
+/*
+Periodically publishes the ring metadata, if this node is responsible for it.
+*/
+func (node *Node) publishRingMetadata() {
+	for node.sleep(RING_METADATA_INTERVAL) {
+		key := hashing.Hash(RING_METADATA_NAME)
+		if predecessor := node.predecessor(); (predecessor == Pointer{} || !belongsTo(key, predecessor.Nodeid, node.Nodeid)) {
+			continue
+		}
+		meta := RingMetadata{Size: node.estimateRingSize(), Version: PROTOCOL_VERSION, Bits: hashing.Bits(), Legacy: hashing.LegacyRounding(), Seeds: node.seeds(), Published: time.Now().Unix()}
+		node.learnNames(map[uint64]string{key: RING_METADATA_NAME})
+		node.PutQuery(node.Nodeid, map[uint64][]Record{key: meta.records()})
+		log.Debug().Msgf("Published ring metadata: %+v", meta)
+	}
+}
+
+/*
+Estimates the number of nodes in the ring from how densely the successor list covers the keyspace
+following this node.
+*/
+func (node *Node) estimateRingSize() int {
+	succList := node.succList()
+	seen := map[uint64]bool{node.Nodeid: true}
+	var last uint64
+	for _, pointer := range succList {
+		if (pointer == Pointer{} || seen[pointer.Nodeid]) {
+			continue
+		}
+		seen[pointer.Nodeid] = true
+		last = pointer.Nodeid
+	}
+	if len(seen) == 1 {
+		return 1
+	}
+	distance := (last - node.Nodeid) & hashing.Mask()
+	return max(len(seen), int(float64(len(seen)-1)*(float64(hashing.Mask())+1)/float64(distance)))
+}
+
+/*
+Returns up to RING_MAX_SEEDS addresses of nodes known to be in the ring, starting with this one.
+*/
+func (node *Node) seeds() []string {
+	seeds := []string{node.IP}
+	seen := map[string]bool{node.IP: true}
+	candidates := node.succList()
+	for _, peer := range node.Peers() {
+		candidates = append(candidates, Pointer{Nodeid: peer.Nodeid, IP: peer.IP})
+	}
+	for _, pointer := range candidates {
+		if len(seeds) == RING_MAX_SEEDS {
+			break
+		}
+		if pointer.IP != "" && !seen[pointer.IP] {
+			seen[pointer.IP] = true
+			seeds = append(seeds, pointer.IP)
+		}
+	}
+	return seeds
+}
+
+/*
+Returns the record set the metadata is stored as.
+*/
+func (meta RingMetadata) records() []Record {
+	return []Record{
+		NewRecord(TYPE_TXT, "size="+strconv.Itoa(meta.Size)),
+		NewRecord(TYPE_TXT, "version="+meta.Version),
+		NewRecord(TYPE_TXT, "bits="+strconv.Itoa(meta.Bits)),
+		NewRecord(TYPE_TXT, "legacy-hash="+strconv.FormatBool(meta.Legacy)),
+		NewRecord(TYPE_TXT, "seeds="+strings.Join(meta.Seeds, ",")),
+		NewRecord(TYPE_TXT, "published="+strconv.FormatInt(meta.Published, 10)),
+		NewRecord(TYPE_CACHE, fmt.Sprintf("max-age=%d", RING_METADATA_MAX_AGE)),
+	}
+}
+
+/*
+Fetches the ring metadata from the ring. Returns an error if it has not been published yet.
+*/
+func (node *Node) RingMetadata() (RingMetadata, error) {
+	records, err := node.resolve(RING_METADATA_NAME, false, time.Time{}, nil)
+	if err != nil {
+		return RingMetadata{}, err
+	}
+	var meta RingMetadata
+	for _, record := range records {
+		rtype, value := ParseRecord(record)
+		if rtype != TYPE_TXT {
+			continue
+		}
+		field, value, _ := strings.Cut(value, "=")
+		switch field {
+		case "size":
+			meta.Size, _ = strconv.Atoi(value)
+		case "version":
+			meta.Version = value
+		case "bits":
+			meta.Bits, _ = strconv.Atoi(value)
+		case "legacy-hash":
+			meta.Legacy, _ = strconv.ParseBool(value)
+		case "seeds":
+			meta.Seeds = strings.Split(value, ",")
+		case "published":
+			meta.Published, _ = strconv.ParseInt(value, 10, 64)
+		}
+	}
+	return meta, nil
+}
@@ -0,0 +1,172 @@
+/*
+Several independent rings in one process, e.g. a prod and a staging ring. Each ring is served by
+its own node, with its own configuration, storage directory and listeners, and nodes of different
+rings share no state. Clients pick the ring to talk to by namespace.
+*/
+package node
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+var errUnknownNamespace = errors.New("unknown namespace")
+
+/*
+The rings this process participates in, by namespace. The default ring has the empty namespace.
+*/
+type Rings struct {
+	mu    sync.Mutex
+	nodes map[string]*Node
+}
+
+/*
+Registers the node serving the ring in namespace.
+*/
+func (rings *Rings) Add(namespace string, node *Node) {
+	rings.mu.Lock()
+	defer rings.mu.Unlock()
+	if rings.nodes == nil {
+		rings.nodes = make(map[string]*Node)
+	}
+	rings.nodes[namespace] = node
+}
+
+/*
+Returns the node serving the ring in namespace.
+*/
+func (rings *Rings) Get(namespace string) (*Node, error) {
+	rings.mu.Lock()
+	defer rings.mu.Unlock()
+	node, ok := rings.nodes[namespace]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", errUnknownNamespace, namespace)
+	}
+	return node, nil
+}
+
+/*
+Returns the namespaces of all rings, in lexical order.
+*/
+func (rings *Rings) Namespaces() []string {
+	rings.mu.Lock()
+	defer rings.mu.Unlock()
+	namespaces := make([]string, 0, len(rings.nodes))
+	for namespace := range rings.nodes {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+/*
+Resolves website in the ring of namespace.
+*/
+func (rings *Rings) Resolve(namespace, website string) ([]Record, error) {
+	node, err := rings.Get(namespace)
+	if err != nil {
+		return nil, err
+	}
+	return node.Resolve(website)
+}
+
+/*
+Shuts down the nodes of all rings.
+*/
+func (rings *Rings) Shutdown() {
+	for _, namespace := range rings.Namespaces() {
+		node, _ := rings.Get(namespace)
+		node.Shutdown()
+	}
+}
+
+/*
+Starts a node for a namespaced ring on host, configured by config: it listens on config.RPCPort,
+creates the ring or joins it through config.Join, and starts the optional listeners.
+*/
+func StartRing(host string, config Config) (*Node, error) {
+	if config.RPCPort == "" {
+		return nil, fmt.Errorf("no RPC port configured for namespace %q", config.Namespace)
+	}
+	if config.Observer && config.Join == "" {
+		return nil, fmt.Errorf("an observer of namespace %q needs a ring to join", config.Namespace)
+	}
+	if err := os.MkdirAll(config.DataDir, 0777); err != nil {
+		return nil, err
+	}
+	addr := net.JoinHostPort(host, config.RPCPort)
+	strategy, err := NewIDStrategy(config)
+	if err != nil {
+		return nil, err
+	}
+	nodeid, err := strategy.NodeID(addr)
+	if err != nil {
+		return nil, fmt.Errorf("no ID for the node of namespace %q: %w", config.Namespace, err)
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	node := &Node{
+		Nodeid:        nodeid,
+		IP:            addr,
+		CachedQuery:   make(map[uint64]LRUCache),
+		HashIPStorage: make(map[uint64]map[uint64][]Record),
+		Config:        config,
+	}
+	if config.CachePersist {
+		node.LoadCache()
+	}
+	node.Serve(listener)
+	log.Info().Msgf("Ring %q: node %d is running at address: %s", config.Namespace, node.Nodeid, addr)
+	if config.Join == "" {
+		node.CreateNetwork()
+	} else {
+		node.JoinNetwork(config.Join)
+	}
+	if config.DiskStore != "" {
+		if err := node.OpenDiskStore(config.DiskStore); err != nil {
+			log.Error().Err(err).Msgf("Ring %q: could not open the disk store", config.Namespace)
+		}
+	}
+	if config.DNSEnabled && config.DNSPort != "" {
+		node.ServeDNS(":" + config.DNSPort)
+	}
+	if config.AdminEnabled && config.AdminPort != "" {
+		node.ServeAdmin(":" + config.AdminPort)
+	}
+	if config.MetricsEnabled && config.MetricsPort != "" {
+		node.ServeMetrics(":" + config.MetricsPort)
+	}
+	return node, nil
+}
+
+/*
+Returns the directory for the storage snapshot and address book of the node.
+*/
+func (node *Node) dataDir() string {
+	if node.Config.DataDir == "" {
+		return "./data"
+	}
+	return node.Config.DataDir
+}
+
+/*
+Returns the address of the node in a form that can be used in file names. The address of a node
+behind a relay contains RELAY_SEPARATOR, which is replaced. A virtual node listens on another
+ephemeral port after every restart, so it is named after the primary and its index instead, for
+its snapshots to be found again.
+*/
+func (node *Node) FileName() string {
+	if node.vnodeIndex > 0 {
+		return fmt.Sprintf("%s-%d", node.vnodes.nodes[0].FileName(), node.vnodeIndex)
+	}
+	return strings.ReplaceAll(node.IP, RELAY_SEPARATOR, "_")
+}
@@ -0,0 +1,122 @@
+/*
+Ring walks on request. A RING_WALK message asks a node to walk the ring along the successor
+pointers, as walkRing does, and to reply with the nodes it visited in ring order, starting with
+itself. Any node can thus be asked for the whole ring, which lets an operator check the ring's
+integrity from a single node: that the walk gets around, that no node appears twice, and that the
+IDs increase along the walk but for the one wrap around the top of the keyspace.
+*/
+package node
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/fauzxan/dns-chord/v2/message"
+	"github.com/rs/zerolog/log"
+)
+
+/*
+Returns the lines of a RING_WALK reply: "node <nodeid> <ip>" per node in ring order, and "broken"
+if the walk did not make it around the ring.
+*/
+func (node *Node) ringWalkReply() []string {
+	walk, ok := node.walkRing()
+	lines := make([]string, 0, len(walk)+1)
+	for _, pointer := range walk {
+		lines = append(lines, fmt.Sprintf("node %d %s", pointer.Nodeid, pointer.IP))
+	}
+	if !ok {
+		lines = append(lines, "broken")
+	}
+	return lines
+}
+
+/*
+Parses a RING_WALK reply, see ringWalkReply. Returns the nodes and whether the walk got around.
+*/
+func parseRingWalk(lines []string) ([]Pointer, bool) {
+	walk := []Pointer{}
+	ok := true
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 3 && fields[0] == "node":
+			nodeid, _ := strconv.ParseUint(fields[1], 10, 64)
+			walk = append(walk, Pointer{Nodeid: nodeid, IP: fields[2]})
+		case len(fields) == 1 && fields[0] == "broken":
+			ok = false
+		}
+	}
+	return walk, ok
+}
+
+/*
+Walks the ring from the node at IP, or from this node if IP is empty or its own. Returns the nodes
+in ring order and whether the walk got around the ring, or an error if the node can not be reached.
+*/
+func (node *Node) RingWalk(IP string) ([]Pointer, bool, error) {
+	if IP == "" || IP == node.IP {
+		walk, ok := node.walkRing()
+		return walk, ok, nil
+	}
+	reply := node.CallRPC(message.RequestMessage{Type: RING_WALK}, IP)
+	if reply.Type != ACK {
+		return nil, false, fmt.Errorf("%w: %s did not walk the ring", ErrUnreachable, IP)
+	}
+	walk, ok := parseRingWalk(reply.QueryResponse)
+	return walk, ok, nil
+}
+
+/*
+Returns the integrity problems of a walk of the ring in ring order: nodes that appear twice, and
+nodes whose ID does not follow on that of the node before them, beyond the one wrap around the
+keyspace. Returns nil for a sound ring.
+*/
+func RingProblems(walk []Pointer) []string {
+	problems := []string{}
+	seen := make(map[string]bool)
+	wraps := 0
+	for i, pointer := range walk {
+		if seen[pointer.IP] {
+			problems = append(problems, fmt.Sprintf("%s (Nodeid %d) appears twice", pointer.IP, pointer.Nodeid))
+		}
+		seen[pointer.IP] = true
+		if next := walk[(i+1)%len(walk)]; len(walk) > 1 && next.Nodeid <= pointer.Nodeid {
+			if wraps++; wraps > 1 {
+				problems = append(problems, fmt.Sprintf("%s (Nodeid %d) is followed by %s (Nodeid %d), out of order", pointer.IP, pointer.Nodeid, next.IP, next.Nodeid))
+			}
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return problems
+}
+
+/*
+Node utility function to print a walk of the ring from the node at IP, or from this node if IP is
+empty, and the integrity problems found in it.
+*/
+func (node *Node) PrintRingWalk(IP string) {
+	walk, ok, err := node.RingWalk(IP)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not walk the ring")
+		return
+	}
+	log.Info().Msg("Ring:")
+	for i, pointer := range walk {
+		log.Info().Msgf("> [%d] Nodeid: %d IP: %s", i+1, pointer.Nodeid, pointer.IP)
+	}
+	problems := RingProblems(walk)
+	if !ok {
+		problems = append(problems, fmt.Sprintf("the walk broke off after %d nodes", len(walk)))
+	}
+	if len(problems) == 0 {
+		log.Info().Msgf("> The ring of %d nodes is sound", len(walk))
+		return
+	}
+	for _, problem := range problems {
+		log.Warn().Msgf("> %s", problem)
+	}
+}
@@ -0,0 +1,115 @@
+/*
+Locking of the routing state. Successor, Predecessor, FingerTable and SuccList are read by every
+lookup and RPC handler, and written by stabilize, FixFingers, CheckPredecessor and the handlers of
+NOTIFY, HANDOFF and LEAVE, all at once. They are guarded by ringMu, and read and written through the
+methods below, which copy them under the lock: a Pointer holds a string, and a torn read of one
+can crash the process. Each access is atomic, while a sequence of them is not, which the protocol
+tolerates: pointers already change between two steps of a lookup, as they do between nodes.
+Changes of the successor and the predecessor are recorded along with the write, see flapping.go.
+The exported fields are left for setting up nodes that do not run yet, such as those of the
+reference model in model.go.
+*/
+package node
+
+import "github.com/fauzxan/dns-chord/v2/hashing"
+
+/*
+Returns the successor of this node.
+*/
+func (node *Node) successor() Pointer {
+	node.ringMu.RLock()
+	defer node.ringMu.RUnlock()
+	return node.Successor
+}
+
+/*
+Returns the predecessor of this node, empty if it has none.
+*/
+func (node *Node) predecessor() Pointer {
+	node.ringMu.RLock()
+	defer node.ringMu.RUnlock()
+	return node.Predecessor
+}
+
+/*
+Returns the i-th finger of this node, empty before the finger table is set up.
+*/
+func (node *Node) finger(i int) Pointer {
+	node.ringMu.RLock()
+	defer node.ringMu.RUnlock()
+	if i >= len(node.FingerTable) {
+		return Pointer{}
+	}
+	return node.FingerTable[i]
+}
+
+/*
+Returns a copy of the finger table.
+*/
+func (node *Node) fingers() []Pointer {
+	node.ringMu.RLock()
+	defer node.ringMu.RUnlock()
+	return append([]Pointer{}, node.FingerTable...)
+}
+
+/*
+Returns a copy of the successor list, this node first.
+*/
+func (node *Node) succList() []Pointer {
+	node.ringMu.RLock()
+	defer node.ringMu.RUnlock()
+	return append([]Pointer{}, node.SuccList...)
+}
+
+/*
+Sets the successor to pointer, recording the change with cause.
+*/
+func (node *Node) setSuccessor(pointer Pointer, cause string) {
+	node.ringMu.Lock()
+	defer node.ringMu.Unlock()
+	node.pointerChanged(POINTER_SUCCESSOR, node.Successor, pointer, cause)
+	node.Successor = pointer
+}
+
+/*
+Sets the predecessor to pointer, recording the change with cause.
+*/
+func (node *Node) setPredecessor(pointer Pointer, cause string) {
+	node.ringMu.Lock()
+	defer node.ringMu.Unlock()
+	node.pointerChanged(POINTER_PREDECESSOR, node.Predecessor, pointer, cause)
+	node.Predecessor = pointer
+}
+
+/*
+Sets the i-th finger to pointer.
+*/
+func (node *Node) setFinger(i int, pointer Pointer) {
+	node.ringMu.Lock()
+	defer node.ringMu.Unlock()
+	if i < len(node.FingerTable) {
+		node.FingerTable[i] = pointer
+	}
+}
+
+/*
+Sets the successor list to list, this node first.
+*/
+func (node *Node) setSuccList(list []Pointer) {
+	node.ringMu.Lock()
+	defer node.ringMu.Unlock()
+	node.SuccList = list
+}
+
+/*
+Sets up the routing state of a node that creates or joins a ring: successor, no predecessor, an
+empty finger table, and a successor list of the node itself.
+*/
+func (node *Node) resetRouting(successor Pointer) {
+	node.ringMu.Lock()
+	defer node.ringMu.Unlock()
+	node.Successor = successor
+	node.Predecessor = Pointer{}
+	node.FingerTable = make([]Pointer, hashing.Bits())
+	node.SuccList = []Pointer{{Nodeid: node.Nodeid, IP: node.IP}}
+}
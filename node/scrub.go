@@ -0,0 +1,415 @@
+/*
+Background integrity scrubbing of storage. Every record set written to HashIPStorage is stamped
+with a CRC32 checksum, and the scrubber periodically walks storage and verifies each entry against
+its checksum and that its compressed records still decode. A corrupt entry is repaired with a
+verified copy from another node, the replicas for the node's own keys and the owner for replicas,
+and quarantined (taken out of storage, but kept for inspection) if there is none. The scrubber then
+compares the checksums of the node's own keys with those of its replicas, and re-replicates the
+keys a replica holds a different or no copy of.
+*/
+package node
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fauzxan/dns-chord/v2/message"
+	"github.com/rs/zerolog/log"
+)
+
+// Constants
+const (
+	SCRUB_INTERVAL = 5 * time.Minute       // Time between two scrub passes.
+	SCRUB_BATCH    = 100                   // Entries verified between two pauses, so that a pass does not hog the storage lock.
+	SCRUB_PAUSE    = 50 * time.Millisecond // Pause between two batches.
+)
+
+/*
+A corrupt entry that could not be repaired.
+*/
+type QuarantinedEntry struct {
+	Bucket  uint64    `json:"bucket"`
+	Key     uint64    `json:"key"`
+	Name    string    `json:"name"`
+	Records []Record  `json:"records"`
+	Reason  string    `json:"reason"`
+	Time    time.Time `json:"time"`
+}
+
+/*
+Outcome of a scrub pass.
+*/
+type ScrubPass struct {
+	Started          time.Time `json:"started"`
+	Finished         time.Time `json:"finished"` // Zero while the pass runs
+	Total            int       `json:"total"`    // Entries in storage when the pass started
+	Checked          int       `json:"checked"`
+	Corrupt          int       `json:"corrupt"`
+	Repaired         int       `json:"repaired"`
+	Quarantined      int       `json:"quarantined"`
+	ReplicasRepaired int       `json:"replicas_repaired"` // Own keys re-replicated to replicas holding another copy
+}
+
+/*
+Checksums of the entries in storage, and the state of the scrubber.
+*/
+type scrubTable struct {
+	mu         sync.Mutex
+	sums       map[uint64]map[uint64]uint32 // Checksum per bucket and key, written along with HashIPStorage
+	quarantine []QuarantinedEntry
+	pass       ScrubPass // Current or last pass
+}
+
+/*
+A storage entry to verify.
+*/
+type scrubEntry struct {
+	bucket uint64
+	key    uint64
+}
+
+/*
+Returns the checksum of a record set. Records are length prefixed, so that no two record sets
+share their encoding.
+*/
+func recordsChecksum(records []Record) uint32 {
+	hash := crc32.NewIEEE()
+	var header [12]byte
+	for _, record := range records {
+		binary.BigEndian.PutUint16(header[0:], record.Type)
+		binary.BigEndian.PutUint16(header[2:], record.Class)
+		binary.BigEndian.PutUint32(header[4:], record.TTL)
+		binary.BigEndian.PutUint32(header[8:], uint32(len(record.Rdata)))
+		hash.Write(header[:])
+		hash.Write(record.Rdata)
+	}
+	return hash.Sum32()
+}
+
+/*
+Returns why a stored record set is malformed, or "" if it is not: compressed records have to
+decode, see compression.go, and every record has to validate, see rdata.go.
+*/
+func malformedRecords(records []Record) string {
+	for _, record := range records {
+		if record.Class == COMPRESSED_CLASS {
+			reader, err := gzip.NewReader(bytes.NewReader(record.Rdata))
+			if err != nil {
+				return "undecodable compressed record"
+			}
+			_, err = io.Copy(io.Discard, reader)
+			reader.Close()
+			if err != nil {
+				return "undecodable compressed record"
+			}
+		}
+		if err := validateRecord(decompressRecord(record)); err != nil {
+			return err.Error()
+		}
+	}
+	return ""
+}
+
+/*
+Records the checksum of the record set just written to bucket. Must be called with storageMu held
+for writing, right after the write.
+*/
+func (node *Node) stampChecksum(bucket uint64, key uint64, records []Record) {
+	node.scrub.mu.Lock()
+	defer node.scrub.mu.Unlock()
+	if node.scrub.sums == nil {
+		node.scrub.sums = make(map[uint64]map[uint64]uint32)
+	}
+	if node.scrub.sums[bucket] == nil {
+		node.scrub.sums[bucket] = make(map[uint64]uint32)
+	}
+	node.scrub.sums[bucket][key] = recordsChecksum(records)
+}
+
+/*
+Forgets all checksums, when storage is replaced as a whole. Entries are stamped again by the next
+scrub pass.
+*/
+func (node *Node) resetChecksums() {
+	node.scrub.mu.Lock()
+	defer node.scrub.mu.Unlock()
+	node.scrub.sums = nil
+}
+
+/*
+Periodically scrubs storage.
+*/
+func (node *Node) scrubStorage() {
+	for node.sleep(SCRUB_INTERVAL) {
+		node.Scrub()
+	}
+}
+
+/*
+Runs a scrub pass over storage and returns its outcome.
+*/
+func (node *Node) Scrub() ScrubPass {
+	entries := []scrubEntry{}
+	node.storageMu.RLock()
+	for bucket, storage := range node.HashIPStorage {
+		for key := range storage {
+			entries = append(entries, scrubEntry{bucket, key})
+		}
+	}
+	node.storageMu.RUnlock()
+	node.pruneChecksums()
+
+	pass := ScrubPass{Started: time.Now(), Total: len(entries)}
+	node.setScrubPass(pass)
+	progress := node.StartProgress("storage scrub", len(entries))
+	for i, entry := range entries {
+		if progress.Stopped() {
+			break
+		}
+		if i > 0 && i%SCRUB_BATCH == 0 {
+			node.setScrubPass(pass)
+			if !node.sleep(SCRUB_PAUSE) {
+				break
+			}
+		}
+		pass.Checked++
+		node.incMetric("scrub_keys_checked_total", 1)
+		progress.Add(1)
+		records, reason := node.verifyEntry(entry)
+		if reason == "" {
+			continue
+		}
+		pass.Corrupt++
+		log.Warn().Msgf("Stored record set of key %d in bucket %d is corrupt: %s", entry.key, entry.bucket, reason)
+		node.incMetric(fmt.Sprintf(`scrub_errors_total{kind=%q}`, reason), 1)
+		if node.repairEntry(entry, records) {
+			pass.Repaired++
+			node.incMetric("scrub_repaired_total", 1)
+		} else if node.quarantineEntry(entry, records, reason) {
+			pass.Quarantined++
+			node.incMetric("scrub_quarantined_total", 1)
+		}
+	}
+	progress.Finish()
+	pass.ReplicasRepaired = node.scrubReplicas()
+	pass.Finished = time.Now()
+	node.setScrubPass(pass)
+	if pass.Corrupt > 0 || pass.ReplicasRepaired > 0 {
+		log.Info().Msgf("Scrubbed %d entries: %d corrupt, %d repaired, %d quarantined, %d key(s) re-replicated", pass.Checked, pass.Corrupt, pass.Repaired, pass.Quarantined, pass.ReplicasRepaired)
+	}
+	return pass
+}
+
+func (node *Node) setScrubPass(pass ScrubPass) {
+	node.scrub.mu.Lock()
+	defer node.scrub.mu.Unlock()
+	node.scrub.pass = pass
+}
+
+/*
+Drops the checksums of entries that are no longer in storage.
+*/
+func (node *Node) pruneChecksums() {
+	node.storageMu.RLock()
+	defer node.storageMu.RUnlock()
+	node.scrub.mu.Lock()
+	defer node.scrub.mu.Unlock()
+	for bucket, sums := range node.scrub.sums {
+		for key := range sums {
+			if _, ok := node.HashIPStorage[bucket][key]; !ok {
+				delete(sums, key)
+			}
+		}
+		if len(sums) == 0 {
+			delete(node.scrub.sums, bucket)
+		}
+	}
+}
+
+/*
+Verifies an entry, and returns its records and why it is corrupt, or "" if it is not. Entries
+without a checksum, e.g. those loaded from disk, are stamped if they are well formed.
+*/
+func (node *Node) verifyEntry(entry scrubEntry) ([]Record, string) {
+	node.storageMu.RLock()
+	defer node.storageMu.RUnlock()
+	records, ok := node.HashIPStorage[entry.bucket][entry.key]
+	if !ok {
+		return nil, "" // Removed since the pass started.
+	}
+	if reason := malformedRecords(records); reason != "" {
+		return records, "malformed"
+	}
+	node.scrub.mu.Lock()
+	defer node.scrub.mu.Unlock()
+	sum, stamped := node.scrub.sums[entry.bucket][entry.key]
+	if !stamped {
+		if node.scrub.sums == nil {
+			node.scrub.sums = make(map[uint64]map[uint64]uint32)
+		}
+		if node.scrub.sums[entry.bucket] == nil {
+			node.scrub.sums[entry.bucket] = make(map[uint64]uint32)
+		}
+		node.scrub.sums[entry.bucket][entry.key] = recordsChecksum(records)
+		return records, ""
+	}
+	if recordsChecksum(records) != sum {
+		return records, "checksum"
+	}
+	return records, ""
+}
+
+/*
+Replaces a corrupt entry with a well formed copy from another node: a replica of the key if it is
+one of this node's own, and its owner otherwise. Returns false if there is no such copy, or if the
+entry was rewritten in the meantime.
+*/
+func (node *Node) repairEntry(entry scrubEntry, corrupt []Record) bool {
+	sources := []Pointer{}
+	if entry.bucket == node.Nodeid {
+		sources = node.replicaTargets()
+	} else if owner, _ := node.backgroundFindSuccessor(entry.key); (owner != Pointer{} && owner.Nodeid != node.Nodeid) {
+		sources = append(sources, owner)
+	}
+	for _, source := range sources {
+		reply := node.CallRPC(message.RequestMessage{Type: GET, TargetId: entry.key}, source.IP)
+		if reply.Records == nil || malformedRecords(reply.Records) != "" {
+			continue
+		}
+		node.storageMu.Lock()
+		current, ok := node.HashIPStorage[entry.bucket][entry.key]
+		// Only replace what was found corrupt, a write in the meantime has stamped a new checksum.
+		replaced := ok && recordsChecksum(current) == recordsChecksum(corrupt)
+		if replaced {
+			node.HashIPStorage[entry.bucket][entry.key] = reply.Records
+			node.stampChecksum(entry.bucket, entry.key, reply.Records)
+		}
+		node.storageMu.Unlock()
+		if replaced {
+			log.Info().Msgf("Repaired key %d in bucket %d with the copy of Nodeid: %d IP: %s", entry.key, entry.bucket, source.Nodeid, source.IP)
+		}
+		return replaced
+	}
+	return false
+}
+
+/*
+Takes a corrupt entry out of storage, so that it is no longer served or replicated. Returns false
+if the entry was rewritten in the meantime.
+*/
+func (node *Node) quarantineEntry(entry scrubEntry, corrupt []Record, reason string) bool {
+	node.storageMu.Lock()
+	defer node.storageMu.Unlock()
+	current, ok := node.HashIPStorage[entry.bucket][entry.key]
+	if !ok || recordsChecksum(current) != recordsChecksum(corrupt) {
+		return false
+	}
+	delete(node.HashIPStorage[entry.bucket], entry.key)
+	node.scrub.mu.Lock()
+	defer node.scrub.mu.Unlock()
+	delete(node.scrub.sums[entry.bucket], entry.key)
+	node.scrub.quarantine = append(node.scrub.quarantine, QuarantinedEntry{
+		Bucket: entry.bucket, Key: entry.key, Name: node.names[entry.key], Records: corrupt, Reason: reason, Time: time.Now(),
+	})
+	log.Error().Msgf("Quarantined key %d (%s) of bucket %d, no intact copy found", entry.key, node.names[entry.key], entry.bucket)
+	return true
+}
+
+/*
+Sends the checksums of this node's own keys to its replicas, and re-replicates the keys a replica
+holds a different or no copy of. Returns the number of keys re-replicated.
+*/
+func (node *Node) scrubReplicas() int {
+	sums := make(map[uint64]uint32)
+	node.storageMu.RLock()
+	for key, records := range node.HashIPStorage[node.Nodeid] {
+		sums[key] = recordsChecksum(records)
+	}
+	node.storageMu.RUnlock()
+	if len(sums) == 0 {
+		return 0
+	}
+	repaired := 0
+	for _, replica := range node.replicaTargets() {
+		reply := node.CallRPC(message.RequestMessage{Type: SCRUB, TargetId: node.Nodeid, Checksums: sums}, replica.IP)
+		if reply.Type != ACK || len(reply.QueryResponse) == 0 {
+			continue
+		}
+		payload := make(map[uint64][]Record)
+		node.storageMu.RLock()
+		for _, line := range reply.QueryResponse {
+			key, err := strconv.ParseUint(line, 10, 64)
+			if records, ok := node.HashIPStorage[node.Nodeid][key]; err == nil && ok {
+				payload[key] = records
+			}
+		}
+		node.storageMu.RUnlock()
+		if len(payload) == 0 {
+			continue
+		}
+		node.incMetric("scrub_replica_mismatches_total", uint64(len(payload)))
+		msg := message.RequestMessage{Type: REPLICATE, TargetId: node.Nodeid, Payload: payload, Names: node.namesFor(payload)}
+		if reply := node.CallRPC(msg, replica.IP); reply.Type != EMPTY {
+			log.Info().Msgf("Re-replicated %d key(s) that differed on Nodeid: %d IP: %s", len(payload), replica.Nodeid, replica.IP)
+			repaired += len(payload)
+		}
+	}
+	return repaired
+}
+
+/*
+Processes a SCRUB message: returns the keys whose checksum in sums differs from that of the copy in
+bucket, or that are missing from it, one decimal key per line.
+*/
+func (node *Node) compareChecksums(bucket uint64, sums map[uint64]uint32) []string {
+	node.storageMu.RLock()
+	defer node.storageMu.RUnlock()
+	differing := []string{}
+	for key, sum := range sums {
+		records, ok := node.HashIPStorage[bucket][key]
+		if !ok || recordsChecksum(records) != sum {
+			differing = append(differing, strconv.FormatUint(key, 10))
+		}
+	}
+	return differing
+}
+
+/*
+State of the scrubber, for the admin endpoint.
+*/
+type ScrubStatus struct {
+	Pass        ScrubPass          `json:"pass"`
+	Quarantined []QuarantinedEntry `json:"quarantined"`
+}
+
+/*
+Returns the current or last scrub pass, and the quarantined entries.
+*/
+func (node *Node) ScrubStatus() ScrubStatus {
+	node.scrub.mu.Lock()
+	defer node.scrub.mu.Unlock()
+	return ScrubStatus{Pass: node.scrub.pass, Quarantined: append([]QuarantinedEntry{}, node.scrub.quarantine...)}
+}
+
+/*
+Writes the progress of the scrubber as gauges, see WriteMetrics.
+*/
+func (node *Node) writeScrubProgress(w io.Writer) {
+	status := node.ScrubStatus()
+	progress := 1.0
+	if status.Pass.Total > 0 && status.Pass.Finished.IsZero() {
+		progress = float64(status.Pass.Checked) / float64(status.Pass.Total)
+	}
+	fmt.Fprintf(w, "dns_chord_scrub_progress %g\n", progress)
+	if !status.Pass.Finished.IsZero() {
+		fmt.Fprintf(w, "dns_chord_scrub_last_pass_timestamp_seconds %d\n", status.Pass.Finished.Unix())
+	}
+	fmt.Fprintf(w, "dns_chord_scrub_quarantined_entries %d\n", len(status.Quarantined))
+}
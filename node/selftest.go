@@ -0,0 +1,161 @@
+/*
+Startup self-test. A battery of checks of the parts of a node that do not depend on the ring it
+joins: the hash that places names and nodes in the keyspace, the interval arithmetic and routing
+(against the reference model in model.go), storage snapshots on disk, and an RPC round trip over
+the loopback interface in each wire format. Deployment tooling runs `dns-chord --selftest` on a
+new build or host and gates the rollout on its exit code.
+*/
+package node
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/fauzxan/dns-chord/v2/hashing"
+	"github.com/fauzxan/dns-chord/v2/message"
+)
+
+// Constants
+const (
+	SELFTEST_ITERATIONS = 200 // Random inputs per model property, fewer than check-model so that startup stays fast.
+)
+
+/*
+Known IDs of names in the default keyspace, computed independently from the first 8 bytes of their
+SHA-256 digest.
+*/
+var selfTestHashes = map[string]uint64{
+	"":                    2566659092,
+	"example.com":         4004493733,
+	"192.168.1.10:8000\n": 2146886887,
+}
+
+/*
+Runs every self-test check, writing one line per check to w. Returns the failed checks, or nil if
+all of them passed.
+*/
+func SelfTest(w io.Writer) error {
+	checks := []struct {
+		name  string
+		check func() error
+	}{
+		{"hash", selfTestHash},
+		{"intervals", func() error { return CheckIntervals(MODEL_SEED, SELFTEST_ITERATIONS) }},
+		{"routing", func() error { return CheckRouting(MODEL_SEED, SELFTEST_ITERATIONS) }},
+		{"storage", selfTestStorage},
+		{"rdata", selfTestRdata},
+		{"rpc " + WIRE_FORMAT_GOB, func() error { return selfTestRPC(WIRE_FORMAT_GOB) }},
+		{"rpc " + WIRE_FORMAT_PROTOBUF, func() error { return selfTestRPC(WIRE_FORMAT_PROTOBUF) }},
+	}
+	var failed []error
+	for _, c := range checks {
+		start := time.Now()
+		if err := c.check(); err != nil {
+			fmt.Fprintf(w, "FAIL %-12s %v\n", c.name, err)
+			failed = append(failed, fmt.Errorf("%s: %w", c.name, err))
+			continue
+		}
+		fmt.Fprintf(w, "ok   %-12s %s\n", c.name, time.Since(start).Round(time.Microsecond))
+	}
+	return errors.Join(failed...)
+}
+
+func selfTestHash() error {
+	if hashing.Bits() != hashing.DEFAULT_BITS || hashing.LegacyRounding() {
+		return nil // The known IDs are those of the default width, truncated.
+	}
+	for input, want := range selfTestHashes {
+		if got := hashing.Hash(input); got != want {
+			return fmt.Errorf("hash of %q is %d, want %d", input, got, want)
+		}
+	}
+	return nil
+}
+
+/*
+Writes a storage snapshot, including a compressed record, to a temporary directory and reads it back.
+*/
+func selfTestStorage() error {
+	dir, err := os.MkdirTemp("", "dns-chord-selftest")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	records := []Record{NewRecord(TYPE_A, "192.0.2.1"), NewRecord(TYPE_AAAA, "2001:db8::1"), NewRecord(TYPE_TXT, strings.Repeat("selftest ", COMPRESSION_THRESHOLD))}
+	want := map[uint64]map[uint64][]Record{1: {hashing.Hash("selftest.example"): compressRecords(records)}}
+	node := &Node{IP: "selftest", Config: Config{DataDir: dir}, HashIPStorage: want}
+	node.writeToStorage()
+	node.HashIPStorage = nil
+	node.readFromStorage()
+	if !reflect.DeepEqual(node.HashIPStorage, want) {
+		return errors.New("storage read back differs from what was written")
+	}
+	if got := decompressRecords(node.HashIPStorage[1][hashing.Hash("selftest.example")]); !reflect.DeepEqual(got, records) {
+		return errors.New("records do not survive compression")
+	}
+	return nil
+}
+
+/*
+Converts DNS records of several types to their text form and back, including the HTTPS record of
+RFC 9460, a type without a name and a control record.
+*/
+func selfTestRdata() error {
+	for _, record := range []Record{
+		{Type: DNS_TYPE_A, Class: DNS_CLASS_IN, Rdata: []byte{192, 0, 2, 1}},
+		{Type: DNS_TYPE_AAAA, Class: DNS_CLASS_IN, Rdata: net.ParseIP("2001:db8::1")},
+		{Type: DNS_TYPE_TXT, Class: DNS_CLASS_IN, Rdata: txtData("v=spf1 -all")},
+		{Type: DNS_TYPE_TXT, Class: DNS_CLASS_IN, Rdata: append(txtData("two"), txtData("strings")...)},
+		{Type: 65, Class: DNS_CLASS_IN, Rdata: []byte{0, 1, 0, 0, 1, 0, 3, 2, 'h', '2'}},
+		{Type: 65534, Class: DNS_CLASS_IN, Rdata: []byte{}},
+		{Type: RR_TYPE_PRIVATE, Class: DNS_CLASS_IN, Rdata: []byte("max-age=60")},
+	} {
+		if got, err := ParseRecordText(RecordText(record)); err != nil || !sameRecord(got, record) {
+			return fmt.Errorf("%s record %x is read back from %q as %s record %x (%v)", RRTypeName(record.Type), record.Rdata, RecordText(record), RRTypeName(got.Type), got.Rdata, err)
+		}
+	}
+	// Addresses that do not parse, or are of the other family, are no A or AAAA records.
+	for _, text := range []string{"A 2001:db8::1", "A example", "AAAA 192.0.2.1", "AAAA ", "TXT \\# 1 05"} {
+		if got, err := ParseRecordText(text); err == nil {
+			return fmt.Errorf("%q is read as %s record %x", text, RRTypeName(got.Type), got.Rdata)
+		}
+	}
+	return nil
+}
+
+/*
+Starts a node of its own on a loopback port, and sends it a PING, a PUT and a GET in the given
+wire format.
+*/
+func selfTestRPC(format string) error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	addr := listener.Addr().String()
+	self := Pointer{Nodeid: hashing.Hash(addr), IP: addr}
+	node := &Node{Nodeid: self.Nodeid, IP: addr, Successor: self, FingerTable: make([]Pointer, hashing.Bits()), Config: Config{WireFormat: format}}
+	node.Serve(listener)
+	defer node.Shutdown()
+
+	if reply := node.CallRPC(message.RequestMessage{Type: PING}, addr); reply.Type != ACK {
+		return fmt.Errorf("PING was answered with %q", reply.Type)
+	}
+	key := hashing.Hash("selftest.example")
+	records := []Record{NewRecord(TYPE_A, "192.0.2.1")}
+	put := message.RequestMessage{Type: PUT, TargetId: node.Nodeid, Payload: map[uint64][]Record{key: records}, Names: map[uint64]string{key: "selftest.example"}}
+	if reply := node.CallRPC(put, addr); reply.Type != ACK {
+		return fmt.Errorf("PUT was answered with %q", reply.Type)
+	}
+	reply := node.CallRPC(message.RequestMessage{Type: GET, TargetId: key}, addr)
+	if got := decompressRecords(reply.Records); !reflect.DeepEqual(got, records) {
+		return fmt.Errorf("GET returned %v, want %v", got, records)
+	}
+	return nil
+}
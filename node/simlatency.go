@@ -0,0 +1,81 @@
+/*
+Simulated network latency for local clusters. A ring run on one machine has next to no latency
+between its nodes, so proximity routing and replica selection can not be evaluated on it. With a
+latency matrix between zones, e.g. SIM_LATENCY=dc1/dc2=40ms,dc1/dc3=80ms,dc2/dc3=60ms, every RPC a
+node sends to a peer is held back by the latency between the zone of the node (ZONE) and the zone
+the peer last replied with, so that a single host can emulate several data centres. Pairs are
+symmetric, and pairs that are not listed, as well as peers whose zone is not known yet, have no
+added latency. Latency within a zone can be set with a pair such as dc1/dc1=1ms.
+*/
+package node
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Constants
+const (
+	SIM_LATENCY_ZONE_SEPARATOR = "/" // Separates the two zones of a pair in SIM_LATENCY.
+)
+
+/*
+Parses SIM_LATENCY entries of the form zone/zone=duration into a matrix keyed by simLatencyKey.
+*/
+func ParseLatencyMatrix(entries []string) (map[string]time.Duration, error) {
+	matrix := make(map[string]time.Duration)
+	for _, entry := range entries {
+		pair, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("latency %q is not of the form zone%szone=duration", entry, SIM_LATENCY_ZONE_SEPARATOR)
+		}
+		from, to, ok := strings.Cut(pair, SIM_LATENCY_ZONE_SEPARATOR)
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("latency %q does not name two zones", entry)
+		}
+		latency, err := time.ParseDuration(value)
+		if err != nil || latency < 0 {
+			return nil, fmt.Errorf("latency %q has no valid duration", entry)
+		}
+		matrix[simLatencyKey(from, to)] = latency
+	}
+	return matrix, nil
+}
+
+/*
+Returns the key of the pair of zones a and b in a latency matrix, the same in either order.
+*/
+func simLatencyKey(a string, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	return a + SIM_LATENCY_ZONE_SEPARATOR + b
+}
+
+/*
+Returns the simulated latency between this node and the peer at IP, 0 if there is none.
+*/
+func (node *Node) simulatedLatency(IP string) time.Duration {
+	if len(node.Config.SimLatency) == 0 || node.Config.Zone == "" {
+		return 0
+	}
+	node.zones.mu.Lock()
+	zone, ok := node.zones.zones[IP]
+	node.zones.mu.Unlock()
+	if !ok || zone == "" {
+		return 0
+	}
+	return node.Config.SimLatency[simLatencyKey(node.Config.Zone, zone)]
+}
+
+/*
+Holds back an RPC to the peer at IP by the simulated latency between the two, see
+simulatedLatency. The delay counts against the deadline of the call like real latency would.
+*/
+func (node *Node) simulateLatency(IP string) {
+	if latency := node.simulatedLatency(IP); latency > 0 {
+		node.incMetric("simulated_latency_rpcs_total", 1)
+		time.Sleep(latency)
+	}
+}
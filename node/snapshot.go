@@ -0,0 +1,264 @@
+/*
+Ring-wide consistent snapshots, for experiments and invariant checks. The initiator records its
+own state under a new epoch and sends a SNAPSHOT marker around the ring. Every message and reply
+carries the epoch of the last snapshot its sender recorded, so that a node records its state
+before it processes anything sent after the cut: the recorded states, taken together, form a
+consistent cut even though the nodes record at different times. State-changing messages that were
+sent before the cut but arrive after it are in transit across the cut, and are recorded along with
+the receiver's state.
+*/
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fauzxan/dns-chord/v2/message"
+	"github.com/rs/zerolog/log"
+)
+
+// Constants
+const (
+	SNAPSHOT_RETAIN         = 4    // Number of recorded snapshots a node keeps, for the initiator to collect.
+	SNAPSHOT_MAX_IN_TRANSIT = 1024 // Upper bound on the messages recorded in transit per snapshot.
+)
+
+/*
+State of one node at a snapshot's cut.
+*/
+type NodeSnapshot struct {
+	Epoch       uint64                         `json:"epoch"`
+	Taken       time.Time                      `json:"taken"`
+	Nodeid      uint64                         `json:"nodeid"`
+	IP          string                         `json:"ip"`
+	Successor   Pointer                        `json:"successor"`
+	Predecessor Pointer                        `json:"predecessor"`
+	SuccList    []Pointer                      `json:"succ_list"`
+	FingerTable []Pointer                      `json:"finger_table"`
+	Storage     map[uint64]map[uint64][]Record `json:"storage"`
+	InTransit   []InTransitMessage             `json:"in_transit"`
+}
+
+/*
+A state-changing message sent before the cut and received after it.
+*/
+type InTransitMessage struct {
+	Type     string   `json:"type"`
+	From     string   `json:"from"`
+	TargetId uint64   `json:"target_id"`
+	Keys     []uint64 `json:"keys,omitempty"`
+}
+
+/*
+The states of every node reachable along the successor pointers at one cut, and the invariants
+they violate.
+*/
+type RingSnapshot struct {
+	Epoch      uint64         `json:"epoch"`
+	Nodes      []NodeSnapshot `json:"nodes"`
+	Complete   bool           `json:"complete"` // False if the walk of the ring broke off, or a node did not return its state
+	Violations []string       `json:"violations"`
+}
+
+type snapshotState struct {
+	mu        sync.Mutex
+	epoch     uint64                   // Epoch of the last snapshot recorded
+	forwarded uint64                   // Epoch of the last marker forwarded to the successor
+	taken     map[uint64]*NodeSnapshot // Recorded snapshots by epoch
+}
+
+/*
+Returns the epoch of the last snapshot this node recorded, to be attached to every message it sends.
+*/
+func (node *Node) snapshotEpoch() uint64 {
+	node.snapshots.mu.Lock()
+	defer node.snapshots.mu.Unlock()
+	return node.snapshots.epoch
+}
+
+/*
+Records the state of the node under epoch, unless it has recorded that or a later snapshot already.
+*/
+func (node *Node) recordSnapshot(epoch uint64) {
+	node.snapshots.mu.Lock()
+	defer node.snapshots.mu.Unlock()
+	if epoch <= node.snapshots.epoch {
+		return
+	}
+	node.snapshots.epoch = epoch
+	if node.snapshots.taken == nil {
+		node.snapshots.taken = make(map[uint64]*NodeSnapshot)
+	}
+	snapshot := &NodeSnapshot{
+		Epoch:       epoch,
+		Taken:       time.Now(),
+		Nodeid:      node.Nodeid,
+		IP:          node.IP,
+		Successor:   node.successor(),
+		Predecessor: node.predecessor(),
+		SuccList:    node.succList(),
+		FingerTable: node.fingers(),
+		Storage:     make(map[uint64]map[uint64][]Record),
+		InTransit:   []InTransitMessage{},
+	}
+	node.storageMu.RLock()
+	for bucket, storage := range node.HashIPStorage {
+		snapshot.Storage[bucket] = make(map[uint64][]Record, len(storage))
+		for key, ip_cache := range storage {
+			snapshot.Storage[bucket][key] = append([]Record(nil), ip_cache...)
+		}
+	}
+	node.storageMu.RUnlock()
+	node.snapshots.taken[epoch] = snapshot
+	for len(node.snapshots.taken) > SNAPSHOT_RETAIN {
+		oldest := epoch
+		for taken := range node.snapshots.taken {
+			oldest = min(oldest, taken)
+		}
+		delete(node.snapshots.taken, oldest)
+	}
+	log.Debug().Msgf("Recorded snapshot %d", epoch)
+}
+
+/*
+Applies the snapshot rules to a received message: records the state first if the sender is past
+a cut this node has not recorded yet, or records the message as in transit if the sender is
+still before the last cut.
+*/
+func (node *Node) observeSnapshot(msg *message.RequestMessage) {
+	epoch := node.snapshotEpoch()
+	if msg.SnapshotEpoch > epoch {
+		node.recordSnapshot(msg.SnapshotEpoch)
+		return
+	}
+	if msg.SnapshotEpoch == epoch || !changesState(msg.Type) {
+		return
+	}
+	node.snapshots.mu.Lock()
+	defer node.snapshots.mu.Unlock()
+	snapshot, ok := node.snapshots.taken[node.snapshots.epoch]
+	if !ok || len(snapshot.InTransit) >= SNAPSHOT_MAX_IN_TRANSIT {
+		return
+	}
+	transit := InTransitMessage{Type: msg.Type, From: msg.From, TargetId: msg.TargetId}
+	for key := range msg.Payload {
+		transit.Keys = append(transit.Keys, key)
+	}
+	snapshot.InTransit = append(snapshot.InTransit, transit)
+}
+
+/*
+Returns true for the message types that change the storage or routing state of the receiver.
+*/
+func changesState(msgType string) bool {
+	switch msgType {
+	case PUT, REPLICATE, SHIFT, HANDOFF, LEAVE, NOTIFY, STABILIZE:
+		return true
+	}
+	return false
+}
+
+/*
+Handles a SNAPSHOT marker: passes it on to the successor, unless the successor started the snapshot.
+*/
+func (node *Node) forwardSnapshotMarker(msg *message.RequestMessage) {
+	node.snapshots.mu.Lock()
+	forward := msg.TargetId > node.snapshots.forwarded
+	if forward {
+		node.snapshots.forwarded = msg.TargetId
+	}
+	node.snapshots.mu.Unlock()
+	successor := node.successor().IP
+	if !forward || successor == msg.IP || successor == node.IP {
+		return
+	}
+	node.spawn("snapshot_marker", func() {
+		node.CallRPC(message.RequestMessage{Type: SNAPSHOT, TargetId: msg.TargetId, IP: msg.IP}, successor)
+	})
+}
+
+/*
+Returns the snapshot this node recorded under epoch, JSON encoded, or nil if it has not kept one.
+*/
+func (node *Node) encodedSnapshot(epoch uint64) []byte {
+	node.snapshots.mu.Lock()
+	defer node.snapshots.mu.Unlock()
+	snapshot, ok := node.snapshots.taken[epoch]
+	if !ok {
+		return nil
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		log.Error().Err(err).Msg("Error encoding snapshot")
+		return nil
+	}
+	return data
+}
+
+/*
+Takes a consistent snapshot of the whole ring: records this node's state under a new epoch, sends
+the marker around the ring, and collects the recorded states of every node along the successor
+pointers. The collected snapshot is checked with CheckRingSnapshot.
+*/
+func (node *Node) TakeSnapshot() RingSnapshot {
+	epoch := uint64(time.Now().UnixNano())
+	if current := node.snapshotEpoch(); epoch <= current {
+		epoch = current + 1
+	}
+	node.recordSnapshot(epoch)
+	marker := message.RequestMessage{Type: SNAPSHOT, TargetId: epoch, IP: node.IP}
+	node.forwardSnapshotMarker(&marker)
+
+	ring, complete := node.walkRing()
+	snapshot := RingSnapshot{Epoch: epoch, Complete: complete}
+	for _, pointer := range ring {
+		data := node.encodedSnapshot(epoch)
+		if pointer.IP != node.IP {
+			data = node.CallRPC(message.RequestMessage{Type: GET_SNAPSHOT, TargetId: epoch}, pointer.IP).Snapshot
+		}
+		var state NodeSnapshot
+		if data == nil || json.Unmarshal(data, &state) != nil {
+			log.Warn().Msgf("Nodeid: %d IP: %s did not return its state for snapshot %d", pointer.Nodeid, pointer.IP, epoch)
+			snapshot.Complete = false
+			continue
+		}
+		snapshot.Nodes = append(snapshot.Nodes, state)
+	}
+	snapshot.Violations = CheckRingSnapshot(snapshot)
+	return snapshot
+}
+
+/*
+Checks the global invariants of a ring snapshot: the successor of every node has it as its
+predecessor, and every key a node stores as its own falls in its range (predecessor, node].
+Returns a description of every violation.
+*/
+func CheckRingSnapshot(snapshot RingSnapshot) []string {
+	violations := []string{}
+	byIP := make(map[string]NodeSnapshot, len(snapshot.Nodes))
+	for _, state := range snapshot.Nodes {
+		byIP[state.IP] = state
+	}
+	for _, state := range snapshot.Nodes {
+		if successor, ok := byIP[state.Successor.IP]; ok && successor.Predecessor.IP != state.IP {
+			violations = append(violations, fmt.Sprintf("successor %d of node %d has predecessor %d", successor.Nodeid, state.Nodeid, successor.Predecessor.Nodeid))
+		}
+		if state.Predecessor.IP == "" {
+			continue
+		}
+		keys := []uint64{}
+		for key := range state.Storage[state.Nodeid] {
+			if !belongsTo(key, state.Predecessor.Nodeid, state.Nodeid) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+		for _, key := range keys {
+			violations = append(violations, fmt.Sprintf("node %d stores key %d outside its range (%d, %d]", state.Nodeid, key, state.Predecessor.Nodeid, state.Nodeid))
+		}
+	}
+	return violations
+}
@@ -0,0 +1,165 @@
+/*
+Ring statistics for research data collection. Every node answers a STATS message with a fixed set
+of counters: lookups it initiated, forwarded and answered, bytes sent and received on RPC
+connections, and keys it transferred to other nodes, along with its resource usage, see
+resources.go. A collector walks the ring, asks every node, and writes one CSV row per node, with
+its instance ID (see instance.go), so that the state of a whole experiment run ends up in one file.
+*/
+package node
+
+import (
+	"encoding/csv"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fauzxan/dns-chord/v2/message"
+	"github.com/rs/zerolog/log"
+)
+
+/*
+Counters reported in STATS replies, in CSV column order, with the metric each one is read from.
+*/
+var statsColumns = []struct {
+	name   string
+	metric string
+}{
+	{"lookups_initiated", "lookups_initiated_total"},
+	{"lookups_forwarded", "lookups_forwarded_total"},
+	{"lookups_answered", "lookups_answered_total"},
+	{"bytes_sent", "rpc_bytes_sent_total"},
+	{"bytes_received", "rpc_bytes_received_total"},
+	{"keys_shifted", `keys_transferred_total{kind="shift"}`},
+	{"keys_handed_off", `keys_transferred_total{kind="handoff"}`},
+	{"keys_replicated", `keys_transferred_total{kind="replicate"}`},
+	{"keys_collected", "storage_gc_transferred_total"},
+	{"resolutions_upstream", `resolutions_total{source="upstream"}`},
+	{"cpu_percent", "cpu_percent"},
+	{"memory_bytes", "memory_bytes"},
+	{"goroutines", "goroutines"},
+	{"open_conns", "open_conns"},
+	{"data_dir_bytes", "data_dir_bytes"},
+	{"disk_free_bytes", "disk_free_bytes"},
+}
+
+/*
+Statistics of one node, as collected from the ring.
+*/
+type NodeStats struct {
+	Nodeid   uint64
+	IP       string
+	Instance string            // Instance ID of the node, see instance.go. Empty if it did not answer.
+	Stats    map[string]uint64 // Counter name (see statsColumns) -> value. Nil if the node did not answer.
+}
+
+/*
+Bytes sent and received on the RPC connections of a node, in both directions.
+*/
+type trafficCounters struct {
+	sent     atomic.Uint64
+	received atomic.Uint64
+}
+
+/*
+Wraps an RPC connection so that the bytes read and written on it are counted.
+*/
+type countingConn struct {
+	net.Conn
+	traffic *trafficCounters
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.traffic.received.Add(uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.traffic.sent.Add(uint64(n))
+	return n, err
+}
+
+/*
+Returns the statistics of this node.
+*/
+func (node *Node) Stats() map[string]uint64 {
+	counters := node.Counters()
+	counters["rpc_bytes_sent_total"] = node.traffic.sent.Load()
+	counters["rpc_bytes_received_total"] = node.traffic.received.Load()
+	for name, value := range node.ResourceUsage().gauges() {
+		counters[name] = uint64(value + 0.5)
+	}
+	stats := make(map[string]uint64, len(statsColumns))
+	for _, column := range statsColumns {
+		stats[column.name] = counters[column.metric]
+	}
+	return stats
+}
+
+/*
+Returns the statistics of this node in the form of a STATS reply, one "name value" line each.
+*/
+func (node *Node) statsReply() []string {
+	lines := []string{}
+	for name, value := range node.Stats() {
+		lines = append(lines, name+" "+strconv.FormatUint(value, 10))
+	}
+	return lines
+}
+
+/*
+Returns the statistics of every node in the ring, in ring order starting at this node.
+*/
+func (node *Node) CollectStats() []NodeStats {
+	walk, ok := node.walkRing()
+	if !ok {
+		log.Warn().Msgf("The ring walk broke off after %d nodes, collecting their statistics only", len(walk))
+	}
+	list := []NodeStats{}
+	for _, pointer := range walk {
+		entry := NodeStats{Nodeid: pointer.Nodeid, IP: pointer.IP}
+		if pointer.IP == node.IP {
+			entry.Instance, entry.Stats = node.InstanceID(), node.Stats()
+		} else if reply := node.CallRPC(message.RequestMessage{Type: STATS}, pointer.IP); reply.Type == ACK {
+			entry.Instance, entry.Stats = reply.Instance, make(map[string]uint64)
+			for _, line := range reply.QueryResponse {
+				if name, value, found := strings.Cut(line, " "); found {
+					entry.Stats[name], _ = strconv.ParseUint(value, 10, 64)
+				}
+			}
+		}
+		list = append(list, entry)
+	}
+	return list
+}
+
+/*
+Writes the statistics as CSV, one row per node, each stamped with the time of the collection.
+Nodes that did not answer have empty counter columns.
+*/
+func WriteStatsCSV(w io.Writer, list []NodeStats) error {
+	writer := csv.NewWriter(w)
+	header := []string{"time", "nodeid", "ip", "instance"}
+	for _, column := range statsColumns {
+		header = append(header, column.name)
+	}
+	writer.Write(header)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	for _, entry := range list {
+		row := []string{now, strconv.FormatUint(entry.Nodeid, 10), entry.IP, entry.Instance}
+		for _, column := range statsColumns {
+			value := ""
+			if entry.Stats != nil {
+				value = strconv.FormatUint(entry.Stats[column.name], 10)
+			}
+			row = append(row, value)
+		}
+		writer.Write(row)
+	}
+	writer.Flush()
+	return writer.Error()
+}
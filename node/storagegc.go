@@ -0,0 +1,201 @@
+/*
+Garbage collection of replicas. A node keeps the keys of its REPLICATION_FACTOR predecessors in
+per-sender buckets of HashIPStorage, but nothing removes them once the ring has moved on: after
+heavy churn, a node can hold replicas of nodes that are far away in the ring by now. The collector
+periodically drops every replicated key outside the range this node replicates, which depends on
+the replication factor of the key (see replicas.go), after making sure that the key's owner has
+it, and transferring it to the owner otherwise. Keys in the node's own bucket are taken care of by
+the keyspace verifier, see keyspace.go.
+*/
+package node
+
+import (
+	"time"
+
+	"github.com/fauzxan/dns-chord/v2/message"
+	"github.com/rs/zerolog/log"
+)
+
+// Constants
+const (
+	STORAGE_GC_INTERVAL = 60 * time.Second // Time between two garbage collection rounds.
+)
+
+/*
+Periodically collects the replicas this node is no longer responsible for.
+*/
+func (node *Node) collectGarbage() {
+	for node.sleep(STORAGE_GC_INTERVAL) {
+		node.collectReplicas()
+	}
+}
+
+/*
+Returns the start of the range this node holds replicas for, of keys whose owners replicate them
+to span successors: its span+1-th predecessor, so that the range is (start, predecessor]. With
+zones, replicas may skip nodes, and span is widened to every predecessor that may pick this node,
+see replicaSpanOf. Returns false if the range can not be determined, or if it spans the whole ring.
+*/
+func (node *Node) replicaRangeStart(span int) (uint64, bool) {
+	start := node.predecessor()
+	if (start == Pointer{}) {
+		return 0, false
+	}
+	for i := 0; i < span; i++ {
+		if start.Nodeid == node.Nodeid {
+			return 0, false // A small ring, where every key is replicated here.
+		}
+		reply := node.CallRPC(message.RequestMessage{Type: GET_PREDECESSOR}, start.IP)
+		if reply.Type == EMPTY || reply.IP == "" {
+			return 0, false
+		}
+		start = Pointer{Nodeid: reply.Nodeid, IP: reply.IP}
+	}
+	if start.Nodeid == node.Nodeid {
+		return 0, false
+	}
+	return start.Nodeid, true
+}
+
+/*
+Drops every key in the replica buckets that falls outside the replicated range for its replication
+factor, see replicas.go, once its owner has it. Returns the number of keys dropped.
+*/
+func (node *Node) collectReplicas() int {
+	type replica struct {
+		bucket, key uint64
+		ip_cache    []Record
+	}
+	replicas := []replica{}
+	node.storageMu.RLock()
+	for bucket, storage := range node.HashIPStorage {
+		if bucket == node.Nodeid {
+			continue
+		}
+		for key, ip_cache := range storage {
+			replicas = append(replicas, replica{bucket, key, ip_cache})
+		}
+	}
+	node.storageMu.RUnlock()
+
+	// The range of each span, walking the ring once per distinct replication factor.
+	type bound struct {
+		start uint64
+		ok    bool
+	}
+	bounds := make(map[int]bound)
+	inRange := func(key uint64, span int) bool {
+		b, known := bounds[span]
+		if !known {
+			b.start, b.ok = node.replicaRangeStart(span)
+			bounds[span] = b
+		}
+		return !b.ok || belongsTo(key, b.start, node.predecessor().Nodeid)
+	}
+
+	stale := make(map[uint64]map[uint64][]Record)
+	for _, r := range replicas {
+		if node.boosted(r.key) {
+			continue
+		}
+		if span := node.replicaSpanOf(replicationFactor(r.ip_cache)); inRange(r.key, span) {
+			if span <= node.replicaSpan() || inRange(r.key, node.replicaSpan()) {
+				continue
+			}
+			// An extra replica. The owner stops sending those once their factor is lowered, so this
+			// copy may still carry the old one.
+			factor, ok := node.ownerReplicationFactor(r.key)
+			if !ok || inRange(r.key, node.replicaSpanOf(factor)) {
+				continue
+			}
+		}
+		if stale[r.bucket] == nil {
+			stale[r.bucket] = make(map[uint64][]Record)
+		}
+		stale[r.bucket][r.key] = r.ip_cache
+	}
+
+	dropped := 0
+	for bucket, keys := range stale {
+		for key, ip_cache := range keys {
+			if !node.ensureOwnerHas(key, ip_cache) {
+				continue
+			}
+			node.dropReplica(bucket, key)
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		log.Info().Msgf("Garbage collected %d replicated key(s) outside the ranges this node replicates", dropped)
+		node.incMetric("storage_gc_dropped_total", uint64(dropped))
+	}
+	return dropped
+}
+
+/*
+Returns the replication factor of key as its owner has it, or false if the owner does not reply
+with its records.
+*/
+func (node *Node) ownerReplicationFactor(key uint64) (int, bool) {
+	owner, _ := node.backgroundFindSuccessor(key)
+	if (owner == Pointer{} || owner.Nodeid == node.Nodeid) {
+		return 0, false
+	}
+	reply := node.CallRPC(message.RequestMessage{Type: GET, TargetId: key}, owner.IP)
+	if reply.Records == nil {
+		return 0, false
+	}
+	return replicationFactor(decompressRecords(reply.Records)), true
+}
+
+/*
+Makes sure that the owner of key holds it, transferring ip_cache to the owner if it does not.
+Returns false if that could not be confirmed.
+*/
+func (node *Node) ensureOwnerHas(key uint64, ip_cache []Record) bool {
+	owner, _ := node.backgroundFindSuccessor(key)
+	if (owner == Pointer{} || owner.Nodeid == node.Nodeid) {
+		return false
+	}
+	reply := node.CallRPC(message.RequestMessage{Type: GET, TargetId: key}, owner.IP)
+	if reply.Records != nil || reply.Type == DENIED {
+		return true // A DENIED reply means the owner has the key, but does not let this node read it.
+	}
+	if reply.Type == EMPTY || redirectable(reply) {
+		return false
+	}
+	payload := map[uint64][]Record{key: ip_cache}
+	reply = node.CallRPC(message.RequestMessage{Type: PUT, TargetId: owner.Nodeid, Payload: payload, Names: node.namesFor(payload)}, owner.IP)
+	if reply.Type != ACK && reply.Type != REDIRECT {
+		log.Warn().Msgf("Could not transfer replicated key %d to its owner Nodeid: %d IP: %s", key, owner.Nodeid, owner.IP)
+		return false
+	}
+	node.incMetric("storage_gc_transferred_total", 1)
+	return true
+}
+
+/*
+Removes key from the replica bucket, along with the bucket once it is empty, and the name of
+the key once no bucket holds it anymore.
+*/
+func (node *Node) dropReplica(bucket uint64, key uint64) {
+	node.storageMu.Lock()
+	defer node.storageMu.Unlock()
+	delete(node.HashIPStorage[bucket], key)
+	if len(node.HashIPStorage[bucket]) == 0 {
+		delete(node.HashIPStorage, bucket)
+	}
+	node.forgetUnstored(key)
+}
+
+/*
+Forgets the name of key once no bucket holds it anymore. The caller holds storageMu.
+*/
+func (node *Node) forgetUnstored(key uint64) {
+	for _, storage := range node.HashIPStorage {
+		if _, ok := storage[key]; ok {
+			return
+		}
+	}
+	node.forgetName(key)
+}
@@ -9,14 +9,15 @@ package node
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"net"
+	"io"
+	"math/rand"
 	"os"
-	"strings"
 	"time"
 
+	"github.com/fauzxan/dns-chord/v2/hashing"
 	"github.com/fauzxan/dns-chord/v2/message"
-	"github.com/fauzxan/dns-chord/v2/utility"
 	"github.com/rs/zerolog/log"
 )
 
@@ -24,8 +25,34 @@ import (
 Used for in-memory-storage. Used to maintain the list of recent queries, and improve query speed.
 */
 type LRUCache struct {
-	value     []string // List of values corresponding to websites records.
-	cacheTime uint64   // Counter to indicate the timestamp of the entry. Used for kicking out Least Recently Used.
+	value     []Record  // List of values corresponding to websites records.
+	cacheTime uint64    // Counter to indicate the timestamp of the entry. Used for kicking out Least Recently Used.
+	expires   time.Time // When the entry may no longer be served, as set by the owner's cache policy. Zero if never.
+	name      string    // Name the entry was cached for, for the cache statistics.
+	added     time.Time // When the entry was cached.
+	hits      uint64    // Number of lookups answered from the entry.
+
+	fetch      time.Duration // Time the lookup that filled the entry took, see xfetch.go.
+	refreshing bool          // Set while a lookup refreshes the entry early.
+}
+
+var ErrNotFound = errors.New("name not found in the ring")
+var ErrMisrouted = errors.New("the lookup did not reach the node responsible for the name")
+
+/*
+Resolves website and prints its records, with the hops and the time it took.
+*/
+func (node *Node) QueryDNS(website string) {
+	var trace LookupTrace
+	start := time.Now()
+	records, err := node.resolve(website, true, time.Time{}, &trace)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not get IPs")
+		return
+	}
+	website, _ = NormalizeName(website)
+	printRecords(DisplayName(website), records)
+	log.Info().Msgf("> Resolved in %d hops, %.2f ms, from %s", trace.Hops, milliseconds(time.Since(start)), trace.Source)
 }
 
 /*
@@ -38,126 +65,362 @@ Mother code for all DNS query logic. It executes one of the following logic path
 3. Query node -> check local cache -> query local storage -> find successor, and send get -> put in local cache -> return entry
 
 4. Query node -> check local cache -> query local storage -> find successor, and send get -> query legacy DNS -> send to appropriate node, or self -> put in local cache -> return entry
+
+Returns the records of website, or an error if it could not be resolved at all. Safe to call
+concurrently, e.g. from the DNS listener.
 */
-func (node *Node) QueryDNS(website string) {
+func (node *Node) Resolve(website string) ([]Record, error) {
+	return node.resolve(website, true, time.Time{}, nil)
+}
+
+/*
+Resolve, optionally without falling back to legacy DNS, which is the case for names in zones the
+ring is authoritative for. Returns ErrNotFound if the name is not in the ring and upstream is false.
+Records how the name was resolved in trace, unless it is nil.
+*/
+func (node *Node) resolve(website string, upstream bool, deadline time.Time, trace *LookupTrace) (records []Record, err error) {
+	website, err = NormalizeName(website)
+	if err != nil {
+		return nil, err
+	}
+	defer node.observeLookup(time.Now())
+	node.cacheMu.Lock()
 	if node.CachedQuery == nil {
 		node.CachedQuery = make(map[uint64]LRUCache)
 	}
 	node.CacheTime += 1
+	cacheTime := node.CacheTime
+	node.cacheMu.Unlock()
 
-	if strings.HasPrefix(website, "www.") {
-		log.Info().Msg("Removing Prefix")
-		website = website[4:]
-	}
-	hashedWebsite := utility.GenerateHash(website)
+	hashedWebsite := hashing.Hash(website)
+	node.cacheMu.Lock()
 	ip_addr, ok := node.CachedQuery[hashedWebsite]
+	if ok && !ip_addr.expires.IsZero() && time.Now().After(ip_addr.expires) {
+		delete(node.CachedQuery, hashedWebsite)
+		node.incMetric(`cache_evictions_total{reason="expired"}`, 1)
+		ok = false
+	}
+	// A lookup may refresh a popular entry before it expires, for all others, see xfetch.go
+	early := ok && node.refreshEarly(ip_addr)
+	if early {
+		ip_addr.refreshing = true
+	}
+	if ok {
+		ip_addr.hits++
+		node.CachedQuery[hashedWebsite] = ip_addr
+	}
+	node.cacheMu.Unlock()
+	if early {
+		node.incMetric("cache_early_refreshes_total", 1)
+		defer func() {
+			if err != nil {
+				records, err = ip_addr.value, nil
+			}
+		}()
+	} else if ok {
+		sampledLog().Info().Msg("Retrieving from LRUCache")
+		node.incMetric(`resolutions_total{source="cache"}`, 1)
+		trace.local(node, "cache", 0, time.Since(ip_addr.added))
+		return ip_addr.value, nil
+	}
+	if !early {
+		node.incMetric("cache_misses_total", 1)
+	}
+	fetchStart := time.Now()
+
+	node.storageMu.RLock()
+	stored, ok := node.HashIPStorage[node.Nodeid][hashedWebsite]
+	node.storageMu.RUnlock()
+	if ok {
+		node.countRead(hashedWebsite)
+		stored = node.boostCachePolicy(hashedWebsite, stored)
+	} else {
+		stored, ok = node.boostedRecords(hashedWebsite)
+	}
+	if !ok {
+		stored, ok = node.diskStore.get(hashedWebsite)
+	}
+	sampledLog().Info().Msgf("> The Website %s has been hashed to %d", website, hashedWebsite)
 	if ok {
-		log.Info().Msg("Retrieving from LRUCache")
-		for _, ip_c := range ip_addr.value {
-			log.Info().Msgf("> %s. IN A %s", website, ip_c)
+		sampledLog().Info().Msg("Retrieving from Local Storage")
+		node.incMetric(`resolutions_total{source="storage"}`, 1)
+		trace.local(node, "storage", 0, 0)
+		return node.followMove(hashedWebsite, decompressRecords(stored)), nil
+	}
+
+	traceId := rand.Uint64()
+	sampledLog().Info().Msgf("> Trace id: %d", traceId)
+	lookupStart := time.Now()
+	succPointer, hopCount := node.findSuccessorBefore(hashedWebsite, 0, traceId, deadline)
+	sampledLog().Info().Msgf("> Number of Hops: %d", hopCount)
+	if succPointer.IP != "" {
+		node.observeHops(hopCount)
+		node.recordLookup(hashedWebsite, hopCount, time.Since(lookupStart))
+	}
+	// log hopcount into the log file using the library
+	sampledLog().Info().Msgf("> The Website would be stored at it's succesor Nodeid: %d IP: %s", succPointer.Nodeid, succPointer.IP)
+	msg := message.RequestMessage{Type: GET, TargetId: hashedWebsite, TraceId: traceId}
+	if !deadline.IsZero() {
+		msg.Budget = int64(max(1, time.Until(deadline)))
+	}
+	reply := node.CallRPC(msg, succPointer.IP)
+	answering := succPointer
+	// An overloaded owner hints at its successor, which holds a replica of its keys.
+	for retries := 0; redirectable(reply) && retries < MAX_BUSY_RETRIES; retries++ {
+		sampledLog().Info().Msgf("> Nodeid: %d is busy, reading replica from Nodeid: %d IP: %s", succPointer.Nodeid, reply.Nodeid, reply.IP)
+		answering = Pointer{Nodeid: reply.Nodeid, IP: reply.IP}
+		reply = node.CallRPC(msg, reply.IP)
+	}
+	// The path failed, spend the retry budget on others, see retry.go
+	fallback := ""
+	if reply.Type == EMPTY && node.Config.LookupRetries > 0 {
+		retry := node.retryLookup(msg, succPointer, deadline)
+		if retry.fallback != "" {
+			reply, answering, fallback = retry.reply, retry.answering, retry.fallback
+		}
+		if retry.owner.IP != "" {
+			succPointer = retry.owner
+		}
+	}
+	if fallback != FALLBACK_REPLICA {
+		var owner Pointer
+		var owned bool
+		reply, owner, owned = node.checkOwnership(hashedWebsite, reply, func(owner Pointer) message.ResponseMessage {
+			return node.CallRPC(msg, owner.IP)
+		})
+		if !owned {
+			node.incMetric(`resolutions_total{source="failed"}`, 1)
+			return nil, ErrMisrouted
 		}
+		if owner.IP != "" {
+			succPointer, answering = owner, owner
+		}
+	}
+	if reply.Type == DENIED {
+		node.incMetric(`resolutions_total{source="failed"}`, 1)
+		return nil, ErrAccessDenied
+	}
+	if reply.Records != nil {
+		sampledLog().Info().Msg("Retrieving from Chord Network")
+		node.incMetric(`resolutions_total{source="ring"}`, 1)
+		trace.remote("ring", answering, hopCount, 0)
+		trace.fellBack(fallback)
+		records := node.followMove(hashedWebsite, decompressRecords(reply.Records))
+		// Read-through caching, as far as the owner of the record allows it.
+		if cacheable, maxAge := cachePolicy(records); cacheable {
+			node.cacheMu.Lock()
+			node.CachedQuery[hashedWebsite] = LRUCache{value: records, cacheTime: cacheTime, expires: time.Now().Add(maxAge), name: website, added: time.Now(), fetch: time.Since(fetchStart)}
+			node.cacheMu.Unlock()
+			node.evictCache()
+		}
+		return records, nil
+	}
+
+	if !upstream {
+		return nil, ErrNotFound
+	}
+	ips, ttl, err := node.lookupUpstreamTTL(website)
+	if err != nil {
+		node.incMetric(`resolutions_total{source="failed"}`, 1)
+		return nil, err
+	}
+	node.incMetric(`resolutions_total{source="upstream"}`, 1)
+	trace.local(node, "upstream", hopCount, 0)
+	// The TTL of the answer, clamped, becomes the cache policy of the set, see ttl.go
+	ip_addresses := upstreamRecords(ips, ttl)
+	sampledLog().Info().Msgf("IP ADDRESSES %v", ip_addresses)
+
+	if ttl > 0 {
+		node.cacheMu.Lock()
+		node.CachedQuery[hashedWebsite] = LRUCache{value: ip_addresses, cacheTime: cacheTime, expires: time.Now().Add(ttl), name: website, added: time.Now(), fetch: time.Since(fetchStart)}
+		node.cacheMu.Unlock()
+	}
+	// The stored set is stamped, so that its owner refreshes it before it goes stale, see refresh.go
+	stamped := append(append([]Record{}, ip_addresses...), learnedRecord(time.Now()))
+	put := message.RequestMessage{Type: PUT, TargetId: succPointer.Nodeid, Payload: map[uint64][]Record{hashedWebsite: stamped}, Names: map[uint64]string{hashedWebsite: website}, TraceId: traceId}
+	reply = node.callAvoidingShutdown(put, succPointer.IP)
+	reply, _, owned := node.checkOwnership(hashedWebsite, reply, func(owner Pointer) message.ResponseMessage {
+		put.TargetId = owner.Nodeid
+		return node.callAvoidingShutdown(put, owner.IP)
+	})
+
+	if reply.Type == REDIRECT {
+		sampledLog().Info().Msgf("> Record was redirected to its current owner Nodeid: %d IP: %s", reply.Nodeid, reply.IP)
+	}
+	if owned && (reply.Type == ACK || reply.Type == REDIRECT) {
+		node.evictCache()
 	} else {
-		ip_addr, ok := node.HashIPStorage[node.Nodeid][hashedWebsite]
-		log.Info().Msgf("> The Website %s has been hashed to %d", website, hashedWebsite)
-		if ok {
-			log.Info().Msg("Retrieving from Local Storage")
-			for _, ip_c := range ip_addr {
-				log.Info().Msgf("> %s. IN A %s", website, ip_c)
-			}
-		} else {
-			succPointer, hopCount := node.FindSuccessor(hashedWebsite, 0)
-			log.Info().Msgf("> Number of Hops: %d", hopCount)
-			// log hopcount into the log file using the library
-			log.Info().Msgf("> The Website would be stored at it's succesor Nodeid: %d IP: %s", succPointer.Nodeid, succPointer.IP)
-			msg := message.RequestMessage{Type: GET, TargetId: hashedWebsite}
-			reply := node.CallRPC(msg, succPointer.IP)
-			if reply.QueryResponse != nil {
-				log.Info().Msg("Retrieving from Chord Network")
-				for _, ip_c := range reply.QueryResponse {
-					log.Info().Msgf("> %s. IN A %s", website, ip_c)
-				}
-			} else {
-				ips, err := net.LookupIP(website)
-				if err != nil {
-					log.Error().Err(err).Msg("Could not get IPs")
-					return
-				}
-				ip_addresses := []string{}
-				log.Info().Msgf("IP ADDRESSES %v", ip_addresses)
+		log.Error().Msg("Put failed")
+	}
+	return ip_addresses, nil
+}
 
-				for _, ip := range ips {
-					ip_addresses = append(ip_addresses, ip.String())
-					log.Info().Msgf("> %s. IN A %s", website, ip.String())
-				}
-				node.CachedQuery[hashedWebsite] = LRUCache{value: ip_addresses, cacheTime: node.CacheTime}
-				reply = node.CallRPC(message.RequestMessage{Type: PUT, TargetId: succPointer.Nodeid, Payload: map[uint64][]string{hashedWebsite: ip_addresses}}, succPointer.IP)
-
-				if reply.Type == ACK {
-					// finding the oldest one based on counter, and removing that key
-					if len(node.CachedQuery) > CACHE_SIZE {
-						var minKey uint64
-						minValue := uint64(18446744073709551615)
-						for key, value := range node.CachedQuery {
-							if value.cacheTime < minValue {
-								minKey = key
-								minValue = value.cacheTime
-							}
-						}
-						if minKey != 0 {
-							delete(node.CachedQuery, minKey)
-						}
-					}
-				} else {
-					log.Error().Msg("Put failed")
-				}
-			}
+/*
+Finds the oldest cache entry based on counter, and removes that key if the cache is over CACHE_SIZE or, with a cache memory limit, until the cache fits.
+*/
+func (node *Node) evictCache() {
+	node.cacheMu.Lock()
+	defer node.cacheMu.Unlock()
+	if len(node.CachedQuery) > CACHE_SIZE {
+		node.evictOldest()
+	}
+	// Under a cache memory limit, keep evicting until the cache fits, but never evict the last entry.
+	for node.Config.MaxCacheBytes > 0 && len(node.CachedQuery) > 1 && node.cacheBytes() > node.Config.MaxCacheBytes {
+		if !node.evictOldest() {
+			break
 		}
+		node.shed("cache")
+	}
+}
 
+/*
+Removes the least recently cached entry. Must be called with the cache lock held.
+*/
+func (node *Node) evictOldest() bool {
+	var minKey uint64
+	minValue := uint64(18446744073709551615)
+	for key, value := range node.CachedQuery {
+		if value.cacheTime < minValue {
+			minKey = key
+			minValue = value.cacheTime
+		}
+	}
+	if minKey == 0 {
+		return false
 	}
+	delete(node.CachedQuery, minKey)
+	node.incMetric(`cache_evictions_total{reason="lru"}`, 1)
+	return true
 }
 
 /*
 Upon receiving a PUT message, or signal, it will simply
  1. Put the entry into local storage
  2. Call node.replicate(payload)
+
+Each entry of the payload is the complete record set of a name, and the whole payload is applied
+under the storage lock, so a batch of record sets is never observed half-applied.
 */
-func (node *Node) PutQuery(succesorId uint64, payload map[uint64][]string) bool {
+func (node *Node) PutQuery(succesorId uint64, payload map[uint64][]Record) bool {
 	//systemcommsin.Println("Recieving a request to insert values into storage")
+	if err := validatePayload(payload); err != nil {
+		log.Error().Err(err).Msg("Refused to store invalid records")
+		return false
+	}
+	node.storageMu.Lock()
+	defer node.storageMu.Unlock()
 	if node.HashIPStorage == nil {
-		node.HashIPStorage = make(map[uint64]map[uint64][]string)
+		node.HashIPStorage = make(map[uint64]map[uint64][]Record)
 	}
 	_, ok := node.HashIPStorage[succesorId]
 	if !ok {
-		node.HashIPStorage[succesorId] = map[uint64][]string{}
+		node.HashIPStorage[succesorId] = map[uint64][]Record{}
 	}
 	for key, ip_cache := range payload {
-		node.HashIPStorage[succesorId][key] = ip_cache
+		node.HashIPStorage[succesorId][key] = compressRecords(ip_cache)
+		node.stampChecksum(succesorId, key, node.HashIPStorage[succesorId][key])
 	}
 
 	return true
 }
 
+/*
+A PUT can arrive at a node that is no longer responsible for some of its keys, e.g. when a node has
+joined in between after the sender looked up the successor. Such keys are forwarded to the node that
+is now responsible for them instead of being stored here permanently. Returns the part of the payload
+that does belong here, and the combined reply of the forwarded PUTs, or nil if nothing was forwarded.
+The combined reply is a REDIRECT, naming the owner if there was only one, when every owner stored
+its keys, and else the reply of the first owner that refused them, e.g. BUSY or DENIED, which the
+PUT is then answered with as a whole, so that the sender does not take refused keys for stored.
+*/
+func (node *Node) forwardMisroutedPut(msg *message.RequestMessage) (map[uint64][]Record, *message.ResponseMessage) {
+	predecessor := node.predecessor()
+	if (predecessor == Pointer{} || msg.HopCount >= MAX_PUT_REDIRECTS) {
+		return msg.Payload, nil
+	}
+	local := make(map[uint64][]Record)
+	forward := make(map[Pointer]map[uint64][]Record)
+	for key, ip_cache := range msg.Payload {
+		if belongsTo(key, predecessor.Nodeid, node.Nodeid) {
+			local[key] = ip_cache
+			continue
+		}
+		owner, _ := node.FindSuccessor(key, 0)
+		if (owner == Pointer{} || owner.Nodeid == node.Nodeid) {
+			local[key] = ip_cache
+			continue
+		}
+		if _, ok := forward[owner]; !ok {
+			forward[owner] = make(map[uint64][]Record)
+		}
+		forward[owner][key] = ip_cache
+	}
+
+	var redirected *message.ResponseMessage
+	owners := 0
+	for owner, payload := range forward {
+		log.Info().Msgf("Redirecting %d misrouted record(s) to Nodeid: %d IP: %s", len(payload), owner.Nodeid, owner.IP)
+		reply := node.CallRPC(message.RequestMessage{Type: PUT, TargetId: owner.Nodeid, Payload: payload, HopCount: msg.HopCount + 1, Names: msg.Names, Identity: msg.Identity, Signed: msg.Signed, Signature: forwardedSignature(msg, payload)}, owner.IP)
+		switch reply.Type {
+		case EMPTY, SHUTTING_DOWN:
+			// The owner could not be reached, keep the records rather than losing them.
+			for key, ip_cache := range payload {
+				local[key] = ip_cache
+			}
+		case ACK, REDIRECT:
+			owners++
+			reply.Type = REDIRECT
+			reply.IP = owner.IP
+			if redirected == nil {
+				redirected = &reply
+			}
+		default:
+			log.Warn().Msgf("Nodeid: %d IP: %s refused %d misrouted record(s): %s", owner.Nodeid, owner.IP, len(payload), reply.Type)
+			return local, &reply
+		}
+	}
+	if owners > 1 {
+		// The keys went to several owners, none of which the reply can name, nor prove ownership for.
+		*redirected = message.ResponseMessage{Type: REDIRECT}
+	}
+	return local, redirected
+}
+
 /*
 Replicate is called periodically to replicate all the storage entries to a new node.
-Replicated data is only sent to "REPLICATION_FACTOR" nodes
+Replicated data is only sent to "REPLICATION_FACTOR" nodes, or as many as the record set asks for,
+see replicas.go
 */
 func (node *Node) replicate() {
-	for {
-		time.Sleep(5 * time.Second)
-		replicationSuccessor := make([]Pointer, REPLICATION_FACTOR)
-		replicationSuccessor = append(replicationSuccessor, node.Successor)
-
-		for i := 0; i < REPLICATION_FACTOR-1; i++ {
-			succesor, _ := node.FindSuccessor(replicationSuccessor[len(replicationSuccessor)-1].Nodeid, 0)
-			replicationSuccessor = append(replicationSuccessor, succesor)
+	for node.sleep(maintenanceInterval(node.Config.ReplicateInterval, DEFAULT_REPLICATE_INTERVAL)) {
+		// Distinct successors, outside this node's failure domain where possible, see failuredomain.go
+		targets := node.replicaTargets()
+		if most := node.mostReplicas(); most > len(targets) {
+			targets = append(targets, node.extraReplicaTargets(targets, most-len(targets))...)
 		}
-
-		for _, pointer := range replicationSuccessor {
-			if (pointer.IP == node.IP || pointer == Pointer{}) {
+		for i, pointer := range targets {
+			payload := node.replicaPayload(i)
+			if !node.transferThrottled() {
+				msg := message.RequestMessage{Type: REPLICATE, TargetId: node.Nodeid, Payload: payload}
+				msg.Names = node.namesFor(msg.Payload)
+				if reply := node.CallRPC(msg, pointer.IP); reply.Type != EMPTY {
+					node.incMetric(`keys_transferred_total{kind="replicate"}`, uint64(len(msg.Payload)))
+				}
 				continue
 			}
-			msg := message.RequestMessage{Type: REPLICATE, TargetId: node.Nodeid, Payload: node.HashIPStorage[node.Nodeid]}
-			node.CallRPC(msg, pointer.IP)
+			// Throttled transfers go in batches, see transfer.go
+			for _, batch := range splitPayload(payload, TRANSFER_BATCH) {
+				msg := message.RequestMessage{Type: REPLICATE, TargetId: node.Nodeid, Payload: batch}
+				msg.Names = node.namesFor(msg.Payload)
+				if !node.throttleTransfer("replicate", len(batch), payloadBytes(batch, msg.Names)) {
+					return
+				}
+				reply := node.CallRPC(msg, pointer.IP)
+				if reply.Type == EMPTY {
+					break
+				}
+				node.incMetric(`keys_transferred_total{kind="replicate"}`, uint64(len(msg.Payload)))
+			}
 		}
 	}
 }
@@ -166,54 +429,171 @@ func (node *Node) replicate() {
 Processes the REPLICATE Type message received.
 1. If the node's entry is not there, then dump the entire payload there, as it is the only entry.
 2. If the node's entry already exists, then add the new keys to it
+3. Keys with an empty record set are dropped, see replicas.go
 */
-func (node *Node) processReplicate(senderId uint64, payload map[uint64][]string) bool {
+func (node *Node) processReplicate(senderId uint64, payload map[uint64][]Record) bool {
+	payload = node.dropInvalid(payload)
+	node.storageMu.Lock()
+	defer node.storageMu.Unlock()
 	if node.HashIPStorage == nil {
-		node.HashIPStorage = make(map[uint64]map[uint64][]string)
+		node.HashIPStorage = make(map[uint64]map[uint64][]Record)
 	}
 
 	innerMap, ok := node.HashIPStorage[senderId]
 	if !ok {
-		innerMap = make(map[uint64][]string)
+		innerMap = make(map[uint64][]Record)
 		node.HashIPStorage[senderId] = innerMap
 	}
 
 	for key, ip_cache := range payload {
+		if len(ip_cache) == 0 {
+			delete(innerMap, key)
+			node.forgetUnstored(key)
+			continue
+		}
 		innerMap[key] = ip_cache
+		node.stampChecksum(senderId, key, ip_cache)
 	}
 
 	return true
 }
 
+/*
+Attaches the responding node's ID and its predecessor's ID to a GET/PUT reply, so that the requester
+can check that this node really is responsible for the key.
+*/
+func (node *Node) attachOwnershipProof(reply *message.ResponseMessage) {
+	reply.Nodeid = node.Nodeid
+	predecessor := node.predecessor()
+	reply.PredecessorId = predecessor.Nodeid
+	reply.PredecessorIP = predecessor.IP
+}
+
+/*
+Checks the ownership proof of a GET/PUT reply: key must fall in (predecessor, responder]. A mismatch
+means the lookup was routed to the wrong node, so it is logged. Replies from nodes that do not know
+their predecessor yet cannot be checked, and are accepted.
+*/
+func verifyOwnership(key uint64, reply message.ResponseMessage) bool {
+	if reply.Type == EMPTY || reply.PredecessorIP == "" {
+		return true
+	}
+	if !belongsTo(key, reply.PredecessorId, reply.Nodeid) {
+		log.Warn().Msgf("Key %d was routed to Nodeid: %d, which only owns (%d, %d]", key, reply.Nodeid, reply.PredecessorId, reply.Nodeid)
+		return false
+	}
+	return true
+}
+
+/*
+Checks the ownership proof of reply, a reply to a GET/PUT of key. If it fails, the request was
+routed to the wrong node, so key is looked up again with FindSuccessor, and the request is sent
+once more by send, to the node found. Returns the reply to use, the node that sent it if the
+request was sent again, and false if the proof failed still, in which case the reply must not be
+used. Mismatches are counted as ownership_mismatches_total.
+*/
+func (node *Node) checkOwnership(key uint64, reply message.ResponseMessage, send func(owner Pointer) message.ResponseMessage) (message.ResponseMessage, Pointer, bool) {
+	if verifyOwnership(key, reply) {
+		return reply, Pointer{}, true
+	}
+	node.incMetric("ownership_mismatches_total", 1)
+	owner, _ := node.FindSuccessor(key, 0)
+	if owner.IP == "" || owner.Nodeid == reply.Nodeid {
+		return reply, Pointer{}, false
+	}
+	log.Info().Msgf("Sending the request for key %d again, to Nodeid: %d IP: %s", key, owner.Nodeid, owner.IP)
+	reply = send(owner)
+	if !verifyOwnership(key, reply) {
+		node.incMetric("ownership_mismatches_total", 1)
+		return reply, owner, false
+	}
+	return reply, owner, true
+}
+
 /*
 Given a hashed website name, return the records associated with it if it exists, else return nil.
+Records this node only holds a replica of are returned too, so that replica holders can serve
+GETs on behalf of a busy owner.
 */
-func (node *Node) GetQuery(hashedId uint64) []string { // unused
+func (node *Node) GetQuery(hashedId uint64) []Record { // unused
+	node.storageMu.RLock()
+	defer node.storageMu.RUnlock()
+	// Records moved here take precedence over any tombstone replicated here.
+	if ip_addr, ok := node.pinned[hashedId]; ok {
+		return ip_addr
+	}
 	ip_addr, ok := node.HashIPStorage[node.Nodeid][hashedId]
 	if ok {
 		return ip_addr
-	} else {
-		return nil
 	}
+	for _, replica := range node.HashIPStorage {
+		if ip_addr, ok := replica[hashedId]; ok {
+			return ip_addr
+		}
+	}
+	if ip_addr, ok := node.diskStore.get(hashedId); ok {
+		return ip_addr
+	}
+	return nil
 }
 
 /*
 Called when a SHIFT message is received. This means that there are new nodes in the network. The node will
 ask you to handover all the entries that falls between you and it. This method helps process this logic.
 */
-func (node *Node) GetShiftRecords(prececId uint64) map[uint64][]string {
-	returnPayload := make(map[uint64][]string)
+func (node *Node) GetShiftRecords(prececId uint64) map[uint64][]Record {
+	payload, _ := node.shiftPage(prececId, 0)
+	return payload
+}
+
+/*
+GetShiftRecords, handing over at most limit entries, all of them if limit is 0. Returns the
+entries and the number of entries still to hand over.
+*/
+func (node *Node) shiftPage(prececId uint64, limit int) (map[uint64][]Record, int) {
+	node.storageMu.Lock()
+	defer node.storageMu.Unlock()
+	returnPayload := make(map[uint64][]Record)
 	nodeStorage, ok := node.HashIPStorage[node.Nodeid]
 	if ok {
+		remaining := 0
 		for hashedWebsite := range nodeStorage {
 			if prececId >= hashedWebsite {
+				if limit > 0 && len(returnPayload) >= limit {
+					remaining++
+					continue
+				}
 				returnPayload[hashedWebsite] = nodeStorage[hashedWebsite]
 				delete(nodeStorage, hashedWebsite)
 			}
 		}
-		return returnPayload
+		return returnPayload, remaining
 	} else {
-		return nil
+		return nil, 0
+	}
+}
+
+/*
+Periodically writes the storage of this node to disk, and reads it back while it holds no keys, as
+it is right after a restart. Buckets without keys do not count, as the replication rounds of other
+nodes, e.g. of the siblings of a virtual node, can create them before the first read.
+*/
+func (node *Node) persistStorage() {
+	for node.sleep(node.jittered(STORAGE_INTERVAL)) {
+		restarted := true
+		node.storageMu.RLock()
+		for _, bucket := range node.HashIPStorage {
+			if len(bucket) > 0 {
+				restarted = false
+				break
+			}
+		}
+		node.storageMu.RUnlock()
+		if restarted {
+			// Read before writing, or the empty storage would overwrite the snapshot.
+			node.readFromStorage()
+		}
+		node.spawn("storage_write", node.writeToStorage)
 	}
 }
 
@@ -222,17 +602,33 @@ Write the entry to persistent storage within the container.
 It opens file in write or (create and write) mode.
 */
 func (node *Node) writeToStorage() {
-	filePath := fmt.Sprintf("./data/%s.json", node.IP)
+	filePath := fmt.Sprintf("%s/%s.json", node.dataDir(), node.FileName())
+	node.storageMu.RLock()
 	myStorage := node.HashIPStorage
 	jsonData, err := json.Marshal(myStorage)
+	// The names of the stored keys, which the keys can not be turned back into.
+	names := make(map[uint64]string)
+	for _, bucket := range myStorage {
+		for key := range bucket {
+			if name, ok := node.names[key]; ok {
+				names[key] = name
+			}
+		}
+	}
+	node.storageMu.RUnlock()
 	if err != nil {
 		log.Error().Err(err).Msg("Error marshalling the JSON data")
 		return
 	}
+	if namesData, err := json.Marshal(names); err != nil {
+		log.Error().Err(err).Msg("Error marshalling the names")
+	} else if err := os.WriteFile(node.namesPath(), namesData, 0666); err != nil {
+		log.Error().Err(err).Msg("Error writing the names")
+	}
 	log.Debug().Msgf("JSON data: %s", jsonData)
 	// Write to the file, create it if it doesn't exist
 	// Append to the file or create it if it doesn't exist
-	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY, 0666)
+	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
 	if err != nil {
 		log.Error().Err(err).Msg("Error opening or creating the file")
 		return
@@ -248,12 +644,44 @@ func (node *Node) writeToStorage() {
 	defer file.Close()
 }
 
+/*
+Returns the storage persisted by a version that kept records in text form, see ParseRecordText,
+with its records converted. Records that do not parse are dropped.
+*/
+func legacyStorage(data []byte) (map[uint64]map[uint64][]Record, error) {
+	var legacy map[uint64]map[uint64][]string
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return nil, err
+	}
+	storage := make(map[uint64]map[uint64][]Record, len(legacy))
+	for bucket, sets := range legacy {
+		storage[bucket] = make(map[uint64][]Record, len(sets))
+		for key, lines := range sets {
+			records := []Record{}
+			for _, line := range lines {
+				record, err := ParseRecordText(decompressLegacyRecord(line))
+				if err != nil {
+					log.Warn().Err(err).Msgf("Dropped a record of key %d", key)
+					continue
+				}
+				records = append(records, compressRecord(record))
+			}
+			storage[bucket][key] = records
+		}
+	}
+	return storage, nil
+}
+
+func (node *Node) namesPath() string {
+	return fmt.Sprintf("%s/names-%s.json", node.dataDir(), node.FileName())
+}
+
 /*
 Reads file from local container storage.
 It opens file in read or (create and read) mode.
 */
 func (node *Node) readFromStorage() {
-	filePath := fmt.Sprintf("./data/%s.json", node.IP)
+	filePath := fmt.Sprintf("%s/%s.json", node.dataDir(), node.FileName())
 
 	// Open the file for reading
 	file, err := os.OpenFile(filePath, os.O_RDONLY|os.O_CREATE, 0666)
@@ -262,9 +690,15 @@ func (node *Node) readFromStorage() {
 		return
 	}
 	defer file.Close()
-	var storage map[uint64]map[uint64][]string
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(&storage)
+	var storage map[uint64]map[uint64][]Record
+	data, err := io.ReadAll(file)
+	if err == nil {
+		err = json.Unmarshal(data, &storage)
+	}
+	if legacy, legacyErr := legacyStorage(data); err != nil && legacyErr == nil {
+		log.Info().Msg("Converted the storage of an older version, with records in text form")
+		storage, err = legacy, nil
+	}
 	if err != nil {
 		log.Error().Err(err).Msg("Error decoding the JSON data")
 		return
@@ -275,5 +709,26 @@ func (node *Node) readFromStorage() {
 	for key, value := range storage {
 		log.Debug().Msgf("Key: %v, Value: %v\n", key, value)
 	}
+	// The names and suffix index of the restored keys, see names.go
+	names := make(map[uint64]string)
+	if namesData, err := os.ReadFile(node.namesPath()); err == nil {
+		if err := json.Unmarshal(namesData, &names); err != nil {
+			log.Error().Err(err).Msg("Error decoding the names")
+		}
+	} else if !os.IsNotExist(err) {
+		log.Error().Err(err).Msg("Error reading the names")
+	}
+	node.storageMu.Lock()
 	node.HashIPStorage = storage
+	node.resetChecksums()
+	restored := make(map[uint64]string)
+	for _, bucket := range storage {
+		for key := range bucket {
+			if name, ok := names[key]; ok {
+				restored[key] = name
+			}
+		}
+	}
+	node.indexNames(restored)
+	node.storageMu.Unlock()
 }
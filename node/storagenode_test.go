@@ -0,0 +1,121 @@
+package node
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/fauzxan/dns-chord/v2/hashing"
+	"github.com/fauzxan/dns-chord/v2/message"
+)
+
+/*
+Sends a PUT of keys to the node at 1000 of a ring of 1000 and 3000, which owns none of the keys
+used here, and returns the reply and the owner, the node at 3000, which is full if full is set.
+*/
+func misroutedPut(t *testing.T, full bool, keys ...uint64) (message.ResponseMessage, *Node) {
+	t.Helper()
+	nodes := NewModelRing(1000, 3000).Nodes()
+	owner := nodes[3000]
+	if full {
+		owner.Config.MaxStorageKeys = 1
+		owner.PutQuery(owner.Nodeid, map[uint64][]Record{2999: {NewRecord(TYPE_A, "192.0.2.1")}})
+	}
+	payload := make(map[uint64][]Record)
+	for _, key := range keys {
+		payload[key] = []Record{NewRecord(TYPE_A, "192.0.2.2")}
+	}
+	var reply message.ResponseMessage
+	msg := message.RequestMessage{Type: PUT, TargetId: 1000, Payload: payload}
+	if err := nodes[1000].HandleIncomingMessage(&msg, &reply); err != nil {
+		t.Fatal(err)
+	}
+	return reply, owner
+}
+
+func TestMisroutedPutRedirects(t *testing.T) {
+	reply, owner := misroutedPut(t, false, 2000)
+	if reply.Type != REDIRECT || reply.IP != owner.IP {
+		t.Fatalf("reply %s from %q, want %s from %q", reply.Type, reply.IP, REDIRECT, owner.IP)
+	}
+	if owner.GetQuery(2000) == nil {
+		t.Error("the owner did not store the redirected key")
+	}
+}
+
+func TestMisroutedPutRefused(t *testing.T) {
+	reply, owner := misroutedPut(t, true, 2000)
+	if reply.Type != BUSY {
+		t.Fatalf("reply %s to a PUT the owner refused, want %s", reply.Type, BUSY)
+	}
+	if owner.GetQuery(2000) != nil {
+		t.Error("the owner stored a key it refused")
+	}
+}
+
+func TestCheckOwnershipReroutes(t *testing.T) {
+	nodes := NewModelRing(1000, 3000).Nodes()
+	client := nodes[1000]
+	// A reply of a node that does not own the key, here the client itself.
+	var misrouted message.ResponseMessage
+	client.attachOwnershipProof(&misrouted)
+	sent := 0
+	reply, owner, owned := client.checkOwnership(2000, misrouted, func(owner Pointer) message.ResponseMessage {
+		sent++
+		var reply message.ResponseMessage
+		msg := message.RequestMessage{Type: GET, TargetId: 2000}
+		nodes[owner.Nodeid].HandleIncomingMessage(&msg, &reply)
+		return reply
+	})
+	if !owned || sent != 1 || owner.Nodeid != 3000 || reply.Nodeid != 3000 {
+		t.Errorf("owned %t after %d request(s) to %v, reply from %d, want the request sent once more to 3000", owned, sent, owner, reply.Nodeid)
+	}
+	// Replies whose proof fails again are not to be used.
+	_, _, owned = client.checkOwnership(2000, misrouted, func(Pointer) message.ResponseMessage { return misrouted })
+	if owned {
+		t.Error("a reply whose ownership proof failed twice was accepted")
+	}
+}
+
+func TestInvalidRecordsRefused(t *testing.T) {
+	nodes := NewModelRing(1000, 3000).Nodes()
+	owner := nodes[3000]
+	invalid := []Record{{Type: DNS_TYPE_A, Class: DNS_CLASS_IN, Rdata: []byte{192, 0, 2}}}
+	var reply message.ResponseMessage
+	msg := message.RequestMessage{Type: PUT, TargetId: 3000, Payload: map[uint64][]Record{2000: invalid}}
+	if err := owner.HandleIncomingMessage(&msg, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Type != INVALID || len(reply.QueryResponse) != 1 {
+		t.Errorf("reply %s %v to a PUT of an invalid A record, want %s with the error", reply.Type, reply.QueryResponse, INVALID)
+	}
+	if nodes[1000].UpdateRecords("invalid.example", invalid) {
+		t.Error("an update with an invalid A record succeeded")
+	}
+	if owner.PutQuery(owner.Nodeid, map[uint64][]Record{2000: invalid}) || owner.GetQuery(2000) != nil {
+		t.Error("an invalid A record was stored")
+	}
+}
+
+func TestLegacyStorage(t *testing.T) {
+	storage, err := legacyStorage([]byte(`{"1":{"2":["192.0.2.1","TXT v=spf1 -all","CACHE max-age=60","A example"]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := RecordsText(storage[1][2])
+	want := []string{"192.0.2.1", "TXT v=spf1 -all", "CACHE max-age=60"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("records converted as %q, want %q", got, want)
+	}
+}
+
+func TestRestoredNamesIndexed(t *testing.T) {
+	key := hashing.Hash("www.example.com")
+	node := &Node{IP: "restore", Config: Config{DataDir: t.TempDir()}, HashIPStorage: map[uint64]map[uint64][]Record{1: {key: {NewRecord(TYPE_A, "192.0.2.1")}}}}
+	node.learnNames(map[uint64]string{key: "www.example.com"})
+	node.writeToStorage()
+	restarted := &Node{IP: node.IP, Config: node.Config}
+	restarted.readFromStorage()
+	if _, names := restarted.localSuffix("example.com"); names[key] != "www.example.com" {
+		t.Errorf("names %v under example.com after a restart, want www.example.com", names)
+	}
+}
@@ -0,0 +1,147 @@
+/*
+Throttling of bulk key transfers. A node that joins a large ring pulls a share of its successor's
+keys, and every node pushes its keys to its replicas, which can saturate the network and make
+unrelated lookups time out. With TRANSFER_RATE (record sets per second) or TRANSFER_BANDWIDTH
+(bytes per second) set, a node moves keys in batches of TRANSFER_BATCH, and spaces the batches out
+so that all of its transfers together stay under the limits: SHIFT pages it pulls when joining,
+REPLICATE batches to its replicas, and the HANDOFF of a decommissioned node, which is sent at once
+after waiting its turn. Lookups, GETs and PUTs are never throttled.
+*/
+package node
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/fauzxan/dns-chord/v2/message"
+	"github.com/rs/zerolog/log"
+)
+
+// Constants
+const (
+	TRANSFER_BATCH = 100 // Record sets per SHIFT page and REPLICATE message while transfers are throttled.
+)
+
+/*
+When the next bulk transfer of a node may start.
+*/
+type transferThrottle struct {
+	mu   sync.Mutex
+	next time.Time
+}
+
+/*
+Returns true if bulk transfers of this node are throttled.
+*/
+func (node *Node) transferThrottled() bool {
+	return node.Config.TransferRate > 0 || node.Config.TransferBandwidth > 0
+}
+
+/*
+Waits until a transfer of records record sets, bytes bytes in all, may start after the transfers
+before it, so that the limits are kept on average. Returns false if the node shut down meanwhile.
+*/
+func (node *Node) throttleTransfer(kind string, records int, bytes int) bool {
+	var length time.Duration
+	if rate := node.Config.TransferRate; rate > 0 {
+		length = max(length, time.Duration(float64(records)/rate*float64(time.Second)))
+	}
+	if bandwidth := node.Config.TransferBandwidth; bandwidth > 0 {
+		length = max(length, time.Duration(float64(bytes)/float64(bandwidth)*float64(time.Second)))
+	}
+	if length == 0 {
+		return true
+	}
+	node.transfers.mu.Lock()
+	now := time.Now()
+	start := now
+	if node.transfers.next.After(start) {
+		start = node.transfers.next
+	}
+	node.transfers.next = start.Add(length)
+	node.transfers.mu.Unlock()
+	if wait := start.Sub(now); wait > 0 {
+		node.incMetric(fmt.Sprintf("transfer_throttled_total{kind=%q}", kind), 1)
+		node.incMetric("transfer_throttle_wait_ms_total", uint64(wait.Milliseconds()))
+		return node.sleep(wait)
+	}
+	return true
+}
+
+/*
+Returns the approximate number of bytes a payload and its names take on the wire.
+*/
+func payloadBytes(payload map[uint64][]Record, names map[uint64]string) int {
+	bytes := 0
+	for key, records := range payload {
+		bytes += 8 + len(names[key])
+		for _, record := range records {
+			bytes += 8 + len(record.Rdata)
+		}
+	}
+	return bytes
+}
+
+/*
+Splits payload into batches of at most size record sets, a single batch if size is 0.
+*/
+func splitPayload(payload map[uint64][]Record, size int) []map[uint64][]Record {
+	if size <= 0 || len(payload) <= size {
+		return []map[uint64][]Record{payload}
+	}
+	batches := []map[uint64][]Record{}
+	batch := make(map[uint64][]Record, size)
+	for key, records := range payload {
+		batch[key] = records
+		if len(batch) == size {
+			batches = append(batches, batch)
+			batch = make(map[uint64][]Record, size)
+		}
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+/*
+Pulls the keys this node takes over from its successor after joining. While transfers are
+throttled, they come in pages of TRANSFER_BATCH, each pulled once the previous one fits under the
+limits. A successor that does not page its SHIFT replies sends all of them at once.
+*/
+func (node *Node) shiftKeys() {
+	limit := 0
+	if node.transferThrottled() {
+		limit = TRANSFER_BATCH
+	}
+	successor := node.successor()
+	msg := message.RequestMessage{Type: SHIFT, TargetId: successor.Nodeid, Limit: limit}
+	reply := node.CallRPC(msg, successor.IP)
+	transfer := node.StartProgress("key transfer", len(reply.Payload)+reply.KeyCount)
+	defer transfer.Finish()
+	node.storageMu.Lock()
+	if _, ok := node.HashIPStorage[node.Nodeid]; !ok {
+		node.HashIPStorage[node.Nodeid] = map[uint64][]Record{}
+	}
+	node.storageMu.Unlock()
+	for {
+		node.learnNames(reply.Names)
+		reply.Payload = node.dropInvalid(reply.Payload)
+		node.storageMu.Lock()
+		for hashedWebsite := range reply.Payload {
+			node.HashIPStorage[node.Nodeid][hashedWebsite] = reply.Payload[hashedWebsite]
+			node.stampChecksum(node.Nodeid, hashedWebsite, reply.Payload[hashedWebsite])
+			transfer.Add(1)
+		}
+		node.storageMu.Unlock()
+		if limit == 0 || reply.KeyCount == 0 || len(reply.Payload) == 0 {
+			return
+		}
+		if transfer.Stopped() || !node.throttleTransfer("shift", len(reply.Payload), payloadBytes(reply.Payload, reply.Names)) {
+			log.Warn().Msgf("Key transfer stopped with %d key(s) left on the successor", reply.KeyCount)
+			return
+		}
+		reply = node.CallRPC(msg, node.successor().IP)
+	}
+}
@@ -0,0 +1,52 @@
+/*
+Clamping of the TTLs of record sets learned from legacy DNS. An upstream that answers with a TTL of
+0 would have the owner of the name resolve it again on every refresh round, and every node look it
+up again on each query, while a TTL of weeks would pin stale addresses in the ring. The TTL of an
+upstream answer is therefore raised to MIN_TTL (default 30 seconds) and lowered to MAX_TTL (default
+one day, 0 for no upper bound) before the record set is cached and stored. The clamped TTL is
+stored with the set as its cache max-age, so that the caches of every node, the TTL of DNS answers
+and the refresh of the set (see refresh.go) all follow it. Record sets published into the ring
+directly are not clamped.
+*/
+package node
+
+import (
+	"net"
+	"strconv"
+	"time"
+)
+
+// Constants
+const (
+	DEFAULT_MIN_TTL = 30    // MIN_TTL if not set, in seconds.
+	DEFAULT_MAX_TTL = 86400 // MAX_TTL if not set, in seconds.
+)
+
+/*
+Returns ttl, an upstream TTL, clamped to MIN_TTL and MAX_TTL, and counts the TTLs it changed.
+*/
+func (node *Node) clampTTL(ttl time.Duration) time.Duration {
+	minTTL := time.Duration(node.Config.MinTTL) * time.Second
+	maxTTL := time.Duration(node.Config.MaxTTL) * time.Second
+	switch {
+	case ttl < minTTL:
+		node.incMetric(`upstream_ttl_clamped_total{bound="min"}`, 1)
+		return minTTL
+	case maxTTL > 0 && ttl > maxTTL:
+		node.incMetric(`upstream_ttl_clamped_total{bound="max"}`, 1)
+		return maxTTL
+	}
+	return ttl
+}
+
+/*
+Returns the records of an upstream answer with the addresses ips and the TTL ttl, along with the
+cache policy that carries the TTL.
+*/
+func upstreamRecords(ips []net.IP, ttl time.Duration) []Record {
+	records := []Record{}
+	for _, ip := range ips {
+		records = append(records, addressRecord(ip))
+	}
+	return append(records, NewRecord(TYPE_CACHE, "max-age="+strconv.Itoa(int(ttl.Seconds()))))
+}
@@ -0,0 +1,110 @@
+package node
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/fauzxan/dns-chord/v2/hashing"
+)
+
+/*
+Returns a node that is alone in its ring, and has just learnt of another node as its successor if
+successor is set, as a node that joined through that node would have.
+*/
+func twoRingNode(id uint64, successor *Node) *Node {
+	node := &Node{Nodeid: id, IP: fmt.Sprint(id), FingerTable: make([]Pointer, hashing.Bits())}
+	node.Successor = Pointer{Nodeid: id, IP: node.IP}
+	if successor != nil {
+		node.Successor = Pointer{Nodeid: successor.Nodeid, IP: successor.IP}
+	}
+	node.SuccList = []Pointer{node.Successor}
+	return node
+}
+
+/*
+Returns the first node of a ring and a second node that joined it through the first, connected
+by the in-memory transport of model.go.
+*/
+func twoRing(first, second uint64) (*Node, *Node) {
+	a := twoRingNode(first, nil)
+	b := twoRingNode(second, a)
+	nodes := map[uint64]*Node{first: a, second: b}
+	for _, n := range nodes {
+		n.transport = modelTransport(nodes)
+	}
+	return a, b
+}
+
+func pointerTo(node *Node) Pointer {
+	return Pointer{Nodeid: node.Nodeid, IP: node.IP}
+}
+
+func TestTwoRingNotify(t *testing.T) {
+	a, b := twoRing(1000, 3000)
+	if !a.Notify(pointerTo(b)) {
+		t.Fatal("the first node did not take the second as its predecessor")
+	}
+	// Alone before, the first node now has the second on both sides.
+	if a.successor() != pointerTo(b) || a.predecessor() != pointerTo(b) {
+		t.Errorf("successor %v and predecessor %v of the first node, want %v for both", a.successor(), a.predecessor(), pointerTo(b))
+	}
+	if a.Notify(pointerTo(b)) {
+		t.Error("a repeated notification changed the predecessor")
+	}
+}
+
+func TestTwoRingStabilize(t *testing.T) {
+	for _, ids := range [][2]uint64{{1000, 3000}, {3000, 1000}, {0, hashing.Mask()}} {
+		a, b := twoRing(ids[0], ids[1])
+		// The second node stabilizes first, as it has a successor to ask, then they take turns.
+		for round := 0; round < 3; round++ {
+			b.stabilizeOnce()
+			a.stabilizeOnce()
+		}
+		for _, n := range []*Node{a, b} {
+			other := a
+			if n == a {
+				other = b
+			}
+			if n.successor() != pointerTo(other) || n.predecessor() != pointerTo(other) {
+				t.Errorf("ring %v: node %d has successor %v and predecessor %v, want %v for both", ids, n.Nodeid, n.successor(), n.predecessor(), pointerTo(other))
+			}
+		}
+		// Once converged, further rounds change nothing on either side.
+		want := [4]Pointer{a.successor(), a.predecessor(), b.successor(), b.predecessor()}
+		for round := 0; round < 5; round++ {
+			a.stabilizeOnce()
+			b.stabilizeOnce()
+			if got := [4]Pointer{a.successor(), a.predecessor(), b.successor(), b.predecessor()}; got != want {
+				t.Fatalf("ring %v: pointers flapped in round %d to %v, from %v", ids, round, got, want)
+			}
+		}
+	}
+}
+
+func TestTwoRingBelongsTo(t *testing.T) {
+	a, b := uint64(1000), uint64(3000)
+	tests := []struct {
+		key   uint64
+		owner uint64
+	}{
+		{1000, a},
+		{1001, b},
+		{2000, b},
+		{3000, b},
+		{3001, a},
+		{hashing.Mask(), a},
+		{0, a},
+		{999, a},
+	}
+	for _, test := range tests {
+		// Each node owns the arc from the other one, exclusive, to itself, inclusive.
+		ownedByA, ownedByB := belongsTo(test.key, b, a), belongsTo(test.key, a, b)
+		if ownedByA == ownedByB {
+			t.Errorf("key %d is owned by both or neither node: %v, %v", test.key, ownedByA, ownedByB)
+		}
+		if owner := map[bool]uint64{true: a, false: b}[ownedByA]; owner != test.owner {
+			t.Errorf("key %d is owned by %d, want %d", test.key, owner, test.owner)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+/*
+Health tracking and failover for the legacy DNS resolvers used on cache fills. With UPSTREAMS
+configured, every upstream lookup goes to the healthiest resolver first: the one with the lowest
+smoothed latency, penalised by its failure rate. A resolver that fails several times in a row is
+taken out of rotation for a while, and the next one is tried instead. A small share of lookups
+goes to another healthy resolver, so that the statistics of the others stay current. Without
+UPSTREAMS, the system resolver is used as before.
+*/
+package node
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Constants
+const (
+	UPSTREAM_TIMEOUT        = 2 * time.Second  // Upper bound on a single upstream lookup.
+	UPSTREAM_MAX_FAILURES   = 3                // Consecutive failures after which an upstream is taken out of rotation.
+	UPSTREAM_DOWN_TIME      = 30 * time.Second // How long an upstream stays out of rotation.
+	UPSTREAM_EXPLORE_RATE   = 0.05             // Share of lookups sent to another healthy upstream first.
+	UPSTREAM_LATENCY_WEIGHT = 0.3              // Weight of a new sample in the smoothed latency.
+)
+
+/*
+Health statistics of one upstream resolver.
+*/
+type UpstreamHealth struct {
+	Addr                string    `json:"addr"`
+	Successes           uint64    `json:"successes"`
+	Failures            uint64    `json:"failures"`
+	LatencyMillis       float64   `json:"latency_ms"` // Smoothed latency of successful lookups
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	DownUntil           time.Time `json:"down_until"` // Out of rotation until then, zero if healthy
+}
+
+type upstreamPool struct {
+	mu        sync.Mutex
+	upstreams map[string]*UpstreamHealth
+}
+
+/*
+Looks up the addresses of website, through the configured upstreams or the system resolver.
+*/
+func (node *Node) lookupUpstream(website string) ([]net.IP, error) {
+	ips, _, err := node.lookupUpstreamTTL(website)
+	return ips, err
+}
+
+/*
+lookupUpstream, along with the TTL of the answer, clamped to MIN_TTL and MAX_TTL, see ttl.go. The
+system resolver does not report TTLs, so its answers are taken to last DNS_DEFAULT_TTL.
+*/
+func (node *Node) lookupUpstreamTTL(website string) ([]net.IP, time.Duration, error) {
+	if len(node.Config.Upstreams) == 0 {
+		ips, err := net.LookupIP(website)
+		if err != nil {
+			return nil, 0, err
+		}
+		return ips, node.clampTTL(DNS_DEFAULT_TTL * time.Second), nil
+	}
+	var lastErr error
+	for _, addr := range node.upstreamOrder() {
+		ctx, cancel := context.WithTimeout(node.context(), UPSTREAM_TIMEOUT)
+		start := time.Now()
+		ips, ttl, err := lookupIPWithTTL(ctx, addr, website)
+		cancel()
+		var dnsErr *net.DNSError
+		if err == nil || (errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+			// A negative answer is an answer, there is no point in asking the next upstream.
+			node.recordUpstream(addr, time.Since(start), true)
+			if err != nil {
+				return nil, 0, err
+			}
+			return ips, node.clampTTL(ttl), nil
+		}
+		log.Warn().Err(err).Msgf("Upstream %s failed, trying the next one", addr)
+		node.recordUpstream(addr, 0, false)
+		lastErr = err
+	}
+	return nil, 0, lastErr
+}
+
+/*
+Returns the configured upstreams in the order they should be tried: healthy ones by score, then
+the ones out of rotation, as a last resort.
+*/
+func (node *Node) upstreamOrder() []string {
+	node.upstreams.mu.Lock()
+	defer node.upstreams.mu.Unlock()
+	now := time.Now()
+	var healthy, down []*UpstreamHealth
+	for _, addr := range node.Config.Upstreams {
+		health := node.upstreamHealth(addr)
+		if now.Before(health.DownUntil) {
+			down = append(down, health)
+		} else {
+			healthy = append(healthy, health)
+		}
+	}
+	score := func(health *UpstreamHealth) float64 {
+		total := float64(health.Successes + health.Failures)
+		if total == 0 {
+			return 0 // Unknown upstreams are tried early, to learn about them.
+		}
+		return (health.LatencyMillis + 1) * (1 + 10*float64(health.Failures)/total)
+	}
+	sort.SliceStable(healthy, func(i, j int) bool { return score(healthy[i]) < score(healthy[j]) })
+	if len(healthy) > 1 && rand.Float64() < UPSTREAM_EXPLORE_RATE {
+		i := 1 + rand.Intn(len(healthy)-1)
+		healthy[0], healthy[i] = healthy[i], healthy[0]
+	}
+	order := make([]string, 0, len(healthy)+len(down))
+	for _, health := range append(healthy, down...) {
+		order = append(order, health.Addr)
+	}
+	return order
+}
+
+/*
+Returns the statistics of addr, creating them if needed. Must be called with the pool lock held.
+*/
+func (node *Node) upstreamHealth(addr string) *UpstreamHealth {
+	if node.upstreams.upstreams == nil {
+		node.upstreams.upstreams = make(map[string]*UpstreamHealth)
+	}
+	health, ok := node.upstreams.upstreams[addr]
+	if !ok {
+		health = &UpstreamHealth{Addr: addr}
+		node.upstreams.upstreams[addr] = health
+	}
+	return health
+}
+
+/*
+Records the outcome of a lookup through addr.
+*/
+func (node *Node) recordUpstream(addr string, latency time.Duration, ok bool) {
+	node.upstreams.mu.Lock()
+	defer node.upstreams.mu.Unlock()
+	health := node.upstreamHealth(addr)
+	if !ok {
+		health.Failures++
+		health.ConsecutiveFailures++
+		if health.ConsecutiveFailures >= UPSTREAM_MAX_FAILURES {
+			log.Warn().Msgf("Taking upstream %s out of rotation for %v", addr, UPSTREAM_DOWN_TIME)
+			health.DownUntil = time.Now().Add(UPSTREAM_DOWN_TIME)
+		}
+		node.incMetric("upstream_failures_total", 1)
+		return
+	}
+	millis := float64(latency) / float64(time.Millisecond)
+	if health.Successes == 0 {
+		health.LatencyMillis = millis
+	} else {
+		health.LatencyMillis = UPSTREAM_LATENCY_WEIGHT*millis + (1-UPSTREAM_LATENCY_WEIGHT)*health.LatencyMillis
+	}
+	health.Successes++
+	health.ConsecutiveFailures = 0
+	health.DownUntil = time.Time{}
+}
+
+/*
+Returns the health statistics of the configured upstreams.
+*/
+func (node *Node) Upstreams() []UpstreamHealth {
+	node.upstreams.mu.Lock()
+	defer node.upstreams.mu.Unlock()
+	upstreams := []UpstreamHealth{}
+	for _, addr := range node.Config.Upstreams {
+		upstreams = append(upstreams, *node.upstreamHealth(addr))
+	}
+	return upstreams
+}
@@ -1,8 +1,14 @@
 package node
 
 import (
-	"net/rpc"
+	"bytes"
+	"encoding/gob"
+	"net"
+	"strings"
+	"time"
 
+	"github.com/fauzxan/dns-chord/v2/capture"
+	"github.com/fauzxan/dns-chord/v2/hashing"
 	"github.com/fauzxan/dns-chord/v2/message"
 	"github.com/rs/zerolog/log"
 )
@@ -17,33 +23,102 @@ import (
 Node utility function to call RPC given a request message, and a destination IP address.
 */
 func (node *Node) CallRPC(msg message.RequestMessage, IP string) message.ResponseMessage {
-	log.Debug().Msgf("Nodeid: %d IP: %s is sending message %v to IP: %s", node.Nodeid, node.IP, msg, IP)
-	clnt, err := rpc.Dial("tcp", IP)
+	msg.From = node.IP
+	msg.SnapshotEpoch = node.snapshotEpoch()
+	msg.Version = WIRE_VERSION
+	msg.Instance = node.InstanceID()
+	node.signRequest(&msg)
+	start := time.Now()
+	var reply message.ResponseMessage
+	if node.Crashed() {
+		return message.ResponseMessage{Type: EMPTY}
+	}
+	if node.breakerAllows(IP) {
+		reply = node.callRPC(msg, IP)
+		node.breakerRecord(IP, reply.Type != EMPTY)
+		if reply.Type != EMPTY {
+			node.learnZone(IP, reply.Zone)
+			node.learnInstance(IP, reply.Instance)
+		}
+	} else {
+		log.Debug().Msgf("Circuit breaker of %s is open, not sending %s", IP, msg.Type)
+		reply = message.ResponseMessage{Type: EMPTY}
+	}
+	if node.Capture != nil {
+		node.Capture.Record(capture.Event{Time: start, Node: node.IP, Peer: IP, Dir: capture.SEND, Type: msg.Type, TraceId: msg.TraceId, Bytes: encodedSize(msg), Duration: time.Since(start), Reply: reply.Type})
+	}
+	// A reply sent after a cut this node has not recorded yet must not be processed before it is.
+	node.recordSnapshot(reply.SnapshotEpoch)
+	return reply
+}
+
+/*
+Delivers an RPC to the node at IP and returns its reply, in place of a TCP connection.
+*/
+type rpcTransport func(msg message.RequestMessage, IP string) message.ResponseMessage
+
+func (node *Node) callRPC(msg message.RequestMessage, IP string) message.ResponseMessage {
+	if node.transport != nil {
+		return node.transport(msg, IP)
+	}
+	sampledLog().Debug().Msgf("Nodeid: %d IP: %s is sending message %v to IP: %s", node.Nodeid, node.IP, msg, IP)
 	reply := message.ResponseMessage{}
+	// Nodes behind a relay are reached through the relay, see relay.go
+	dialIP, method, args := IP, "Node.HandleIncomingMessage", any(msg)
+	if relay, target, ok := strings.Cut(IP, RELAY_SEPARATOR); ok {
+		dialIP, method, args = relay, "Node.Relay", message.RelayRequest{Target: target, Message: msg}
+	}
+	conn, err := net.DialTimeout("tcp", dialIP, DIAL_TIMEOUT)
 	if err != nil {
 		log.Error().Err(err).Msg(msg.Type)
-		log.Debug().Msgf("Nodeid: %d IP: %s received reply %v from IP: %s", node.Nodeid, node.IP, reply, IP)
+		sampledLog().Debug().Msgf("Nodeid: %d IP: %s received reply %v from IP: %s", node.Nodeid, node.IP, reply, IP)
 		reply.Type = EMPTY
 		return reply
 	}
-	err = clnt.Call("Node.HandleIncomingMessage", msg, &reply)
+	callTimeout := CALL_TIMEOUT
+	if msg.Budget > 0 {
+		callTimeout = min(callTimeout, time.Duration(msg.Budget))
+	}
+	conn.SetDeadline(time.Now().Add(callTimeout))
+	node.simulateLatency(IP)
+	clnt := node.newRPCClient(&countingConn{Conn: conn, traffic: &node.traffic})
+	defer clnt.Close()
+	err = clnt.Call(method, args, &reply)
 	if err != nil {
 		log.Error().Err(err).Msg("Error calling RPC")
-		log.Debug().Msgf("Nodeid: %d IP: %s received reply %v from IP: %s", node.Nodeid, node.IP, reply, IP)
+		sampledLog().Debug().Msgf("Nodeid: %d IP: %s received reply %v from IP: %s", node.Nodeid, node.IP, reply, IP)
 		reply.Type = EMPTY
 		return reply
 	}
-	log.Debug().Msgf("Received reply from %s", IP)
+	sampledLog().Debug().Msgf("Received reply from %s", IP)
 	return reply
 }
 
+/*
+Node utility function to record a received message in the capture file.
+*/
+func (node *Node) captureReceived(msg *message.RequestMessage, reply *message.ResponseMessage, start time.Time) {
+	node.Capture.Record(capture.Event{Time: start, Node: node.IP, Peer: msg.From, Dir: capture.RECV, Type: msg.Type, TraceId: msg.TraceId, Bytes: encodedSize(*msg), Duration: time.Since(start), Reply: reply.Type})
+}
+
+/*
+Node utility function to compute the gob encoded size of a request, as it is sent on the wire.
+*/
+func encodedSize(msg message.RequestMessage) int {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(msg); err != nil {
+		return 0
+	}
+	return buf.Len()
+}
+
 /*
 Node utility function to print fingers
 */
 func (node *Node) PrintFingers() {
 	log.Info().Msg("Finger Table:")
-	for i := 0; i < len(node.FingerTable); i++ {
-		log.Info().Msgf("> Finger[%d]: Nodeid: %d IP: %s", i+1, node.FingerTable[i].Nodeid, node.FingerTable[i].IP)
+	for i := 0; i < hashing.Bits(); i++ {
+		log.Info().Msgf("> Finger[%d]: Nodeid: %d IP: %s", i+1, node.finger(i).Nodeid, node.finger(i).IP)
 	}
 }
 
@@ -52,7 +127,8 @@ Node utility function to print the successor
 */
 func (node *Node) PrintSuccessor() {
 	log.Info().Msg("Successor:")
-	log.Info().Msgf(">Nodeid: %d Successor.IP: %s", node.Successor.Nodeid, node.Successor.IP)
+	successor := node.successor()
+	log.Info().Msgf(">Nodeid: %d Successor.IP: %s", successor.Nodeid, successor.IP)
 }
 
 /*
@@ -60,24 +136,49 @@ Node utility function to print predecessor
 */
 func (node *Node) PrintPredecessor() {
 	log.Info().Msg("Predecessor:")
-	log.Info().Msgf(">Nodeid: %d Predecessor.IP: %s", node.Predecessor.Nodeid, node.Predecessor.IP)
+	predecessor := node.predecessor()
+	log.Info().Msgf(">Nodeid: %d Predecessor.IP: %s", predecessor.Nodeid, predecessor.IP)
 }
 
 func (node *Node) PrintStorage() {
 	log.Info().Msg("STORAGE TABLE REQUESTED")
 	log.Info().Msg("Storage:")
+	node.storageMu.RLock()
+	defer node.storageMu.RUnlock()
 	for id, storage := range node.HashIPStorage {
 		log.Info().Msgf(">id: %d", id)
 		for _, value := range storage {
-			log.Info().Msgf(">>value: %s", value)
+			log.Info().Msgf(">>value: %s", RecordsText(value))
 		}
 	}
 }
 
 func (node *Node) PrintCache() {
 	log.Info().Msg("CACHE TABLE REQUESTED")
+	node.cacheMu.Lock()
+	defer node.cacheMu.Unlock()
 	for id, cache := range node.CachedQuery {
-		log.Info().Msgf(">id: %d value: %s", id, cache.value)
+		log.Info().Msgf(">id: %d value: %s", id, RecordsText(cache.value))
+	}
+}
+
+/*
+Node utility function to print the number of live goroutines per background task
+*/
+func (node *Node) PrintGoroutines() {
+	log.Info().Msg("GOROUTINE COUNTS REQUESTED")
+	for name, count := range node.GoroutineCounts() {
+		log.Info().Msgf(">%s: %d", name, count)
+	}
+}
+
+/*
+Node utility function to print the smoothed RTT to each probed peer
+*/
+func (node *Node) PrintLatencies() {
+	log.Info().Msg("PEER LATENCIES REQUESTED")
+	for _, peer := range node.PeerLatencies() {
+		log.Info().Msgf(">Nodeid: %d IP: %s RTT: %s (%d samples)", peer.Nodeid, peer.IP, peer.RTT, peer.Samples)
 	}
 }
 
@@ -0,0 +1,162 @@
+/*
+Virtual nodes, for an even spread of the keyspace over few processes. With only a handful of nodes,
+the arcs between their IDs, and with them the shares of the keys, differ by large factors. With
+VIRTUAL_NODES=V, a process takes V positions on the ring instead of one: besides its own node, the
+primary, it starts V-1 virtual nodes, each a full node with its own ID, RPC listener, storage and
+fingers. Virtual node i listens on an ephemeral port, and its ID is the hash of the primary's
+address and i, so that it comes back to the same position after a restart. Its snapshots are
+named after the primary's address and i as well, so that it reads its keys back. Only the primary serves
+DNS, the admin and the metrics endpoints, and the menu.
+
+The nodes of a process know each other. A lookup that reaches one of them is handed to a sibling
+in-process when the sibling is closer to the key than any finger, which saves the hops between
+positions of one process, and fixing the fingers of each virtual node takes the same shortcut.
+Keys are stored on whichever node of the process owns them, as without virtual nodes. As the
+positions of a process fail together, a process with virtual nodes and no ZONE is its own failure
+domain, named after the primary, so that replicas are placed on other processes (see
+failuredomain.go). Decommissioning or leaving the primary has its virtual nodes leave first, each
+handing its keys off to its successor. The number of keys of every position is exported as
+dns_chord_virtual_node_keys{nodeid}.
+*/
+package node
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/fauzxan/dns-chord/v2/hashing"
+	"github.com/rs/zerolog/log"
+)
+
+/*
+The nodes of a process, the primary first.
+*/
+type vnodeGroup struct {
+	mu    sync.Mutex
+	nodes []*Node
+}
+
+/*
+Returns the failure domain of a process at addr with config, see the top of this file: addr if it
+runs virtual nodes and no ZONE is configured, else the configured ZONE.
+*/
+func VirtualZone(config Config, addr string) string {
+	if config.VirtualNodes > 1 && config.Zone == "" {
+		return addr
+	}
+	return config.Zone
+}
+
+/*
+Starts the VIRTUAL_NODES-1 virtual nodes of this node, the primary, on host, and joins them to the
+ring through it. The primary must be part of the ring already. Returns the virtual nodes started.
+*/
+func (node *Node) StartVirtualNodes(host string) []*Node {
+	if node.Config.VirtualNodes <= 1 {
+		return nil
+	}
+	if node.Observing() || node.Config.RelayVia != "" {
+		log.Warn().Msg("Observers and nodes behind a relay take a single position, not starting virtual nodes")
+		return nil
+	}
+	group := &vnodeGroup{nodes: []*Node{node}}
+	node.vnodes = group
+	started := []*Node{}
+	for i := 1; i < node.Config.VirtualNodes; i++ {
+		listener, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+		if err != nil {
+			log.Error().Err(err).Msgf("Could not listen for virtual node %d", i)
+			break
+		}
+		config := node.Config
+		config.DataDir = filepath.Join(node.dataDir(), fmt.Sprintf("vnode-%d", i))
+		if err := os.MkdirAll(config.DataDir, 0777); err != nil {
+			log.Error().Err(err).Msgf("Could not create the data directory of virtual node %d", i)
+		}
+		config.DNSEnabled, config.AdminEnabled, config.MetricsEnabled = false, false, false
+		config.RelayPort, config.DiskStore, config.CachePersist = "", "", false
+		vnode := &Node{
+			Nodeid:        hashing.Hash(fmt.Sprintf("%s#%d", node.IP, i)),
+			IP:            listener.Addr().String(),
+			CachedQuery:   make(map[uint64]LRUCache),
+			HashIPStorage: make(map[uint64]map[uint64][]Record),
+			Config:        config,
+			vnodes:        group,
+			vnodeIndex:    i,
+		}
+		group.mu.Lock()
+		group.nodes = append(group.nodes, vnode)
+		group.mu.Unlock()
+		vnode.Serve(listener)
+		log.Info().Msgf("Virtual node %d is running at address: %s with Nodeid: %d", i, vnode.IP, vnode.Nodeid)
+		vnode.JoinNetwork(node.IP)
+		started = append(started, vnode)
+	}
+	return started
+}
+
+/*
+Returns the other nodes of this node's process, for a node with virtual nodes.
+*/
+func (node *Node) siblings() []*Node {
+	if node.vnodes == nil {
+		return nil
+	}
+	node.vnodes.mu.Lock()
+	defer node.vnodes.mu.Unlock()
+	siblings := make([]*Node, 0, len(node.vnodes.nodes)-1)
+	for _, sibling := range node.vnodes.nodes {
+		if sibling != node && !sibling.Decommissioning() {
+			siblings = append(siblings, sibling)
+		}
+	}
+	return siblings
+}
+
+/*
+Returns the sibling that most closely precedes id and is closer to it than best, the closest
+preceding finger, or nil if there is none.
+*/
+func (node *Node) closerSibling(id uint64, best Pointer) *Node {
+	var closest *Node
+	for _, sibling := range node.siblings() {
+		if sibling.Nodeid != id && between(sibling.Nodeid, best.Nodeid, id) && (closest == nil || between(sibling.Nodeid, closest.Nodeid, id)) {
+			closest = sibling
+		}
+	}
+	return closest
+}
+
+/*
+Has the virtual nodes of this primary leave the ring one after the other, see Leave.
+*/
+func (node *Node) departSiblings() {
+	if node.vnodes == nil || node.vnodes.nodes[0] != node {
+		return
+	}
+	for _, sibling := range node.siblings() {
+		sibling.Leave()
+	}
+}
+
+/*
+Writes the number of keys of each position of this process, for a process with virtual nodes.
+*/
+func (node *Node) writeVirtualNodes(w io.Writer) {
+	if node.vnodes == nil {
+		return
+	}
+	node.vnodes.mu.Lock()
+	nodes := append([]*Node{}, node.vnodes.nodes...)
+	node.vnodes.mu.Unlock()
+	for _, vnode := range nodes {
+		vnode.storageMu.RLock()
+		keys := len(vnode.HashIPStorage[vnode.Nodeid])
+		vnode.storageMu.RUnlock()
+		fmt.Fprintf(w, "dns_chord_virtual_node_keys{nodeid=\"%d\"} %d\n", vnode.Nodeid, keys)
+	}
+}
@@ -0,0 +1,58 @@
+/*
+Warm start of the routing state of a joining node. A new node used to start with an empty finger
+table and only its successor, and routed every lookup through the successor until FixFingers had
+filled the table. Instead, it asks its successor for its successor and fingers, which target
+almost the same points of the ring, and starts out with the successor list and a finger table
+derived from them. The entries are not checked up front: FixFingers replaces each of them with
+the result of a real lookup within a round, and any live node between this one and a key is a
+correct next hop in the meantime.
+*/
+package node
+
+import (
+	"github.com/fauzxan/dns-chord/v2/hashing"
+	"github.com/fauzxan/dns-chord/v2/message"
+	"github.com/rs/zerolog/log"
+)
+
+/*
+Seeds the successor list and finger table from the routing state of the successor. Returns the
+number of peers known to the successor that the fingers were chosen from.
+*/
+func (node *Node) warmStart() int {
+	reply := node.CallRPC(message.RequestMessage{Type: GET_FINGERS}, node.successor().IP)
+	if reply.Type != ACK {
+		log.Warn().Msgf("Successor %s did not share its routing state, starting with an empty finger table", node.successor().IP)
+		return 0
+	}
+	next := Pointer{Nodeid: reply.Nodeid, IP: reply.IP}
+	known := []Pointer{node.successor()}
+	if (next != Pointer{} && next.IP != node.IP) {
+		known = append(known, next)
+		node.setSuccList([]Pointer{{Nodeid: node.Nodeid, IP: node.IP}, node.successor(), next})
+	}
+	for id, IP := range reply.Fingers {
+		if IP != node.IP && IP != node.successor().IP && IP != next.IP {
+			known = append(known, Pointer{Nodeid: id, IP: IP})
+		}
+	}
+
+	for i := 0; i < hashing.Bits(); i++ {
+		target := (node.Nodeid + 1<<i) & hashing.Mask()
+		// The first known node at or after the target, which the true finger can only precede.
+		distance := func(pointer Pointer) uint64 { return (pointer.Nodeid - target) & hashing.Mask() }
+		var best Pointer
+		for _, pointer := range known {
+			if (best == Pointer{}) || distance(pointer) < distance(best) {
+				best = pointer
+			}
+		}
+		// Targets up to the successor are the successor's, whatever the successor knows.
+		if belongsTo(target, node.Nodeid, node.successor().Nodeid) {
+			best = node.successor()
+		}
+		node.setFinger(i, best)
+	}
+	log.Info().Msgf("> Warm started the finger table from %d peers known to the successor", len(known))
+	return len(known)
+}
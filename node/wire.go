@@ -0,0 +1,588 @@
+/*
+Wire format of the Chord RPCs. Every message carries the wire version of its sender, and RPCs can
+be encoded with gob (the default, understood by every node) or protobuf. The protobuf format is
+self-describing only through message/wire.proto, so that nodes written in other languages can
+take part in the ring. A protobuf connection starts with WIRE_PREAMBLE, which can not be the start
+of a gob stream; an RPC listener tells the two apart by the first bytes of every connection and
+serves both, so that a ring can be moved from gob to protobuf one node at a time: upgrade every
+node, then switch WIRE_FORMAT to protobuf node by node.
+*/
+package node
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"sort"
+
+	"github.com/fauzxan/dns-chord/v2/message"
+	"github.com/rs/zerolog/log"
+)
+
+// Constants
+const (
+	WIRE_VERSION         = 2                // Version of the message structure, see message.RequestMessage. 2 carries typed records.
+	WIRE_FORMAT_GOB      = "gob"            // Go's native encoding, as used by net/rpc by default.
+	WIRE_FORMAT_PROTOBUF = "protobuf"       // Length prefixed protobuf frames, see message/wire.proto.
+	WIRE_PREAMBLE        = "\x00DCPB\x01"   // Start of a protobuf connection. A gob stream never starts with a zero byte.
+	WIRE_MAX_FRAME       = 64 * 1024 * 1024 // Upper bound on the size of a protobuf frame.
+)
+
+var errWireFormat = errors.New("malformed protobuf frame")
+
+/*
+Returns an RPC client on conn, speaking the configured wire format.
+*/
+func (node *Node) newRPCClient(conn net.Conn) *rpc.Client {
+	if node.Config.WireFormat != WIRE_FORMAT_PROTOBUF {
+		return rpc.NewClient(conn)
+	}
+	if _, err := io.WriteString(conn, WIRE_PREAMBLE); err != nil {
+		log.Debug().Err(err).Msg("Could not write the wire preamble")
+	}
+	return rpc.NewClientWithCodec(&pbClientCodec{pbCodec: newPBCodec(conn, conn)})
+}
+
+/*
+Serves the RPCs arriving on conn until it is closed, in whichever wire format the peer speaks.
+*/
+func (node *Node) serveRPCConn(server *rpc.Server, conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	preamble, err := reader.Peek(len(WIRE_PREAMBLE))
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if string(preamble) == WIRE_PREAMBLE {
+		reader.Discard(len(WIRE_PREAMBLE))
+		node.incMetric(fmt.Sprintf("rpc_connections_total{format=%q}", WIRE_FORMAT_PROTOBUF), 1)
+		server.ServeCodec(&pbServerCodec{pbCodec: newPBCodec(reader, conn)})
+		return
+	}
+	node.incMetric(fmt.Sprintf("rpc_connections_total{format=%q}", WIRE_FORMAT_GOB), 1)
+	server.ServeConn(&bufferedConn{Conn: conn, reader: reader})
+}
+
+/*
+A connection whose first bytes have been peeked at, and are read from the buffer first.
+*/
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+/*
+Framing shared by the client and server codecs: every header and every body is a protobuf
+message, prefixed with its length as a varint.
+*/
+type pbCodec struct {
+	reader *bufio.Reader
+	writer *bufio.Writer
+	closer io.Closer
+	body   []byte // Body frame read along with the last header
+}
+
+func newPBCodec(r io.Reader, rwc io.ReadWriteCloser) pbCodec {
+	reader, ok := r.(*bufio.Reader)
+	if !ok {
+		reader = bufio.NewReader(r)
+	}
+	return pbCodec{reader: reader, writer: bufio.NewWriter(rwc), closer: rwc}
+}
+
+func (c *pbCodec) readFrame() ([]byte, error) {
+	length, err := binary.ReadUvarint(c.reader)
+	if err != nil {
+		return nil, err
+	}
+	if length > WIRE_MAX_FRAME {
+		return nil, errWireFormat
+	}
+	frame := make([]byte, length)
+	_, err = io.ReadFull(c.reader, frame)
+	return frame, err
+}
+
+func (c *pbCodec) writeFrames(frames ...[]byte) error {
+	for _, frame := range frames {
+		c.writer.Write(binary.AppendUvarint(nil, uint64(len(frame))))
+		c.writer.Write(frame)
+	}
+	return c.writer.Flush()
+}
+
+func (c *pbCodec) Close() error {
+	return c.closer.Close()
+}
+
+type pbServerCodec struct{ pbCodec }
+
+func (c *pbServerCodec) ReadRequestHeader(req *rpc.Request) error {
+	header, err := c.readFrame()
+	if err != nil {
+		return err
+	}
+	if c.body, err = c.readFrame(); err != nil {
+		return err
+	}
+	return pbFields(header, func(field int, value uint64, data []byte) {
+		switch field {
+		case 1:
+			req.ServiceMethod = string(data)
+		case 2:
+			req.Seq = value
+		}
+	})
+}
+
+func (c *pbServerCodec) ReadRequestBody(body any) error {
+	switch body := body.(type) {
+	case nil:
+		return nil
+	case *message.RequestMessage:
+		return decodeRequest(c.body, body)
+	case *message.RelayRequest:
+		return decodeRelayRequest(c.body, body)
+	}
+	return fmt.Errorf("no protobuf encoding for %T", body)
+}
+
+func (c *pbServerCodec) WriteResponse(resp *rpc.Response, body any) error {
+	header := pbString(nil, 1, resp.ServiceMethod)
+	header = pbVarint(header, 2, resp.Seq)
+	header = pbString(header, 3, resp.Error)
+	var data []byte
+	if reply, ok := body.(*message.ResponseMessage); ok && resp.Error == "" {
+		data = encodeResponse(reply)
+	}
+	return c.writeFrames(header, data)
+}
+
+type pbClientCodec struct{ pbCodec }
+
+func (c *pbClientCodec) WriteRequest(req *rpc.Request, body any) error {
+	header := pbString(nil, 1, req.ServiceMethod)
+	header = pbVarint(header, 2, req.Seq)
+	var data []byte
+	switch body := body.(type) {
+	case message.RequestMessage:
+		data = encodeRequest(&body)
+	case *message.RequestMessage:
+		data = encodeRequest(body)
+	case message.RelayRequest:
+		data = encodeRelayRequest(&body)
+	case *message.RelayRequest:
+		data = encodeRelayRequest(body)
+	default:
+		return fmt.Errorf("no protobuf encoding for %T", body)
+	}
+	return c.writeFrames(header, data)
+}
+
+func (c *pbClientCodec) ReadResponseHeader(resp *rpc.Response) error {
+	header, err := c.readFrame()
+	if err != nil {
+		return err
+	}
+	if c.body, err = c.readFrame(); err != nil {
+		return err
+	}
+	return pbFields(header, func(field int, value uint64, data []byte) {
+		switch field {
+		case 1:
+			resp.ServiceMethod = string(data)
+		case 2:
+			resp.Seq = value
+		case 3:
+			resp.Error = string(data)
+		}
+	})
+}
+
+func (c *pbClientCodec) ReadResponseBody(body any) error {
+	if reply, ok := body.(*message.ResponseMessage); ok {
+		return decodeResponse(c.body, reply)
+	}
+	return nil
+}
+
+/*
+Encodes a request in the protobuf format of message/wire.proto.
+*/
+func encodeRequest(msg *message.RequestMessage) []byte {
+	buf := pbString(nil, 1, msg.Type)
+	buf = pbVarint(buf, 2, msg.TargetId)
+	buf = pbString(buf, 3, msg.IP)
+	buf = pbPayload(buf, 4, msg.Payload)
+	buf = pbVarint(buf, 5, uint64(msg.HopCount))
+	buf = pbNames(buf, 6, msg.Names)
+	buf = pbString(buf, 7, msg.From)
+	buf = pbVarint(buf, 8, msg.TraceId)
+	buf = pbString(buf, 9, msg.Identity)
+	if len(msg.Signature) > 0 {
+		buf = pbBytes(buf, 10, msg.Signature)
+	}
+	buf = pbVarint(buf, 11, msg.SnapshotEpoch)
+	buf = pbVarint(buf, 12, uint64(msg.Version))
+	buf = pbVarint(buf, 13, uint64(msg.Budget))
+	buf = pbVarint(buf, 14, uint64(msg.Limit))
+	buf = pbString(buf, 15, msg.Instance)
+	if msg.Background {
+		buf = pbVarint(buf, 16, 1)
+	}
+	if msg.Signed != 0 {
+		buf = pbVarint(buf, 17, uint64(msg.Signed))
+	}
+	return pbChecksums(buf, 18, msg.Checksums)
+}
+
+func decodeRequest(data []byte, msg *message.RequestMessage) error {
+	var err error
+	parseErr := pbFields(data, func(field int, value uint64, data []byte) {
+		switch field {
+		case 1:
+			msg.Type = string(data)
+		case 2:
+			msg.TargetId = value
+		case 3:
+			msg.IP = string(data)
+		case 4:
+			msg.Payload, err = pbParsePayloadEntry(msg.Payload, data, err)
+		case 5:
+			msg.HopCount = int(int64(value))
+		case 6:
+			msg.Names, err = pbParseNameEntry(msg.Names, data, err)
+		case 7:
+			msg.From = string(data)
+		case 8:
+			msg.TraceId = value
+		case 9:
+			msg.Identity = string(data)
+		case 10:
+			msg.Signature = append([]byte(nil), data...)
+		case 11:
+			msg.SnapshotEpoch = value
+		case 12:
+			msg.Version = int(value)
+		case 13:
+			msg.Budget = int64(value)
+		case 14:
+			msg.Limit = int(int64(value))
+		case 15:
+			msg.Instance = string(data)
+		case 16:
+			msg.Background = value != 0
+		case 17:
+			msg.Signed = int64(value)
+		case 18:
+			msg.Checksums, err = pbParseChecksumEntry(msg.Checksums, data, err)
+		}
+	})
+	return errors.Join(parseErr, err)
+}
+
+/*
+Encodes a reply in the protobuf format of message/wire.proto.
+*/
+func encodeResponse(reply *message.ResponseMessage) []byte {
+	buf := pbString(nil, 1, reply.Type)
+	buf = pbVarint(buf, 2, reply.Nodeid)
+	buf = pbString(buf, 3, reply.IP)
+	for _, record := range reply.QueryResponse {
+		buf = pbBytes(buf, 4, []byte(record))
+	}
+	buf = pbPayload(buf, 5, reply.Payload)
+	buf = pbVarint(buf, 6, reply.PredecessorId)
+	buf = pbString(buf, 7, reply.PredecessorIP)
+	buf = pbNames(buf, 8, reply.Names)
+	buf = pbVarint(buf, 9, uint64(reply.KeyCount))
+	buf = pbVarint(buf, 10, reply.SuggestedId)
+	buf = pbNames(buf, 11, reply.Fingers)
+	buf = pbVarint(buf, 12, reply.SnapshotEpoch)
+	if len(reply.Snapshot) > 0 {
+		buf = pbBytes(buf, 13, reply.Snapshot)
+	}
+	buf = pbVarint(buf, 14, uint64(reply.Version))
+	buf = pbString(buf, 15, reply.Zone)
+	buf = pbNames(buf, 16, reply.Replicas)
+	buf = pbString(buf, 17, reply.Instance)
+	buf = pbVarint(buf, 18, uint64(reply.HopCount))
+	buf = pbVarint(buf, 19, uint64(reply.Elapsed))
+	for _, record := range reply.Records {
+		buf = pbBytes(buf, 20, pbRecord(record))
+	}
+	return buf
+}
+
+func decodeResponse(data []byte, reply *message.ResponseMessage) error {
+	var err error
+	parseErr := pbFields(data, func(field int, value uint64, data []byte) {
+		switch field {
+		case 1:
+			reply.Type = string(data)
+		case 2:
+			reply.Nodeid = value
+		case 3:
+			reply.IP = string(data)
+		case 4:
+			reply.QueryResponse = append(reply.QueryResponse, string(data))
+		case 5:
+			reply.Payload, err = pbParsePayloadEntry(reply.Payload, data, err)
+		case 6:
+			reply.PredecessorId = value
+		case 7:
+			reply.PredecessorIP = string(data)
+		case 8:
+			reply.Names, err = pbParseNameEntry(reply.Names, data, err)
+		case 9:
+			reply.KeyCount = int(int64(value))
+		case 10:
+			reply.SuggestedId = value
+		case 11:
+			reply.Fingers, err = pbParseNameEntry(reply.Fingers, data, err)
+		case 12:
+			reply.SnapshotEpoch = value
+		case 13:
+			reply.Snapshot = append([]byte(nil), data...)
+		case 14:
+			reply.Version = int(value)
+		case 15:
+			reply.Zone = string(data)
+		case 16:
+			reply.Replicas, err = pbParseNameEntry(reply.Replicas, data, err)
+		case 17:
+			reply.Instance = string(data)
+		case 18:
+			reply.HopCount = int(int64(value))
+		case 19:
+			reply.Elapsed = int64(value)
+		case 20:
+			var record message.Record
+			record, err = pbParseRecord(data, err)
+			reply.Records = append(reply.Records, record)
+		}
+	})
+	return errors.Join(parseErr, err)
+}
+
+func encodeRelayRequest(req *message.RelayRequest) []byte {
+	buf := pbString(nil, 1, req.Target)
+	return pbBytes(buf, 2, encodeRequest(&req.Message))
+}
+
+func decodeRelayRequest(data []byte, req *message.RelayRequest) error {
+	var err error
+	parseErr := pbFields(data, func(field int, value uint64, data []byte) {
+		switch field {
+		case 1:
+			req.Target = string(data)
+		case 2:
+			err = errors.Join(err, decodeRequest(data, &req.Message))
+		}
+	})
+	return errors.Join(parseErr, err)
+}
+
+/*
+Protobuf utility function to append a string field, omitted if empty like proto3 does.
+*/
+func pbString(buf []byte, field int, value string) []byte {
+	if value == "" {
+		return buf
+	}
+	return pbBytes(buf, field, []byte(value))
+}
+
+/*
+Protobuf utility function to append a map<uint64, Records> field, in ascending key order.
+*/
+func pbPayload(buf []byte, field int, payload map[uint64][]message.Record) []byte {
+	for _, key := range sortedKeys(payload) {
+		entry := pbVarint(nil, 1, key)
+		var records []byte
+		for _, record := range payload[key] {
+			records = pbBytes(records, 2, pbRecord(record))
+		}
+		entry = pbBytes(entry, 2, records)
+		buf = pbBytes(buf, field, entry)
+	}
+	return buf
+}
+
+/*
+Protobuf utility function to encode a Record message.
+*/
+func pbRecord(record message.Record) []byte {
+	buf := pbVarint(nil, 1, uint64(record.Type))
+	buf = pbVarint(buf, 2, uint64(record.Class))
+	buf = pbVarint(buf, 3, uint64(record.TTL))
+	if len(record.Rdata) > 0 {
+		buf = pbBytes(buf, 4, record.Rdata)
+	}
+	return buf
+}
+
+/*
+Protobuf utility function to append a map<uint64, uint32> field, in ascending key order.
+*/
+func pbChecksums(buf []byte, field int, sums map[uint64]uint32) []byte {
+	for _, key := range sortedKeys(sums) {
+		entry := pbVarint(nil, 1, key)
+		entry = pbVarint(entry, 2, uint64(sums[key]))
+		buf = pbBytes(buf, field, entry)
+	}
+	return buf
+}
+
+/*
+Protobuf utility function to append a map<uint64, string> field, in ascending key order.
+*/
+func pbNames(buf []byte, field int, names map[uint64]string) []byte {
+	for _, key := range sortedKeys(names) {
+		entry := pbVarint(nil, 1, key)
+		entry = pbString(entry, 2, names[key])
+		buf = pbBytes(buf, field, entry)
+	}
+	return buf
+}
+
+func sortedKeys[V any](m map[uint64]V) []uint64 {
+	keys := make([]uint64, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+func pbParsePayloadEntry(payload map[uint64][]message.Record, data []byte, err error) (map[uint64][]message.Record, error) {
+	if payload == nil {
+		payload = make(map[uint64][]message.Record)
+	}
+	var key uint64
+	var records []message.Record
+	entryErr := pbFields(data, func(field int, value uint64, data []byte) {
+		switch field {
+		case 1:
+			key = value
+		case 2:
+			err = errors.Join(err, pbFields(data, func(field int, _ uint64, data []byte) {
+				if field == 2 {
+					var record message.Record
+					record, err = pbParseRecord(data, err)
+					records = append(records, record)
+				}
+			}))
+		}
+	})
+	payload[key] = records
+	return payload, errors.Join(err, entryErr)
+}
+
+func pbParseRecord(data []byte, err error) (message.Record, error) {
+	var record message.Record
+	recordErr := pbFields(data, func(field int, value uint64, data []byte) {
+		switch field {
+		case 1:
+			record.Type = uint16(value)
+		case 2:
+			record.Class = uint16(value)
+		case 3:
+			record.TTL = uint32(value)
+		case 4:
+			record.Rdata = append([]byte(nil), data...)
+		}
+	})
+	return record, errors.Join(err, recordErr)
+}
+
+func pbParseChecksumEntry(sums map[uint64]uint32, data []byte, err error) (map[uint64]uint32, error) {
+	if sums == nil {
+		sums = make(map[uint64]uint32)
+	}
+	var key uint64
+	var sum uint32
+	entryErr := pbFields(data, func(field int, value uint64, data []byte) {
+		switch field {
+		case 1:
+			key = value
+		case 2:
+			sum = uint32(value)
+		}
+	})
+	sums[key] = sum
+	return sums, errors.Join(err, entryErr)
+}
+
+func pbParseNameEntry(names map[uint64]string, data []byte, err error) (map[uint64]string, error) {
+	if names == nil {
+		names = make(map[uint64]string)
+	}
+	var key uint64
+	var name string
+	entryErr := pbFields(data, func(field int, value uint64, data []byte) {
+		switch field {
+		case 1:
+			key = value
+		case 2:
+			name = string(data)
+		}
+	})
+	names[key] = name
+	return names, errors.Join(err, entryErr)
+}
+
+/*
+Protobuf utility function calling fn for every field of a message, with the value of varint and
+fixed width fields, or the data of length delimited ones. Unknown fields are skipped by the
+callers, so that older nodes can read messages of newer ones.
+*/
+func pbFields(data []byte, fn func(field int, value uint64, data []byte)) error {
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errWireFormat
+		}
+		data = data[n:]
+		field := int(tag >> 3)
+		switch tag & 7 {
+		case 0:
+			value, n := binary.Uvarint(data)
+			if n <= 0 {
+				return errWireFormat
+			}
+			data = data[n:]
+			fn(field, value, nil)
+		case 1:
+			if len(data) < 8 {
+				return errWireFormat
+			}
+			fn(field, binary.LittleEndian.Uint64(data), nil)
+			data = data[8:]
+		case 2:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return errWireFormat
+			}
+			fn(field, 0, data[n:n+int(length)])
+			data = data[n+int(length):]
+		case 5:
+			if len(data) < 4 {
+				return errWireFormat
+			}
+			fn(field, uint64(binary.LittleEndian.Uint32(data)), nil)
+			data = data[4:]
+		default:
+			return errWireFormat
+		}
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package node
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/fauzxan/dns-chord/v2/message"
+)
+
+/*
+Returns a request with every field set, so that a field the encoder misses fails the round trip.
+*/
+func wireTestRequest() message.RequestMessage {
+	return message.RequestMessage{
+		Type:          FIND_SUCCESSOR,
+		TargetId:      1 << 40,
+		IP:            "192.168.1.10:8000",
+		Payload:       map[uint64][]Record{1: {NewRecord(TYPE_A, "10.0.0.1"), {Type: 65, Class: COMPRESSED_CLASS, TTL: 60, Rdata: []byte{0, 1}}}, 2: nil}, // An empty record set drops the key, see replicas.go
+		HopCount:      3,
+		Names:         map[uint64]string{1: "example.com"},
+		From:          "192.168.1.11:8000",
+		TraceId:       42,
+		Identity:      "alice",
+		Signature:     []byte{0, 1, 2, 255},
+		Signed:        1700000000 * 1000 * 1000 * 1000,
+		SnapshotEpoch: 7,
+		Version:       WIRE_VERSION,
+		Budget:        int64(1500 * 1000 * 1000),
+		Limit:         100,
+		Instance:      "8901cbfc-5d42-4ea7-abd0-ecad6dabddb3",
+		Background:    true,
+		Checksums:     map[uint64]uint32{1: 0xDEADBEEF, 2: 0},
+	}
+}
+
+/*
+Returns a reply with every field set, see wireTestRequest.
+*/
+func wireTestResponse() message.ResponseMessage {
+	return message.ResponseMessage{
+		Type:          ACK,
+		Nodeid:        1 << 30,
+		IP:            "192.168.1.12:8000",
+		QueryResponse: []string{"10.0.0.1", "", "10.0.0.2"},
+		Payload:       map[uint64][]Record{3: {NewRecord(TYPE_TXT, "a")}, 4: {NewRecord(TYPE_TXT, "b"), NewRecord(TYPE_CACHE, "no-cache")}},
+		PredecessorId: 5,
+		PredecessorIP: "192.168.1.13:8000",
+		Names:         map[uint64]string{3: "a.example", 4: "b.example"},
+		KeyCount:      12,
+		SuggestedId:   1 << 31,
+		Fingers:       map[uint64]string{6: "192.168.1.14:8000"},
+		SnapshotEpoch: 8,
+		Snapshot:      []byte(`{"nodeid":1}`),
+		Version:       WIRE_VERSION,
+		Zone:          "rack-1",
+		Replicas:      map[uint64]string{7: "192.168.1.15:8000"},
+		Instance:      "0c5bb4a8-06d7-4a2b-9f0e-3f3c1a7f1d11",
+		HopCount:      4,
+		Elapsed:       int64(2500 * 1000),
+		Records:       []Record{NewRecord(TYPE_AAAA, "2001:db8::1"), {Type: DNS_TYPE_TXT, Class: DNS_CLASS_IN, TTL: 30, Rdata: txtData("v=spf1 -all")}},
+	}
+}
+
+/*
+Fails t if a field of v is left at its zero value.
+*/
+func requireAllFieldsSet(t *testing.T, v any) {
+	t.Helper()
+	value := reflect.ValueOf(v)
+	for i := 0; i < value.NumField(); i++ {
+		if value.Field(i).IsZero() {
+			t.Fatalf("%s.%s is not set, the round trip would not cover it", value.Type().Name(), value.Type().Field(i).Name)
+		}
+	}
+}
+
+func TestWireRequestRoundTrip(t *testing.T) {
+	msg := wireTestRequest()
+	requireAllFieldsSet(t, msg)
+	var decoded message.RequestMessage
+	if err := decodeRequest(encodeRequest(&msg), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, msg) {
+		t.Errorf("request decoded as\n%+v\nwant\n%+v", decoded, msg)
+	}
+}
+
+func TestWireResponseRoundTrip(t *testing.T) {
+	reply := wireTestResponse()
+	requireAllFieldsSet(t, reply)
+	var decoded message.ResponseMessage
+	if err := decodeResponse(encodeResponse(&reply), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, reply) {
+		t.Errorf("reply decoded as\n%+v\nwant\n%+v", decoded, reply)
+	}
+}
+
+func TestWireRelayRequestRoundTrip(t *testing.T) {
+	req := message.RelayRequest{Target: "node-behind-nat", Message: wireTestRequest()}
+	requireAllFieldsSet(t, req)
+	var decoded message.RelayRequest
+	if err := decodeRelayRequest(encodeRelayRequest(&req), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, req) {
+		t.Errorf("relay request decoded as\n%+v\nwant\n%+v", decoded, req)
+	}
+}
+
+func TestWireEmptyMessages(t *testing.T) {
+	var msg, decodedMsg message.RequestMessage
+	if err := decodeRequest(encodeRequest(&msg), &decodedMsg); err != nil || !reflect.DeepEqual(decodedMsg, msg) {
+		t.Errorf("empty request decoded as %+v, %v", decodedMsg, err)
+	}
+	var reply, decodedReply message.ResponseMessage
+	if err := decodeResponse(encodeResponse(&reply), &decodedReply); err != nil || !reflect.DeepEqual(decodedReply, reply) {
+		t.Errorf("empty reply decoded as %+v, %v", decodedReply, err)
+	}
+}
+
+func TestWireMalformed(t *testing.T) {
+	valid := encodeRequest(&message.RequestMessage{Type: PUT, IP: "192.168.1.10:8000", Payload: map[uint64][]Record{1: {NewRecord(TYPE_TXT, "x")}}})
+	tests := map[string][]byte{
+		"truncated tag":       {0x80},
+		"truncated varint":    {0x10, 0x80},
+		"truncated fixed64":   {0x09, 1, 2, 3},
+		"truncated fixed32":   {0x0d, 1},
+		"length past the end": {0x1a, 0x05, 'a'},
+		"group wire type":     {0x0b},
+		"truncated message":   valid[:len(valid)-1],
+	}
+	for name, data := range tests {
+		if err := pbFields(data, func(int, uint64, []byte) {}); err == nil {
+			t.Errorf("%s: pbFields accepted %x", name, data)
+		}
+		var msg message.RequestMessage
+		if err := decodeRequest(data, &msg); err == nil {
+			t.Errorf("%s: decodeRequest accepted %x", name, data)
+		}
+	}
+}
+
+func FuzzPBFields(f *testing.F) {
+	msg, reply := wireTestRequest(), wireTestResponse()
+	f.Add(encodeRequest(&msg))
+	f.Add(encodeResponse(&reply))
+	f.Add(encodeRelayRequest(&message.RelayRequest{Target: "n", Message: msg}))
+	f.Add([]byte{0x80})
+	f.Add([]byte{0x1a, 0xff, 0xff, 0xff, 0xff, 0x0f})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		consumed := 0
+		if err := pbFields(data, func(field int, value uint64, data []byte) { consumed += len(data) }); err == nil && consumed > len(data) {
+			t.Fatalf("pbFields returned %d bytes of fields from %d bytes", consumed, len(data))
+		}
+		// Whatever decodes has to survive another round trip unchanged.
+		var msg message.RequestMessage
+		if decodeRequest(data, &msg) == nil {
+			var again message.RequestMessage
+			if err := decodeRequest(encodeRequest(&msg), &again); err != nil || !reflect.DeepEqual(again, msg) {
+				t.Fatalf("request %+v decoded again as %+v, %v", msg, again, err)
+			}
+		}
+		var reply message.ResponseMessage
+		if decodeResponse(data, &reply) == nil {
+			var again message.ResponseMessage
+			if err := decodeResponse(encodeResponse(&reply), &again); err != nil || !reflect.DeepEqual(again, reply) {
+				t.Fatalf("reply %+v decoded again as %+v, %v", reply, again, err)
+			}
+		}
+		var req message.RelayRequest
+		decodeRelayRequest(data, &req)
+	})
+}
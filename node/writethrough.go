@@ -0,0 +1,59 @@
+/*
+Write-through replication. The owner of a key sends its keys to the replica targets every 5
+seconds (see replicate in storagenode.go), so that a write it accepted just before failing would
+be lost with it. With WRITE_THROUGH (default true), the owner also sends the keys of every PUT it
+accepts to the replica targets of its last replication round right away, in a REPLICATE message of
+those keys only, without waiting for the replies. A record set goes to as many of those targets as
+its replication factor asks for (see replicas.go), and extra replicas beyond the regular ones get
+it with the next round. When the owner stops replying, reads fall back to its replicas, see
+retry.go. Keys replicated on write are counted in keys_transferred_total{kind="write_through"}.
+*/
+package node
+
+import (
+	"github.com/fauzxan/dns-chord/v2/message"
+)
+
+/*
+Sends the keys of payload, just stored in the bucket of owner, to the replica targets, see the top
+of this file. The keys are read back from storage, so that the replicas get them as stored.
+*/
+func (node *Node) replicateWrite(owner uint64, payload map[uint64][]Record) {
+	if !node.Config.WriteThrough || owner != node.Nodeid || node.Observing() {
+		return
+	}
+	node.replicas.mu.Lock()
+	targets := append([]Pointer{}, node.replicas.targets...)
+	node.replicas.mu.Unlock()
+	if len(targets) == 0 {
+		return
+	}
+	node.storageMu.RLock()
+	stored := make(map[uint64][]Record, len(payload))
+	for key := range payload {
+		if records, ok := node.HashIPStorage[node.Nodeid][key]; ok {
+			stored[key] = records
+		}
+	}
+	node.storageMu.RUnlock()
+
+	for i, target := range targets {
+		batch := make(map[uint64][]Record, len(stored))
+		for key, records := range stored {
+			if replicationFactor(records) > i {
+				batch[key] = records
+			}
+		}
+		if len(batch) == 0 || target.IP == node.IP {
+			continue
+		}
+		msg := message.RequestMessage{Type: REPLICATE, TargetId: node.Nodeid, Payload: batch}
+		msg.Names = node.namesFor(batch)
+		IP := target.IP
+		node.spawn("write_through", func() {
+			if reply := node.CallRPC(msg, IP); reply.Type != EMPTY {
+				node.incMetric(`keys_transferred_total{kind="write_through"}`, uint64(len(batch)))
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+/*
+Cache stampede protection by probabilistic early refresh (XFetch, Vattani et al., "Optimal
+Probabilistic Cache Stampede Prevention"). When a popular entry expires, every lookup that arrives
+before it is filled again goes to the ring or upstream at once. Instead, each lookup answered from
+the cache refreshes the entry early with a probability that grows as its expiry nears: it does so
+if
+
+	now - delta * beta * ln(rand()) >= expires
+
+where delta is the time the lookup that filled the entry took, and beta is XFETCH_BETA (default 1,
+higher refreshes earlier, 0 disables). The lookup that draws the refresh resolves the name as if
+it had missed the cache, while the entry is marked as being refreshed, so that the others keep
+being answered from the cache instead of refreshing too. If the refresh fails, the lookup is
+answered from the entry, which has not expired yet. Early refreshes are counted in
+cache_early_refreshes_total.
+*/
+package node
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Constants
+const (
+	XFETCH_DEFAULT_DELTA = 50 * time.Millisecond // Assumed time of the lookup that filled an entry, for entries loaded from disk.
+	DEFAULT_XFETCH_BETA  = 1.0                   // XFETCH_BETA if not set.
+)
+
+/*
+Returns true if the lookup that found entry in the cache should refresh it early, see the top of
+this file. Entries that never expire, or that are being refreshed already, are not refreshed early.
+*/
+func (node *Node) refreshEarly(entry LRUCache) bool {
+	beta := node.Config.XFetchBeta
+	if beta <= 0 || entry.expires.IsZero() || entry.refreshing {
+		return false
+	}
+	delta := entry.fetch
+	if delta <= 0 {
+		delta = XFETCH_DEFAULT_DELTA
+	}
+	// 1 - rand.Float64() is in (0, 1], so that the logarithm is finite.
+	early := time.Duration(-float64(delta) * beta * math.Log(1-rand.Float64()))
+	return !time.Now().Add(early).Before(entry.expires)
+}
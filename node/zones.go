@@ -0,0 +1,110 @@
+/*
+Authoritative zones. The ring can act as the authoritative backend for zones whose records have
+been published into it. For names in such a zone, the DNS listener answers with the AA bit set,
+never falls back to legacy DNS, and synthesizes the SOA and NS records of the zone, so that
+downstream resolvers treat its answers as coming from a proper authoritative server.
+*/
+package node
+
+import (
+	"encoding/binary"
+	"strings"
+	"time"
+)
+
+// Constants
+const (
+	SOA_REFRESH = 3600   // Seconds after which secondaries should refresh the zone.
+	SOA_RETRY   = 600    // Seconds after which a failed refresh should be retried.
+	SOA_EXPIRE  = 604800 // Seconds after which secondaries should stop answering for the zone.
+	SOA_MINIMUM = 300    // Seconds negative answers may be cached for.
+)
+
+/*
+Returns the authoritative zone that name falls in, preferring the most specific one.
+*/
+func (node *Node) authoritativeZone(name string) (string, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	best := ""
+	for _, zone := range node.Config.AuthZones {
+		zone = strings.ToLower(strings.TrimSuffix(zone, "."))
+		if (name == zone || strings.HasSuffix(name, "."+zone)) && len(zone) > len(best) {
+			best = zone
+		}
+	}
+	return best, best != ""
+}
+
+/*
+Returns the name servers of zone: the configured ones, or ns.<zone> if none are configured.
+*/
+func (node *Node) zoneNameservers(zone string) []string {
+	if len(node.Config.AuthNameservers) > 0 {
+		return node.Config.AuthNameservers
+	}
+	return []string{"ns." + zone}
+}
+
+/*
+Returns the synthesized SOA record of zone. The serial is derived from the start time of the node.
+*/
+func (node *Node) soaRR(zone string) dnsRR {
+	data := appendDNSName(nil, node.zoneNameservers(zone)[0])
+	data = appendDNSName(data, "hostmaster."+zone)
+	data = binary.BigEndian.AppendUint32(data, soaSerial)
+	data = binary.BigEndian.AppendUint32(data, SOA_REFRESH)
+	data = binary.BigEndian.AppendUint32(data, SOA_RETRY)
+	data = binary.BigEndian.AppendUint32(data, SOA_EXPIRE)
+	data = binary.BigEndian.AppendUint32(data, SOA_MINIMUM)
+	return dnsRR{Name: zone, Type: DNS_TYPE_SOA, TTL: SOA_MINIMUM, Data: data}
+}
+
+/*
+Returns the synthesized NS records of zone.
+*/
+func (node *Node) nsRRs(zone string) []dnsRR {
+	rrs := []dnsRR{}
+	for _, ns := range node.zoneNameservers(zone) {
+		rrs = append(rrs, dnsRR{Name: zone, Type: DNS_TYPE_NS, TTL: DNS_DEFAULT_TTL, Data: appendDNSName(nil, ns)})
+	}
+	return rrs
+}
+
+// Serial of the synthesized SOA records, in the conventional YYYYMMDDnn form.
+var soaSerial = func() uint32 {
+	now := time.Now().UTC()
+	return uint32(now.Year()*1000000 + int(now.Month())*10000 + now.Day()*100)
+}()
+
+/*
+Answers a query for a name in an authoritative zone from the ring alone.
+*/
+func (node *Node) answerAuthoritative(zone string, question dnsQuestion) dnsAnswer {
+	apex := strings.EqualFold(strings.TrimSuffix(question.Name, "."), zone)
+	answer := dnsAnswer{Rcode: RCODE_NOERROR, Authoritative: true}
+	if apex && (question.Type == DNS_TYPE_SOA || question.Type == DNS_TYPE_ANY) {
+		soa := node.soaRR(zone)
+		soa.Name = ""
+		answer.Answers = append(answer.Answers, soa)
+	}
+	if apex && (question.Type == DNS_TYPE_NS || question.Type == DNS_TYPE_ANY) {
+		for _, ns := range node.nsRRs(zone) {
+			ns.Name = ""
+			answer.Answers = append(answer.Answers, ns)
+		}
+	}
+
+	var trace LookupTrace
+	records, err := node.resolve(question.Name, false, time.Time{}, &trace)
+	if err == nil {
+		answer.Answers = append(answer.Answers, recordsToRRs(records, question.Type)...)
+	} else if !apex {
+		answer.Rcode = RCODE_NXDOMAIN
+	}
+	if len(answer.Answers) == 0 {
+		// Negative answers carry the SOA, so resolvers know how long to cache them.
+		answer.Authority = []dnsRR{node.soaRR(zone)}
+	}
+	answer.Additional = node.debugRRs(trace)
+	return answer
+}
@@ -1,11 +1,8 @@
 package utility
 
 import (
-	"crypto/sha256"
-	"encoding/binary"
 	"encoding/csv"
 	"log"
-	"math"
 	"net"
 	"os"
 )
@@ -16,20 +13,6 @@ import (
 ***************************************
 */
 
-const M = 32
-
-/*
-Function to generate the hash of the the input IP address
-*/
-func GenerateHash(input string) uint64 {
-	data := []byte(input)
-	id := sha256.Sum256(data)
-	unmoddedID := float64(binary.BigEndian.Uint64(id[:8]))
-	modValue := float64(math.Pow(2, M))
-	moddedID := math.Mod(unmoddedID, modValue)
-	return uint64(moddedID)
-}
-
 /*
 Function to automatically get the outbound IP without user input in .env file
 */